@@ -0,0 +1,97 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// AppendImage adds the image m as a new page at the end of the TIFF file
+// in rw, without rewriting the pages already in it. The image data and IFD
+// are written at the end of the file, and the IFD is linked from the last
+// IFD of the chain. opt determines the options used for encoding the
+// image, as for Encode, except that the byte order and the use of BigTIFF
+// follow the file. Asking for BigTIFF or big-endian byte order when the
+// file does not use them is an error, as is growing a classic TIFF file
+// beyond 4 GiB.
+func AppendImage(rw io.ReadWriteSeeker, m image.Image, opt *Options) error {
+	r, ok := rw.(io.ReaderAt)
+	if !ok {
+		r = &seekReaderAt{rs: rw}
+	}
+	d, err := readFirstIFD(r)
+	if err != nil {
+		return err
+	}
+	big, order := d.bigTIFF, d.byteOrder
+	if opt != nil && opt.BigTIFF && !big {
+		return fmt.Errorf("tiff: cannot append a BigTIFF image to a classic TIFF file")
+	}
+	if opt != nil && opt.ClassicTIFF && big {
+		return fmt.Errorf("tiff: cannot append a ClassicTIFF image to a BigTIFF file")
+	}
+	if opt != nil && opt.BigEndian && order != binary.BigEndian {
+		return fmt.Errorf("tiff: cannot append a big-endian image to a little-endian file")
+	}
+
+	last := d
+	err = d.walkIFDs(func(d1 *decoder) error {
+		last = d1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The offset of the next IFD follows the entry count and the entries.
+	nextOff := last.ifdOffset + 2 + int64(len(last.ifd))
+	if big {
+		nextOff = last.ifdOffset + 8 + int64(len(last.ifd))
+	}
+
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	o.BigEndian = order == binary.BigEndian
+	p, err := newImagePage(m, &o, nil)
+	if err != nil {
+		return err
+	}
+	end, err := rw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	start := int(end)
+	if !big && uint64(start+p.size(false)) > math.MaxUint32 {
+		return fmt.Errorf("tiff: appended image does not fit in a classic TIFF file")
+	}
+	if err := p.write(rw, start, 0, big, order); err != nil {
+		return err
+	}
+
+	if _, err := rw.Seek(nextOff, io.SeekStart); err != nil {
+		return err
+	}
+	if big {
+		return binary.Write(rw, order, uint64(start+p.imageLen))
+	}
+	return binary.Write(rw, order, uint32(start+p.imageLen))
+}
+
+// A seekReaderAt implements io.ReaderAt by seeking rs before each read.
+type seekReaderAt struct {
+	rs io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.rs, p)
+}
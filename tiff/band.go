@@ -0,0 +1,372 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prl900/scimage"
+	"github.com/prl900/scimage/scicolor"
+)
+
+var (
+	errSampleType = errors.New("tiff: band does not hold samples of the requested type")
+	errNoSamples  = errors.New("tiff: band holds no valid samples")
+)
+
+// readSamples decompresses the image strip by strip, or tile by tile, and
+// calls fn for every pixel with its index y*width+x and the size bytes of
+// its sample in the given band.
+func (d *decoder) readSamples(band, size int, fn func(i int, p []byte)) error {
+	spp := len(d.features[tBitsPerSample])
+	if band < 0 || band >= spp {
+		return fmt.Errorf("tiff: band %d out of range [0, %d)", band, spp)
+	}
+	// With planar storage, the band is stored in its own blocks.
+	plane, sample := 0, band
+	if d.firstVal(tPlanarConfiguration) == pcPlanar {
+		plane, sample, spp = band, 0, 1
+	}
+	blocks, err := d.blocks(plane)
+	if err != nil {
+		return err
+	}
+	bounds := image.Rect(0, 0, d.config.Width, d.config.Height)
+	for k, b := range blocks {
+		if d.buf, err = d.decompress(b); err != nil {
+			return err
+		}
+		w, h := b.rect.Dx(), b.rect.Dy()
+		if err = d.unpredict(d.buf, w, h); err != nil {
+			return err
+		}
+		r := b.rect.Intersect(bounds)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				off := (((y-b.rect.Min.Y)*w+x-b.rect.Min.X)*spp + sample) * size
+				if off+size > len(d.buf) {
+					return errNoPixels
+				}
+				fn(y*d.config.Width+x, d.buf[off:off+size])
+			}
+		}
+		d.progress(k+1, len(blocks))
+	}
+	return nil
+}
+
+// bandLen returns the number of samples of a band of the image, which are
+// held in memory with size bytes each. It returns an error if the band
+// exceeds d.MaxImageBytes or cannot be held in memory.
+func (d *decoder) bandLen(size int) (int, error) {
+	w, h := d.config.Width, d.config.Height
+	if w > 0 && h > int(^uint(0)>>1)/size/w {
+		return 0, FormatError{Kind: TooLarge, Detail: fmt.Sprintf("band of %dx%d samples does not fit in memory", w, h)}
+	}
+	if err := d.checkSize(d.rawSize(w, h, 1)); err != nil {
+		return 0, err
+	}
+	return w * h, nil
+}
+
+// Float32Band returns the samples of the given band of an image holding
+// 32-bit floating point samples, in row-major order, along with the width
+// and height of the image.
+func (d *decoder) Float32Band(band int) ([]float32, int, int, error) {
+	if d.bandFormat(band) != ieeefpSample || d.bpp != 32 {
+		return nil, 0, 0, errSampleType
+	}
+	n, err := d.bandLen(4)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	data := make([]float32, n)
+	err = d.readSamples(band, 4, func(i int, p []byte) {
+		data[i] = math.Float32frombits(d.byteOrder.Uint32(p))
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return data, d.config.Width, d.config.Height, nil
+}
+
+// Float64Band returns the samples of the given band of an image holding
+// 64-bit floating point samples, in row-major order, along with the width
+// and height of the image.
+func (d *decoder) Float64Band(band int) ([]float64, int, int, error) {
+	if d.bandFormat(band) != ieeefpSample || d.bpp != 64 {
+		return nil, 0, 0, errSampleType
+	}
+	n, err := d.bandLen(8)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	data := make([]float64, n)
+	err = d.readSamples(band, 8, func(i int, p []byte) {
+		data[i] = math.Float64frombits(d.byteOrder.Uint64(p))
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return data, d.config.Width, d.config.Height, nil
+}
+
+// Int16Band returns the samples of the given band of an image holding
+// 16-bit signed integer samples, in row-major order, along with the width
+// and height of the image.
+func (d *decoder) Int16Band(band int) ([]int16, int, int, error) {
+	if d.bandFormat(band) != sintSample || d.bpp != 16 {
+		return nil, 0, 0, errSampleType
+	}
+	n, err := d.bandLen(2)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	data := make([]int16, n)
+	err = d.readSamples(band, 2, func(i int, p []byte) {
+		data[i] = int16(d.byteOrder.Uint16(p))
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return data, d.config.Width, d.config.Height, nil
+}
+
+// Int32Band returns the samples of the given band of an image holding
+// 32-bit signed integer samples, in row-major order, along with the width
+// and height of the image.
+func (d *decoder) Int32Band(band int) ([]int32, int, int, error) {
+	if d.bandFormat(band) != sintSample || d.bpp != 32 {
+		return nil, 0, 0, errSampleType
+	}
+	n, err := d.bandLen(4)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	data := make([]int32, n)
+	err = d.readSamples(band, 4, func(i int, p []byte) {
+		data[i] = int32(d.byteOrder.Uint32(p))
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return data, d.config.Width, d.config.Height, nil
+}
+
+// sampleReader returns the size in bytes of the samples of the given band,
+// and a function converting a sample to float64. Only sample types with a
+// whole number of bytes are supported.
+func (d *decoder) sampleReader(band int) (int, func(p []byte) float64, error) {
+	f := d.bandFormat(band)
+	switch {
+	case f == uintSample && d.bpp == 8:
+		return 1, func(p []byte) float64 { return float64(p[0]) }, nil
+	case f == uintSample && d.bpp == 16:
+		return 2, func(p []byte) float64 { return float64(d.byteOrder.Uint16(p)) }, nil
+	case f == uintSample && d.bpp == 32:
+		return 4, func(p []byte) float64 { return float64(d.byteOrder.Uint32(p)) }, nil
+	case f == sintSample && d.bpp == 8:
+		return 1, func(p []byte) float64 { return float64(int8(p[0])) }, nil
+	case f == sintSample && d.bpp == 16:
+		return 2, func(p []byte) float64 { return float64(int16(d.byteOrder.Uint16(p))) }, nil
+	case f == sintSample && d.bpp == 32:
+		return 4, func(p []byte) float64 { return float64(int32(d.byteOrder.Uint32(p))) }, nil
+	case f == ieeefpSample && d.bpp == 32:
+		return 4, func(p []byte) float64 { return float64(math.Float32frombits(d.byteOrder.Uint32(p))) }, nil
+	case f == ieeefpSample && d.bpp == 64:
+		return 8, func(p []byte) float64 { return math.Float64frombits(d.byteOrder.Uint64(p)) }, nil
+	}
+	return 0, nil, errSampleType
+}
+
+// bandScale returns the scale and offset of the given band, as stored by
+// GDAL in the SCALE and OFFSET metadata items.
+func (d *decoder) bandScale(band int) (scale, offset float64, err error) {
+	dataset, bands, err := d.GDALMetadata()
+	if err != nil {
+		return 0, 0, err
+	}
+	scale, offset = 1, 0
+	for _, f := range []struct {
+		key string
+		v   *float64
+	}{{"SCALE", &scale}, {"OFFSET", &offset}} {
+		s, ok := bands[band][f.key]
+		if !ok {
+			s, ok = dataset[f.key]
+		}
+		if !ok {
+			continue
+		}
+		if *f.v, err = strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil {
+			return 0, 0, FormatError{Kind: BadTag, Tag: tGDALMetadata, Detail: fmt.Sprintf("bad GDALMetadata %s value %q", f.key, s)}
+		}
+	}
+	return scale, offset, nil
+}
+
+// ScaledFloat64Band returns the samples of the given band in physical
+// units, in row-major order. Each sample is computed as value*scale+offset,
+// where scale and offset are the values of the SCALE and OFFSET items of
+// the band in the GDALMetadata tag. An item missing from the band is looked
+// up in the dataset items, and defaults to a scale of 1 and an offset of 0
+// if missing from both. Samples equal to the GDALNoData value are returned
+// as NaN.
+func (d *decoder) ScaledFloat64Band(band int) ([]float64, error) {
+	size, conv, err := d.sampleReader(band)
+	if err != nil {
+		return nil, err
+	}
+	scale, offset, err := d.bandScale(band)
+	if err != nil {
+		return nil, err
+	}
+	noData, hasNoData, err := d.NoData()
+	if err != nil {
+		return nil, err
+	}
+	n, err := d.bandLen(8)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]float64, n)
+	err = d.readSamples(band, size, func(i int, p []byte) {
+		v := conv(p)
+		if hasNoData && v == noData {
+			data[i] = math.NaN()
+			return
+		}
+		data[i] = v*scale + offset
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// BandStatistics returns the minimum, maximum, mean and standard deviation
+// of the samples of the given band, skipping samples equal to the GDALNoData
+// value and NaN samples. The samples are not scaled, and the standard
+// deviation is that of the population. The samples are streamed, so the
+// band is never held in memory as a whole. If no sample is valid, the
+// error is non-nil.
+func (d *decoder) BandStatistics(band int) (min, max, mean, stddev float64, err error) {
+	size, conv, err := d.sampleReader(band)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	noData, hasNoData, err := d.NoData()
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	// The mean and the sum of the squared differences from it, m2, are
+	// updated with Welford's algorithm.
+	var n, m2 float64
+	min, max = math.Inf(1), math.Inf(-1)
+	err = d.readSamples(band, size, func(_ int, p []byte) {
+		v := conv(p)
+		if hasNoData && v == noData || math.IsNaN(v) {
+			return
+		}
+		n++
+		delta := v - mean
+		mean += delta / n
+		m2 += delta * (v - mean)
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	})
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if n == 0 {
+		return 0, 0, 0, 0, errNoSamples
+	}
+	return min, max, mean, math.Sqrt(m2 / n), nil
+}
+
+// Bands returns the number of bands of the image, that is its number of
+// samples per pixel.
+func (d *decoder) Bands() (int, error) {
+	n := len(d.features[tBitsPerSample])
+	if _, ok := d.features[tSamplesPerPixel]; ok && int(d.firstVal(tSamplesPerPixel)) != n {
+		return 0, FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: "SamplesPerPixel does not match BitsPerSample"}
+	}
+	return n, nil
+}
+
+// Band returns the given band of the image as a grayscale image. Bands of
+// 8 and 16-bit integer samples are supported. As with Decode, the samples
+// of WhiteIsZero images are inverted.
+func (d *decoder) Band(band int) (image.Image, error) {
+	if _, err := d.Bands(); err != nil {
+		return nil, err
+	}
+	// The supported samples take at most 2 bytes.
+	if _, err := d.bandLen(2); err != nil {
+		return nil, err
+	}
+	w := d.config.Width
+	r := image.Rect(0, 0, w, d.config.Height)
+	var (
+		img  image.Image
+		size int
+		fn   func(i int, p []byte)
+	)
+	invert := d.mode == mGrayInvert
+	f := d.bandFormat(band)
+	switch {
+	case f == uintSample && d.bpp == 8:
+		m := scimage.NewGrayU8(r, 0, 255)
+		img, size = m, 1
+		fn = func(i int, p []byte) {
+			v := p[0]
+			if invert {
+				v = 0xff - v
+			}
+			m.SetGrayU8(i%w, i/w, scicolor.GrayU8{Y: v, Min: m.Min, Max: m.Max})
+		}
+	case f == uintSample && d.bpp == 16:
+		m := scimage.NewGrayU16(r, 0, 65535)
+		img, size = m, 2
+		fn = func(i int, p []byte) {
+			v := d.byteOrder.Uint16(p)
+			if invert {
+				v = 0xffff - v
+			}
+			m.SetGrayU16(i%w, i/w, scicolor.GrayU16{Y: v, Min: m.Min, Max: m.Max})
+		}
+	case f == sintSample && d.bpp == 8:
+		m := scimage.NewGrayS8(r, -128, 127)
+		img, size = m, 1
+		fn = func(i int, p []byte) {
+			v := int8(p[0])
+			if invert {
+				v = ^v
+			}
+			m.SetGrayS8(i%w, i/w, scicolor.GrayS8{Y: v, Min: m.Min, Max: m.Max})
+		}
+	case f == sintSample && d.bpp == 16:
+		m := scimage.NewGrayS16(r, -32768, 32767)
+		img, size = m, 2
+		fn = func(i int, p []byte) {
+			v := int16(d.byteOrder.Uint16(p))
+			if invert {
+				v = ^v
+			}
+			m.SetGrayS16(i%w, i/w, scicolor.GrayS16{Y: v, Min: m.Min, Max: m.Max})
+		}
+	default:
+		return nil, errSampleType
+	}
+	if err := d.readSamples(band, size, fn); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
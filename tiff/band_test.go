@@ -0,0 +1,518 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/prl900/scimage/scicolor"
+)
+
+// float32Pix returns the samples v encoded with the given byte order.
+func float32Pix(order binary.ByteOrder, v ...float32) []byte {
+	var b bytes.Buffer
+	for _, x := range v {
+		binary.Write(&b, order, math.Float32bits(x))
+	}
+	return b.Bytes()
+}
+
+func TestFloat32Band(t *testing.T) {
+	want := []float32{
+		-1.5, 0, 2.25,
+		100, 3e8, -7,
+		float32(math.Inf(1)), 0.125, 42,
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		// Three strips of one row each.
+		strips := makeTIFF(order, float32Pix(order, want...),
+			shortsEntry(tImageWidth, 3),
+			shortsEntry(tImageLength, 3),
+			shortsEntry(tBitsPerSample, 32),
+			shortsEntry(tSampleFormat, uint16(ieeefpSample)),
+			longsEntry(tStripOffsets, pixOffset, pixOffset+12, pixOffset+24),
+			longsEntry(tStripByteCounts, 12, 12, 12),
+		)
+
+		// Four padded 2x2 tiles.
+		tiles := makeTIFF(order, float32Pix(order,
+			-1.5, 0, 100, 3e8,
+			2.25, 0, -7, 0,
+			float32(math.Inf(1)), 0.125, 0, 0,
+			42, 0, 0, 0,
+		),
+			shortsEntry(tImageWidth, 3),
+			shortsEntry(tImageLength, 3),
+			shortsEntry(tBitsPerSample, 32),
+			shortsEntry(tSampleFormat, uint16(ieeefpSample)),
+			shortsEntry(tTileWidth, 2),
+			shortsEntry(tTileLength, 2),
+			longsEntry(tTileOffsets, pixOffset, pixOffset+16, pixOffset+32, pixOffset+48),
+			longsEntry(tTileByteCounts, 16, 16, 16, 16),
+		)
+
+		for _, b := range [][]byte{strips, tiles} {
+			d, err := newDecoder(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, w, h, err := d.Float32Band(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w != 3 || h != 3 {
+				t.Errorf("%v: got size %dx%d, want 3x3", order, w, h)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: got %v, want %v", order, got, want)
+			}
+			if _, _, _, err := d.Float32Band(1); err == nil {
+				t.Errorf("%v: band 1: got nil error, want non-nil", order)
+			}
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := d.Float32Band(0); err != errSampleType {
+		t.Errorf("8-bit image: got %v, want %v", err, errSampleType)
+	}
+}
+
+// fpPredict applies the floating point predictor to a row of single-sample
+// pixels.
+func fpPredict(row []float64) []byte {
+	n := len(row)
+	b := make([]byte, 8*n)
+	for i, v := range row {
+		bits := math.Float64bits(v)
+		for j := 0; j < 8; j++ {
+			b[j*n+i] = byte(bits >> uint(56-8*j))
+		}
+	}
+	for i := len(b) - 1; i > 0; i-- {
+		b[i] -= b[i-1]
+	}
+	return b
+}
+
+func TestFloat64Band(t *testing.T) {
+	want := []float64{
+		6378137.123456789, -0.1,
+		math.Pi, -9.80665e-12,
+	}
+	var pix bytes.Buffer
+	w := zlib.NewWriter(&pix)
+	w.Write(fpPredict(want[:2]))
+	w.Write(fpPredict(want[2:]))
+	w.Close()
+
+	// A single deflated 2x2 tile, using the floating point predictor.
+	b := makeTIFF(binary.LittleEndian, pix.Bytes(),
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tBitsPerSample, 64),
+		shortsEntry(tCompression, cDeflate),
+		shortsEntry(tPredictor, prFloatingPoint),
+		shortsEntry(tSampleFormat, uint16(ieeefpSample)),
+		shortsEntry(tTileWidth, 2),
+		shortsEntry(tTileLength, 2),
+		longsEntry(tTileOffsets, pixOffset),
+		longsEntry(tTileByteCounts, uint32(pix.Len())),
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err := d.Float64Band(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, _, _, err := d.Float32Band(0); err != errSampleType {
+		t.Errorf("Float32Band: got %v, want %v", err, errSampleType)
+	}
+}
+
+func TestIntBands(t *testing.T) {
+	want16 := []int16{-32768, -412, 0, 8848}
+	want32 := []int32{-2147483648, -10994, 0, 2147483647}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var pix16, pix32 bytes.Buffer
+		binary.Write(&pix16, order, want16)
+		binary.Write(&pix32, order, want32)
+
+		b := makeTIFF(order, pix16.Bytes(),
+			shortsEntry(tImageWidth, 2),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tBitsPerSample, 16),
+			shortsEntry(tRowsPerStrip, 2),
+			shortsEntry(tSampleFormat, uint16(sintSample)),
+		)
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got16, _, _, err := d.Int16Band(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got16, want16) {
+			t.Errorf("%v: Int16Band: got %v, want %v", order, got16, want16)
+		}
+
+		b = makeTIFF(order, pix32.Bytes(),
+			shortsEntry(tImageWidth, 2),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tBitsPerSample, 32),
+			shortsEntry(tRowsPerStrip, 2),
+			shortsEntry(tSampleFormat, uint16(sintSample)),
+		)
+		d, err = newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got32, _, _, err := d.Int32Band(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got32, want32) {
+			t.Errorf("%v: Int32Band: got %v, want %v", order, got32, want32)
+		}
+		if _, _, _, err := d.Int16Band(0); err != errSampleType {
+			t.Errorf("%v: Int16Band of 32-bit samples: got %v, want %v", order, err, errSampleType)
+		}
+	}
+}
+
+func TestBandTooLarge(t *testing.T) {
+	// A few bytes claim a band of 2^33 samples.
+	for _, tc := range []struct {
+		bps    uint16
+		format sampleFormat
+		band   func(d *decoder) error
+	}{
+		{32, ieeefpSample, func(d *decoder) error { _, _, _, err := d.Float32Band(0); return err }},
+		{64, ieeefpSample, func(d *decoder) error { _, _, _, err := d.Float64Band(0); return err }},
+		{16, sintSample, func(d *decoder) error { _, _, _, err := d.Int16Band(0); return err }},
+		{32, sintSample, func(d *decoder) error { _, _, _, err := d.Int32Band(0); return err }},
+		{32, ieeefpSample, func(d *decoder) error { _, err := d.ScaledFloat64Band(0); return err }},
+		{16, uintSample, func(d *decoder) error { _, err := d.Band(0); return err }},
+	} {
+		b := makeTIFF(binary.LittleEndian, make([]byte, 8),
+			longsEntry(tImageWidth, 1<<17),
+			longsEntry(tImageLength, 1<<16),
+			shortsEntry(tBitsPerSample, tc.bps),
+			shortsEntry(tSampleFormat, uint16(tc.format)),
+		)
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		limits := []int64{DefaultMaxImageBytes}
+		if strconv.IntSize == 32 {
+			// Without a limit, the band still overflows int.
+			limits = append(limits, -1)
+		}
+		for _, max := range limits {
+			d.MaxImageBytes = max
+			err := tc.band(d)
+			if e, ok := err.(FormatError); !ok || e.Kind != TooLarge {
+				t.Errorf("%d-bit format %d, MaxImageBytes %d: got %v, want too large band", tc.bps, tc.format, max, err)
+			}
+		}
+	}
+}
+
+func TestScaledFloat64Band(t *testing.T) {
+	const md = `<GDALMetadata>
+  <Item name="OFFSET">-10</Item>
+  <Item name="SCALE" sample="0" role="scale">0.5</Item>
+</GDALMetadata>`
+	var pix bytes.Buffer
+	binary.Write(&pix, binary.LittleEndian, []int16{-9999, 0, 20, -4})
+	b := makeTIFF(binary.LittleEndian, pix.Bytes(),
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tBitsPerSample, 16),
+		shortsEntry(tRowsPerStrip, 2),
+		shortsEntry(tSampleFormat, uint16(sintSample)),
+		asciiEntry(tGDALMetadata, md),
+		asciiEntry(tGDALNoData, "-9999"),
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.ScaledFloat64Band(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || !math.IsNaN(got[0]) || got[1] != -10 || got[2] != 0 || got[3] != -12 {
+		t.Errorf("got %v, want [NaN -10 0 -12]", got)
+	}
+
+	// Without metadata, the raw samples are returned.
+	d, err = newDecoder(bytes.NewReader(makeTIFF(binary.LittleEndian, []byte{1, 2},
+		shortsEntry(tImageWidth, 2),
+		longsEntry(tStripByteCounts, 2),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err = d.ScaledFloat64Band(0); err != nil || !reflect.DeepEqual(got, []float64{1, 2}) {
+		t.Errorf("no metadata: got %v, %v, want [1 2], nil", got, err)
+	}
+}
+
+func TestBandStatistics(t *testing.T) {
+	var pix bytes.Buffer
+	binary.Write(&pix, binary.LittleEndian, []int16{-9999, 2, 4, 4, 4, 5, 5, 7, 9})
+	b := makeTIFF(binary.LittleEndian, pix.Bytes(),
+		shortsEntry(tImageWidth, 3),
+		shortsEntry(tImageLength, 3),
+		shortsEntry(tBitsPerSample, 16),
+		shortsEntry(tRowsPerStrip, 3),
+		shortsEntry(tSampleFormat, uint16(sintSample)),
+		asciiEntry(tGDALNoData, "-9999"),
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max, mean, stddev, err := d.BandStatistics(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if min != 2 || max != 9 || mean != 5 || stddev != 2 {
+		t.Errorf("got %v %v %v %v, want 2 9 5 2", min, max, mean, stddev)
+	}
+
+	nan := float32(math.NaN())
+	b = makeTIFF(binary.LittleEndian, float32Pix(binary.LittleEndian, nan, 1.5, -0.5, nan),
+		shortsEntry(tImageWidth, 4),
+		shortsEntry(tBitsPerSample, 32),
+		longsEntry(tStripByteCounts, 16),
+		shortsEntry(tSampleFormat, uint16(ieeefpSample)),
+	)
+	if d, err = newDecoder(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if min, max, mean, stddev, err = d.BandStatistics(0); err != nil || min != -0.5 || max != 1.5 || mean != 0.5 || stddev != 1 {
+		t.Errorf("float: got %v %v %v %v, %v, want -0.5 1.5 0.5 1, nil", min, max, mean, stddev, err)
+	}
+
+	b = makeTIFF(binary.LittleEndian, float32Pix(binary.LittleEndian, nan),
+		shortsEntry(tBitsPerSample, 32),
+		longsEntry(tStripByteCounts, 4),
+		shortsEntry(tSampleFormat, uint16(ieeefpSample)),
+	)
+	if d, err = newDecoder(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err = d.BandStatistics(0); err != errNoSamples {
+		t.Errorf("all NaN: got %v, want %v", err, errNoSamples)
+	}
+}
+
+func TestBands(t *testing.T) {
+	const w, h, spp = 2, 3, 5
+	// Sample s of pixel i holds 100*s + i.
+	var chunky, planar bytes.Buffer
+	for i := 0; i < w*h; i++ {
+		for s := 0; s < spp; s++ {
+			binary.Write(&chunky, binary.BigEndian, uint16(100*s+i))
+		}
+	}
+	for s := 0; s < spp; s++ {
+		for i := 0; i < w*h; i++ {
+			binary.Write(&planar, binary.BigEndian, uint16(100*s+i))
+		}
+	}
+	entries := []rawEntry{
+		shortsEntry(tImageWidth, w),
+		shortsEntry(tImageLength, h),
+		shortsEntry(tBitsPerSample, 16, 16, 16, 16, 16),
+		shortsEntry(tSamplesPerPixel, spp),
+		shortsEntry(tRowsPerStrip, 2),
+	}
+	// Two strips per plane, of 2 and 1 rows.
+	planarOffsets := make([]uint32, 0, 2*spp)
+	planarCounts := make([]uint32, 0, 2*spp)
+	for s := uint32(0); s < spp; s++ {
+		off := pixOffset + s*2*w*h
+		planarOffsets = append(planarOffsets, off, off+2*2*w)
+		planarCounts = append(planarCounts, 2*2*w, 2*w)
+	}
+	files := map[string][]byte{
+		"chunky": makeTIFF(binary.BigEndian, chunky.Bytes(), append(entries,
+			longsEntry(tStripOffsets, pixOffset, pixOffset+2*spp*2*w),
+			longsEntry(tStripByteCounts, 2*spp*2*w, 2*spp*w),
+		)...),
+		"planar": makeTIFF(binary.BigEndian, planar.Bytes(), append(entries,
+			shortsEntry(tPlanarConfiguration, pcPlanar),
+			longsEntry(tStripOffsets, planarOffsets...),
+			longsEntry(tStripByteCounts, planarCounts...),
+		)...),
+	}
+	for name, b := range files {
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		n, err := d.Bands()
+		if err != nil || n != spp {
+			t.Fatalf("%s: Bands: got %d, %v, want %d, nil", name, n, err, spp)
+		}
+		for s := 0; s < spp; s++ {
+			m, err := d.Band(s)
+			if err != nil {
+				t.Fatalf("%s: band %d: %v", name, s, err)
+			}
+			for i := 0; i < w*h; i++ {
+				c, ok := m.At(i%w, i/w).(scicolor.GrayU16)
+				if want := uint16(100*s + i); !ok || c.Y != want {
+					t.Errorf("%s: band %d pixel %d: got %v, want %d", name, s, i, m.At(i%w, i/w), want)
+				}
+			}
+		}
+		if _, err := d.Band(spp); err == nil {
+			t.Errorf("%s: band %d: got nil error, want non-nil", name, spp)
+		}
+	}
+
+	for _, e := range []rawEntry{shortsEntry(tSamplesPerPixel, 3), shortsEntry(tSamplesPerPixel)} {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(e)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Bands(); err == nil {
+			t.Errorf("SamplesPerPixel %v: got nil error, want non-nil", e.vals)
+		}
+	}
+}
+
+func TestSampleFormats(t *testing.T) {
+	// Two pixels of an unsigned integer and a floating point sample.
+	var pix bytes.Buffer
+	for _, v := range []interface{}{uint32(7), float32(1.5), uint32(9), float32(-2)} {
+		binary.Write(&pix, binary.LittleEndian, v)
+	}
+	b := makeTIFF(binary.LittleEndian, pix.Bytes(),
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tBitsPerSample, 32, 32),
+		shortsEntry(tSamplesPerPixel, 2),
+		longsEntry(tStripByteCounts, 16),
+		shortsEntry(tSampleFormat, uint16(uintSample), uint16(ieeefpSample)),
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.SampleFormats(), []int{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SampleFormats: got %v, want %v", got, want)
+	}
+	f, _, _, err := d.Float32Band(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float32{1.5, -2}; !reflect.DeepEqual(f, want) {
+		t.Errorf("band 1: got %v, want %v", f, want)
+	}
+	if _, _, _, err := d.Float32Band(0); err != errSampleType {
+		t.Errorf("band 0 as float32: got %v, want %v", err, errSampleType)
+	}
+	u, err := d.ScaledFloat64Band(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{7, 9}; !reflect.DeepEqual(u, want) {
+		t.Errorf("band 0: got %v, want %v", u, want)
+	}
+
+	// Decode cannot represent mixed formats.
+	d, err = newDecoder(bytes.NewReader(buildTIFF(
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tBitsPerSample, 16, 16, 16),
+		shortsEntry(tSampleFormat, uint16(uintSample), uint16(sintSample), uint16(uintSample)),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.decodeImage()
+	if e, ok := err.(FormatError); !ok || e.Kind != Unsupported || e.Tag != tSampleFormat {
+		t.Errorf("Decode: got %v, want an Unsupported FormatError about SampleFormat", err)
+	}
+
+	// A single value applies to all the samples.
+	d, err = newDecoder(bytes.NewReader(buildTIFF(
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tBitsPerSample, 16, 16, 16),
+		shortsEntry(tSampleFormat, uint16(sintSample)),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.SampleFormats(), []int{2, 2, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("single value: SampleFormats: got %v, want %v", got, want)
+	}
+}
+
+func TestInkNames(t *testing.T) {
+	// A 1x1 image of six inks, of which the last two are spot colors.
+	b := makeTIFF(binary.LittleEndian, []byte{10, 20, 30, 40, 50, 60},
+		shortsEntry(tBitsPerSample, 8, 8, 8, 8, 8, 8),
+		shortsEntry(tSamplesPerPixel, 6),
+		shortsEntry(tPhotometricInterpretation, pCMYK),
+		shortsEntry(tInkSet, inkNotCMYK),
+		asciiEntry(tInkNames, "Cyan\x00Magenta\x00Yellow\x00Black\x00Orange\x00Green"),
+		shortsEntry(tNumberOfInks, 6),
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.InkNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Cyan", "Magenta", "Yellow", "Black", "Orange", "Green"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got ink names %q, want %q", names, want)
+	}
+	m, err := d.Band(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := m.At(0, 0).(scicolor.GrayU8); !ok || c.Y != 50 {
+		t.Errorf("band 4: got %v, want 50", m.At(0, 0))
+	}
+	if _, err := Decode(bytes.NewReader(b)); err == nil {
+		t.Error("Decode: got nil error, want non-nil")
+	}
+
+	for _, entries := range [][]rawEntry{
+		{shortsEntry(tNumberOfInks, 2), asciiEntry(tInkNames, "Orange\x00Green\x00Violet")},
+		{shortsEntry(tNumberOfInks, 2)},
+		{shortsEntry(tNumberOfInks), asciiEntry(tInkNames, "Orange")},
+	} {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(entries...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.InkNames(); err == nil {
+			t.Errorf("entries %v: got nil error, want non-nil", entries)
+		}
+	}
+}
@@ -13,23 +13,26 @@ type buffer struct {
 }
 
 // fill reads data from b.r until the buffer contains at least end bytes.
+// The buffer grows along with the data read, so that a large end only
+// causes a large allocation if b.r holds as much data.
 func (b *buffer) fill(end int) error {
-	m := len(b.buf)
-	if end > m {
-		if end > cap(b.buf) {
-			newcap := 1024
-			for newcap < end {
-				newcap *= 2
+	for m := len(b.buf); m < end; m = len(b.buf) {
+		if m == cap(b.buf) {
+			newcap := 2 * cap(b.buf)
+			if newcap < 1024 {
+				newcap = 1024
 			}
-			newbuf := make([]byte, end, newcap)
+			newbuf := make([]byte, m, newcap)
 			copy(newbuf, b.buf)
 			b.buf = newbuf
-		} else {
-			b.buf = b.buf[:end]
 		}
-		if n, err := io.ReadFull(b.r, b.buf[m:end]); err != nil {
-			end = m + n
-			b.buf = b.buf[:end]
+		n := end
+		if n > cap(b.buf) {
+			n = cap(b.buf)
+		}
+		b.buf = b.buf[:n]
+		if k, err := io.ReadFull(b.r, b.buf[m:n]); err != nil {
+			b.buf = b.buf[:m+k]
 			return err
 		}
 	}
@@ -44,7 +47,10 @@ func (b *buffer) ReadAt(p []byte, off int64) (int, error) {
 	}
 
 	err := b.fill(end)
-	return copy(p, b.buf[o:end]), err
+	if o > len(b.buf) {
+		return 0, err
+	}
+	return copy(p, b.buf[o:]), err
 }
 
 // Slice returns a slice of the underlying buffer. The slice contains
@@ -57,6 +63,13 @@ func (b *buffer) Slice(off, n int) ([]byte, error) {
 	return b.buf[off:end], nil
 }
 
+// A slicer is an io.ReaderAt whose data can be accessed without copying,
+// such as a buffer or a mappedFile.
+type slicer interface {
+	io.ReaderAt
+	Slice(off, n int) ([]byte, error)
+}
+
 // newReaderAt converts an io.Reader into an io.ReaderAt.
 func newReaderAt(r io.Reader) io.ReaderAt {
 	if ra, ok := r.(io.ReaderAt); ok {
@@ -0,0 +1,116 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A cacheKey identifies a strip or tile of one of the images of a file.
+type cacheKey struct {
+	ifd   int64 // The offset of the IFD of the image.
+	index int   // The index of the strip or tile.
+}
+
+type cacheEntry struct {
+	key cacheKey
+	buf []byte
+}
+
+// tileCache is a least recently used cache of decompressed strips and
+// tiles, holding at most size bytes. It is safe for concurrent use, and is
+// shared by a Reader and its overviews.
+type tileCache struct {
+	mu           sync.Mutex
+	size         int // The budget in bytes, 0 if the cache is disabled.
+	used         int
+	lru          *list.List // Of *cacheEntry, most recently used first.
+	entries      map[cacheKey]*list.Element
+	hits, misses int64
+}
+
+func newTileCache() *tileCache {
+	return &tileCache{lru: list.New(), entries: make(map[cacheKey]*list.Element)}
+}
+
+// get returns the cached data of the block with the given key, if any.
+func (c *tileCache) get(k cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return nil, false
+	}
+	e, ok := c.entries[k]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).buf, true
+}
+
+// put adds the data of the block with the given key to the cache, evicting
+// the least recently used blocks as needed. Blocks larger than the whole
+// budget are not cached.
+func (c *tileCache) put(k cacheKey, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(buf) > c.size {
+		return
+	}
+	if e, ok := c.entries[k]; ok {
+		// Another goroutine decompressed the same block.
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.lru.PushFront(&cacheEntry{k, buf})
+	c.used += len(buf)
+	c.evict()
+}
+
+// evict removes the least recently used blocks until the cache fits its
+// budget.
+func (c *tileCache) evict() {
+	for c.used > c.size {
+		e := c.lru.Back()
+		ce := c.lru.Remove(e).(*cacheEntry)
+		delete(c.entries, ce.key)
+		c.used -= len(ce.buf)
+	}
+}
+
+// resize sets the budget of the cache to n bytes.
+func (c *tileCache) resize(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	c.size = n
+	c.evict()
+}
+
+// SetCacheSize sets the size in bytes of the cache of decompressed strips
+// and tiles of the Reader, which is shared by its overviews. The strips and
+// tiles read by Decode, ReadWindow and ReadWindowScaled are kept in the
+// cache, so that reading overlapping windows decompresses each of them
+// once. When the cache is full, the least recently used ones are dropped.
+// The cache is disabled by default, and by a size of zero or less, which
+// also empties it.
+func (r *Reader) SetCacheSize(n int) {
+	r.cache.resize(n)
+}
+
+// CacheStats returns the number of strips or tiles found in the cache of
+// the Reader, and the number of those that were not and had to be
+// decompressed, since the Reader was opened. Lookups are only counted
+// while the cache is enabled.
+func (r *Reader) CacheStats() (hits, misses int64) {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	return r.cache.hits, r.cache.misses
+}
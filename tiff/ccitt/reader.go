@@ -0,0 +1,354 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ccitt implements the CCITT Group 3 and Group 4 bilevel image
+// compressions, as used by the TIFF file format. They are described in the
+// ITU-T recommendations T.4 and T.6.
+package ccitt // import "github.com/prl900/image/tiff/ccitt"
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+var (
+	errInvalidCode = errors.New("ccitt: invalid code")
+	errInvalidMode = errors.New("ccitt: invalid changing element")
+	errRunTooLong  = errors.New("ccitt: run longer than the line")
+	errExtension   = errors.New("ccitt: unsupported extension mode")
+)
+
+// Colors of the runs.
+const (
+	white = 0
+	black = 1
+)
+
+// decoder holds the state of the decompression of an image.
+type decoder struct {
+	r     io.ByteReader
+	bits  uint32 // Bits read from r but not consumed yet, right-aligned.
+	nbits uint   // Number of bits in bits.
+
+	width int
+	// ref and cur hold the changing elements of the reference line and of
+	// the line being decoded, that is the positions of the pixels whose
+	// color differs from the previous one. Changes to black have even
+	// indices, since lines start with an imaginary white pixel.
+	ref, cur []int
+	row      []byte // The line being decoded, packed 8 pixels per byte.
+}
+
+func newDecoder(r io.Reader, width int) *decoder {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &decoder{r: br, width: width}
+}
+
+// peek returns the next n bits of the data, without consuming them. n must
+// be at most 24.
+func (d *decoder) peek(n uint) (uint32, error) {
+	for d.nbits < n {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		d.bits = d.bits<<8 | uint32(b)
+		d.nbits += 8
+	}
+	return d.bits >> (d.nbits - n) & (1<<n - 1), nil
+}
+
+// readBit returns the next bit of the data.
+func (d *decoder) readBit() (int, error) {
+	v, err := d.peek(1)
+	if err != nil {
+		return 0, err
+	}
+	d.nbits--
+	return int(v), nil
+}
+
+// readEOL consumes an EOL code and the fill bits preceding it, if the data
+// continues with one, and reports whether it did.
+func (d *decoder) readEOL() (bool, error) {
+	for {
+		v, err := d.peek(uint(len(eolCode)))
+		if err == io.ErrUnexpectedEOF {
+			// The data ends with a short line.
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		switch v {
+		case 1:
+			d.nbits -= uint(len(eolCode))
+			return true, nil
+		case 0:
+			// No code holds that many zeros, so that the first one is a
+			// fill bit.
+			d.nbits--
+		default:
+			return false, nil
+		}
+	}
+}
+
+// decode reads the next code of the tree t, and returns its value.
+func (d *decoder) decode(t tree) (int, error) {
+	n := int32(0)
+	for {
+		b, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		n = t[n][b]
+		if n < 0 {
+			return int(^n), nil
+		}
+		if n == 0 {
+			return 0, errInvalidCode
+		}
+	}
+}
+
+// readRun reads the make-up codes and the terminating code of a run of the
+// given color, and returns its length.
+func (d *decoder) readRun(color int) (int, error) {
+	t := whiteTree
+	if color == black {
+		t = blackTree
+	}
+	n := 0
+	for {
+		v, err := d.decode(t)
+		if err != nil {
+			return 0, err
+		}
+		if v == eol {
+			return 0, errInvalidCode
+		}
+		n += v
+		if v < 64 {
+			return n, nil
+		}
+	}
+}
+
+// fill sets the color of the pixels of the line in [x0, x1). The line is
+// initially white.
+func (d *decoder) fill(x0, x1, color int) {
+	if color == white {
+		return
+	}
+	for x := x0; x < x1; x++ {
+		d.row[x/8] |= 0x80 >> uint(x%8)
+	}
+}
+
+// change records a changing element of the line being decoded. Changes
+// past the end of the line are not recorded, and two changes at the same
+// position cancel each other.
+func (d *decoder) change(x int) {
+	if x >= d.width {
+		return
+	}
+	if n := len(d.cur); n > 0 && d.cur[n-1] == x {
+		d.cur = d.cur[:n-1]
+		return
+	}
+	d.cur = append(d.cur, x)
+}
+
+// refChanges returns the changing elements b1 and b2 of the reference line:
+// b1 is the first change to the opposite of color after a0, and b2 the next
+// one. Missing changes are at the end of the line. i is the index of b1 in
+// the previous call, which is used as the starting point of the search.
+func (d *decoder) refChanges(a0, color int, i *int) (b1, b2 int) {
+	ref := d.ref
+	j := *i
+	if j > len(ref) {
+		j = len(ref)
+	}
+	for j > 0 && ref[j-1] > a0 {
+		j--
+	}
+	for j < len(ref) && ref[j] <= a0 {
+		j++
+	}
+	if j%2 != color {
+		j++
+	}
+	*i = j
+	b1, b2 = d.width, d.width
+	if j < len(ref) {
+		b1 = ref[j]
+	}
+	if j+1 < len(ref) {
+		b2 = ref[j+1]
+	}
+	return b1, b2
+}
+
+// decode1D decodes a line coded with the one-dimensional coding of T.4 into
+// d.row.
+func (d *decoder) decode1D() error {
+	d.cur = d.cur[:0]
+	for x, color := 0, white; x < d.width; color = 1 - color {
+		n, err := d.readRun(color)
+		if err != nil {
+			return err
+		}
+		if x+n > d.width {
+			return errRunTooLong
+		}
+		d.fill(x, x+n, color)
+		x += n
+		d.change(x)
+	}
+	d.ref, d.cur = d.cur, d.ref
+	return nil
+}
+
+// decode2D decodes a line coded with the two-dimensional coding of T.4 and
+// T.6 into d.row, relative to the reference line d.ref.
+func (d *decoder) decode2D() error {
+	d.cur = d.cur[:0]
+	a0, color, i := -1, white, 0
+	for a0 < d.width {
+		mode, err := d.decode(modeTree)
+		if err != nil {
+			return err
+		}
+		// The first run of the line starts at the first pixel, rather
+		// than at the imaginary pixel before it.
+		start := a0
+		if start < 0 {
+			start = 0
+		}
+		b1, b2 := d.refChanges(a0, color, &i)
+		switch mode {
+		case modePass:
+			d.fill(start, b2, color)
+			a0 = b2
+		case modeHorizontal:
+			r1, err := d.readRun(color)
+			if err != nil {
+				return err
+			}
+			r2, err := d.readRun(1 - color)
+			if err != nil {
+				return err
+			}
+			a1, a2 := start+r1, start+r1+r2
+			if a2 > d.width {
+				return errRunTooLong
+			}
+			d.fill(start, a1, color)
+			d.fill(a1, a2, 1-color)
+			d.change(a1)
+			d.change(a2)
+			a0 = a2
+		case modeV0, modeVR1, modeVR2, modeVR3, modeVL1, modeVL2, modeVL3:
+			a1 := b1 + verticalOffsets[mode]
+			if a1 < start || a1 > d.width {
+				return errInvalidMode
+			}
+			d.fill(start, a1, color)
+			d.change(a1)
+			a0 = a1
+			color = 1 - color
+		case modeExtension:
+			return errExtension
+		default:
+			return errInvalidCode
+		}
+	}
+	d.ref, d.cur = d.cur, d.ref
+	return nil
+}
+
+// verticalOffsets are the offsets of a1 from b1 in the vertical modes.
+var verticalOffsets = [...]int{
+	modeV0:  0,
+	modeVR1: 1,
+	modeVR2: 2,
+	modeVR3: 3,
+	modeVL1: -1,
+	modeVL2: -2,
+	modeVL3: -3,
+}
+
+// Group3Options are the options of the Group 3 coding of an image, as given
+// by the T4Options TIFF tag.
+type Group3Options struct {
+	// TwoD is whether lines may be coded with the two-dimensional coding.
+	// Each line then starts with a bit telling whether it is coded with the
+	// one-dimensional coding.
+	TwoD bool
+}
+
+// DecodeGroup3 decodes the Group 3 compressed data in r of an image with
+// the given size. The pixels are returned as by DecodeGroup4. The EOL codes
+// starting the lines may be preceded by fill bits, and may be missing.
+func DecodeGroup3(r io.Reader, width, height int, opts Group3Options) ([]byte, error) {
+	if width <= 0 || height < 0 {
+		return nil, errors.New("ccitt: invalid image size")
+	}
+	d := newDecoder(r, width)
+	stride := (width + 7) / 8
+	dst := make([]byte, stride*height)
+	for y := 0; y < height; y++ {
+		d.row = dst[y*stride : (y+1)*stride]
+		if _, err := d.readEOL(); err != nil {
+			return nil, err
+		}
+		oneD := true
+		if opts.TwoD {
+			b, err := d.readBit()
+			if err != nil {
+				return nil, err
+			}
+			oneD = b == 1
+		}
+		var err error
+		if oneD {
+			err = d.decode1D()
+		} else {
+			err = d.decode2D()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// DecodeGroup4 decodes the Group 4 compressed data in r of an image with
+// the given size. It returns the pixels in rows of (width+7)/8 bytes, with
+// 8 pixels per byte, most significant bit first. White pixels are 0 and
+// black pixels are 1, as with a TIFF PhotometricInterpretation of
+// WhiteIsZero.
+func DecodeGroup4(r io.Reader, width, height int) ([]byte, error) {
+	if width <= 0 || height < 0 {
+		return nil, errors.New("ccitt: invalid image size")
+	}
+	d := newDecoder(r, width)
+	stride := (width + 7) / 8
+	dst := make([]byte, stride*height)
+	// The reference line of the first line is an imaginary white line.
+	for y := 0; y < height; y++ {
+		d.row = dst[y*stride : (y+1)*stride]
+		if err := d.decode2D(); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
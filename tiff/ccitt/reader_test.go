@@ -0,0 +1,315 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ccitt
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// packBits packs a string of '0' and '1' characters into bytes, most
+// significant bit first, ignoring spaces.
+func packBits(s string) []byte {
+	s = strings.Replace(s, " ", "", -1)
+	b := make([]byte, (len(s)+7)/8)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '1' {
+			b[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return b
+}
+
+func TestDecodeGroup4(t *testing.T) {
+	// The codes of each line, coded by hand from the tables of T.4, are
+	// followed by an EOFB.
+	data := packBits("" +
+		"1 " + // V0
+		"001 0111 10 1 " + // H, white 2, black 3, V0
+		"011 011 1 " + // VR1, VR1, V0
+		"010 010 1 " + // VL1, VL1, V0
+		"0001 1 " + // P, V0
+		"000000000001 000000000001")
+	want := []byte{
+		0x00, // ........
+		0x38, // ..###...
+		0x1c, // ...###..
+		0x38, // ..###...
+		0x00, // ........
+	}
+	got, err := DecodeGroup4(bytes.NewReader(data), 8, len(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	if _, err := DecodeGroup4(bytes.NewReader(data[:2]), 8, len(want)); err == nil {
+		t.Error("truncated data: got nil error, want non-nil")
+	}
+	if _, err := DecodeGroup4(bytes.NewReader(packBits("0000001 000")), 8, 1); err == nil {
+		t.Error("extension mode: got nil error, want non-nil")
+	}
+}
+
+// bitWriter accumulates codes written as strings of '0' and '1'.
+type bitWriter struct {
+	bits strings.Builder
+}
+
+func (w *bitWriter) code(codes []code, val int) {
+	for _, c := range codes {
+		if c.val == val {
+			w.bits.WriteString(c.bits)
+			return
+		}
+	}
+	panic("no code")
+}
+
+func (w *bitWriter) run(color, n int) {
+	codes := whiteCodes
+	if color == black {
+		codes = blackCodes
+	}
+	for n >= 2560 {
+		w.code(extendedCodes, 2560)
+		n -= 2560
+	}
+	if m := n / 64 * 64; m > 1728 {
+		w.code(extendedCodes, m)
+	} else if m > 0 {
+		w.code(codes, m)
+	}
+	w.code(codes, n%64)
+}
+
+// changes returns the changing elements of a line of pixels.
+func changes(line []int) []int {
+	var c []int
+	color := white
+	for x, v := range line {
+		if v != color {
+			c = append(c, x)
+			color = v
+		}
+	}
+	return c
+}
+
+// encoder is a straightforward encoder of lines of pixels.
+type encoder struct {
+	bitWriter
+	ref []int // The changing elements of the reference line.
+}
+
+// eol writes an EOL code, preceded by fill bits if align is true, so that
+// it ends on a byte boundary.
+func (e *encoder) eol(align bool) {
+	if align {
+		for (e.bits.Len()+len(eolCode))%8 != 0 {
+			e.bits.WriteByte('0')
+		}
+	}
+	e.bits.WriteString(eolCode)
+}
+
+// line1D writes a line with the one-dimensional coding.
+func (e *encoder) line1D(line []int) {
+	cur := changes(line)
+	x, color := 0, white
+	for _, c := range append(cur, len(line)) {
+		e.run(color, c-x)
+		x, color = c, 1-color
+	}
+	e.ref = cur
+}
+
+// line2D writes a line with the two-dimensional coding.
+func (e *encoder) line2D(line []int) {
+	width := len(line)
+	cur := changes(line)
+	// next returns the first change in c after x whose index has the
+	// given parity, if any, and the change after it. Missing changes
+	// are at the end of the line.
+	next := func(c []int, x, parity int) (int, int) {
+		for i, v := range c {
+			if v > x && (parity < 0 || i%2 == parity) {
+				if i+1 < len(c) {
+					return v, c[i+1]
+				}
+				return v, width
+			}
+		}
+		return width, width
+	}
+	a0, color := -1, white
+	for a0 < width {
+		a1, a2 := next(cur, a0, -1)
+		b1, b2 := next(e.ref, a0, color)
+		switch {
+		case b2 < a1:
+			e.code(modeCodes, modePass)
+			a0 = b2
+		case a1-b1 >= -3 && a1-b1 <= 3:
+			e.code(modeCodes, []int{modeVL3, modeVL2, modeVL1, modeV0, modeVR1, modeVR2, modeVR3}[a1-b1+3])
+			a0 = a1
+			color = 1 - color
+		default:
+			start := a0
+			if start < 0 {
+				start = 0
+			}
+			e.code(modeCodes, modeHorizontal)
+			e.run(color, a1-start)
+			e.run(1-color, a2-a1)
+			a0 = a2
+		}
+	}
+	e.ref = cur
+}
+
+func encodeGroup4(lines [][]int) []byte {
+	var e encoder
+	for _, line := range lines {
+		e.line2D(line)
+	}
+	e.eol(false)
+	e.eol(false)
+	return packBits(e.bits.String())
+}
+
+// encodeGroup3 codes every fourth line with the one-dimensional coding if
+// twoD is true, and all of them otherwise.
+func encodeGroup3(lines [][]int, twoD, align bool) []byte {
+	var e encoder
+	for y, line := range lines {
+		e.eol(align)
+		switch {
+		case !twoD:
+			e.line1D(line)
+		case y%4 == 0:
+			e.bits.WriteByte('1')
+			e.line1D(line)
+		default:
+			e.bits.WriteByte('0')
+			e.line2D(line)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		e.eol(false)
+	}
+	return packBits(e.bits.String())
+}
+
+// randomLines returns lines of random runs, which are often similar to
+// those of the previous line, and their pixels packed as by the decoders.
+func randomLines(rnd *rand.Rand, width, height int) ([][]int, []byte) {
+	lines := make([][]int, height)
+	var pix []byte
+	for y := range lines {
+		line := make([]int, width)
+		color, x := rnd.Intn(2), 0
+		for x < width {
+			n := 1 + rnd.Intn(1+[]int{4, 70, 3000}[rnd.Intn(3)])
+			if y > 0 && rnd.Intn(2) == 0 {
+				copy(line[x:], lines[y-1][x:])
+				x += n
+				continue
+			}
+			for ; n > 0 && x < width; n-- {
+				line[x] = color
+				x++
+			}
+			color = 1 - color
+		}
+		lines[y] = line
+		row := make([]byte, (width+7)/8)
+		for x, v := range line {
+			if v == black {
+				row[x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+		pix = append(pix, row...)
+	}
+	return lines, pix
+}
+
+func TestDecodeGroup4Random(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, width := range []int{1, 7, 100, 1728, 6000} {
+		lines, want := randomLines(rnd, width, 50)
+		got, err := DecodeGroup4(bytes.NewReader(encodeGroup4(lines)), width, len(lines))
+		if err != nil {
+			t.Fatalf("width %d: %v", width, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("width %d: decoded pixels differ", width)
+		}
+	}
+}
+
+func TestDecodeGroup3(t *testing.T) {
+	want := []byte{0x00, 0x38, 0x1c, 0x38, 0x00}
+	const rtc = eolCode + eolCode + eolCode + eolCode + eolCode + eolCode
+	for _, tc := range []struct {
+		desc string
+		opts Group3Options
+		bits string
+	}{
+		{"1D", Group3Options{}, "" +
+			eolCode + "10011 " + // white 8
+			eolCode + "0111 10 1000 " + // white 2, black 3, white 3
+			eolCode + "1000 10 0111 " +
+			eolCode + "0111 10 1000 " +
+			eolCode + "10011 " + rtc},
+		{"1D with fill bits", Group3Options{}, "" +
+			"0000" + eolCode + "10011 " +
+			"000" + eolCode + "0111 10 1000 " +
+			"00000000" + eolCode + "1000 10 0111 " +
+			"000" + eolCode + "0111 10 1000 " +
+			"00000000" + eolCode + "10011 " + rtc},
+		{"1D without EOL", Group3Options{}, "" +
+			"10011 0111 10 1000 1000 10 0111 0111 10 1000 10011"},
+		{"2D", Group3Options{TwoD: true}, "" +
+			eolCode + "1 10011 " + // 1D: white 8
+			eolCode + "0 001 0111 10 1 " + // 2D: H, white 2, black 3, V0
+			eolCode + "0 011 011 1 " + // VR1, VR1, V0
+			eolCode + "1 0111 10 1000 " + // 1D: white 2, black 3, white 3
+			eolCode + "0 0001 1 " + // P, V0
+			rtc},
+	} {
+		got, err := DecodeGroup3(bytes.NewReader(packBits(tc.bits)), 8, len(want), tc.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %x, want %x", tc.desc, got, want)
+		}
+	}
+}
+
+func TestDecodeGroup3Random(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, width := range []int{1, 7, 100, 1728, 6000} {
+		lines, want := randomLines(rnd, width, 50)
+		for _, twoD := range []bool{false, true} {
+			for _, align := range []bool{false, true} {
+				data := encodeGroup3(lines, twoD, align)
+				got, err := DecodeGroup3(bytes.NewReader(data), width, len(lines), Group3Options{TwoD: twoD})
+				if err != nil {
+					t.Fatalf("width %d, 2D %t, aligned %t: %v", width, twoD, align, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("width %d, 2D %t, aligned %t: decoded pixels differ", width, twoD, align)
+				}
+			}
+		}
+	}
+}
@@ -7,27 +7,43 @@ package tiff
 import (
 	"bufio"
 	"io"
+	"math/bits"
 )
 
+// zstdNewReader and zstdNewWriter return a Zstandard decompressor reading
+// from r and a compressor writing to w with the given level, where zero
+// selects the default level. They are nil unless the package is built with
+// the zstd build tag.
+var (
+	zstdNewReader func(r io.Reader) (io.ReadCloser, error)
+	zstdNewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+)
+
+// errNoZstd is returned when decoding Zstandard compressed data without
+// Zstandard support.
+var errNoZstd = FormatError{Kind: UnsupportedCompression, Tag: tCompression, Detail: "Zstandard compression without the zstd build tag"}
+
 type byteReader interface {
 	io.Reader
 	io.ByteReader
 }
 
 // unpackBits decodes the PackBits-compressed data in src and returns the
-// uncompressed data.
+// uncompressed data. At most n bytes are returned: as in libtiff, a corrupt
+// run that extends beyond n bytes is truncated rather than overrunning the
+// strip.
 //
 // The PackBits compression format is described in section 9 (p. 42)
 // of the TIFF spec.
-func unpackBits(r io.Reader) ([]byte, error) {
+func unpackBits(r io.Reader, n int) ([]byte, error) {
 	buf := make([]byte, 128)
-	dst := make([]byte, 0, 1024)
+	dst := make([]byte, 0, minInt(n, 1024))
 	br, ok := r.(byteReader)
 	if !ok {
 		br = bufio.NewReader(r)
 	}
 
-	for {
+	for len(dst) < n {
 		b, err := br.ReadByte()
 		if err != nil {
 			if err == io.EOF {
@@ -38,21 +54,120 @@ func unpackBits(r io.Reader) ([]byte, error) {
 		code := int(int8(b))
 		switch {
 		case code >= 0:
-			n, err := io.ReadFull(br, buf[:code+1])
+			m, err := io.ReadFull(br, buf[:code+1])
 			if err != nil {
 				return nil, err
 			}
-			dst = append(dst, buf[:n]...)
+			dst = append(dst, buf[:minInt(m, n-len(dst))]...)
 		case code == -128:
 			// No-op.
 		default:
 			if b, err = br.ReadByte(); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
 				return nil, err
 			}
 			for j := 0; j < 1-code; j++ {
 				buf[j] = b
 			}
-			dst = append(dst, buf[:1-code]...)
+			dst = append(dst, buf[:minInt(1-code, n-len(dst))]...)
+		}
+	}
+	return dst, nil
+}
+
+// packBits appends the PackBits-compressed form of src to dst and returns
+// the extended slice. Runs of three or more equal bytes are replicated, and
+// everything else is stored literally, so the output is never longer than
+// src plus one byte per 128 bytes of input.
+func packBits(dst, src []byte) []byte {
+	lit := 0 // Start of the pending literal bytes.
+	for i := 0; i < len(src); {
+		j := i + 1
+		for j < len(src) && j-i < 128 && src[j] == src[i] {
+			j++
+		}
+		if j-i < 3 {
+			i = j
+			continue
+		}
+		dst = packLiterals(dst, src[lit:i])
+		dst = append(dst, byte(1-(j-i)), src[i])
+		i, lit = j, j
+	}
+	return packLiterals(dst, src[lit:])
+}
+
+// packLiterals appends p to dst as PackBits literal runs.
+func packLiterals(dst, p []byte) []byte {
+	for len(p) > 0 {
+		n := minInt(len(p), 128)
+		dst = append(dst, byte(n-1))
+		dst = append(dst, p[:n]...)
+		p = p[n:]
+	}
+	return dst
+}
+
+// packBitsWriter compresses the data written to it with PackBits. As
+// required by the TIFF spec, each row of rowLen bytes is packed separately.
+type packBitsWriter struct {
+	w      io.Writer
+	rowLen int
+	row    []byte
+	buf    []byte
+}
+
+func newPackBitsWriter(w io.Writer, rowLen int) *packBitsWriter {
+	return &packBitsWriter{w: w, rowLen: rowLen, row: make([]byte, 0, rowLen)}
+}
+
+func (p *packBitsWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		k := minInt(len(b), p.rowLen-len(p.row))
+		p.row = append(p.row, b[:k]...)
+		b = b[k:]
+		if len(p.row) == p.rowLen {
+			if err := p.flush(); err != nil {
+				return 0, err
+			}
 		}
 	}
+	return n, nil
+}
+
+func (p *packBitsWriter) flush() error {
+	p.buf = packBits(p.buf[:0], p.row)
+	p.row = p.row[:0]
+	_, err := p.w.Write(p.buf)
+	return err
+}
+
+// Close writes out a final partial row, if any.
+func (p *packBitsWriter) Close() error {
+	if len(p.row) == 0 {
+		return nil
+	}
+	return p.flush()
+}
+
+// reverseBits reverses the order of the bits of each byte of p, which
+// converts data with a FillOrder of 2 to the default fill order.
+func reverseBits(p []byte) {
+	for i, b := range p {
+		p[i] = bits.Reverse8(b)
+	}
+}
+
+// reverseBitsReader reverses the order of the bits of each byte read from r.
+type reverseBitsReader struct {
+	r io.Reader
+}
+
+func (r reverseBitsReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	reverseBits(p[:n])
+	return n, err
 }
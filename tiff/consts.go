@@ -20,6 +20,13 @@ const (
 	beHeader = "MM\x00\x2A" // Header for big-endian files.
 
 	ifdLen = 12 // Length of an IFD entry in bytes.
+
+	// BigTIFF files use 8-byte offsets and counts, and a different version
+	// number in the header. See http://www.awaresystems.be/imaging/tiff/bigtiff.html.
+	leHeaderBig = "II\x2B\x00" // Header for little-endian BigTIFF files.
+	beHeaderBig = "MM\x00\x2B" // Header for big-endian BigTIFF files.
+
+	ifdLenBig = 20 // Length of a BigTIFF IFD entry in bytes.
 )
 
 // Data types (p. 14-16 of the spec).
@@ -36,18 +43,27 @@ const (
 	dtSRational = 10
 	dtFloat32   = 11
 	dtFloat64   = 12
+	dtIFD       = 13
+
+	// BigTIFF data types.
+	dtLong8  = 16
+	dtSLong8 = 17
+	dtIFD8   = 18
 )
 
 // The length of one instance of each data type in bytes.
-var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 0, 2, 4, 8, 4, 8}
+var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4, 0, 0, 8, 8, 8}
 
 // Tags (see p. 28-41 of the spec).
 const (
+	tNewSubfileType = 254
+
 	tImageWidth                = 256
 	tImageLength               = 257
 	tBitsPerSample             = 258
 	tCompression               = 259
 	tPhotometricInterpretation = 262
+	tFillOrder                 = 266
 
 	tStripOffsets    = 273
 	tSamplesPerPixel = 277
@@ -59,29 +75,62 @@ const (
 	tTileOffsets    = 324
 	tTileByteCounts = 325
 
-	tOrientation    = 274
-	tXResolution    = 282
-	tYResolution    = 283
-	tXPosition      = 286
-	tYPosition      = 287
-	tResolutionUnit = 296
+	tOrientation         = 274
+	tXResolution         = 282
+	tYResolution         = 283
+	tPlanarConfiguration = 284
+	tXPosition           = 286
+	tYPosition           = 287
+	tT4Options           = 292
+	tT6Options           = 293
+	tResolutionUnit      = 296
 
 	tPredictor    = 317
 	tColorMap     = 320
+	tSubIFDs      = 330
+	tInkSet       = 332
+	tInkNames     = 333
+	tNumberOfInks = 334
 	tExtraSamples = 338
 	tSampleFormat = 339
+	tJPEGTables   = 347
+
+	tJPEGInterchangeFormat       = 513
+	tJPEGInterchangeFormatLength = 514
+
+	tYCbCrSubSampling = 530
+
+	// Informational tags
+	tImageDescription = 270
+	tMake             = 271
+	tModel            = 272
+	tSoftware         = 305
+	tDateTime         = 306
+	tArtist           = 315
+	tCopyright        = 33432
 
 	// GeoTIFF tags
 	tModelPixelScale     = 33550
 	tModelTiepoint       = 33922
 	tModelTransformation = 34264
 	tGeoKeyDirectory     = 34735
-	//tModel2              = 34736
-	//tModel3              = 34737
+	tGeoDoubleParams     = 34736
+	tGeoASCIIParams      = 34737
 
 	// GDAL tags
 	tGDALMetadata = 42112
 	tGDALNoData   = 42113
+
+	tExifIFD = 34665
+)
+
+// Tags of the EXIF IFD, as returned by Exif (see the EXIF 2.3 spec).
+const (
+	ExifExposureTime     = 33434 // RATIONAL, in seconds.
+	ExifFNumber          = 33437 // RATIONAL.
+	ExifISOSpeedRatings  = 34855 // SHORT.
+	ExifDateTimeOriginal = 36867 // ASCII, as "YYYY:MM:DD HH:MM:SS".
+	ExifFocalLength      = 37386 // RATIONAL, in millimeters.
 )
 
 // Key ID Summary
@@ -164,6 +213,27 @@ const (
 	CT_TransvMercator_SouthOriented   = 27
 )
 
+// GTModelTypeGeoKey codes (section 6.3.1.1).
+const (
+	ModelTypeProjected  = 1 // Projection coordinate system.
+	ModelTypeGeographic = 2 // Geographic latitude-longitude system.
+	ModelTypeGeocentric = 3 // Geocentric (X,Y,Z) coordinate system.
+)
+
+// RasterType is a GTRasterTypeGeoKey code (section 6.3.1.2), telling
+// whether the georeferencing of an image refers to the corners or to the
+// centers of its pixels.
+type RasterType int
+
+const (
+	RasterPixelIsArea  RasterType = 1 // A pixel covers an area, the default.
+	RasterPixelIsPoint RasterType = 2 // A pixel is a point sample.
+)
+
+// KvUserDefined is the value of a key whose code is not one of the standard
+// codes, but is instead defined by other keys.
+const KvUserDefined = 32767
+
 // Compression types (defined in various places in the spec and supplements).
 const (
 	cNone       = 1
@@ -176,8 +246,27 @@ const (
 	cDeflate    = 8 // zlib compression.
 	cPackBits   = 32773
 	cDeflateOld = 32946 // Superseded by cDeflate.
+	cZstd       = 50000 // Zstandard compression.
 )
 
+// compressionNames holds the names of compression schemes the decoder does
+// not support, to make errors about them easier to understand.
+var compressionNames = map[uint]string{
+	cCCITT: "CCITT modified Huffman RLE",
+	32771:  "CCITT RLEW",
+	32809:  "ThunderScan",
+	32908:  "Pixar film",
+	32909:  "Pixar log",
+	34661:  "JBIG",
+	34676:  "SGI LogLuv",
+	34677:  "SGI LogLuv 24",
+	34712:  "JPEG 2000",
+	34887:  "LERC",
+	34925:  "LZMA",
+	50001:  "WebP",
+	50002:  "JPEG XL",
+}
+
 // Photometric interpretation values (see p. 37 of the spec).
 const (
 	pWhiteIsZero = 0
@@ -192,8 +281,42 @@ const (
 
 // Values for the tPredictor tag (page 64-65 of the spec).
 const (
-	prNone       = 1
-	prHorizontal = 2
+	prNone          = 1
+	prHorizontal    = 2
+	prFloatingPoint = 3 // See Adobe Photoshop TIFF Technical Note 3.
+)
+
+// Bits of the tNewSubfileType tag (page 36).
+const (
+	sfReducedResolution = 1 // The image is a reduced-resolution version of another image.
+	sfPage              = 2 // The image is a page of a multi-page image.
+	sfMask              = 4 // The image is a transparency mask for another image.
+)
+
+// Values for the tFillOrder tag (page 32).
+const (
+	foMSB2LSB = 1 // The most significant bit of each byte comes first.
+	foLSB2MSB = 2 // The least significant bit of each byte comes first.
+)
+
+// Bits of the tT4Options and tT6Options tags (page 51-52).
+const (
+	t4TwoD         = 1 // Lines may be coded with the two-dimensional coding.
+	t4Uncompressed = 2 // The uncompressed mode may be used.
+	t4FillBits     = 4 // EOL codes are preceded by fill bits to end on a byte boundary.
+	t6Uncompressed = 2 // The uncompressed mode may be used.
+)
+
+// Values for the tPlanarConfiguration tag (page 38).
+const (
+	pcChunky = 1 // The samples of a pixel are stored contiguously.
+	pcPlanar = 2 // Each sample is stored in its own plane.
+)
+
+// Values for the tInkSet tag (page 70).
+const (
+	inkCMYK    = 1
+	inkNotCMYK = 2
 )
 
 // Values for the tResolutionUnit tag (page 18).
@@ -203,6 +326,16 @@ const (
 	resPerCM   = 3 // Dots per centimeter.
 )
 
+// ExtraSample describes the meaning of an extra sample, such as an alpha
+// channel. Its values are those of the ExtraSamples tag (page 31-32).
+type ExtraSample int
+
+const (
+	UnspecifiedSample ExtraSample = iota // Data of unspecified meaning.
+	AssociatedAlpha                      // Alpha premultiplied into the color samples.
+	UnassociatedAlpha                    // Alpha independent of the color samples.
+)
+
 // sampleFormat represents the mode of the image.
 type sampleFormat int
 
@@ -225,6 +358,11 @@ const (
 	mRGB
 	mRGBA
 	mNRGBA
+	mCMYK
+	mCMYKA     // CMYK with an extra sample, usually alpha.
+	mSeparated // Other inks than CMYK, only read by the band accessors.
+	mYCbCr
+	mCIELab
 )
 
 // CompressionType describes the type of compression used in Options.
@@ -233,6 +371,16 @@ type CompressionType int
 const (
 	Uncompressed CompressionType = iota
 	Deflate
+	LZW
+	PackBits
+	// Zstd is only available when the package is built with the zstd
+	// build tag. It uses the github.com/klauspost/compress/zstd package,
+	// which is vendored.
+	Zstd
+
+	// UnknownCompression is returned by Compression for the compression
+	// schemes that the encoder does not support, such as JPEG or CCITT.
+	UnknownCompression CompressionType = -1
 )
 
 // specValue returns the compression type constant from the TIFF spec that
@@ -241,6 +389,77 @@ func (c CompressionType) specValue() uint32 {
 	switch c {
 	case Deflate:
 		return cDeflate
+	case LZW:
+		return cLZW
+	case PackBits:
+		return cPackBits
+	case Zstd:
+		return cZstd
 	}
 	return cNone
 }
+
+// PredictorType describes the type of predictor used in Options.
+type PredictorType int
+
+const (
+	NoPredictor            PredictorType = iota
+	HorizontalPredictor                  // Horizontal differencing of the samples.
+	FloatingPointPredictor               // Byte shuffling and differencing of floating point samples.
+)
+
+// specValue returns the predictor constant from the TIFF spec that is
+// equivalent to p.
+func (p PredictorType) specValue() uint32 {
+	switch p {
+	case HorizontalPredictor:
+		return prHorizontal
+	case FloatingPointPredictor:
+		return prFloatingPoint
+	}
+	return prNone
+}
+
+// SampleFormatType describes how the samples written with Options are
+// interpreted.
+type SampleFormatType int
+
+const (
+	UnsignedSample SampleFormatType = iota // Unsigned integers, the default.
+	SignedSample                           // Two's complement signed integers.
+	FloatSample                            // IEEE floating point numbers.
+)
+
+// specValue returns the sample format constant from the TIFF spec that is
+// equivalent to f.
+func (f SampleFormatType) specValue() sampleFormat {
+	switch f {
+	case SignedSample:
+		return sintSample
+	case FloatSample:
+		return ieeefpSample
+	}
+	return uintSample
+}
+
+// ResolutionUnit is the unit of the horizontal and vertical resolutions of
+// an image.
+type ResolutionUnit int
+
+const (
+	PerInch          ResolutionUnit = iota // Dots per inch, the default.
+	PerCM                                  // Dots per centimeter.
+	NoResolutionUnit                       // The resolutions only give the aspect ratio of the pixels.
+)
+
+// specValue returns the resolution unit constant from the TIFF spec that
+// is equivalent to u.
+func (u ResolutionUnit) specValue() uint32 {
+	switch u {
+	case PerCM:
+		return resPerCM
+	case NoResolutionUnit:
+		return resNone
+	}
+	return resPerInch
+}
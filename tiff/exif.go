@@ -0,0 +1,163 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Exif returns the entries of the EXIF IFD of the image, pointed to by its
+// ExifIFD tag, keyed by tag, such as ExifExposureTime or ExifFNumber. The
+// values have the Go type matching their data type: string for ASCII,
+// []byte for BYTE and UNDEFINED, uint16 for SHORT, uint32 for LONG and IFD,
+// uint64 for LONG8 and IFD8, int8, int16, int32 and int64 for the signed
+// integer types, float32 for FLOAT, and float64 for DOUBLE and for
+// RATIONAL and SRATIONAL, which are divided out. Entries of all types but
+// ASCII, BYTE and UNDEFINED with more than one value are given as slices
+// of these types.
+func (d *decoder) Exif() (map[uint16]interface{}, error) {
+	dtype, _, raw, ok := d.RawTag(tExifIFD)
+	if !ok {
+		return nil, FormatError{Kind: MissingTag, Tag: tExifIFD, Detail: "ExifIFD tag missing"}
+	}
+	var offset int64
+	switch dtype {
+	case dtLong, dtIFD:
+		offset = int64(d.byteOrder.Uint32(raw))
+	case dtLong8, dtIFD8:
+		offset = int64(d.byteOrder.Uint64(raw))
+	default:
+		return nil, FormatError{Kind: BadTag, Tag: tExifIFD, Detail: fmt.Sprintf("ExifIFD of data type %d", dtype)}
+	}
+	e, err := d.ifdDecoder(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	exif := map[uint16]interface{}{}
+	entryLen := e.ifdLen()
+	for i := 0; i+entryLen <= len(e.ifd); i += entryLen {
+		tag, dt, count, raw, err := e.ifdData(e.ifd[i : i+entryLen])
+		if err != nil {
+			return nil, err
+		}
+		v, err := e.exifValue(dt, int(count), raw)
+		if err != nil {
+			return nil, FormatError{Kind: BadTag, Tag: tag, Detail: err.Error()}
+		}
+		exif[uint16(tag)] = v
+	}
+	return exif, nil
+}
+
+// exifValue converts the raw data of an IFD entry, with count values of
+// type dtype, to a value as returned by Exif.
+func (d *decoder) exifValue(dtype uint16, count int, raw []byte) (interface{}, error) {
+	order := d.byteOrder
+	n := int(lengths[dtype])
+	switch dtype {
+	case dtASCII:
+		return string(bytes.TrimRight(raw, "\x00")), nil
+	case dtByte, dtUndefined:
+		return raw, nil
+	case dtShort:
+		v := make([]uint16, count)
+		for i := range v {
+			v[i] = order.Uint16(raw[n*i:])
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	case dtLong, dtIFD:
+		v := make([]uint32, count)
+		for i := range v {
+			v[i] = order.Uint32(raw[n*i:])
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	case dtLong8, dtIFD8:
+		v := make([]uint64, count)
+		for i := range v {
+			v[i] = order.Uint64(raw[n*i:])
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	case dtInt8:
+		v := make([]int8, count)
+		for i := range v {
+			v[i] = int8(raw[i])
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	case dtInt16:
+		v := make([]int16, count)
+		for i := range v {
+			v[i] = int16(order.Uint16(raw[n*i:]))
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	case dtInt32:
+		v := make([]int32, count)
+		for i := range v {
+			v[i] = int32(order.Uint32(raw[n*i:]))
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	case dtSLong8:
+		v := make([]int64, count)
+		for i := range v {
+			v[i] = int64(order.Uint64(raw[n*i:]))
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	case dtFloat32:
+		v := make([]float32, count)
+		for i := range v {
+			v[i] = math.Float32frombits(order.Uint32(raw[n*i:]))
+		}
+		if count == 1 {
+			return v[0], nil
+		}
+		return v, nil
+	}
+
+	// The remaining types hold float64 values.
+	v := make([]float64, count)
+	for i := range v {
+		p := raw[n*i:]
+		switch dtype {
+		case dtFloat64:
+			v[i] = math.Float64frombits(order.Uint64(p))
+		case dtRational, dtSRational:
+			num, den := float64(order.Uint32(p)), float64(order.Uint32(p[4:]))
+			if dtype == dtSRational {
+				num, den = float64(int32(order.Uint32(p))), float64(int32(order.Uint32(p[4:])))
+			}
+			if den == 0 {
+				return nil, fmt.Errorf("zero denominator")
+			}
+			v[i] = num / den
+		}
+	}
+	if count == 1 {
+		return v[0], nil
+	}
+	return v, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// exifTIFF returns a file whose image has an EXIF IFD, written after the
+// image IFD, with the given entries. The values of RATIONAL and SRATIONAL
+// entries are given as numerator and denominator pairs. Values of more than
+// 4 bytes follow the EXIF IFD.
+func exifTIFF(entries ...rawEntry) []byte {
+	off := len(makeTIFF(binary.LittleEndian, []byte{0}, longsEntry(tExifIFD, 0)))
+	b := bytes.NewBuffer(makeTIFF(binary.LittleEndian, []byte{0}, longsEntry(tExifIFD, uint32(off))))
+
+	var data bytes.Buffer
+	dataOff := off + 2 + ifdLen*len(entries) + 4
+	binary.Write(b, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		var val bytes.Buffer
+		count := len(e.vals)
+		for _, v := range e.vals {
+			switch e.datatype {
+			case dtByte, dtASCII, dtUndefined:
+				val.WriteByte(byte(v))
+			case dtShort:
+				binary.Write(&val, binary.LittleEndian, uint16(v))
+			case dtLong:
+				binary.Write(&val, binary.LittleEndian, uint32(v))
+			case dtRational, dtSRational:
+				binary.Write(&val, binary.LittleEndian, uint32(v))
+				count = len(e.vals) / 2
+			}
+		}
+		binary.Write(b, binary.LittleEndian, [2]uint16{e.tag, e.datatype})
+		binary.Write(b, binary.LittleEndian, uint32(count))
+		if val.Len() <= 4 {
+			b.Write(append(val.Bytes(), make([]byte, 4-val.Len())...))
+		} else {
+			binary.Write(b, binary.LittleEndian, uint32(dataOff+data.Len()))
+			data.Write(val.Bytes())
+		}
+	}
+	binary.Write(b, binary.LittleEndian, uint32(0))
+	b.Write(data.Bytes())
+	return b.Bytes()
+}
+
+func TestExif(t *testing.T) {
+	b := exifTIFF(
+		rawEntry{ExifExposureTime, dtRational, []uint64{1, 250}},
+		rawEntry{ExifFNumber, dtRational, []uint64{28, 10}},
+		shortsEntry(ExifISOSpeedRatings, 400),
+		asciiEntry(ExifDateTimeOriginal, "2017:06:01 12:00:00"),
+		rawEntry{37380, dtSRational, []uint64{0xffffffff, 3}}, // ExposureBiasValue.
+		rawEntry{37500, dtUndefined, []uint64{1, 2, 3}},       // MakerNote.
+		longsEntry(65000, 7, 8),                               // A private tag.
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Exif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint16]interface{}{
+		ExifExposureTime:     1.0 / 250,
+		ExifFNumber:          2.8,
+		ExifISOSpeedRatings:  uint16(400),
+		ExifDateTimeOriginal: "2017:06:01 12:00:00",
+		37380:                -1.0 / 3,
+		37500:                []byte{1, 2, 3},
+		65000:                []uint32{7, 8},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	d, err = newDecoder(bytes.NewReader(buildTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Exif(); err == nil {
+		t.Error("no EXIF IFD: got nil error, want non-nil")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"image/color"
+)
+
+// GrayFloat32 is an in-memory image of 32-bit floating point samples, such
+// as a raster of physical measurements. Encode writes it with floating point
+// samples. Its colors are its samples scaled from [Min, Max] to the range of
+// color.Gray16, and clamped to it.
+type GrayFloat32 struct {
+	// Pix holds the image's samples. The sample at (x, y) is at
+	// Pix[(y-Rect.Min.Y)*Stride+(x-Rect.Min.X)].
+	Pix []float32
+	// Stride is the Pix stride, in samples, between vertically adjacent
+	// pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Min and Max are the samples shown as black and white.
+	Min, Max float32
+}
+
+// NewGrayFloat32 returns a new GrayFloat32 image with the given bounds,
+// whose samples range from min to max.
+func NewGrayFloat32(r image.Rectangle, min, max float32) *GrayFloat32 {
+	w, h := r.Dx(), r.Dy()
+	return &GrayFloat32{
+		Pix:    make([]float32, w*h),
+		Stride: w,
+		Rect:   r,
+		Min:    min,
+		Max:    max,
+	}
+}
+
+func (p *GrayFloat32) ColorModel() color.Model { return color.Gray16Model }
+
+func (p *GrayFloat32) Bounds() image.Rectangle { return p.Rect }
+
+func (p *GrayFloat32) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.Gray16{}
+	}
+	v := (p.Pix[p.PixOffset(x, y)] - p.Min) / (p.Max - p.Min)
+	switch {
+	case v > 1:
+		v = 1
+	case !(v > 0):
+		// Samples below Min, and NaN samples, are black.
+		v = 0
+	}
+	return color.Gray16{Y: uint16(v * 0xffff)}
+}
+
+// PixOffset returns the index of the element of Pix that corresponds to
+// the pixel at (x, y).
+func (p *GrayFloat32) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
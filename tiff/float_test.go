@@ -0,0 +1,30 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestGrayFloat32(t *testing.T) {
+	m := NewGrayFloat32(image.Rect(1, 2, 4, 4), -10, 10)
+	copy(m.Pix, []float32{
+		-10, 0, 10,
+		-20, 20, float32(math.NaN()),
+	})
+	want := []uint16{0, 0x7fff, 0xffff, 0, 0xffff, 0}
+	for i, w := range want {
+		x, y := 1+i%3, 2+i/3
+		if got := m.At(x, y); got != (color.Gray16{Y: w}) {
+			t.Errorf("(%d, %d): got %v, want %v", x, y, got, color.Gray16{Y: w})
+		}
+	}
+	if got := m.At(0, 0); got != (color.Gray16{}) {
+		t.Errorf("out of bounds: got %v, want %v", got, color.Gray16{})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// NoData returns the value marking pixels that hold no data, as stored by
+// GDAL in the GDALNoData tag. The returned bool reports whether the tag is
+// present.
+func (d *decoder) NoData() (float64, bool, error) {
+	s, ok := d.asciiVal(tGDALNoData)
+	if !ok {
+		return 0, false, nil
+	}
+	s = strings.TrimSpace(s)
+	// C libraries may print NaN with a sign, which ParseFloat rejects.
+	if t := strings.TrimLeft(s, "+-"); strings.EqualFold(t, "nan") {
+		s = t
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, true, FormatError{Kind: BadTag, Tag: tGDALNoData, Detail: fmt.Sprintf("bad GDALNoData value %q", s)}
+	}
+	return f, true, nil
+}
+
+// gdalMetadata is the XML document stored by GDAL in the GDALMetadata tag.
+type gdalMetadata struct {
+	XMLName xml.Name `xml:"GDALMetadata"`
+	Items   []struct {
+		Name   string `xml:"name,attr"`
+		Sample string `xml:"sample,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"Item"`
+}
+
+// GDALMetadata returns the metadata items stored by GDAL in the
+// GDALMetadata tag. Dataset items are returned in the first map, and band
+// items in the second one, keyed by the band number given by their sample
+// attribute. Both maps are nil if the tag is missing.
+func (d *decoder) GDALMetadata() (map[string]string, map[int]map[string]string, error) {
+	s, ok := d.asciiVal(tGDALMetadata)
+	if !ok {
+		return nil, nil, nil
+	}
+	var md gdalMetadata
+	if err := xml.Unmarshal([]byte(s), &md); err != nil {
+		return nil, nil, FormatError{Kind: BadTag, Tag: tGDALMetadata, Detail: "bad GDALMetadata: " + err.Error()}
+	}
+	dataset := map[string]string{}
+	bands := map[int]map[string]string{}
+	for _, item := range md.Items {
+		if item.Sample == "" {
+			dataset[item.Name] = item.Value
+			continue
+		}
+		band, err := strconv.Atoi(item.Sample)
+		if err != nil || band < 0 {
+			return nil, nil, FormatError{Kind: BadTag, Tag: tGDALMetadata, Detail: fmt.Sprintf("bad GDALMetadata sample %q", item.Sample)}
+		}
+		if bands[band] == nil {
+			bands[band] = map[string]string{}
+		}
+		bands[band][item.Name] = item.Value
+	}
+	return dataset, bands, nil
+}
+
+// PaletteLUT returns the palette of a paletted image as a lookup table from
+// sample values to colors, along with the names of the categories of a
+// classified image, if any. The names are read from the CATEGORY_NAMES item
+// of the GDALMetadata tag, a comma-separated list giving the name of each
+// sample value in order, looked up in the items of the first band and then
+// in the dataset items. The names are nil if the item is missing.
+func (d *decoder) PaletteLUT() ([]color.RGBA, []string, error) {
+	p, err := d.ColorMap()
+	if err != nil {
+		return nil, nil, err
+	}
+	lut := make([]color.RGBA, len(p))
+	for i, c := range p {
+		lut[i] = c.(color.RGBA)
+	}
+	dataset, bands, err := d.GDALMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, ok := bands[0]["CATEGORY_NAMES"]
+	if !ok {
+		s, ok = dataset["CATEGORY_NAMES"]
+	}
+	if !ok {
+		return lut, nil, nil
+	}
+	names := strings.Split(s, ",")
+	for i, n := range names {
+		names[i] = strings.TrimSpace(n)
+	}
+	return lut, names, nil
+}
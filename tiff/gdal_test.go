@@ -0,0 +1,153 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"image/color"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNoData(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want float64
+	}{
+		{"-9999", -9999},
+		{" 0 ", 0},
+		{"3.4028234663852886e+38\n", 3.4028234663852886e+38},
+		{"nan", math.NaN()},
+		{"-nan", math.NaN()},
+		{"NaN", math.NaN()},
+	}
+	for _, tc := range testCases {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(asciiEntry(tGDALNoData, tc.s))))
+		if err != nil {
+			t.Fatalf("%q: %v", tc.s, err)
+		}
+		got, ok, err := d.NoData()
+		if !ok || err != nil {
+			t.Errorf("%q: got %t, %v, want true, nil", tc.s, ok, err)
+			continue
+		}
+		if got != tc.want && !(math.IsNaN(got) && math.IsNaN(tc.want)) {
+			t.Errorf("%q: got %v, want %v", tc.s, got, tc.want)
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := d.NoData(); ok || err != nil {
+		t.Errorf("missing tag: got %t, %v, want false, nil", ok, err)
+	}
+
+	// A bad value is only reported by NoData, not while decoding.
+	b := buildTIFF(asciiEntry(tGDALNoData, "none"))
+	if d, err = newDecoder(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := d.NoData(); !ok || err == nil {
+		t.Errorf("bad value: got %t, %v, want true, non-nil error", ok, err)
+	}
+	if _, err := Decode(bytes.NewReader(b)); err != nil {
+		t.Errorf("Decode: %v", err)
+	}
+}
+
+func TestGDALMetadata(t *testing.T) {
+	const md = `<GDALMetadata>
+  <Item name="AREA_OR_POINT">Area</Item>
+  <Item name="STATISTICS_MINIMUM" sample="0">-12.5</Item>
+  <Item name="STATISTICS_MAXIMUM" sample="0">4000</Item>
+  <Item name="OFFSET" sample="1" role="offset">0</Item>
+  <Item name="SCALE" sample="1" role="scale">0.0001</Item>
+</GDALMetadata>
+`
+	d, err := newDecoder(bytes.NewReader(buildTIFF(asciiEntry(tGDALMetadata, md))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataset, bands, err := d.GDALMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"AREA_OR_POINT": "Area"}; !reflect.DeepEqual(dataset, want) {
+		t.Errorf("dataset: got %v, want %v", dataset, want)
+	}
+	wantBands := map[int]map[string]string{
+		0: {"STATISTICS_MINIMUM": "-12.5", "STATISTICS_MAXIMUM": "4000"},
+		1: {"OFFSET": "0", "SCALE": "0.0001"},
+	}
+	if !reflect.DeepEqual(bands, wantBands) {
+		t.Errorf("bands: got %v, want %v", bands, wantBands)
+	}
+
+	for _, bad := range []string{
+		"<GDALMetadata><Item name=\"A\">1</Item>",
+		"<Metadata></Metadata>",
+		"<GDALMetadata><Item name=\"A\" sample=\"x\">1</Item></GDALMetadata>",
+	} {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(asciiEntry(tGDALMetadata, bad))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := d.GDALMetadata(); err == nil {
+			t.Errorf("%q: got nil error, want non-nil", bad)
+		}
+	}
+}
+
+func TestPaletteLUT(t *testing.T) {
+	cm := []uint16{
+		0x1c1c, 0x8000,
+		0x8c8c, 0x80ff,
+		0x2a2a, 0xffff,
+	}
+	wantLUT := []color.RGBA{{0x1c, 0x8c, 0x2a, 0xff}, {0x80, 0x80, 0xff, 0xff}}
+	for _, tc := range []struct {
+		md        string
+		wantNames []string
+	}{
+		{"", nil},
+		{`<GDALMetadata><Item name="CATEGORY_NAMES">Water, Forest</Item></GDALMetadata>`, []string{"Water", "Forest"}},
+		{`<GDALMetadata>
+  <Item name="CATEGORY_NAMES">Unused</Item>
+  <Item name="CATEGORY_NAMES" sample="0">Land,Sea</Item>
+</GDALMetadata>`, []string{"Land", "Sea"}},
+	} {
+		entries := []rawEntry{
+			shortsEntry(tBitsPerSample, 1),
+			shortsEntry(tPhotometricInterpretation, pPaletted),
+			shortsEntry(tColorMap, cm...),
+		}
+		if tc.md != "" {
+			entries = append(entries, asciiEntry(tGDALMetadata, tc.md))
+		}
+		d, err := newDecoder(bytes.NewReader(buildTIFF(entries...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lut, names, err := d.PaletteLUT()
+		if err != nil {
+			t.Errorf("%q: %v", tc.md, err)
+			continue
+		}
+		if !reflect.DeepEqual(lut, wantLUT) || !reflect.DeepEqual(names, tc.wantNames) {
+			t.Errorf("%q: got %v, %q, want %v, %q", tc.md, lut, names, wantLUT, tc.wantNames)
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.PaletteLUT(); err == nil {
+		t.Error("no ColorMap: got nil error, want non-nil")
+	}
+}
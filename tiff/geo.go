@@ -0,0 +1,743 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GeoKeys holds the contents of a GeoTIFF GeoKeyDirectory.
+//
+// Keys maps a key ID, such as GTModelTypeGeoKey, to its value. Depending on
+// where the GeoKeyDirectory stores it, a value is a uint (a single SHORT),
+// a []uint (several SHORTs), a float64 (a single GeoDoubleParams entry),
+// a []float64 (several GeoDoubleParams entries) or a string (an entry of
+// GeoASCIIParams, without its terminating '|'). When encoding, a single
+// SHORT may also be given as an int or a uint16.
+type GeoKeys struct {
+	Version       uint // KeyDirectoryVersion, always 1.
+	Revision      uint // KeyRevision, always 1.
+	MinorRevision uint // MinorRevision, 0 or 1.
+
+	Keys map[int]interface{}
+}
+
+// Uint returns the value of the SHORT key id. If the key holds several
+// values, the first one is returned.
+func (k GeoKeys) Uint(id int) (uint, bool) {
+	switch v := k.Keys[id].(type) {
+	case uint:
+		return v, true
+	case []uint:
+		if len(v) > 0 {
+			return v[0], true
+		}
+	}
+	return 0, false
+}
+
+// Float returns the value of the DOUBLE key id. If the key holds several
+// values, the first one is returned.
+func (k GeoKeys) Float(id int) (float64, bool) {
+	switch v := k.Keys[id].(type) {
+	case float64:
+		return v, true
+	case []float64:
+		if len(v) > 0 {
+			return v[0], true
+		}
+	}
+	return 0, false
+}
+
+// String returns the value of the ASCII key id.
+func (k GeoKeys) String(id int) (string, bool) {
+	s, ok := k.Keys[id].(string)
+	return s, ok
+}
+
+// EPSG returns the EPSG code of the coordinate reference system of the
+// keys: the ProjectedCSTypeGeoKey of projected models, and the
+// GeographicTypeGeoKey of geographic ones. If GTModelTypeGeoKey is missing,
+// the projected code is used if present, and the geographic one otherwise.
+// The boolean result is false if the code is missing, undefined (0) or
+// user-defined (KvUserDefined), in which case the coordinate reference
+// system is only described by the other keys.
+func (k GeoKeys) EPSG() (int, bool) {
+	id := ProjectedCSTypeGeoKey
+	switch model, _ := k.Uint(GTModelTypeGeoKey); model {
+	case ModelTypeGeographic:
+		id = GeographicTypeGeoKey
+	case ModelTypeProjected:
+	default:
+		if _, ok := k.Uint(ProjectedCSTypeGeoKey); !ok {
+			id = GeographicTypeGeoKey
+		}
+	}
+	code, ok := k.Uint(id)
+	if !ok || code == 0 || code == KvUserDefined {
+		return 0, false
+	}
+	return int(code), true
+}
+
+// GeoKeysFromEPSG returns the keys of the common coordinate reference
+// system with the given EPSG code, as written by EncodeGeo: the
+// GTModelTypeGeoKey, the GTRasterTypeGeoKey, which is RasterPixelIsArea,
+// and the ProjectedCSTypeGeoKey or GeographicTypeGeoKey. Supported codes
+// are those of common geographic systems, such as 4326, of Web Mercator
+// (3857), and of the UTM zones of WGS 84, NAD83, NAD27, ETRS89 and GDA94,
+// among other projected systems.
+func GeoKeysFromEPSG(code int) (GeoKeys, error) {
+	k := GeoKeys{Version: 1, Revision: 1, Keys: map[int]interface{}{
+		GTRasterTypeGeoKey: uint(RasterPixelIsArea),
+	}}
+	switch {
+	case geographicCodes[code]:
+		k.Keys[GTModelTypeGeoKey] = uint(ModelTypeGeographic)
+		k.Keys[GeographicTypeGeoKey] = uint(code)
+	case isProjectedCode(code):
+		k.Keys[GTModelTypeGeoKey] = uint(ModelTypeProjected)
+		k.Keys[ProjectedCSTypeGeoKey] = uint(code)
+	default:
+		return GeoKeys{}, fmt.Errorf("tiff: unsupported EPSG code %d", code)
+	}
+	return k, nil
+}
+
+// geographicCodes holds the EPSG codes of common geographic coordinate
+// systems.
+var geographicCodes = map[int]bool{
+	4148: true, // Hartebeesthoek94.
+	4230: true, // ED50.
+	4258: true, // ETRS89.
+	4267: true, // NAD27.
+	4269: true, // NAD83.
+	4277: true, // OSGB 1936.
+	4283: true, // GDA94.
+	4322: true, // WGS 72.
+	4326: true, // WGS 84.
+	4612: true, // JGD2000.
+	4617: true, // NAD83(CSRS).
+	4674: true, // SIRGAS 2000.
+	7844: true, // GDA2020.
+}
+
+// isProjectedCode reports whether code is the EPSG code of a common
+// projected coordinate system.
+func isProjectedCode(code int) bool {
+	switch code {
+	case 2193, // NZGD2000 / New Zealand Transverse Mercator.
+		3031,  // WGS 84 / Antarctic Polar Stereographic.
+		3035,  // ETRS89 / LAEA Europe.
+		3112,  // GDA94 / Geoscience Australia Lambert.
+		3395,  // WGS 84 / World Mercator.
+		3413,  // WGS 84 / NSIDC Sea Ice Polar Stereographic North.
+		3577,  // GDA94 / Australian Albers.
+		3857,  // WGS 84 / Pseudo-Mercator.
+		5070,  // NAD83 / Conus Albers.
+		27700: // OSGB 1936 / British National Grid.
+		return true
+	}
+	for _, r := range [][2]int{
+		{25828, 25838}, // ETRS89 / UTM zones 28N to 38N.
+		{26703, 26722}, // NAD27 / UTM zones 3N to 22N.
+		{26901, 26923}, // NAD83 / UTM zones 1N to 23N.
+		{28348, 28358}, // GDA94 / MGA zones 48 to 58.
+		{32601, 32661}, // WGS 84 / UTM zones 1N to 60N, and UPS North.
+		{32701, 32761}, // WGS 84 / UTM zones 1S to 60S, and UPS South.
+	} {
+		if r[0] <= code && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectionParams holds the common parameters of a map projection. Angles
+// are in degrees and lengths in meters, whatever the units of the GeoKeys.
+// Parameters that the projection does not use are zero,
+// except for ScaleFactor, which is then 1.
+type ProjectionParams struct {
+	CoordTrans int // The ProjCoordTransGeoKey, one of the CT_* codes.
+
+	// CentralMeridian and LatitudeOfOrigin are the longitude and latitude
+	// of the origin of the projection: its natural origin, false origin or
+	// center, depending on the projection.
+	CentralMeridian, LatitudeOfOrigin float64
+	// StdParallel1 and StdParallel2 are the standard parallels of conic
+	// projections. Equirectangular projections only use StdParallel1.
+	StdParallel1, StdParallel2 float64
+	// ScaleFactor is the scale factor at the natural origin, or at the
+	// center of oblique projections.
+	ScaleFactor float64
+	// Azimuth is the azimuth of the center line of oblique projections.
+	Azimuth float64
+	// FalseEasting and FalseNorthing are the coordinates of the origin.
+	FalseEasting, FalseNorthing float64
+}
+
+// ProjParams returns the parameters of the projection described by the
+// ProjCoordTransGeoKey and the keys it uses. Files whose projected
+// coordinate system is given by an EPSG code alone, such as most UTM files,
+// have no ProjCoordTransGeoKey, and ProjParams returns an error of kind
+// MissingTag for them.
+func (k GeoKeys) ProjParams() (ProjectionParams, error) {
+	ct, ok := k.Uint(ProjCoordTransGeoKey)
+	if !ok {
+		return ProjectionParams{}, FormatError{Kind: MissingTag, Tag: tGeoKeyDirectory, Detail: "ProjCoordTransGeoKey missing"}
+	}
+	// get returns the value of the first of the keys that is present, as
+	// in libgeotiff, where parameters are often stored in the keys of
+	// related projections.
+	get := func(ids ...int) float64 {
+		for _, id := range ids {
+			if v, ok := k.Float(id); ok {
+				return v
+			}
+		}
+		return 0
+	}
+	p := ProjectionParams{CoordTrans: int(ct), ScaleFactor: 1}
+	scale := func(ids ...int) {
+		if v := get(ids...); v != 0 {
+			p.ScaleFactor = v
+		}
+	}
+	switch ct {
+	case CT_TransverseMercator, CT_TransvMercator_SouthOriented, CT_Mercator,
+		CT_LambertConfConic_Helmert, CT_Stereographic, CT_ObliqueStereographic,
+		CT_CassiniSoldner, CT_Polyconic, CT_Sinusoidal, CT_MillerCylindrical,
+		CT_Robinson, CT_VanDerGrinten, CT_NewZealandMapGrid, CT_Equirectangular:
+		p.CentralMeridian = get(ProjNatOriginLongGeoKey, ProjFalseOriginLongGeoKey, ProjCenterLongGeoKey)
+		p.LatitudeOfOrigin = get(ProjNatOriginLatGeoKey, ProjFalseOriginLatGeoKey, ProjCenterLatGeoKey)
+		p.FalseEasting = get(ProjFalseEastingGeoKey, ProjFalseOriginEastingGeoKey, ProjCenterEastingGeoKey)
+		p.FalseNorthing = get(ProjFalseNorthingGeoKey, ProjFalseOriginNorthingGeoKey, ProjCenterNorthingGeoKey)
+		switch ct {
+		case CT_Equirectangular, CT_Mercator:
+			// The latitude of true scale, which replaces the scale
+			// factor of Mercator projections in their 2SP variant.
+			p.StdParallel1 = get(ProjStdParallel1GeoKey)
+		}
+		scale(ProjScaleAtNatOriginGeoKey, ProjScaleAtCenterGeoKey)
+	case CT_LambertConfConic_2SP, CT_AlbersEqualArea, CT_EquidistantConic:
+		p.CentralMeridian = get(ProjFalseOriginLongGeoKey, ProjNatOriginLongGeoKey, ProjCenterLongGeoKey)
+		p.LatitudeOfOrigin = get(ProjFalseOriginLatGeoKey, ProjNatOriginLatGeoKey, ProjCenterLatGeoKey)
+		p.StdParallel1 = get(ProjStdParallel1GeoKey)
+		p.StdParallel2 = get(ProjStdParallel2GeoKey)
+		p.FalseEasting = get(ProjFalseOriginEastingGeoKey, ProjFalseEastingGeoKey)
+		p.FalseNorthing = get(ProjFalseOriginNorthingGeoKey, ProjFalseNorthingGeoKey)
+	case CT_ObliqueMercator, CT_ObliqueMercator_Laborde, CT_ObliqueMercator_Rosenmund,
+		CT_ObliqueMercator_Spherical:
+		p.CentralMeridian = get(ProjCenterLongGeoKey, ProjNatOriginLongGeoKey)
+		p.LatitudeOfOrigin = get(ProjCenterLatGeoKey, ProjNatOriginLatGeoKey)
+		p.Azimuth = get(ProjAzimuthAngleGeoKey)
+		p.FalseEasting = get(ProjFalseEastingGeoKey, ProjCenterEastingGeoKey)
+		p.FalseNorthing = get(ProjFalseNorthingGeoKey, ProjCenterNorthingGeoKey)
+		scale(ProjScaleAtCenterGeoKey, ProjScaleAtNatOriginGeoKey)
+	case CT_LambertAzimEqualArea, CT_AzimuthalEquidistant, CT_Gnomonic, CT_Orthographic:
+		p.CentralMeridian = get(ProjCenterLongGeoKey, ProjNatOriginLongGeoKey)
+		p.LatitudeOfOrigin = get(ProjCenterLatGeoKey, ProjNatOriginLatGeoKey)
+		p.FalseEasting = get(ProjFalseEastingGeoKey, ProjCenterEastingGeoKey)
+		p.FalseNorthing = get(ProjFalseNorthingGeoKey, ProjCenterNorthingGeoKey)
+	case CT_PolarStereographic:
+		p.CentralMeridian = get(ProjStraightVertPoleLongGeoKey, ProjNatOriginLongGeoKey)
+		p.LatitudeOfOrigin = get(ProjNatOriginLatGeoKey)
+		p.FalseEasting = get(ProjFalseEastingGeoKey)
+		p.FalseNorthing = get(ProjFalseNorthingGeoKey)
+		scale(ProjScaleAtNatOriginGeoKey)
+	default:
+		return ProjectionParams{}, FormatError{Kind: Unsupported, Tag: tGeoKeyDirectory, Detail: fmt.Sprintf("coordinate transformation %d", ct)}
+	}
+
+	u, err := k.Units()
+	if err != nil {
+		return ProjectionParams{}, err
+	}
+	azimuth := u.Angular
+	if code, ok := k.Uint(GeogAzimuthUnitsGeoKey); ok {
+		if azimuth, ok = angularUnits[code]; !ok {
+			return ProjectionParams{}, FormatError{Kind: Unsupported, Tag: tGeoKeyDirectory, Detail: fmt.Sprintf("unit %d of GeoKey %d", code, GeogAzimuthUnitsGeoKey)}
+		}
+	}
+	p.CentralMeridian *= u.Angular
+	p.LatitudeOfOrigin *= u.Angular
+	p.StdParallel1 *= u.Angular
+	p.StdParallel2 *= u.Angular
+	p.Azimuth *= azimuth
+	p.FalseEasting *= u.Linear
+	p.FalseNorthing *= u.Linear
+	return p, nil
+}
+
+// GeoKeys parses the GeoKeyDirectory of the image, resolving the values
+// stored in the GeoDoubleParams and GeoASCIIParams tags.
+//
+// The GeoKeyDirectory is described in section 2.4 of the GeoTIFF spec.
+func (d *decoder) GeoKeys() (GeoKeys, error) {
+	dir, ok := d.features[tGeoKeyDirectory]
+	if !ok {
+		return GeoKeys{}, FormatError{Kind: MissingTag, Tag: tGeoKeyDirectory, Detail: "GeoKeyDirectory tag missing"}
+	}
+	// The directory starts with a header of four SHORTs, followed by
+	// four SHORTs for each key.
+	if len(dir) < 4 {
+		return GeoKeys{}, FormatError{Kind: BadTag, Tag: tGeoKeyDirectory, Detail: "GeoKeyDirectory too short"}
+	}
+	k := GeoKeys{
+		Version:       dir[0],
+		Revision:      dir[1],
+		MinorRevision: dir[2],
+		Keys:          make(map[int]interface{}),
+	}
+	if k.Version != 1 || k.Revision != 1 || k.MinorRevision > 1 {
+		return GeoKeys{}, FormatError{Kind: BadTag, Tag: tGeoKeyDirectory, Detail: "bad GeoKeyDirectory version"}
+	}
+	n := int(dir[3])
+	if len(dir) < 4*(n+1) {
+		return GeoKeys{}, FormatError{Kind: BadTag, Tag: tGeoKeyDirectory, Detail: "GeoKeyDirectory too short"}
+	}
+
+	doubles := d.geoDouble
+	ascii := d.features[tGeoASCIIParams]
+	for i := 1; i <= n; i++ {
+		e := dir[4*i : 4*i+4]
+		id, count, off := int(e[0]), int(e[2]), int(e[3])
+		switch e[1] {
+		case 0:
+			// The value is stored in the Value_Offset field itself.
+			k.Keys[id] = e[3]
+		case tGeoKeyDirectory:
+			if off+count > len(dir) {
+				return GeoKeys{}, FormatError{Kind: BadTag, Tag: tGeoKeyDirectory, Detail: "GeoKey value out of range"}
+			}
+			v := make([]uint, count)
+			copy(v, dir[off:off+count])
+			if count == 1 {
+				k.Keys[id] = v[0]
+			} else {
+				k.Keys[id] = v
+			}
+		case tGeoDoubleParams:
+			if off+count > len(doubles) {
+				return GeoKeys{}, FormatError{Kind: BadTag, Tag: tGeoKeyDirectory, Detail: "GeoKey value out of range"}
+			}
+			v := make([]float64, count)
+			for j := range v {
+				v[j] = doubles[off+j]
+			}
+			if count == 1 {
+				k.Keys[id] = v[0]
+			} else {
+				k.Keys[id] = v
+			}
+		case tGeoASCIIParams:
+			if off+count > len(ascii) {
+				return GeoKeys{}, FormatError{Kind: BadTag, Tag: tGeoKeyDirectory, Detail: "GeoKey value out of range"}
+			}
+			b := make([]byte, count)
+			for j := range b {
+				b[j] = byte(ascii[off+j])
+			}
+			// Strings in GeoASCIIParams are terminated by a '|'.
+			k.Keys[id] = strings.TrimRight(string(b), "|\x00")
+		default:
+			return GeoKeys{}, FormatError{Kind: BadTag, Tag: tGeoKeyDirectory, Detail: "bad GeoKey location"}
+		}
+	}
+	return k, nil
+}
+
+// GeoTransform returns the affine transformation from pixel to model space
+// in the GDAL order: the model coordinates of pixel (px, py) are
+//
+//	x = t[0] + px*t[1] + py*t[2]
+//	y = t[3] + px*t[4] + py*t[5]
+//
+// The transformation is derived from the ModelPixelScale and ModelTiepoint
+// tags or, if they are absent, from the ModelTransformation tag (section
+// 2.6.1 of the GeoTIFF spec). Images georeferenced by several tiepoints
+// alone have no such transformation, and their tiepoints are returned by
+// GCPs.
+//
+// The model coordinates are in the units of the file, as given by Units;
+// NormalizedGeoTransform converts them to meters or degrees.
+func (d *decoder) GeoTransform() ([6]float64, error) {
+	switch {
+	case len(d.pixScale) >= 2 && len(d.tiePoint) >= 6:
+		// The tiepoint maps raster point (I, J) to model point (X, Y).
+		i, j, x, y := d.tiePoint[0], d.tiePoint[1], d.tiePoint[3], d.tiePoint[4]
+		sx, sy := d.pixScale[0], d.pixScale[1]
+		return [6]float64{x - i*sx, sx, 0, y + j*sy, 0, -sy}, nil
+	case d.transform != nil:
+		m, _, err := d.ModelTransformation()
+		if err != nil {
+			return [6]float64{}, err
+		}
+		return [6]float64{m[3], m[0], m[1], m[7], m[4], m[5]}, nil
+	case len(d.tiePoint) > 6:
+		return [6]float64{}, FormatError{Kind: Unsupported, Tag: tModelTiepoint, Detail: fmt.Sprintf("georeferencing by %d tiepoints without ModelPixelScale; use GCPs", len(d.tiePoint)/6)}
+	}
+	return [6]float64{}, FormatError{Kind: MissingTag, Detail: "no georeferencing: need ModelPixelScale and ModelTiepoint, or ModelTransformation"}
+}
+
+// NormalizedGeoTransform is like GeoTransform, with model coordinates in
+// meters for projected and geocentric coordinate systems, and in degrees
+// for geographic ones. Images without GeoKeys are assumed to use these
+// units already.
+func (d *decoder) NormalizedGeoTransform() ([6]float64, error) {
+	t, err := d.GeoTransform()
+	if err != nil {
+		return t, err
+	}
+	if _, ok := d.features[tGeoKeyDirectory]; !ok {
+		return t, nil
+	}
+	k, err := d.GeoKeys()
+	if err != nil {
+		return [6]float64{}, err
+	}
+	u, err := k.Units()
+	if err != nil {
+		return [6]float64{}, err
+	}
+	// Geocentric coordinates are in the GeogLinearUnits.
+	size := u.Linear
+	switch model, _ := k.Uint(GTModelTypeGeoKey); model {
+	case ModelTypeGeographic:
+		size = u.Angular
+	case ModelTypeGeocentric:
+		size = u.GeogLinear
+	}
+	for i := range t {
+		t[i] *= size
+	}
+	return t, nil
+}
+
+// ModelTransformation returns the 4x4 matrix, in row-major order, of the
+// ModelTransformation tag, which maps raster space to model space. The
+// boolean result reports whether the tag is present.
+func (d *decoder) ModelTransformation() ([16]float64, bool, error) {
+	var m [16]float64
+	if d.transform == nil {
+		return m, false, nil
+	}
+	if len(d.transform) != len(m) {
+		return m, true, FormatError{Kind: BadTag, Tag: tModelTransformation, Detail: fmt.Sprintf("ModelTransformation has %d values, want %d", len(d.transform), len(m))}
+	}
+	copy(m[:], d.transform)
+	return m, true, nil
+}
+
+// A GCP is a ground control point, one of the tiepoints of the
+// ModelTiepoint tag, which maps the raster point (I, J, K) to the model
+// point (X, Y, Z).
+type GCP struct {
+	I, J, K float64
+	X, Y, Z float64
+}
+
+// GCPs returns the tiepoints of the ModelTiepoint tag. A single tiepoint
+// is usually combined with the ModelPixelScale tag, as used by
+// GeoTransform, while several tiepoints describe a georeferencing that may
+// not be affine.
+func (d *decoder) GCPs() ([]GCP, error) {
+	if d.tiePoint == nil {
+		return nil, FormatError{Kind: MissingTag, Tag: tModelTiepoint, Detail: "ModelTiepoint tag missing"}
+	}
+	if len(d.tiePoint)%6 != 0 {
+		return nil, FormatError{Kind: BadTag, Tag: tModelTiepoint, Detail: fmt.Sprintf("ModelTiepoint has %d values, want a multiple of 6", len(d.tiePoint))}
+	}
+	gcps := make([]GCP, len(d.tiePoint)/6)
+	for i := range gcps {
+		t := d.tiePoint[6*i:]
+		gcps[i] = GCP{t[0], t[1], t[2], t[3], t[4], t[5]}
+	}
+	return gcps, nil
+}
+
+// RasterType returns the raster type given by the GTRasterTypeGeoKey, which
+// defaults to RasterPixelIsArea.
+func (k GeoKeys) RasterType() RasterType {
+	if v, ok := k.Uint(GTRasterTypeGeoKey); ok {
+		return RasterType(v)
+	}
+	return RasterPixelIsArea
+}
+
+// pixelTransform returns the GeoTransform of the image, adjusted so that
+// it maps the top-left corner of the top-left pixel to (0, 0) in raster
+// space, whatever the GTRasterTypeGeoKey. With the RasterPixelIsPoint raster
+// type, the georeferencing tags map the centers of the pixels instead.
+func (d *decoder) pixelTransform() ([6]float64, error) {
+	t, err := d.GeoTransform()
+	if err != nil {
+		return t, err
+	}
+	if _, ok := d.features[tGeoKeyDirectory]; !ok {
+		// Without GeoKeys, the raster type is the default, PixelIsArea.
+		return t, nil
+	}
+	k, err := d.GeoKeys()
+	if err != nil {
+		return t, err
+	}
+	if k.RasterType() == RasterPixelIsPoint {
+		t[0] -= 0.5*t[1] + 0.5*t[2]
+		t[3] -= 0.5*t[4] + 0.5*t[5]
+	}
+	return t, nil
+}
+
+// Units returns the sizes of the units used by the GeoKeys of the image.
+// In particular, the model space coordinates returned by GeoTransform and
+// PixelToWorld are in units of Linear meters for projected coordinate
+// systems, and of Angular degrees for geographic ones. NormalizedGeoTransform
+// applies these sizes.
+func (d *decoder) Units() (Units, error) {
+	k, err := d.GeoKeys()
+	if err != nil {
+		return Units{}, err
+	}
+	return k.Units()
+}
+
+// PixelToWorld returns the model coordinates of the point (px, py) in
+// raster space, in pixels from the top-left corner of the image: the center
+// of the top-left pixel is at (0.5, 0.5). The GTRasterTypeGeoKey is taken
+// into account, so that the result is the same for the PixelIsArea and
+// PixelIsPoint conventions.
+func (d *decoder) PixelToWorld(px, py float64) (x, y float64, err error) {
+	t, err := d.pixelTransform()
+	if err != nil {
+		return 0, 0, err
+	}
+	return t[0] + px*t[1] + py*t[2], t[3] + px*t[4] + py*t[5], nil
+}
+
+// WorldToPixel is the inverse of PixelToWorld. It returns the raster space
+// coordinates of the point (x, y) in model space.
+func (d *decoder) WorldToPixel(x, y float64) (px, py float64, err error) {
+	t, err := d.pixelTransform()
+	if err != nil {
+		return 0, 0, err
+	}
+	det := t[1]*t[5] - t[2]*t[4]
+	if det == 0 {
+		return 0, 0, FormatError{Kind: BadTag, Detail: "georeferencing transformation is not invertible"}
+	}
+	x, y = x-t[0], y-t[3]
+	return (x*t[5] - y*t[2]) / det, (y*t[1] - x*t[4]) / det, nil
+}
+
+// BoundingBox returns the extent of the image in model space, that is in
+// the coordinate reference system of the file. If the image is rotated or
+// sheared in model space, the extent is the smallest axis-aligned rectangle
+// holding its four corners.
+func (d *decoder) BoundingBox() (minX, minY, maxX, maxY float64, err error) {
+	t, err := d.pixelTransform()
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	w, h := float64(d.config.Width), float64(d.config.Height)
+	minX, minY = math.Inf(1), math.Inf(1)
+	maxX, maxY = math.Inf(-1), math.Inf(-1)
+	for _, c := range [4][2]float64{{0, 0}, {w, 0}, {0, h}, {w, h}} {
+		x := t[0] + c[0]*t[1] + c[1]*t[2]
+		y := t[3] + c[0]*t[4] + c[1]*t[5]
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	return minX, minY, maxX, maxY, nil
+}
+
+// DecodeGeoKeys reads the GeoKeyDirectory of the TIFF image from r without
+// decoding the pixel data.
+func DecodeGeoKeys(r io.Reader) (GeoKeys, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return GeoKeys{}, err
+	}
+	return d.GeoKeys()
+}
+
+// ifdEntries returns the GeoKeyDirectory, GeoDoubleParams and GeoASCIIParams
+// entries holding the keys. The two latter are only present if needed.
+func (k GeoKeys) ifdEntries() ([]ifdEntry, error) {
+	ids := make([]int, 0, len(k.Keys))
+	for id := range k.Keys {
+		ids = append(ids, id)
+	}
+	// The keys have to be written in ascending order.
+	sort.Ints(ids)
+
+	dir := []uint32{1, 1, uint32(k.MinorRevision), uint32(len(ids))}
+	var shorts []uint32 // SHORT arrays, stored after the keys.
+	var doubles []float64
+	var ascii []byte
+	for _, id := range ids {
+		var loc, count, off int
+		switch v := k.Keys[id].(type) {
+		case uint:
+			count, off = 1, int(v)
+		case int:
+			count, off = 1, v
+		case uint16:
+			count, off = 1, int(v)
+		case []uint:
+			loc, count, off = tGeoKeyDirectory, len(v), len(shorts)
+			for _, x := range v {
+				shorts = append(shorts, uint32(x))
+			}
+		case float64:
+			loc, count, off = tGeoDoubleParams, 1, len(doubles)
+			doubles = append(doubles, v)
+		case []float64:
+			loc, count, off = tGeoDoubleParams, len(v), len(doubles)
+			doubles = append(doubles, v...)
+		case string:
+			loc, count, off = tGeoASCIIParams, len(v)+1, len(ascii)
+			ascii = append(append(ascii, v...), '|')
+		default:
+			return nil, fmt.Errorf("tiff: unsupported value type %T for GeoKey %d", v, id)
+		}
+		if off < 0 || off > 0xffff || count > 0xffff {
+			return nil, fmt.Errorf("tiff: value of GeoKey %d out of range", id)
+		}
+		dir = append(dir, uint32(id), uint32(loc), uint32(count), uint32(off))
+	}
+	if len(shorts) > 0 {
+		// Offsets of SHORT arrays are relative to the start of the directory.
+		for i := 4; i < len(dir); i += 4 {
+			if dir[i+1] == tGeoKeyDirectory {
+				dir[i+3] += uint32(len(dir))
+			}
+		}
+		dir = append(dir, shorts...)
+	}
+
+	entries := []ifdEntry{{tGeoKeyDirectory, dtShort, dir}}
+	if len(doubles) > 0 {
+		entries = append(entries, ifdEntry{tGeoDoubleParams, dtFloat64, float64Data(doubles)})
+	}
+	if len(ascii) > 0 {
+		entries = append(entries, ifdEntry{tGeoASCIIParams, dtASCII, asciiData(string(ascii))})
+	}
+	return entries, nil
+}
+
+// GeoOptions are the encoding parameters of a GeoTIFF image.
+type GeoOptions struct {
+	Options
+	// ModelPixelScale holds the size of a pixel in model space, as
+	// (ScaleX, ScaleY, ScaleZ).
+	ModelPixelScale []float64
+	// ModelTiepoint holds tiepoints mapping raster to model space, as
+	// (I, J, K, X, Y, Z) sextuples.
+	ModelTiepoint []float64
+	// GeoKeys are written to the GeoKeyDirectory, unless GeoKeys.Keys is
+	// empty.
+	GeoKeys GeoKeys
+}
+
+// EncodeGeo writes the image m to w as a GeoTIFF. opts determines the options
+// used for encoding, such as the compression type and the georeferencing
+// tags. If opts is nil, EncodeGeo is equivalent to Encode with nil options.
+func EncodeGeo(w io.Writer, m image.Image, opts *GeoOptions) error {
+	if opts == nil {
+		return Encode(w, m, nil)
+	}
+	extra, err := opts.ifdEntries()
+	if err != nil {
+		return err
+	}
+	return writeImage(w, m, &opts.Options, extra)
+}
+
+// ifdEntries returns the IFD entries of the georeferencing tags of opts.
+func (opts *GeoOptions) ifdEntries() ([]ifdEntry, error) {
+	var extra []ifdEntry
+	if len(opts.ModelPixelScale) > 0 {
+		extra = append(extra, ifdEntry{tModelPixelScale, dtFloat64, float64Data(opts.ModelPixelScale)})
+	}
+	if len(opts.ModelTiepoint) > 0 {
+		if len(opts.ModelTiepoint)%6 != 0 {
+			return nil, fmt.Errorf("tiff: ModelTiepoint has %d values, want a multiple of 6", len(opts.ModelTiepoint))
+		}
+		extra = append(extra, ifdEntry{tModelTiepoint, dtFloat64, float64Data(opts.ModelTiepoint)})
+	}
+	if len(opts.GeoKeys.Keys) > 0 {
+		entries, err := opts.GeoKeys.ifdEntries()
+		if err != nil {
+			return nil, err
+		}
+		extra = append(extra, entries...)
+	}
+	return extra, nil
+}
+
+// EncodeFloat32 writes data, which holds the samples of a raster of width
+// by height pixels in row-major order, to w as a single band image of 32-bit
+// floating point samples. opts determines the options used for encoding,
+// such as the compression type, the predictor and the georeferencing tags,
+// and may be nil. Its SampleFormat and BitsPerSample are ignored.
+func EncodeFloat32(w io.Writer, data []float32, width, height int, opts *GeoOptions) error {
+	if width < 0 || height < 0 || len(data) != width*height {
+		return fmt.Errorf("tiff: %d samples for a %dx%d raster", len(data), width, height)
+	}
+	var o GeoOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.SampleFormat, o.BitsPerSample = FloatSample, 0
+	return EncodeGeo(w, float32Image(data, width, height), &o)
+}
+
+// float32Image returns an image whose samples are data, the samples of a
+// raster of width by height pixels. The samples are not copied.
+func float32Image(data []float32, width, height int) *GrayFloat32 {
+	return &GrayFloat32{
+		Pix:    data,
+		Stride: width,
+		Rect:   image.Rect(0, 0, width, height),
+		Max:    1,
+	}
+}
+
+// EncodeInt16 writes data, which holds the samples of a raster of width by
+// height pixels in row-major order, to w as a single band image of 16-bit
+// signed integer samples. The nodata value is written to the GDALNoData tag.
+// opts determines the options used for encoding, such as the compression
+// type and the georeferencing tags, and may be nil. Its SampleFormat and
+// BitsPerSample are ignored.
+func EncodeInt16(w io.Writer, data []int16, width, height int, nodata int16, opts *GeoOptions) error {
+	if width < 0 || height < 0 || len(data) != width*height {
+		return fmt.Errorf("tiff: %d samples for a %dx%d raster", len(data), width, height)
+	}
+	m := image.NewGray16(image.Rect(0, 0, width, height))
+	for i, v := range data {
+		// An image.Gray16's Pix is in big-endian order.
+		m.Pix[2*i+0] = uint8(uint16(v) >> 8)
+		m.Pix[2*i+1] = uint8(v)
+	}
+	var o GeoOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.SampleFormat, o.BitsPerSample = SignedSample, 0
+	extra, err := o.ifdEntries()
+	if err != nil {
+		return err
+	}
+	extra = append(extra, ifdEntry{tGDALNoData, dtASCII, asciiData(strconv.Itoa(int(nodata)))})
+	return writeImage(w, m, &o.Options, extra)
+}
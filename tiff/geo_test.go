@@ -0,0 +1,789 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeGeoKeys(t *testing.T) {
+	b := buildTIFF(
+		shortsEntry(tGeoKeyDirectory,
+			1, 1, 0, 4,
+			GTModelTypeGeoKey, 0, 1, 2,
+			GTRasterTypeGeoKey, 0, 1, 1,
+			GTCitationGeoKey, tGeoASCIIParams, 7, 0,
+			GeogSemiMajorAxisGeoKey, tGeoDoubleParams, 1, 1,
+		),
+		doublesEntry(tGeoDoubleParams, 298.257223563, 6378137),
+		asciiEntry(tGeoASCIIParams, "WGS 84|"),
+	)
+	keys, err := DecodeGeoKeys(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := keys.Uint(GTModelTypeGeoKey); !ok || v != 2 {
+		t.Errorf("GTModelTypeGeoKey: got %d, %t, want 2, true", v, ok)
+	}
+	if v, ok := keys.Uint(GTRasterTypeGeoKey); !ok || v != 1 {
+		t.Errorf("GTRasterTypeGeoKey: got %d, %t, want 1, true", v, ok)
+	}
+	if v, ok := keys.Float(GeogSemiMajorAxisGeoKey); !ok || v != 6378137 {
+		t.Errorf("GeogSemiMajorAxisGeoKey: got %v, %t, want 6378137, true", v, ok)
+	}
+	if v, ok := keys.String(GTCitationGeoKey); !ok || v != "WGS 84" {
+		t.Errorf("GTCitationGeoKey: got %q, %t, want \"WGS 84\", true", v, ok)
+	}
+	if _, ok := keys.Uint(ProjectedCSTypeGeoKey); ok {
+		t.Errorf("ProjectedCSTypeGeoKey: got ok, want missing")
+	}
+}
+
+func TestPixelToWorld(t *testing.T) {
+	scale := doublesEntry(tModelPixelScale, 10, 20, 0)
+	tiepoint := doublesEntry(tModelTiepoint, 0, 0, 0, 1000, 2000, 0)
+	rotated := doublesEntry(tModelTransformation,
+		10, 2, 0, 1000,
+		1, -20, 0, 2000,
+		0, 0, 0, 0,
+		0, 0, 0, 1,
+	)
+	rasterType := func(v uint16) rawEntry {
+		return shortsEntry(tGeoKeyDirectory, 1, 1, 0, 1, GTRasterTypeGeoKey, 0, 1, v)
+	}
+	for _, tc := range []struct {
+		desc    string
+		entries []rawEntry
+		px, py  float64
+		x, y    float64
+	}{
+		{"no GeoKeys", []rawEntry{scale, tiepoint}, 0, 0, 1000, 2000},
+		{"PixelIsArea", []rawEntry{scale, tiepoint, rasterType(uint16(RasterPixelIsArea))}, 0, 0, 1000, 2000},
+		{"PixelIsArea center", []rawEntry{scale, tiepoint, rasterType(uint16(RasterPixelIsArea))}, 2.5, 1.5, 1025, 1970},
+		// The tiepoint maps the center of the top-left pixel.
+		{"PixelIsPoint", []rawEntry{scale, tiepoint, rasterType(uint16(RasterPixelIsPoint))}, 0, 0, 995, 2010},
+		{"PixelIsPoint center", []rawEntry{scale, tiepoint, rasterType(uint16(RasterPixelIsPoint))}, 0.5, 0.5, 1000, 2000},
+		{"rotated", []rawEntry{rotated}, 3, 2, 1034, 1963},
+		{"rotated PixelIsPoint", []rawEntry{rotated, rasterType(uint16(RasterPixelIsPoint))}, 3.5, 2.5, 1034, 1963},
+	} {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(tc.entries...)))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		x, y, err := d.PixelToWorld(tc.px, tc.py)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if x != tc.x || y != tc.y {
+			t.Errorf("%s: PixelToWorld(%v, %v): got (%v, %v), want (%v, %v)", tc.desc, tc.px, tc.py, x, y, tc.x, tc.y)
+		}
+		px, py, err := d.WorldToPixel(tc.x, tc.y)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if math.Abs(px-tc.px) > 1e-9 || math.Abs(py-tc.py) > 1e-9 {
+			t.Errorf("%s: WorldToPixel(%v, %v): got (%v, %v), want (%v, %v)", tc.desc, tc.x, tc.y, px, py, tc.px, tc.py)
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF(doublesEntry(tModelPixelScale, 0, 0, 0), tiepoint)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.WorldToPixel(0, 0); err == nil {
+		t.Error("zero scale: got nil error, want non-nil")
+	}
+}
+
+func TestBoundingBox(t *testing.T) {
+	// buildTIFF makes a 1x1 image, so a larger one is described here.
+	size := []rawEntry{shortsEntry(tImageWidth, 4), shortsEntry(tImageLength, 3), longsEntry(tStripByteCounts, 12)}
+	for _, tc := range []struct {
+		desc    string
+		entries []rawEntry
+		want    [4]float64
+	}{{
+		"north up",
+		[]rawEntry{
+			doublesEntry(tModelPixelScale, 10, 20, 0),
+			doublesEntry(tModelTiepoint, 0, 0, 0, 1000, 2000, 0),
+		},
+		[4]float64{1000, 1940, 1040, 2000},
+	}, {
+		"PixelIsPoint",
+		[]rawEntry{
+			doublesEntry(tModelPixelScale, 10, 20, 0),
+			doublesEntry(tModelTiepoint, 0, 0, 0, 1000, 2000, 0),
+			shortsEntry(tGeoKeyDirectory, 1, 1, 0, 1, GTRasterTypeGeoKey, 0, 1, uint16(RasterPixelIsPoint)),
+		},
+		[4]float64{995, 1950, 1035, 2010},
+	}, {
+		"rotated",
+		[]rawEntry{
+			doublesEntry(tModelTransformation,
+				0, 10, 0, 1000,
+				10, 0, 0, 2000,
+				0, 0, 0, 0,
+				0, 0, 0, 1,
+			),
+		},
+		[4]float64{1000, 2000, 1030, 2040},
+	}} {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(append(size, tc.entries...)...)))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		minX, minY, maxX, maxY, err := d.BoundingBox()
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got := [4]float64{minX, minY, maxX, maxY}; got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF(size...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := d.BoundingBox(); err == nil {
+		t.Error("no georeferencing: got nil error, want non-nil")
+	}
+}
+
+func TestProjParams(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		keys map[int]interface{}
+		want ProjectionParams
+	}{{
+		"transverse mercator",
+		map[int]interface{}{
+			ProjCoordTransGeoKey:       uint(CT_TransverseMercator),
+			ProjNatOriginLongGeoKey:    147.0,
+			ProjNatOriginLatGeoKey:     0.0,
+			ProjScaleAtNatOriginGeoKey: 0.9996,
+			ProjFalseEastingGeoKey:     500000.0,
+			ProjFalseNorthingGeoKey:    10000000.0,
+		},
+		ProjectionParams{CoordTrans: CT_TransverseMercator, CentralMeridian: 147, ScaleFactor: 0.9996, FalseEasting: 500000, FalseNorthing: 10000000},
+	}, {
+		"albers",
+		map[int]interface{}{
+			ProjCoordTransGeoKey:          uint(CT_AlbersEqualArea),
+			ProjStdParallel1GeoKey:        -18.0,
+			ProjStdParallel2GeoKey:        -36.0,
+			ProjFalseOriginLongGeoKey:     132.0,
+			ProjFalseOriginLatGeoKey:      0.0,
+			ProjFalseOriginEastingGeoKey:  0.0,
+			ProjFalseOriginNorthingGeoKey: 0.0,
+		},
+		ProjectionParams{CoordTrans: CT_AlbersEqualArea, CentralMeridian: 132, StdParallel1: -18, StdParallel2: -36, ScaleFactor: 1},
+	}, {
+		"lambert conformal conic with natural origin keys",
+		map[int]interface{}{
+			ProjCoordTransGeoKey:    uint(CT_LambertConfConic_2SP),
+			ProjStdParallel1GeoKey:  []float64{33},
+			ProjStdParallel2GeoKey:  45.0,
+			ProjNatOriginLongGeoKey: -96.0,
+			ProjNatOriginLatGeoKey:  23.0,
+			ProjFalseEastingGeoKey:  1000.0,
+		},
+		ProjectionParams{CoordTrans: CT_LambertConfConic_2SP, CentralMeridian: -96, LatitudeOfOrigin: 23, StdParallel1: 33, StdParallel2: 45, ScaleFactor: 1, FalseEasting: 1000},
+	}, {
+		"polar stereographic",
+		map[int]interface{}{
+			ProjCoordTransGeoKey:           uint(CT_PolarStereographic),
+			ProjStraightVertPoleLongGeoKey: -45.0,
+			ProjNatOriginLatGeoKey:         90.0,
+			ProjScaleAtNatOriginGeoKey:     0.994,
+		},
+		ProjectionParams{CoordTrans: CT_PolarStereographic, CentralMeridian: -45, LatitudeOfOrigin: 90, ScaleFactor: 0.994},
+	}, {
+		"oblique mercator",
+		map[int]interface{}{
+			ProjCoordTransGeoKey:    uint(CT_ObliqueMercator),
+			ProjCenterLongGeoKey:    115.0,
+			ProjCenterLatGeoKey:     4.0,
+			ProjAzimuthAngleGeoKey:  53.3,
+			ProjScaleAtCenterGeoKey: 0.99984,
+		},
+		ProjectionParams{CoordTrans: CT_ObliqueMercator, CentralMeridian: 115, LatitudeOfOrigin: 4, Azimuth: 53.3, ScaleFactor: 0.99984},
+	}} {
+		got, err := GeoKeys{Keys: tc.keys}.ProjParams()
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+
+	// A US survey foot state plane zone with angles in grads.
+	p, err := GeoKeys{Keys: map[int]interface{}{
+		ProjCoordTransGeoKey:          uint(CT_LambertConfConic_2SP),
+		ProjStdParallel1GeoKey:        50.0,
+		ProjStdParallel2GeoKey:        40.0,
+		ProjFalseOriginLongGeoKey:     -100.0,
+		ProjFalseOriginLatGeoKey:      30.0,
+		ProjFalseOriginEastingGeoKey:  1968500.0,
+		ProjFalseOriginNorthingGeoKey: 3937.0,
+		ProjLinearUnitsGeoKey:         uint(9003),
+		GeogAngularUnitsGeoKey:        uint(9105),
+	}}.ProjParams()
+	if err != nil {
+		t.Fatalf("state plane: %v", err)
+	}
+	want := ProjectionParams{CoordTrans: CT_LambertConfConic_2SP, CentralMeridian: -90, LatitudeOfOrigin: 27, StdParallel1: 45, StdParallel2: 36, ScaleFactor: 1, FalseEasting: 600000, FalseNorthing: 1200}
+	for _, v := range [][2]float64{
+		{p.CentralMeridian, want.CentralMeridian},
+		{p.LatitudeOfOrigin, want.LatitudeOfOrigin},
+		{p.StdParallel1, want.StdParallel1},
+		{p.StdParallel2, want.StdParallel2},
+		{p.FalseEasting, want.FalseEasting},
+		{p.FalseNorthing, want.FalseNorthing},
+	} {
+		if math.Abs(v[0]-v[1]) > 1e-9 {
+			t.Errorf("state plane: got %+v, want %+v", p, want)
+			break
+		}
+	}
+
+	_, err = GeoKeys{Keys: map[int]interface{}{ProjectedCSTypeGeoKey: uint(32755)}}.ProjParams()
+	if e, ok := err.(FormatError); !ok || e.Kind != MissingTag {
+		t.Errorf("EPSG code only: got %v, want a MissingTag error", err)
+	}
+	_, err = GeoKeys{Keys: map[int]interface{}{ProjCoordTransGeoKey: uint(CT_TransvMercator_Modified_Alaska)}}.ProjParams()
+	if e, ok := err.(FormatError); !ok || e.Kind != Unsupported {
+		t.Errorf("modified Alaska: got %v, want an Unsupported error", err)
+	}
+}
+
+func TestGeoKeysEPSG(t *testing.T) {
+	for _, tc := range []struct {
+		keys map[int]interface{}
+		want int
+		ok   bool
+	}{
+		{map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeProjected), ProjectedCSTypeGeoKey: uint(32754), GeographicTypeGeoKey: uint(4326)}, 32754, true},
+		{map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeGeographic), ProjectedCSTypeGeoKey: uint(32754), GeographicTypeGeoKey: uint(4326)}, 4326, true},
+		{map[int]interface{}{ProjectedCSTypeGeoKey: uint(3857)}, 3857, true},
+		{map[int]interface{}{GeographicTypeGeoKey: uint(4283)}, 4283, true},
+		{map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeProjected), ProjectedCSTypeGeoKey: uint(KvUserDefined), GeographicTypeGeoKey: uint(4326)}, 0, false},
+		{map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeGeographic), GeographicTypeGeoKey: uint(0)}, 0, false},
+		{map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeProjected)}, 0, false},
+		{nil, 0, false},
+	} {
+		got, ok := GeoKeys{Keys: tc.keys}.EPSG()
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%v: got %d, %t, want %d, %t", tc.keys, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestGeoKeysFromEPSG(t *testing.T) {
+	for _, tc := range []struct {
+		code  int
+		model uint
+	}{
+		{4326, ModelTypeGeographic},
+		{4283, ModelTypeGeographic},
+		{3857, ModelTypeProjected},
+		{32755, ModelTypeProjected},
+		{32601, ModelTypeProjected},
+		{26910, ModelTypeProjected},
+	} {
+		k, err := GeoKeysFromEPSG(tc.code)
+		if err != nil {
+			t.Errorf("%d: %v", tc.code, err)
+			continue
+		}
+		if model, _ := k.Uint(GTModelTypeGeoKey); model != tc.model {
+			t.Errorf("%d: model type: got %d, want %d", tc.code, model, tc.model)
+		}
+		if code, ok := k.EPSG(); !ok || code != tc.code {
+			t.Errorf("%d: EPSG: got %d, %t", tc.code, code, ok)
+		}
+		if k.RasterType() != RasterPixelIsArea {
+			t.Errorf("%d: raster type: got %d, want %d", tc.code, k.RasterType(), RasterPixelIsArea)
+		}
+	}
+	for _, code := range []int{0, 4978, 32600, 99999} {
+		if _, err := GeoKeysFromEPSG(code); err == nil {
+			t.Errorf("%d: got nil error, want non-nil", code)
+		}
+	}
+
+	// The keys round trip through EncodeGeo.
+	k, err := GeoKeysFromEPSG(32755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeGeo(&buf, image.NewGray(image.Rect(0, 0, 1, 1)), &GeoOptions{GeoKeys: k}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GeoKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, k) {
+		t.Errorf("decoded keys: got %+v, want %+v", got, k)
+	}
+}
+
+func TestRasterType(t *testing.T) {
+	for _, tc := range []struct {
+		keys map[int]interface{}
+		want RasterType
+	}{
+		{nil, RasterPixelIsArea},
+		{map[int]interface{}{GTRasterTypeGeoKey: uint(1)}, RasterPixelIsArea},
+		{map[int]interface{}{GTRasterTypeGeoKey: uint(2)}, RasterPixelIsPoint},
+	} {
+		if got := (GeoKeys{Keys: tc.keys}).RasterType(); got != tc.want {
+			t.Errorf("%v: got %d, want %d", tc.keys, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeGeoKeysBadHeader(t *testing.T) {
+	for _, hdr := range [][]uint16{
+		{2, 1, 0, 0},
+		{1, 2, 0, 0},
+		{1, 1, 5, 0},
+		{1, 1, 0, 3},
+	} {
+		b := buildTIFF(shortsEntry(tGeoKeyDirectory, hdr...))
+		if _, err := DecodeGeoKeys(bytes.NewReader(b)); err == nil {
+			t.Errorf("header %v: got nil error, want non-nil", hdr)
+		}
+	}
+}
+
+func TestGeoTransform(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		entries []rawEntry
+		want    [6]float64
+	}{{
+		"scale and tiepoint",
+		[]rawEntry{
+			doublesEntry(tModelPixelScale, 30, 30, 0),
+			doublesEntry(tModelTiepoint, 0, 0, 0, 440720, 3751320, 0),
+		},
+		[6]float64{440720, 30, 0, 3751320, 0, -30},
+	}, {
+		"tiepoint away from the origin",
+		[]rawEntry{
+			doublesEntry(tModelPixelScale, 0.5, 0.25, 0),
+			doublesEntry(tModelTiepoint, 10, 20, 0, 100, 200, 0),
+		},
+		[6]float64{95, 0.5, 0, 205, 0, -0.25},
+	}, {
+		"transformation",
+		[]rawEntry{
+			doublesEntry(tModelTransformation,
+				30, 2, 0, 440720,
+				1, -30, 0, 3751320,
+				0, 0, 0, 0,
+				0, 0, 0, 1,
+			),
+		},
+		[6]float64{440720, 30, 2, 3751320, 1, -30},
+	}}
+	for _, tc := range testCases {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(tc.entries...)))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		got, err := d.GeoTransform()
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GeoTransform(); err == nil {
+		t.Error("no georeferencing: got nil error, want non-nil")
+	}
+}
+
+func TestNormalizedGeoTransform(t *testing.T) {
+	const usFoot = 1200.0 / 3937
+	for _, tc := range []struct {
+		desc string
+		keys map[int]interface{}
+		want [6]float64
+	}{
+		{"no units", map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeProjected)}, [6]float64{1000, 10, 0, 2000, 0, -10}},
+		{"US survey feet", map[int]interface{}{
+			GTModelTypeGeoKey:     uint(ModelTypeProjected),
+			ProjLinearUnitsGeoKey: uint(9003),
+		}, [6]float64{1000 * usFoot, 10 * usFoot, 0, 2000 * usFoot, 0, -10 * usFoot}},
+		{"grads", map[int]interface{}{
+			GTModelTypeGeoKey:      uint(ModelTypeGeographic),
+			GeogAngularUnitsGeoKey: uint(9105),
+			// The linear unit does not apply to geographic systems.
+			ProjLinearUnitsGeoKey: uint(9003),
+		}, [6]float64{900, 9, 0, 1800, 0, -9}},
+	} {
+		opts := &GeoOptions{
+			ModelPixelScale: []float64{10, 10, 0},
+			ModelTiepoint:   []float64{0, 0, 0, 1000, 2000, 0},
+			GeoKeys:         GeoKeys{Keys: tc.keys},
+		}
+		var buf bytes.Buffer
+		if err := EncodeGeo(&buf, image.NewGray(image.Rect(0, 0, 2, 2)), opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := d.GeoTransform(); err != nil || got != [6]float64{1000, 10, 0, 2000, 0, -10} {
+			t.Errorf("%s: GeoTransform: got %v, %v, want the native units", tc.desc, got, err)
+		}
+		got, err := d.NormalizedGeoTransform()
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-tc.want[i]) > 1e-9 {
+				t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+				break
+			}
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF(
+		doublesEntry(tModelPixelScale, 30, 30, 0),
+		doublesEntry(tModelTiepoint, 0, 0, 0, 440720, 3751320, 0),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.NormalizedGeoTransform(); err != nil || got != [6]float64{440720, 30, 0, 3751320, 0, -30} {
+		t.Errorf("no GeoKeys: got %v, %v", got, err)
+	}
+}
+
+func TestGCPs(t *testing.T) {
+	want := []GCP{
+		{0, 0, 0, 440720, 3751320, 0},
+		{100, 0, 0, 443720, 3751420, 0},
+		{0, 100, 0, 440620, 3748320, 0},
+	}
+	var v []float64
+	for _, g := range want {
+		v = append(v, g.I, g.J, g.K, g.X, g.Y, g.Z)
+	}
+	d, err := newDecoder(bytes.NewReader(buildTIFF(doublesEntry(tModelTiepoint, v...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GCPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := d.GeoTransform(); err == nil {
+		t.Error("GeoTransform with GCPs: got nil error, want non-nil")
+	} else if e, ok := err.(FormatError); !ok || e.Tag != tModelTiepoint {
+		t.Errorf("GeoTransform with GCPs: got %v, want a ModelTiepoint error", err)
+	}
+
+	for _, entries := range [][]rawEntry{
+		nil,
+		{doublesEntry(tModelTiepoint, 1, 2, 3, 4, 5)},
+	} {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(entries...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.GCPs(); err == nil {
+			t.Errorf("entries %v: got nil error, want non-nil", entries)
+		}
+	}
+}
+
+func TestModelTransformation(t *testing.T) {
+	d, err := newDecoder(bytes.NewReader(buildTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := d.ModelTransformation(); ok || err != nil {
+		t.Errorf("missing tag: got %t, %v, want false, nil", ok, err)
+	}
+
+	var want [16]float64
+	for i := range want {
+		want[i] = float64(i)
+	}
+	d, err = newDecoder(bytes.NewReader(buildTIFF(doublesEntry(tModelTransformation, want[:]...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := d.ModelTransformation()
+	if !ok || err != nil {
+		t.Fatalf("got %t, %v, want true, nil", ok, err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	d, err = newDecoder(bytes.NewReader(buildTIFF(doublesEntry(tModelTransformation, want[:12]...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := d.ModelTransformation(); !ok || err == nil {
+		t.Errorf("12 values: got %t, %v, want true, non-nil error", ok, err)
+	}
+	if _, err := d.GeoTransform(); err == nil {
+		t.Error("GeoTransform with 12 values: got nil error, want non-nil")
+	}
+}
+
+func TestEncodeGeo(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 4, 3))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 10)
+	}
+	keys := GeoKeys{Keys: map[int]interface{}{
+		GTModelTypeGeoKey:       uint(1),
+		GTRasterTypeGeoKey:      1,
+		ProjectedCSTypeGeoKey:   uint(32754),
+		GTCitationGeoKey:        "WGS 84 / UTM zone 54S",
+		PCSCitationGeoKey:       "UTM",
+		GeogSemiMajorAxisGeoKey: 6378137.0,
+		ProjStdParallel1GeoKey:  []float64{-10, -20},
+		GeogLinearUnitsGeoKey:   []uint{9001, 9002},
+	}}
+	opts := &GeoOptions{
+		Options:         Options{Compression: Deflate},
+		ModelPixelScale: []float64{25, 25, 0},
+		ModelTiepoint:   []float64{0, 0, 0, 500000, 8000000, 0},
+		GeoKeys:         keys,
+	}
+	var buf bytes.Buffer
+	if err := EncodeGeo(&buf, m, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeGeoKeys(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := GeoKeys{Version: 1, Revision: 1, Keys: map[int]interface{}{
+		GTModelTypeGeoKey:       uint(1),
+		GTRasterTypeGeoKey:      uint(1),
+		ProjectedCSTypeGeoKey:   uint(32754),
+		GTCitationGeoKey:        "WGS 84 / UTM zone 54S",
+		PCSCitationGeoKey:       "UTM",
+		GeogSemiMajorAxisGeoKey: 6378137.0,
+		ProjStdParallel1GeoKey:  []float64{-10, -20},
+		GeogLinearUnitsGeoKey:   []uint{9001, 9002},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GeoKeys: got %v, want %v", got, want)
+	}
+
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt, err := d.GeoTransform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantGT := [6]float64{500000, 25, 0, 8000000, 0, -25}; gt != wantGT {
+		t.Errorf("GeoTransform: got %v, want %v", gt, wantGT)
+	}
+
+	m1, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, m, m1)
+}
+
+func TestEncodeGeoParams(t *testing.T) {
+	keys := GeoKeys{Version: 1, Revision: 1, Keys: map[int]interface{}{
+		GTCitationGeoKey:        "WGS 84 / UTM zone 54S",
+		GeogCitationGeoKey:      "GCS Name = GCS_WGS_1984|Datum = D_WGS_1984",
+		GeogSemiMajorAxisGeoKey: 6378137.0,
+		GeogInvFlatteningGeoKey: 298.257223563,
+	}}
+	var buf bytes.Buffer
+	if err := EncodeGeo(&buf, image.NewGray(image.Rect(0, 0, 1, 1)), &GeoOptions{GeoKeys: keys}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each string is terminated by a '|', and the whole by a NUL.
+	_, _, ascii, ok := d.RawTag(tGeoASCIIParams)
+	if want := "WGS 84 / UTM zone 54S|GCS Name = GCS_WGS_1984|Datum = D_WGS_1984|\x00"; !ok || string(ascii) != want {
+		t.Errorf("GeoASCIIParams: got %q, want %q", ascii, want)
+	}
+	dtype, count, _, ok := d.RawTag(tGeoDoubleParams)
+	if !ok || dtype != dtFloat64 || count != 2 {
+		t.Errorf("GeoDoubleParams: got type %d, count %d, want %d, 2", dtype, count, dtFloat64)
+	}
+	// The entries point into the params in ascending key order.
+	want := [][4]uint{
+		{GTCitationGeoKey, tGeoASCIIParams, 22, 0},
+		{GeogCitationGeoKey, tGeoASCIIParams, 43, 22},
+		{GeogSemiMajorAxisGeoKey, tGeoDoubleParams, 1, 0},
+		{GeogInvFlatteningGeoKey, tGeoDoubleParams, 1, 1},
+	}
+	dir := d.features[tGeoKeyDirectory]
+	for i, w := range want {
+		if e := dir[4+4*i : 8+4*i]; e[0] != w[0] || e[1] != w[1] || e[2] != w[2] || e[3] != w[3] {
+			t.Errorf("entry %d: got %v, want %v", i, e, w)
+		}
+	}
+
+	got, err := d.GeoKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, keys) {
+		t.Errorf("GeoKeys: got %v, want %v", got, keys)
+	}
+}
+
+func TestEncodeFloat32(t *testing.T) {
+	const w, h = 7, 4
+	data := make([]float32, w*h)
+	for i := range data {
+		data[i] = float32(i)*1.5 - 10
+	}
+	data[5] = float32(math.NaN())
+	for _, opts := range []*GeoOptions{
+		nil,
+		{
+			Options:         Options{Compression: Deflate, PredictorType: FloatingPointPredictor},
+			ModelPixelScale: []float64{0.5, 0.5, 0},
+			ModelTiepoint:   []float64{0, 0, 0, 140, -30, 0},
+		},
+		{Options: Options{BigEndian: true}},
+		{
+			Options:         Options{Compression: Deflate, PredictorType: FloatingPointPredictor, BigEndian: true},
+			ModelPixelScale: []float64{0.5, 0.5, 0},
+			ModelTiepoint:   []float64{0, 0, 0, 140, -30, 0},
+		},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeFloat32(&buf, data, w, h, opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.firstVal(tBitsPerSample); got != 32 {
+			t.Errorf("BitsPerSample: got %d, want 32", got)
+		}
+		got, gw, gh, err := d.Float32Band(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gw != w || gh != h {
+			t.Fatalf("size: got %dx%d, want %dx%d", gw, gh, w, h)
+		}
+		// The samples are encoded without being copied, and must be left
+		// unchanged.
+		for i, v := range got {
+			if want := float32(i)*1.5 - 10; i != 5 && (v != want || data[i] != want) {
+				t.Errorf("sample %d: got %v, data %v, want %v", i, v, data[i], want)
+			}
+		}
+		if !math.IsNaN(float64(got[5])) {
+			t.Errorf("sample 5: got %v, want NaN", got[5])
+		}
+		if opts == nil || opts.Compression == Uncompressed {
+			continue
+		}
+		if got := d.firstVal(tPredictor); got != prFloatingPoint {
+			t.Errorf("Predictor: got %d, want %d", got, prFloatingPoint)
+		}
+		gt, err := d.GeoTransform()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := [6]float64{140, 0.5, 0, -30, 0, -0.5}; gt != want {
+			t.Errorf("GeoTransform: got %v, want %v", gt, want)
+		}
+	}
+
+	if err := EncodeFloat32(ioutil.Discard, data, w, h+1, nil); err == nil {
+		t.Error("short data: got nil error, want non-nil")
+	}
+}
+
+func TestEncodeInt16(t *testing.T) {
+	const w, h = 6, 5
+	data := make([]int16, w*h)
+	for i := range data {
+		data[i] = int16(i*2000 - 30000)
+	}
+	data[0] = math.MinInt16
+	opts := &GeoOptions{
+		Options:         Options{Compression: Deflate, Predictor: true},
+		ModelPixelScale: []float64{30, 30, 0},
+		ModelTiepoint:   []float64{0, 0, 0, 300000, 6000000, 0},
+	}
+	var buf bytes.Buffer
+	if err := EncodeInt16(&buf, data, w, h, math.MinInt16, opts); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err := d.Int16Band(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Errorf("samples: got %v, want %v", got, data)
+	}
+	noData, ok, err := d.NoData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || noData != math.MinInt16 {
+		t.Errorf("NoData: got %v, %t, want %d, true", noData, ok, math.MinInt16)
+	}
+	if _, err := d.GeoTransform(); err != nil {
+		t.Error(err)
+	}
+}
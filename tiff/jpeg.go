@@ -0,0 +1,155 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// JPEG markers.
+const (
+	jpegSOI = 0xd8 // Start of image.
+	jpegEOI = 0xd9 // End of image.
+)
+
+// jpegStream returns the JPEG stream of a strip or tile, whose data is read
+// from r. If the image has a JPEGTables tag, the data is an abbreviated
+// stream relying on the tables of the tag, which are then inserted into it.
+func (d *decoder) jpegStream(r io.Reader) (io.Reader, error) {
+	f := d.features[tJPEGTables]
+	if len(f) == 0 {
+		return r, nil
+	}
+	// The tables are a stream of their own, from which the EOI marker is
+	// removed, and the SOI marker of the data is skipped.
+	tables := make([]byte, len(f))
+	for i, v := range f {
+		tables[i] = byte(v)
+	}
+	if len(tables) < 4 || tables[0] != 0xff || tables[1] != jpegSOI || tables[len(tables)-2] != 0xff || tables[len(tables)-1] != jpegEOI {
+		return nil, FormatError{Kind: BadTag, Tag: tJPEGTables, Detail: "bad JPEGTables"}
+	}
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		return nil, truncated(err)
+	}
+	if soi[0] != 0xff || soi[1] != jpegSOI {
+		return nil, FormatError{Kind: Malformed, Detail: "missing JPEG SOI marker"}
+	}
+	return io.MultiReader(bytes.NewReader(tables[:len(tables)-2]), r), nil
+}
+
+// decodeJPEG decodes the JPEG stream of a strip or tile of w×h pixels, and
+// returns its pixels with chunky storage of 8-bit samples.
+func (d *decoder) decodeJPEG(r io.Reader, w, h int) ([]byte, error) {
+	if err := d.checkJPEG(); err != nil {
+		return nil, err
+	}
+	r, err := d.jpegStream(r)
+	if err != nil {
+		return nil, err
+	}
+	m, err := jpeg.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	b := m.Bounds()
+	if b.Dx() < w || b.Dy() < h {
+		return nil, FormatError{Kind: Malformed, Detail: "JPEG image smaller than its strip or tile"}
+	}
+	return d.jpegPixels(m, image.Rectangle{b.Min, b.Min.Add(image.Pt(w, h))})
+}
+
+// decodeOldJPEG returns the pixels of the strip or tile covering r of an
+// image with old-style JPEG compression, with chunky storage of 8-bit
+// samples. Only images stored as a single JPEG stream, which the
+// JPEGInterchangeFormat tag points to, are supported.
+func (d *decoder) decodeOldJPEG(r image.Rectangle) ([]byte, error) {
+	if err := d.checkJPEG(); err != nil {
+		return nil, err
+	}
+	off, ok := d.features[tJPEGInterchangeFormat]
+	if !ok {
+		return nil, FormatError{Kind: UnsupportedCompression, Tag: tCompression, Detail: "old-style JPEG unsupported"}
+	}
+	// The stream is decoded once, and shared by all strips and tiles,
+	// which may be decompressed concurrently.
+	d.oldJPEGOnce.Do(func() {
+		o := int64(off[0])
+		if size, ok := d.size(); o < 0 || ok && o > size {
+			d.oldJPEGErr = FormatError{Kind: Truncated, Tag: tJPEGInterchangeFormat, Detail: "JPEG stream out of file bounds"}
+			return
+		}
+		n := math.MaxInt64 - o
+		if l, ok := d.features[tJPEGInterchangeFormatLength]; ok && l[0] > 0 {
+			n = int64(l[0])
+		}
+		d.oldJPEG, d.oldJPEGErr = jpeg.Decode(io.NewSectionReader(d.r, o, n))
+	})
+	if d.oldJPEGErr != nil {
+		return nil, d.oldJPEGErr
+	}
+	return d.jpegPixels(d.oldJPEG, r)
+}
+
+// checkJPEG returns an error if the samples of the image cannot be JPEG
+// compressed.
+func (d *decoder) checkJPEG() error {
+	if spp := d.blockSamples(); d.bpp != 8 || spp != 1 && spp != 3 {
+		return FormatError{Kind: UnsupportedCompression, Tag: tCompression, Detail: fmt.Sprintf("JPEG compression with %d samples of %d bits", spp, d.bpp)}
+	}
+	return nil
+}
+
+// jpegPixels returns the pixels of m within r, with chunky storage of 8-bit
+// samples. YCbCr images are converted to RGB. Pixels outside of the bounds
+// of m are zero.
+func (d *decoder) jpegPixels(m image.Image, r image.Rectangle) ([]byte, error) {
+	spp := d.blockSamples()
+	switch m.(type) {
+	case *image.Gray:
+		if spp != 1 {
+			return nil, FormatError{Kind: Malformed, Detail: "JPEG image has the wrong number of samples"}
+		}
+	default:
+		if spp != 3 {
+			return nil, FormatError{Kind: Malformed, Detail: "JPEG image has the wrong number of samples"}
+		}
+	}
+	// Without a JFIF or Adobe marker, the samples of a JPEG stream are
+	// assumed to be YCbCr, while the PhotometricInterpretation of the image
+	// may say that they are RGB.
+	rgb := d.firstVal(tPhotometricInterpretation) == pRGB
+
+	buf := make([]byte, r.Dx()*r.Dy()*spp)
+	b := r.Intersect(m.Bounds())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := ((y-r.Min.Y)*r.Dx() + b.Min.X - r.Min.X) * spp
+		for x := b.Min.X; x < b.Max.X; x++ {
+			switch m := m.(type) {
+			case *image.Gray:
+				buf[i] = m.Pix[m.PixOffset(x, y)]
+			case *image.YCbCr:
+				yy, cb, cr := m.Y[m.YOffset(x, y)], m.Cb[m.COffset(x, y)], m.Cr[m.COffset(x, y)]
+				if rgb {
+					buf[i], buf[i+1], buf[i+2] = yy, cb, cr
+				} else {
+					buf[i], buf[i+1], buf[i+2] = color.YCbCrToRGB(yy, cb, cr)
+				}
+			default:
+				c := color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)
+				buf[i], buf[i+1], buf[i+2] = c.R, c.G, c.B
+			}
+			i += spp
+		}
+	}
+	return buf, nil
+}
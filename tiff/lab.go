@@ -0,0 +1,59 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import "math"
+
+// The reference white of CIELab images is D50 (p. 110 of the spec of
+// TIFF 6.0, part 2).
+const (
+	d50X = 0.96422
+	d50Y = 1.0
+	d50Z = 0.82521
+)
+
+// labToRGB converts the CIE L*a*b* color (l, a, b), relative to the D50
+// white point, to sRGB. The returned components are in [0, 1].
+//
+// The conversion goes through CIE XYZ, and adapts it from D50 to the D65
+// white point of sRGB with the Bradford transform.
+// See http://www.brucelindbloom.com/index.html?Math.html.
+func labToRGB(l, a, b float64) (float64, float64, float64) {
+	const (
+		epsilon = 216.0 / 24389
+		kappa   = 24389.0 / 27
+	)
+	fy := (l + 16) / 116
+	fx := fy + a/500
+	fz := fy - b/200
+	finv := func(t float64) float64 {
+		if t3 := t * t * t; t3 > epsilon {
+			return t3
+		}
+		return (116*t - 16) / kappa
+	}
+	yr := l / kappa
+	if l > kappa*epsilon {
+		yr = fy * fy * fy
+	}
+	x, y, z := d50X*finv(fx), d50Y*yr, d50Z*finv(fz)
+
+	// XYZ (D50) to linear sRGB (D65).
+	r := 3.1338561*x - 1.6168667*y - 0.4906146*z
+	g := -0.9787684*x + 1.9161415*y + 0.0334540*z
+	bl := 0.0719453*x - 0.2289914*y + 1.4052427*z
+	return gammaSRGB(r), gammaSRGB(g), gammaSRGB(bl)
+}
+
+// gammaSRGB applies the sRGB transfer function to the linear component c,
+// clamping the result to [0, 1].
+func gammaSRGB(c float64) float64 {
+	if c <= 0.0031308 {
+		c *= 12.92
+	} else {
+		c = 1.055*math.Pow(c, 1/2.4) - 0.055
+	}
+	return math.Max(0, math.Min(1, c))
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+)
+
+// errStopWalk stops walkIFDs early from the function it calls.
+var errStopWalk = errors.New("tiff: stop walking IFDs")
+
+// SubfileType returns the value of the NewSubfileType tag of the image, a
+// set of flags where 1 marks a reduced-resolution version of another image,
+// 2 a page of a multi-page image and 4 a transparency mask for another
+// image. It is 0 if the tag is missing.
+func (d *decoder) SubfileType() uint32 {
+	return uint32(d.firstVal(tNewSubfileType))
+}
+
+// Mask returns the transparency mask of the image, stored in one of the
+// IFDs that follow its own before the next page. The mask is opaque where
+// the image is shown and transparent elsewhere. ok is false if the image
+// has no transparency mask.
+func (d *decoder) Mask() (mask *image.Alpha, ok bool, err error) {
+	var md *decoder
+	err = d.walkIFDs(func(d1 *decoder) error {
+		subfileType := d1.firstVal(tNewSubfileType)
+		switch {
+		case subfileType&sfMask != 0 && subfileType&sfReducedResolution == 0:
+			md = d1
+			return errStopWalk
+		case subfileType&sfReducedResolution == 0:
+			// The next page starts.
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, false, err
+	}
+	if md == nil {
+		return nil, false, nil
+	}
+	if err := md.configure(); err != nil {
+		return nil, false, err
+	}
+	if md.firstVal(tPhotometricInterpretation) != pTransMask {
+		return nil, false, FormatError{Kind: BadTag, Tag: tPhotometricInterpretation, Detail: "transparency mask not of the TransparencyMask photometric interpretation"}
+	}
+	if md.config.Width != d.config.Width || md.config.Height != d.config.Height {
+		return nil, false, FormatError{Kind: BadTag, Tag: tImageWidth, Detail: "transparency mask size differs from the image"}
+	}
+	m, err := md.decodeImage()
+	if err != nil {
+		return nil, false, err
+	}
+	b := m.Bounds()
+	mask = image.NewAlpha(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if r, _, _, _ := m.At(x, y).RGBA(); r != 0 {
+				mask.Pix[mask.PixOffset(x, y)] = 0xff
+			}
+		}
+	}
+	return mask, true, nil
+}
+
+// ApplyMask returns a copy of m that is transparent where mask is, such as
+// an image with its transparency mask as returned by Mask.
+func ApplyMask(m image.Image, mask *image.Alpha) *image.NRGBA {
+	b := m.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.DrawMask(dst, b, m, b.Min, mask, mask.Bounds().Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	b := makePages(binary.LittleEndian, false,
+		page{[]byte{10, 20, 30, 40}, []rawEntry{
+			shortsEntry(tImageWidth, 2),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tRowsPerStrip, 2),
+		}},
+		// The rows of the mask are padded to whole bytes.
+		page{[]byte{0x80, 0x40}, []rawEntry{
+			longsEntry(tNewSubfileType, sfMask),
+			shortsEntry(tImageWidth, 2),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tBitsPerSample, 1),
+			shortsEntry(tPhotometricInterpretation, pTransMask),
+			shortsEntry(tRowsPerStrip, 2),
+		}},
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.SubfileType(); got != 0 {
+		t.Errorf("got SubfileType %d, want 0", got)
+	}
+	mask, ok, err := d.Mask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("mask not found")
+	}
+	if want := []byte{0xff, 0, 0, 0xff}; !bytes.Equal(mask.Pix, want) {
+		t.Errorf("got mask %v, want %v", mask.Pix, want)
+	}
+
+	m, err := d.decodeImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	masked := ApplyMask(m, mask)
+	want := []color.NRGBA{{10, 10, 10, 0xff}, {}, {}, {40, 40, 40, 0xff}}
+	for i, c := range want {
+		x, y := i%2, i/2
+		if got := masked.NRGBAAt(x, y); got != c {
+			t.Errorf("(%d, %d): got %v, want %v", x, y, got, c)
+		}
+	}
+
+	// The mask can be decoded on its own.
+	pages, err := DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	if got := color.GrayModel.Convert(pages[1].At(1, 1)).(color.Gray); got.Y != 0xff {
+		t.Errorf("mask (1, 1): got %v, want 0xff", got.Y)
+	}
+}
+
+func TestMaskNone(t *testing.T) {
+	// The mask of the pyramid belongs to an overview.
+	d, err := newDecoder(bytes.NewReader(pyramid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := d.Mask(); err != nil || ok {
+		t.Errorf("got ok %v and error %v, want no mask", ok, err)
+	}
+	overviews, err := d.Overviews()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := overviews[0].d.SubfileType(); got != sfReducedResolution {
+		t.Errorf("got SubfileType %d, want %d", got, sfReducedResolution)
+	}
+}
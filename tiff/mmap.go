@@ -0,0 +1,80 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"io"
+	"os"
+)
+
+// A mappedFile is a file mapped in memory. Its strips and tiles are
+// decompressed from the mapping in place, instead of being copied first.
+type mappedFile struct {
+	data []byte
+}
+
+func (m *mappedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns the size of the file.
+func (m *mappedFile) Size() int64 {
+	return int64(len(m.data))
+}
+
+// Slice returns the n bytes at offset off in the file, without copying
+// them. The slice is shorter than n bytes, and the error is io.EOF, if the
+// file ends before.
+func (m *mappedFile) Slice(off, n int) ([]byte, error) {
+	if off < 0 || off > len(m.data) {
+		return nil, io.EOF
+	}
+	if n > len(m.data)-off {
+		return m.data[off:], io.EOF
+	}
+	return m.data[off : off+n], nil
+}
+
+// Close unmaps the file.
+func (m *mappedFile) Close() error {
+	data := m.data
+	m.data = nil
+	return unmapFile(data)
+}
+
+// DecodeFile opens the named file and returns a Reader of its first image,
+// like DecodeAt. On the systems that support it, the file is mapped in
+// memory, so that its strips and tiles are decompressed from the mapping
+// rather than read into buffers first. Elsewhere, the file is read with
+// ReadAt. The Reader must be closed with Close, which unmaps and closes the
+// file.
+func DecodeFile(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var ra io.ReaderAt = f
+	var c io.Closer = f
+	if data, err := mapFile(f); err == nil {
+		// The mapping does not need the file to stay open.
+		f.Close()
+		m := &mappedFile{data}
+		ra, c = m, m
+	}
+	r, err := DecodeAt(ra)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	r.closer = c
+	return r, nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package tiff
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile always fails, as memory mapping is not supported on this system.
+func mapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("tiff: memory mapping not supported")
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/prl900/scimage"
+	"github.com/prl900/scimage/scicolor"
+)
+
+// Orientation returns the value of the Orientation tag of the image (p. 36
+// of the spec), which tells where the first row and column of the stored
+// pixels are displayed. It is 1 (top-left) if the tag is missing.
+func (d *decoder) Orientation() int {
+	if o := d.firstVal(tOrientation); o != 0 {
+		return int(o)
+	}
+	return 1
+}
+
+// orient returns img, holding the pixels as stored in the file, transformed
+// for display according to the Orientation tag. Unknown orientations are
+// treated as top-left.
+func (d *decoder) orient(img image.Image) (image.Image, error) {
+	return d.orientTo(img, d.newImage)
+}
+
+// orientTo is like orient, but creates the transformed image with
+// newImage, which must return images of the same type as img.
+func (d *decoder) orientTo(img image.Image, newImage func(r image.Rectangle) (image.Image, error)) (image.Image, error) {
+	o := d.Orientation()
+	if o < 2 || o > 8 {
+		return img, nil
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 swap rows and columns.
+	r := image.Rect(0, 0, w, h)
+	if o >= 5 {
+		r = image.Rect(0, 0, h, w)
+	}
+	dst, err := newImage(r)
+	if err != nil {
+		return nil, err
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // Top-right.
+				dx, dy = w-1-x, y
+			case 3: // Bottom-right.
+				dx, dy = w-1-x, h-1-y
+			case 4: // Bottom-left.
+				dx, dy = x, h-1-y
+			case 5: // Left-top.
+				dx, dy = y, x
+			case 6: // Right-top.
+				dx, dy = h-1-y, x
+			case 7: // Right-bottom.
+				dx, dy = h-1-y, w-1-x
+			case 8: // Left-bottom.
+				dx, dy = y, w-1-x
+			}
+			copyPixel(dst, dx, dy, img, b.Min.X+x, b.Min.Y+y)
+		}
+	}
+	return dst, nil
+}
+
+// copyPixel sets the pixel of dst at (dx, dy) to the pixel of src at
+// (sx, sy). Both images must have the same type, as returned by newImage.
+func copyPixel(dst image.Image, dx, dy int, src image.Image, sx, sy int) {
+	switch m := dst.(type) {
+	case *scimage.GrayU8:
+		m.SetGrayU8(dx, dy, src.At(sx, sy).(scicolor.GrayU8))
+	case *scimage.GrayU16:
+		m.SetGrayU16(dx, dy, src.At(sx, sy).(scicolor.GrayU16))
+	case *scimage.GrayS8:
+		m.SetGrayS8(dx, dy, src.At(sx, sy).(scicolor.GrayS8))
+	case *scimage.GrayS16:
+		m.SetGrayS16(dx, dy, src.At(sx, sy).(scicolor.GrayS16))
+	case *image.Paletted:
+		m.SetColorIndex(dx, dy, src.(*image.Paletted).ColorIndexAt(sx, sy))
+	case draw.Image:
+		m.Set(dx, dy, src.At(sx, sy))
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// An Overview is a reduced-resolution version of an image, such as the
+// levels of the image pyramids of Cloud Optimized GeoTIFF files.
+type Overview struct {
+	Width, Height int // The size of the overview in pixels.
+
+	d *decoder
+}
+
+// ReadWindow reads the given window of the overview, in its own pixel
+// coordinates. See decoder.ReadWindow.
+func (o Overview) ReadWindow(x, y, w, h int) (image.Image, error) {
+	return o.d.ReadWindow(x, y, w, h)
+}
+
+// Overviews returns the reduced-resolution versions of the image, stored in
+// the IFDs that follow its own, in file order. This is usually from the
+// highest to the lowest resolution. Transparency masks are skipped.
+func (d *decoder) Overviews() ([]Overview, error) {
+	if d.overviews != nil {
+		return d.overviews, nil
+	}
+	overviews := []Overview{}
+	err := d.walkIFDs(func(d1 *decoder) error {
+		// Masks are not overviews, even those of reduced resolution,
+		// which belong to an overview. See Mask.
+		subfileType := d1.firstVal(tNewSubfileType)
+		if subfileType&sfMask != 0 || subfileType&sfReducedResolution == 0 {
+			return nil
+		}
+		if err := d1.configure(); err != nil {
+			return err
+		}
+		overviews = append(overviews, Overview{d1.config.Width, d1.config.Height, d1})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.overviews = overviews
+	return overviews, nil
+}
+
+// ReadWindowScaled reads the window of the image with its top-left corner at
+// (x, y) and a size of w by h pixels, for display at a size of width by
+// height pixels. The window is read from the overview of the lowest
+// resolution that still holds at least width by height pixels in the
+// window, or from the image itself if no overview does. The bounds of the
+// returned image are the window in the pixel coordinates of the overview
+// it was read from.
+func (d *decoder) ReadWindowScaled(x, y, w, h, width, height int) (image.Image, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("tiff: invalid output size %dx%d", width, height)
+	}
+	overviews, err := d.Overviews()
+	if err != nil {
+		return nil, err
+	}
+	r := image.Rect(x, y, x+w, y+h)
+	if w <= 0 || h <= 0 || !r.In(image.Rect(0, 0, d.config.Width, d.config.Height)) {
+		return nil, fmt.Errorf("tiff: window %v outside of image bounds %dx%d", r, d.config.Width, d.config.Height)
+	}
+	best, bestR := d, r
+	for _, o := range overviews {
+		// The window in the pixel coordinates of the overview covers at
+		// least the pixels of r.
+		or := image.Rect(
+			x*o.Width/d.config.Width,
+			y*o.Height/d.config.Height,
+			ceilDiv((x+w)*o.Width, d.config.Width),
+			ceilDiv((y+h)*o.Height, d.config.Height),
+		)
+		if w*o.Width < width*d.config.Width || h*o.Height < height*d.config.Height {
+			continue
+		}
+		if o.Width < best.config.Width {
+			best, bestR = o.d, or
+		}
+	}
+	return best.ReadWindow(bestR.Min.X, bestR.Min.Y, bestR.Dx(), bestR.Dy())
+}
+
+// DecodeScaled decodes the first image of the TIFF file in r, scaled down
+// to fit in maxW by maxH pixels while keeping its aspect ratio. Images that
+// already fit are not scaled up. The image is read from the overview of the
+// lowest resolution that holds at least the pixels of the scaled image, or
+// from the image itself if no overview does, and is box-filtered to the
+// scaled size one strip or row of tiles at a time, so that the full image
+// is never held in memory. As with Decode, the orientation of the image is
+// applied. The returned image has the type returned by Decode if the
+// source already has the scaled size, and is an image.RGBA64 otherwise.
+func DecodeScaled(r io.ReaderAt, maxW, maxH int) (image.Image, error) {
+	if maxW <= 0 || maxH <= 0 {
+		return nil, fmt.Errorf("tiff: invalid output size %dx%d", maxW, maxH)
+	}
+	d, err := newDecoderAt(r)
+	if err != nil {
+		return nil, err
+	}
+	if d.ApplyOrientation && d.Orientation() >= 5 {
+		// Rows and columns are swapped for display.
+		maxW, maxH = maxH, maxW
+	}
+	w, h := d.config.Width, d.config.Height
+	tw, th := w, h
+	switch {
+	case w <= maxW && h <= maxH:
+	case w*maxH > h*maxW:
+		tw, th = maxW, maxInt(1, h*maxW/w)
+	default:
+		tw, th = maxInt(1, w*maxH/h), maxH
+	}
+
+	overviews, err := d.Overviews()
+	if err != nil {
+		return nil, err
+	}
+	src := d
+	for _, o := range overviews {
+		if o.Width >= tw && o.Height >= th && o.Width < src.config.Width {
+			src = o.d
+		}
+	}
+	orient := func(img image.Image, newImage func(r image.Rectangle) (image.Image, error)) (image.Image, error) {
+		if !d.ApplyOrientation {
+			return img, nil
+		}
+		return d.orientTo(img, newImage)
+	}
+	sw, sh := src.config.Width, src.config.Height
+	if sw == tw && sh == th {
+		img, err := src.ReadWindow(0, 0, sw, sh)
+		if err != nil {
+			return nil, err
+		}
+		return orient(img, src.newImage)
+	}
+
+	// Each pixel of the source is added to the sums of the pixel of the
+	// scaled image it falls in.
+	sums := make([]uint64, 4*tw*th)
+	counts := make([]uint64, tw*th)
+	_, bh := src.TileSize()
+	for y0 := 0; y0 < sh; y0 += bh {
+		m, err := src.ReadWindow(0, y0, sw, minInt(bh, sh-y0))
+		if err != nil {
+			return nil, err
+		}
+		mb := m.Bounds()
+		for y := mb.Min.Y; y < mb.Max.Y; y++ {
+			row := y * th / sh * tw
+			for x := mb.Min.X; x < mb.Max.X; x++ {
+				i := row + x*tw/sw
+				cr, cg, cb, ca := m.At(x, y).RGBA()
+				s := sums[4*i : 4*i+4]
+				s[0] += uint64(cr)
+				s[1] += uint64(cg)
+				s[2] += uint64(cb)
+				s[3] += uint64(ca)
+				counts[i]++
+			}
+		}
+	}
+	img := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for i, n := range counts {
+		s := sums[4*i : 4*i+4]
+		p := img.Pix[8*i : 8*i+8]
+		for j, v := range s {
+			v /= n
+			p[2*j], p[2*j+1] = uint8(v>>8), uint8(v)
+		}
+	}
+	return orient(img, func(r image.Rectangle) (image.Image, error) {
+		return image.NewRGBA64(r), nil
+	})
+}
+
+// RawTile returns the data of a strip or tile as stored in the file,
+// without decompressing it, along with its compression scheme. Level 0 is
+// the image itself, and level i is its i'th overview, as returned by
+// Overviews. The strips or tiles of a level are numbered as in its
+// StripOffsets or TileOffsets tag: in row-major order, and plane after plane
+// for planar images. The tiles left out of sparse files have no data.
+func (d *decoder) RawTile(level, tileIndex int) (data []byte, compression CompressionType, err error) {
+	ld := d
+	if level != 0 {
+		overviews, err := d.Overviews()
+		if err != nil {
+			return nil, 0, err
+		}
+		if level < 0 || level > len(overviews) {
+			return nil, 0, fmt.Errorf("tiff: level %d out of range [0, %d]", level, len(overviews))
+		}
+		ld = overviews[level-1].d
+	}
+	planes, err := ld.planes()
+	if err != nil {
+		return nil, 0, err
+	}
+	var blocks []block
+	for _, p := range planes {
+		blocks = append(blocks, p...)
+	}
+	if tileIndex < 0 || tileIndex >= len(blocks) {
+		return nil, 0, fmt.Errorf("tiff: tile index %d out of range [0, %d)", tileIndex, len(blocks))
+	}
+	b := blocks[tileIndex]
+	data = make([]byte, b.count)
+	if b.count > 0 {
+		if n, err := ld.r.ReadAt(data, b.offset); n < len(data) {
+			return nil, 0, truncated(err)
+		}
+	}
+	return data, ld.Compression(), nil
+}
+
+// ceilDiv returns a/b rounded up, for positive b and non-negative a.
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// SubIFDImages decodes the images described by the IFDs listed in the
+// SubIFDs tag, which usually hold reduced-resolution versions of the image.
+// It returns no images if the tag is missing.
+func (d *decoder) SubIFDImages() ([]image.Image, error) {
+	offsets := d.features[tSubIFDs]
+	size, sizeKnown := d.size()
+	imgs := make([]image.Image, 0, len(offsets))
+	for _, off := range offsets {
+		if off == 0 || sizeKnown && int64(off) >= size {
+			return nil, FormatError{Kind: BadTag, Tag: tSubIFDs, Detail: "SubIFD offset out of file bounds"}
+		}
+		d1, err := d.ifdDecoder(int64(off))
+		if err != nil {
+			return nil, err
+		}
+		if err := d1.configure(); err != nil {
+			return nil, err
+		}
+		img, err := d1.decodeImage()
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
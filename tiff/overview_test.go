@@ -0,0 +1,400 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/prl900/scimage/scicolor"
+)
+
+// pyramid returns a file holding an 8x8 image followed by its 4x4 and 2x2
+// overviews, and a mask between them. The pixels of the image of size n
+// have the value n.
+func pyramid() []byte {
+	level := func(n int, entries ...rawEntry) page {
+		pix := bytes.Repeat([]byte{byte(n)}, n*n)
+		return page{pix, append(entries,
+			shortsEntry(tImageWidth, uint16(n)),
+			shortsEntry(tImageLength, uint16(n)),
+			shortsEntry(tRowsPerStrip, uint16(n)),
+		)}
+	}
+	return makePages(binary.LittleEndian, false,
+		level(8),
+		level(4, longsEntry(tNewSubfileType, sfReducedResolution)),
+		page{[]byte{0xff, 0xff}, []rawEntry{
+			longsEntry(tNewSubfileType, sfReducedResolution|sfMask),
+			shortsEntry(tImageWidth, 2),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tBitsPerSample, 1),
+			shortsEntry(tPhotometricInterpretation, pTransMask),
+			shortsEntry(tRowsPerStrip, 2),
+		}},
+		level(2, longsEntry(tNewSubfileType, sfReducedResolution)),
+	)
+}
+
+func TestOverviews(t *testing.T) {
+	d, err := newDecoder(bytes.NewReader(pyramid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overviews, err := d.Overviews()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overviews) != 2 {
+		t.Fatalf("got %d overviews, want 2", len(overviews))
+	}
+	for i, want := range []int{4, 2} {
+		if o := overviews[i]; o.Width != want || o.Height != want {
+			t.Errorf("overview %d: got size %dx%d, want %dx%d", i, o.Width, o.Height, want, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		x, y, w, h    int
+		width, height int
+		level         uint8 // The size of the level read.
+		want          image.Rectangle
+	}{
+		{0, 0, 8, 8, 8, 8, 8, image.Rect(0, 0, 8, 8)},
+		{0, 0, 8, 8, 4, 3, 4, image.Rect(0, 0, 4, 4)},
+		{0, 0, 8, 8, 1, 2, 2, image.Rect(0, 0, 2, 2)},
+		{2, 2, 4, 4, 2, 2, 4, image.Rect(1, 1, 3, 3)},
+		{2, 2, 4, 4, 3, 3, 8, image.Rect(2, 2, 6, 6)},
+		{3, 1, 2, 5, 1, 1, 4, image.Rect(1, 0, 3, 3)},
+	} {
+		m, err := d.ReadWindowScaled(tc.x, tc.y, tc.w, tc.h, tc.width, tc.height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Bounds() != tc.want {
+			t.Errorf("%+v: got bounds %v, want %v", tc, m.Bounds(), tc.want)
+			continue
+		}
+		// The pixels of each level have the value of its size.
+		if c, ok := m.At(tc.want.Min.X, tc.want.Min.Y).(scicolor.GrayU8); !ok || c.Y != tc.level {
+			t.Errorf("%+v: got pixel %v, want %d", tc, m.At(tc.want.Min.X, tc.want.Min.Y), tc.level)
+		}
+	}
+}
+
+func TestDecodeScaled(t *testing.T) {
+	for _, tc := range []struct {
+		maxW, maxH int
+		want       image.Rectangle
+		level      uint8 // The size of the level read.
+	}{
+		{100, 100, image.Rect(0, 0, 8, 8), 8},
+		{4, 5, image.Rect(0, 0, 4, 4), 4},
+		{3, 3, image.Rect(0, 0, 3, 3), 4},
+		{1, 1, image.Rect(0, 0, 1, 1), 2},
+	} {
+		m, err := DecodeScaled(bytes.NewReader(pyramid()), tc.maxW, tc.maxH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Bounds() != tc.want {
+			t.Errorf("%dx%d: got bounds %v, want %v", tc.maxW, tc.maxH, m.Bounds(), tc.want)
+			continue
+		}
+		if r, _, _, _ := m.At(0, 0).RGBA(); r != uint32(tc.level)*0x101 {
+			t.Errorf("%dx%d: got pixel %v, want %d", tc.maxW, tc.maxH, m.At(0, 0), tc.level)
+		}
+	}
+
+	// Files without overviews are decimated strip by strip.
+	b := makeTIFF(binary.LittleEndian, []byte{
+		0, 20, 40, 60,
+		40, 60, 80, 100,
+	},
+		shortsEntry(tImageWidth, 4),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tRowsPerStrip, 1),
+		longsEntry(tStripOffsets, pixOffset, pixOffset+4),
+		longsEntry(tStripByteCounts, 4, 4),
+	)
+	m, err := DecodeScaled(bytes.NewReader(b), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Bounds(), image.Rect(0, 0, 2, 1); got != want {
+		t.Fatalf("got bounds %v, want %v", got, want)
+	}
+	for x, want := range []uint32{30, 70} {
+		if r, _, _, _ := m.At(x, 0).RGBA(); r != want*0x101 {
+			t.Errorf("pixel %d: got %v, want %d", x, m.At(x, 0), want)
+		}
+	}
+
+	if _, err := DecodeScaled(bytes.NewReader(b), 0, 2); err == nil {
+		t.Error("zero size: got nil error, want non-nil")
+	}
+}
+
+func TestOverviewsCycle(t *testing.T) {
+	b := pyramid()
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overviews, err := d.Overviews()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Point the last IFD back to the first overview.
+	last := overviews[1].d
+	n := int(binary.LittleEndian.Uint16(b[last.ifdOffset:]))
+	binary.LittleEndian.PutUint32(b[int(last.ifdOffset)+2+ifdLen*n:], uint32(overviews[0].d.ifdOffset))
+
+	d, err = newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Overviews(); err == nil {
+		t.Error("got nil error, want non-nil")
+	}
+}
+
+func TestSubIFDImages(t *testing.T) {
+	sub := func(offsets ...uint64) rawEntry {
+		return rawEntry{tSubIFDs, dtIFD, offsets}
+	}
+	pages := func(subIFDs rawEntry) []byte {
+		return makePages(binary.LittleEndian, false,
+			page{[]byte{10, 20, 30, 40}, []rawEntry{
+				shortsEntry(tImageWidth, 2),
+				shortsEntry(tImageLength, 2),
+				shortsEntry(tRowsPerStrip, 2),
+				subIFDs,
+			}},
+			page{[]byte{25}, []rawEntry{longsEntry(tNewSubfileType, sfReducedResolution)}},
+			page{[]byte{26}, []rawEntry{longsEntry(tNewSubfileType, sfReducedResolution)}},
+		)
+	}
+	// The layout of the file does not depend on the values of the entry,
+	// so that the offsets of the IFDs can be found with placeholders.
+	d, err := newDecoder(bytes.NewReader(pages(sub(1, 1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []uint64
+	d.walkIFDs(func(d1 *decoder) error {
+		offsets = append(offsets, uint64(d1.ifdOffset))
+		return nil
+	})
+
+	b := pages(sub(offsets[1], offsets[0]))
+	d, err = newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgs, err := d.SubIFDImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 2 {
+		t.Fatalf("got %d images, want 2", len(imgs))
+	}
+	for i, want := range []uint8{26, 25} {
+		if c, ok := imgs[i].At(0, 0).(scicolor.GrayU8); !ok || c.Y != want {
+			t.Errorf("image %d: got pixel %v, want %d", i, imgs[i].At(0, 0), want)
+		}
+	}
+
+	d, err = newDecoder(bytes.NewReader(pages(sub(offsets[0], uint64(len(b))))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SubIFDImages(); err == nil {
+		t.Error("offset out of bounds: got nil error, want non-nil")
+	}
+}
+
+func TestRawTile(t *testing.T) {
+	d, err := newDecoder(bytes.NewReader(pyramid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for level, n := range []int{8, 4, 2} {
+		data, c, err := d.RawTile(level, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := bytes.Repeat([]byte{byte(n)}, n*n); !bytes.Equal(data, want) || c != Uncompressed {
+			t.Errorf("level %d: got %v and compression %d, want %v and %d", level, data, c, want, Uncompressed)
+		}
+	}
+	for _, tc := range []struct{ level, index int }{{-1, 0}, {3, 0}, {0, 1}, {1, -1}} {
+		if _, _, err := d.RawTile(tc.level, tc.index); err == nil {
+			t.Errorf("level %d, index %d: got nil error, want non-nil", tc.level, tc.index)
+		}
+	}
+
+	m := image.NewGray(image.Rect(0, 0, 40, 20))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate, TileWidth: 32, TileLength: 16}); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = newDecoder(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for i, x := range []int{0, 32} {
+		data, c, err := d.RawTile(0, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != Deflate {
+			t.Errorf("tile %d: compression: got %d, want %d", i, c, Deflate)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The tile on the right edge is padded with zeros.
+		want := make([]byte, 32*16)
+		for y := 0; y < 16; y++ {
+			for tx := 0; tx < 32 && x+tx < 40; tx++ {
+				want[y*32+tx] = m.GrayAt(x+tx, y).Y
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("tile %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	r, err := Open(bytes.NewReader(pyramid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overviews, err := r.Overviews()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadWindow(0, 0, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadWindow(0, 0, 2, 2); err != errClosed {
+		t.Errorf("ReadWindow: got %v, want %v", err, errClosed)
+	}
+	if _, err := overviews[0].ReadWindow(0, 0, 2, 2); err != errClosed {
+		t.Errorf("overview ReadWindow: got %v, want %v", err, errClosed)
+	}
+	if _, err := r.Overviews(); err != errClosed {
+		t.Errorf("Overviews: got %v, want %v", err, errClosed)
+	}
+	// The configuration read by Open remains available.
+	if r.config.Width != 8 {
+		t.Errorf("width: got %d, want 8", r.config.Width)
+	}
+}
+
+func TestDecodeFile(t *testing.T) {
+	for _, name := range []string{
+		"video-001.tiff",
+		"video-001-uncompressed.tiff",
+		"video-001-tile-64x64.tiff",
+		"bw-packbits.tiff",
+	} {
+		want, err := load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := DecodeFile(testdataDir + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.Decode()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		compare(t, want, got)
+		// Decoding again reads the same data.
+		if got, err = r.Decode(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		compare(t, want, got)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Decode(); err != errClosed {
+			t.Errorf("%s: Decode after Close: got %v, want %v", name, err, errClosed)
+		}
+	}
+
+	if _, err := DecodeFile(testdataDir + "no-such-file.tiff"); err == nil {
+		t.Error("missing file: got nil error, want non-nil")
+	}
+	if _, err := DecodeFile(testdataDir + "video-001.png"); err == nil {
+		t.Error("PNG file: got nil error, want non-nil")
+	}
+}
+
+func TestReaderCache(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i / 3)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate, TileWidth: 16, TileLength: 16}); err != nil {
+		t.Fatal(err)
+	}
+	cr := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+	r, err := Open(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Concurrency = 1
+	// Room for two 16x16 tiles.
+	r.SetCacheSize(2 * 16 * 16)
+
+	read := func(x, y int) {
+		w, err := r.ReadWindow(x, y, 4, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compare(t, m.SubImage(image.Rect(x, y, x+4, y+4)), w)
+	}
+	cr.calls = 0
+	read(0, 0)  // Tile 0, missed.
+	read(20, 0) // Tile 1, missed.
+	read(4, 4)  // Tile 0, hit.
+	read(40, 0) // Tile 2, missed, evicts tile 1.
+	read(0, 8)  // Tile 0, hit.
+	read(20, 4) // Tile 1, missed.
+	if hits, misses := r.CacheStats(); hits != 2 || misses != 4 {
+		t.Errorf("got %d hits and %d misses, want 2 and 4", hits, misses)
+	}
+	if cr.calls != 4 {
+		t.Errorf("got %d reads, want 4", cr.calls)
+	}
+
+	// Disabling the cache empties it.
+	r.SetCacheSize(0)
+	cr.calls = 0
+	read(0, 0)
+	if hits, misses := r.CacheStats(); hits != 2 || misses != 4 || cr.calls != 1 {
+		t.Errorf("disabled cache: got %d hits, %d misses and %d reads, want 2, 4 and 1", hits, misses, cr.calls)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// projNames maps the CT_* coordinate transformation codes to the names of
+// the equivalent PROJ projections.
+var projNames = map[int]string{
+	CT_TransverseMercator:           "tmerc",
+	CT_TransvMercator_SouthOriented: "tmerc",
+	CT_ObliqueMercator:              "omerc",
+	CT_Mercator:                     "merc",
+	CT_LambertConfConic_2SP:         "lcc",
+	CT_LambertConfConic_Helmert:     "lcc",
+	CT_LambertAzimEqualArea:         "laea",
+	CT_AlbersEqualArea:              "aea",
+	CT_AzimuthalEquidistant:         "aeqd",
+	CT_EquidistantConic:             "eqdc",
+	CT_Stereographic:                "stere",
+	CT_PolarStereographic:           "stere",
+	CT_ObliqueStereographic:         "sterea",
+	CT_Equirectangular:              "eqc",
+	CT_CassiniSoldner:               "cass",
+	CT_Gnomonic:                     "gnom",
+	CT_MillerCylindrical:            "mill",
+	CT_Orthographic:                 "ortho",
+	CT_Polyconic:                    "poly",
+	CT_Robinson:                     "robin",
+	CT_Sinusoidal:                   "sinu",
+	CT_VanDerGrinten:                "vandg",
+	CT_NewZealandMapGrid:            "nzmg",
+}
+
+// projDatums maps the EPSG codes of common geographic coordinate systems to
+// the PROJ parameters of their datum.
+var projDatums = map[uint]string{
+	4326: "+datum=WGS84",
+	4269: "+datum=NAD83",
+	4267: "+datum=NAD27",
+	4283: "+ellps=GRS80 +towgs84=0,0,0",
+	4258: "+ellps=GRS80 +towgs84=0,0,0",
+	4322: "+ellps=WGS72",
+}
+
+// ellipsoids maps the EPSG codes of common ellipsoids to their semi-major
+// axis, in meters, and inverse flattening.
+var ellipsoids = map[uint][2]float64{
+	7001: {6377563.396, 299.3249646},  // Airy 1830.
+	7003: {6378160, 298.25},           // Australian National Spheroid.
+	7004: {6377397.155, 299.1528128},  // Bessel 1841.
+	7008: {6378206.4, 294.9786982139}, // Clarke 1866.
+	7019: {6378137, 298.257222101},    // GRS 1980.
+	7022: {6378388, 297},              // International 1924.
+	7024: {6378245, 298.3},            // Krassowsky 1940.
+	7030: {6378137, 298.257223563},    // WGS 84.
+	7035: {6371007, 0},                // GRS 1980 authalic sphere.
+	7043: {6378135, 298.26},           // WGS 72.
+	7059: {6378137, 0},                // Popular Visualisation Sphere.
+}
+
+// gcsEllipsoids maps the EPSG codes of common geographic coordinate systems
+// to the codes of their ellipsoids.
+var gcsEllipsoids = map[uint]uint{
+	4326: 7030,
+	4269: 7019,
+	4267: 7008,
+	4283: 7019,
+	4258: 7019,
+	4322: 7043,
+}
+
+// Ellipsoid returns the semi-major axis a, the semi-minor axis b and the
+// inverse flattening invF of the ellipsoid of the keys. The ellipsoid is
+// given by two of the GeogSemiMajorAxisGeoKey, GeogSemiMinorAxisGeoKey and
+// GeogInvFlatteningGeoKey, from which the third is computed, or else by
+// the GeogEllipsoidGeoKey or GeographicTypeGeoKey code of a common
+// ellipsoid. The inverse flattening of a sphere is 0. The axes are in the
+// GeogLinearUnits of the keys for explicit values, and in meters otherwise.
+// ok is false if the ellipsoid is unknown.
+func (k GeoKeys) Ellipsoid() (a, b, invF float64, ok bool) {
+	a, hasA := k.Float(GeogSemiMajorAxisGeoKey)
+	b, hasB := k.Float(GeogSemiMinorAxisGeoKey)
+	invF, hasInvF := k.Float(GeogInvFlatteningGeoKey)
+	switch {
+	case hasA && hasInvF:
+		return a, minorAxis(a, invF), invF, true
+	case hasA && hasB:
+		if a == b {
+			return a, b, 0, true
+		}
+		return a, b, a / (a - b), true
+	case hasB && hasInvF:
+		if invF == 0 {
+			return b, b, 0, true
+		}
+		return b / (1 - 1/invF), b, invF, true
+	}
+	code, _ := k.Uint(GeogEllipsoidGeoKey)
+	if _, known := ellipsoids[code]; !known {
+		gcs, _ := k.Uint(GeographicTypeGeoKey)
+		code = gcsEllipsoids[gcs]
+	}
+	e, known := ellipsoids[code]
+	if !known {
+		return 0, 0, 0, false
+	}
+	return e[0], minorAxis(e[0], e[1]), e[1], true
+}
+
+// minorAxis returns the semi-minor axis of the ellipsoid with semi-major
+// axis a and inverse flattening invF.
+func minorAxis(a, invF float64) float64 {
+	if invF == 0 {
+		return a
+	}
+	return a * (1 - 1/invF)
+}
+
+// linearUnits maps the EPSG codes of common linear units to their size in
+// meters.
+var linearUnits = map[uint]float64{
+	9001: 1,             // Metre.
+	9002: 0.3048,        // Foot.
+	9003: 1200.0 / 3937, // US survey foot.
+	9005: 0.3047972654,  // Clarke's foot.
+	9014: 1.8288,        // Fathom.
+	9030: 1852,          // Nautical mile.
+	9035: 1609.344,      // Statute mile.
+	9036: 1000,          // Kilometre.
+}
+
+// angularUnits maps the EPSG codes of common angular units to their size in
+// degrees.
+var angularUnits = map[uint]float64{
+	9101: 180 / math.Pi,        // Radian.
+	9102: 1,                    // Degree.
+	9103: 1.0 / 60,             // Arc-minute.
+	9104: 1.0 / 3600,           // Arc-second.
+	9105: 0.9,                  // Grad.
+	9106: 0.9,                  // Gon.
+	9109: 180 / math.Pi * 1e-6, // Microradian.
+}
+
+// Units holds the sizes of the units used by GeoKeys.
+type Units struct {
+	// Linear is the size in meters of the ProjLinearUnits, the unit of the
+	// model space of projected coordinate systems, as used by GeoTransform,
+	// and of the false eastings and northings of projections.
+	Linear float64
+	// GeogLinear is the size in meters of the GeogLinearUnits, the unit of
+	// the explicit ellipsoid axes.
+	GeogLinear float64
+	// Angular is the size in degrees of the GeogAngularUnits, the unit of
+	// the model space of geographic coordinate systems and of the angles
+	// of projections.
+	Angular float64
+}
+
+// Units returns the sizes of the units given by the ProjLinearUnitsGeoKey,
+// GeogLinearUnitsGeoKey and GeogAngularUnitsGeoKey. User-defined units
+// (KvUserDefined) are sized by the corresponding size keys. Missing keys
+// default to meters and degrees. An unknown unit is an error.
+func (k GeoKeys) Units() (Units, error) {
+	var u Units
+	var err error
+	if u.Linear, err = k.unit(ProjLinearUnitsGeoKey, ProjLinearUnitSizeGeoKey, linearUnits, 1); err != nil {
+		return Units{}, err
+	}
+	if u.GeogLinear, err = k.unit(GeogLinearUnitsGeoKey, GeogLinearUnitSizeGeoKey, linearUnits, 1); err != nil {
+		return Units{}, err
+	}
+	// The size of a user-defined angular unit is in radians.
+	if u.Angular, err = k.unit(GeogAngularUnitsGeoKey, GeogAngularUnitSizeGeoKey, angularUnits, 180/math.Pi); err != nil {
+		return Units{}, err
+	}
+	return u, nil
+}
+
+// unit returns the size of the unit given by the key id, looked up in
+// sizes or, for a user-defined unit, given by the key sizeID and multiplied
+// by scale. A missing key gives a size of 1.
+func (k GeoKeys) unit(id, sizeID int, sizes map[uint]float64, scale float64) (float64, error) {
+	code, ok := k.Uint(id)
+	if !ok {
+		return 1, nil
+	}
+	if size, ok := sizes[code]; ok {
+		return size, nil
+	}
+	if size, ok := k.Float(sizeID); ok && code == KvUserDefined && size > 0 {
+		return size * scale, nil
+	}
+	return 0, FormatError{Kind: Unsupported, Tag: tGeoKeyDirectory, Detail: fmt.Sprintf("unit %d of GeoKey %d", code, id)}
+}
+
+// projUnits maps the EPSG codes of linear units to their PROJ names.
+var projUnits = map[uint]string{
+	9001: "m",
+	9002: "ft",
+	9003: "us-ft",
+	9036: "km",
+}
+
+// ProjString returns a PROJ (proj4) string describing the coordinate
+// reference system of the keys. A system with an EPSG code, as given by
+// EPSG, is described as +init=epsg:NNNN. Otherwise, the string is built from
+// the model type, the projection parameters, the geographic coordinate
+// system and the linear units. Only the datums of the common geographic
+// coordinate systems are known; other datums are described by their
+// ellipsoid, as returned by Ellipsoid.
+func (k GeoKeys) ProjString() (string, error) {
+	if code, ok := k.EPSG(); ok {
+		return fmt.Sprintf("+init=epsg:%d", code), nil
+	}
+	var b bytes.Buffer
+	add := func(name string, v float64) {
+		fmt.Fprintf(&b, " +%s=%s", name, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+
+	switch model, _ := k.Uint(GTModelTypeGeoKey); model {
+	case ModelTypeGeographic:
+		b.WriteString("+proj=longlat")
+	case ModelTypeGeocentric:
+		b.WriteString("+proj=geocent")
+	default:
+		p, err := k.ProjParams()
+		if err != nil {
+			return "", err
+		}
+		name, ok := projNames[p.CoordTrans]
+		if !ok {
+			return "", FormatError{Kind: Unsupported, Tag: tGeoKeyDirectory, Detail: fmt.Sprintf("coordinate transformation %d", p.CoordTrans)}
+		}
+		b.WriteString("+proj=" + name)
+		switch p.CoordTrans {
+		case CT_LambertConfConic_2SP, CT_AlbersEqualArea, CT_EquidistantConic:
+			add("lat_1", p.StdParallel1)
+			add("lat_2", p.StdParallel2)
+			add("lat_0", p.LatitudeOfOrigin)
+			add("lon_0", p.CentralMeridian)
+		case CT_LambertConfConic_Helmert:
+			// The single standard parallel is the latitude of origin.
+			add("lat_1", p.LatitudeOfOrigin)
+			add("lat_0", p.LatitudeOfOrigin)
+			add("lon_0", p.CentralMeridian)
+			add("k_0", p.ScaleFactor)
+		case CT_ObliqueMercator, CT_ObliqueMercator_Laborde, CT_ObliqueMercator_Rosenmund,
+			CT_ObliqueMercator_Spherical:
+			add("lat_0", p.LatitudeOfOrigin)
+			add("lonc", p.CentralMeridian)
+			add("alpha", p.Azimuth)
+			add("k", p.ScaleFactor)
+		case CT_PolarStereographic:
+			pole := 90.0
+			if p.LatitudeOfOrigin < 0 {
+				pole = -90
+			}
+			add("lat_0", pole)
+			add("lat_ts", p.LatitudeOfOrigin)
+			add("lon_0", p.CentralMeridian)
+			add("k_0", p.ScaleFactor)
+		case CT_Mercator, CT_Equirectangular:
+			if p.StdParallel1 != 0 || p.CoordTrans == CT_Equirectangular {
+				add("lat_ts", p.StdParallel1)
+			} else {
+				add("k", p.ScaleFactor)
+			}
+			add("lat_0", p.LatitudeOfOrigin)
+			add("lon_0", p.CentralMeridian)
+		default:
+			add("lat_0", p.LatitudeOfOrigin)
+			add("lon_0", p.CentralMeridian)
+			add("k", p.ScaleFactor)
+			if p.CoordTrans == CT_TransvMercator_SouthOriented {
+				b.WriteString(" +axis=wsu")
+			}
+		}
+		add("x_0", p.FalseEasting)
+		add("y_0", p.FalseNorthing)
+	}
+
+	gcs, _ := k.Uint(GeographicTypeGeoKey)
+	if datum, ok := projDatums[gcs]; ok {
+		b.WriteString(" " + datum)
+	} else if a, bAxis, invF, ok := k.Ellipsoid(); ok {
+		add("a", a)
+		if invF != 0 {
+			add("rf", invF)
+		} else {
+			add("b", bAxis)
+		}
+	}
+	if model, _ := k.Uint(GTModelTypeGeoKey); model != ModelTypeGeographic {
+		if u, ok := k.Uint(ProjLinearUnitsGeoKey); ok {
+			if name, ok := projUnits[u]; ok {
+				b.WriteString(" +units=" + name)
+			} else if size, ok := k.Float(ProjLinearUnitSizeGeoKey); ok {
+				add("to_meter", size)
+			}
+		}
+	}
+	b.WriteString(" +no_defs")
+	return b.String(), nil
+}
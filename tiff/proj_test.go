@@ -0,0 +1,176 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"math"
+	"testing"
+)
+
+func TestProjString(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		keys map[int]interface{}
+		want string
+	}{{
+		"EPSG code",
+		map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeProjected), ProjectedCSTypeGeoKey: uint(32755)},
+		"+init=epsg:32755",
+	}, {
+		"geographic EPSG code",
+		map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeGeographic), GeographicTypeGeoKey: uint(4326)},
+		"+init=epsg:4326",
+	}, {
+		"user-defined geographic",
+		map[int]interface{}{
+			GTModelTypeGeoKey:       uint(ModelTypeGeographic),
+			GeographicTypeGeoKey:    uint(KvUserDefined),
+			GeogSemiMajorAxisGeoKey: 6378137.0,
+			GeogInvFlatteningGeoKey: 298.257222101,
+		},
+		"+proj=longlat +a=6378137 +rf=298.257222101 +no_defs",
+	}, {
+		"transverse mercator",
+		map[int]interface{}{
+			GTModelTypeGeoKey:          uint(ModelTypeProjected),
+			ProjectedCSTypeGeoKey:      uint(KvUserDefined),
+			GeographicTypeGeoKey:       uint(4326),
+			ProjCoordTransGeoKey:       uint(CT_TransverseMercator),
+			ProjNatOriginLongGeoKey:    147.0,
+			ProjScaleAtNatOriginGeoKey: 0.9996,
+			ProjFalseEastingGeoKey:     500000.0,
+			ProjFalseNorthingGeoKey:    10000000.0,
+			ProjLinearUnitsGeoKey:      uint(9001),
+		},
+		"+proj=tmerc +lat_0=0 +lon_0=147 +k=0.9996 +x_0=500000 +y_0=10000000 +datum=WGS84 +units=m +no_defs",
+	}, {
+		"albers",
+		map[int]interface{}{
+			GTModelTypeGeoKey:         uint(ModelTypeProjected),
+			GeographicTypeGeoKey:      uint(4283),
+			ProjCoordTransGeoKey:      uint(CT_AlbersEqualArea),
+			ProjStdParallel1GeoKey:    -18.0,
+			ProjStdParallel2GeoKey:    -36.0,
+			ProjFalseOriginLongGeoKey: 132.0,
+		},
+		"+proj=aea +lat_1=-18 +lat_2=-36 +lat_0=0 +lon_0=132 +x_0=0 +y_0=0 +ellps=GRS80 +towgs84=0,0,0 +no_defs",
+	}, {
+		"lambert conformal conic in US survey feet",
+		map[int]interface{}{
+			GTModelTypeGeoKey:             uint(ModelTypeProjected),
+			GeographicTypeGeoKey:          uint(4269),
+			ProjCoordTransGeoKey:          uint(CT_LambertConfConic_2SP),
+			ProjStdParallel1GeoKey:        33.0,
+			ProjStdParallel2GeoKey:        45.0,
+			ProjFalseOriginLatGeoKey:      23.0,
+			ProjFalseOriginLongGeoKey:     -96.0,
+			ProjFalseOriginEastingGeoKey:  1968500.0,
+			ProjFalseOriginNorthingGeoKey: 0.0,
+			ProjLinearUnitsGeoKey:         uint(9003),
+		},
+		"+proj=lcc +lat_1=33 +lat_2=45 +lat_0=23 +lon_0=-96 +x_0=600000 +y_0=0 +datum=NAD83 +units=us-ft +no_defs",
+	}, {
+		"polar stereographic",
+		map[int]interface{}{
+			GTModelTypeGeoKey:              uint(ModelTypeProjected),
+			GeographicTypeGeoKey:           uint(4326),
+			ProjCoordTransGeoKey:           uint(CT_PolarStereographic),
+			ProjStraightVertPoleLongGeoKey: 0.0,
+			ProjNatOriginLatGeoKey:         -71.0,
+		},
+		"+proj=stere +lat_0=-90 +lat_ts=-71 +lon_0=0 +k_0=1 +x_0=0 +y_0=0 +datum=WGS84 +no_defs",
+	}} {
+		got, err := GeoKeys{Keys: tc.keys}.ProjString()
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tc.desc, got, tc.want)
+		}
+	}
+
+	if _, err := (GeoKeys{Keys: map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeProjected)}}).ProjString(); err == nil {
+		t.Error("no projection: got nil error, want non-nil")
+	}
+}
+
+func TestUnits(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		keys map[int]interface{}
+		want Units
+	}{{
+		"defaults",
+		map[int]interface{}{},
+		Units{Linear: 1, GeogLinear: 1, Angular: 1},
+	}, {
+		"us survey feet and grads",
+		map[int]interface{}{
+			ProjLinearUnitsGeoKey:  uint(9003),
+			GeogAngularUnitsGeoKey: uint(9105),
+		},
+		Units{Linear: 1200.0 / 3937, GeogLinear: 1, Angular: 0.9},
+	}, {
+		"user-defined",
+		map[int]interface{}{
+			ProjLinearUnitsGeoKey:     uint(KvUserDefined),
+			ProjLinearUnitSizeGeoKey:  2.0,
+			GeogLinearUnitsGeoKey:     uint(9036),
+			GeogAngularUnitsGeoKey:    uint(KvUserDefined),
+			GeogAngularUnitSizeGeoKey: math.Pi / 180,
+		},
+		Units{Linear: 2, GeogLinear: 1000, Angular: 1},
+	}} {
+		got, err := GeoKeys{Keys: tc.keys}.Units()
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.desc, got, tc.want)
+		}
+	}
+
+	for _, keys := range []map[int]interface{}{
+		{ProjLinearUnitsGeoKey: uint(9999)},
+		{GeogAngularUnitsGeoKey: uint(KvUserDefined)},
+	} {
+		_, err := GeoKeys{Keys: keys}.Units()
+		if e, ok := err.(FormatError); !ok || e.Kind != Unsupported {
+			t.Errorf("%v: got %v, want an Unsupported error", keys, err)
+		}
+	}
+}
+
+func TestEllipsoid(t *testing.T) {
+	const wgs84A, wgs84InvF = 6378137, 298.257223563
+	wgs84B := wgs84A * (1 - 1/wgs84InvF)
+	for _, tc := range []struct {
+		desc       string
+		keys       map[int]interface{}
+		a, b, invF float64
+		ok         bool
+	}{
+		{"axis and flattening", map[int]interface{}{GeogSemiMajorAxisGeoKey: float64(wgs84A), GeogInvFlatteningGeoKey: wgs84InvF}, wgs84A, wgs84B, wgs84InvF, true},
+		{"axes", map[int]interface{}{GeogSemiMajorAxisGeoKey: float64(wgs84A), GeogSemiMinorAxisGeoKey: wgs84B}, wgs84A, wgs84B, wgs84InvF, true},
+		{"minor axis and flattening", map[int]interface{}{GeogSemiMinorAxisGeoKey: wgs84B, GeogInvFlatteningGeoKey: wgs84InvF}, wgs84A, wgs84B, wgs84InvF, true},
+		{"sphere", map[int]interface{}{GeogSemiMajorAxisGeoKey: 6371000.0, GeogSemiMinorAxisGeoKey: 6371000.0}, 6371000, 6371000, 0, true},
+		{"ellipsoid code", map[int]interface{}{GeogEllipsoidGeoKey: uint(7030)}, wgs84A, wgs84B, wgs84InvF, true},
+		{"geographic code", map[int]interface{}{GeographicTypeGeoKey: uint(4326)}, wgs84A, wgs84B, wgs84InvF, true},
+		{"one value", map[int]interface{}{GeogSemiMajorAxisGeoKey: float64(wgs84A)}, 0, 0, 0, false},
+		{"unknown code", map[int]interface{}{GeogEllipsoidGeoKey: uint(KvUserDefined)}, 0, 0, 0, false},
+	} {
+		a, b, invF, ok := GeoKeys{Keys: tc.keys}.Ellipsoid()
+		if ok != tc.ok || !approxEqual(a, tc.a) || !approxEqual(b, tc.b) || !approxEqual(invF, tc.invF) {
+			t.Errorf("%s: got %v, %v, %v, %t, want %v, %v, %v, %t", tc.desc, a, b, invF, ok, tc.a, tc.b, tc.invF, tc.ok)
+		}
+	}
+}
+
+// approxEqual reports whether x and y are equal within a relative error of 1e-9.
+func approxEqual(x, y float64) bool {
+	return math.Abs(x-y) <= 1e-9*math.Abs(y)
+}
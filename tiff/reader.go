@@ -10,38 +10,78 @@ package tiff // import "github.com/prl900/image/tiff"
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
 	"io/ioutil"
 	"math"
-	"strconv"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 
 	//"github.com/prl900/geowarp"
+	"github.com/prl900/image/tiff/ccitt"
 	"github.com/prl900/image/tiff/lzw"
 	"github.com/prl900/scimage"
 	"github.com/prl900/scimage/scicolor"
 )
 
-// A FormatError reports that the input is not a valid TIFF image.
-type FormatError string
+// An ErrorKind classifies the errors reported by a FormatError.
+type ErrorKind int
+
+const (
+	Malformed   ErrorKind = iota // The structure of the file is invalid.
+	BadHeader                    // The file does not start with a TIFF header.
+	BadTag                       // The value of a tag is invalid.
+	MissingTag                   // A required tag is missing.
+	Truncated                    // The file ends before the data it refers to.
+	Unsupported                  // A valid but unimplemented feature is used.
+	UnsupportedCompression
+	UnsupportedPhotometric
+	TooLarge // The image exceeds the size limit of the decoder.
+)
+
+// DefaultMaxImageBytes is the default limit on the size of the uncompressed
+// pixel data of the images that are decoded.
+const DefaultMaxImageBytes = 1 << 30
+
+// A FormatError reports that the input is not a valid TIFF image, that it
+// uses a feature that is not implemented, or that it is too large to decode.
+type FormatError struct {
+	Kind ErrorKind
+	// Tag is the tag of the IFD entry the error is about, or zero if the
+	// error is not about a single entry.
+	Tag    int
+	Detail string
+}
 
 func (e FormatError) Error() string {
-	return "tiff: invalid format: " + string(e)
+	s := "tiff: invalid format: " + e.Detail
+	if e.Kind >= Unsupported {
+		s = "tiff: unsupported feature: " + e.Detail
+	}
+	if e.Tag != 0 {
+		s += fmt.Sprintf(" (tag %d)", e.Tag)
+	}
+	return s
 }
 
-// An UnsupportedError reports that the input uses a valid but
-// unimplemented feature.
-type UnsupportedError string
+var errNoPixels = FormatError{Kind: Truncated, Detail: "not enough pixel data"}
 
-func (e UnsupportedError) Error() string {
-	return "tiff: unsupported feature: " + string(e)
+// truncated converts the errors of reads past the end of the input into
+// FormatErrors, and returns other errors unchanged.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return FormatError{Kind: Truncated, Detail: "unexpected end of file"}
+	}
+	return err
 }
 
-var errNoPixels = FormatError("not enough pixel data")
-
 type decoder struct {
 	r         io.ReaderAt
 	byteOrder binary.ByteOrder
@@ -50,10 +90,47 @@ type decoder struct {
 	sFormat   sampleFormat
 	bpp       uint
 	features  map[int][]uint
+	bigTIFF   bool
+	ifdOffset int64 // Offset of the IFD of the image in the file.
+	nextIFD   int64 // Offset of the next IFD in the file, or 0.
+	overviews []Overview
 	palette   []color.Color
-	noData    float64
 	pixScale  []float64
 	tiePoint  []float64
+	transform []float64
+	geoDouble []float64
+	ifd       []byte // The raw entries of the IFD.
+	cache     *tileCache
+	ctx       context.Context // Cancels the decoding if not nil.
+	strict    bool            // Whether IFD entries must be sorted by tag.
+
+	// oldJPEG is the image of a file with old-style JPEG compression,
+	// which is decoded once for all strips and tiles.
+	oldJPEGOnce sync.Once
+	oldJPEG     image.Image
+	oldJPEGErr  error
+
+	// ApplyOrientation determines whether Decode transforms the image
+	// according to its Orientation tag. It is true by default.
+	ApplyOrientation bool
+
+	// Concurrency is the maximum number of strips or tiles decompressed
+	// concurrently when decoding the image. If zero or negative, the value
+	// of runtime.GOMAXPROCS is used.
+	Concurrency int
+
+	// MaxImageBytes is the maximum size in bytes of the uncompressed pixel
+	// data of an image, or of a strip or tile, that is decoded. Larger
+	// images are rejected before any memory is allocated for them, which
+	// protects against small files that claim huge images. If zero,
+	// DefaultMaxImageBytes is used. If negative, there is no limit.
+	MaxImageBytes int64
+
+	// Progress, if not nil, is called after each strip or tile is decoded,
+	// with the number of strips or tiles decoded so far and the number
+	// of those that are read in total. It is called from the goroutine
+	// that decodes the image, never concurrently.
+	Progress func(done, total int)
 
 	buf   []byte
 	off   int    // Current offset in buf.
@@ -71,58 +148,174 @@ func (d *decoder) firstVal(tag int) uint {
 	return f[0]
 }
 
-// ifdUint decodes the IFD entry in p, which must be of the Byte, Short
-// or Long type, and returns the decoded uint values.
-func (d *decoder) ifdUint(p []byte) (u []uint, err error) {
-	var raw []byte
-	if len(p) < ifdLen {
-		return nil, FormatError("bad IFD entry")
+// asciiVal returns the string held by the ASCII features entry with the
+// given tag, without its terminating NUL, and whether the tag exists.
+func (d *decoder) asciiVal(tag int) (string, bool) {
+	f, ok := d.features[tag]
+	if !ok {
+		return "", false
+	}
+	b := make([]byte, len(f))
+	for i, v := range f {
+		b[i] = byte(v)
+	}
+	return string(bytes.TrimRight(b, "\x00")), true
+}
+
+// blockSamples returns the number of samples per pixel stored in each strip
+// or tile, which is 1 for images with planar storage.
+func (d *decoder) blockSamples() int {
+	if d.firstVal(tPlanarConfiguration) == pcPlanar {
+		return 1
+	}
+	return len(d.features[tBitsPerSample])
+}
+
+// ifdLen returns the length of an IFD entry in bytes.
+func (d *decoder) ifdLen() int {
+	if d.bigTIFF {
+		return ifdLenBig
+	}
+	return ifdLen
+}
+
+// offsetLen returns the length of a file offset in bytes.
+func (d *decoder) offsetLen() int {
+	if d.bigTIFF {
+		return 8
+	}
+	return 4
+}
+
+// size returns the size of the file being decoded, and whether it is known.
+// It is known for readers with a Size method, such as *bytes.Reader and
+// *io.SectionReader, and for readers with a Stat method, such as *os.File.
+func (d *decoder) size() (int64, bool) {
+	switch r := d.r.(type) {
+	case interface {
+		Size() int64
+	}:
+		return r.Size(), true
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		if fi, err := r.Stat(); err == nil {
+			return fi.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// offset decodes the file offset in p, which is 8 bytes long in BigTIFF
+// files and 4 bytes long otherwise.
+func (d *decoder) offset(p []byte) int64 {
+	if d.bigTIFF {
+		return int64(d.byteOrder.Uint64(p))
+	}
+	return int64(d.byteOrder.Uint32(p))
+}
+
+// ifdData returns the tag, data type, number of values and raw data of the
+// IFD entry in p, reading the data from the file if it does not fit in the
+// entry.
+func (d *decoder) ifdData(p []byte) (tag int, datatype uint16, count uint64, raw []byte, err error) {
+	if len(p) < d.ifdLen() {
+		return 0, 0, 0, nil, FormatError{Kind: Malformed, Detail: "bad IFD entry"}
 	}
 
-	datatype := d.byteOrder.Uint16(p[2:4])
-	if dt := int(datatype); dt <= 0 || dt >= len(lengths) {
-		return nil, UnsupportedError("IFD entry datatype")
+	tag = int(d.byteOrder.Uint16(p[0:2]))
+	datatype = d.byteOrder.Uint16(p[2:4])
+	if dt := int(datatype); dt <= 0 || dt >= len(lengths) || lengths[dt] == 0 {
+		return 0, 0, 0, nil, FormatError{Kind: Unsupported, Tag: tag, Detail: "IFD entry datatype"}
 	}
 
-	count := d.byteOrder.Uint32(p[4:8])
-	if count > math.MaxInt32/lengths[datatype] {
-		return nil, FormatError("IFD data too large")
+	// In BigTIFF files, the count and the value or pointer to it take
+	// 8 bytes each instead of 4.
+	var val []byte
+	if d.bigTIFF {
+		count, val = d.byteOrder.Uint64(p[4:12]), p[12:20]
+	} else {
+		count, val = uint64(d.byteOrder.Uint32(p[4:8])), p[8:12]
 	}
-	if datalen := lengths[datatype] * count; datalen > 4 {
+	if count > math.MaxInt32/uint64(lengths[datatype]) {
+		return 0, 0, 0, nil, FormatError{Kind: BadTag, Tag: tag, Detail: "IFD data too large"}
+	}
+	if datalen := uint64(lengths[datatype]) * count; datalen > uint64(len(val)) {
 		// The IFD contains a pointer to the real value.
 		raw = make([]byte, datalen)
-		_, err = d.r.ReadAt(raw, int64(d.byteOrder.Uint32(p[8:12])))
+		if _, err = d.r.ReadAt(raw, d.offset(val)); err != nil {
+			return 0, 0, 0, nil, truncated(err)
+		}
 	} else {
-		raw = p[8 : 8+datalen]
+		raw = val[:datalen]
 	}
+	return tag, datatype, count, raw, nil
+}
+
+// ifdUint decodes the IFD entry in p, which must be of the Byte, Short,
+// Long, Long8, IFD, IFD8, Rational or Double type, and returns the decoded
+// uint values.
+func (d *decoder) ifdUint(p []byte) (u []uint, err error) {
+	tag, datatype, count, raw, err := d.ifdData(p)
 	if err != nil {
 		return nil, err
 	}
 
 	u = make([]uint, count)
 	switch datatype {
-	case dtByte, dtASCII:
-		for i := uint32(0); i < count; i++ {
+	case dtByte, dtASCII, dtUndefined:
+		for i := uint64(0); i < count; i++ {
 			u[i] = uint(raw[i])
 		}
 	case dtShort:
-		for i := uint32(0); i < count; i++ {
+		for i := uint64(0); i < count; i++ {
 			u[i] = uint(d.byteOrder.Uint16(raw[2*i : 2*(i+1)]))
 		}
-	case dtLong:
-		for i := uint32(0); i < count; i++ {
+	case dtLong, dtIFD:
+		for i := uint64(0); i < count; i++ {
 			u[i] = uint(d.byteOrder.Uint32(raw[4*i : 4*(i+1)]))
 		}
-	case dtFloat64:
-		for i := uint32(0); i < count; i++ {
+	case dtFloat64, dtLong8, dtIFD8:
+		for i := uint64(0); i < count; i++ {
 			u[i] = uint(d.byteOrder.Uint64(raw[8*i : 8*(i+1)]))
 		}
+	case dtRational:
+		// Each value is returned as its numerator and denominator.
+		u = make([]uint, 2*count)
+		for i := uint64(0); i < 2*count; i++ {
+			u[i] = uint(d.byteOrder.Uint32(raw[4*i : 4*(i+1)]))
+		}
 	default:
-		return nil, UnsupportedError("data type")
+		return nil, FormatError{Kind: Unsupported, Tag: tag, Detail: "data type"}
 	}
 	return u, nil
 }
 
+// ifdFloat64 decodes the IFD entry in p, which must be of the Float or
+// Double type, and returns the decoded float64 values. Unlike ifdUint, it
+// does not truncate them where uint has 32 bits.
+func (d *decoder) ifdFloat64(p []byte) ([]float64, error) {
+	tag, datatype, count, raw, err := d.ifdData(p)
+	if err != nil {
+		return nil, err
+	}
+
+	f := make([]float64, count)
+	switch datatype {
+	case dtFloat32:
+		for i := range f {
+			f[i] = float64(math.Float32frombits(d.byteOrder.Uint32(raw[4*i : 4*(i+1)])))
+		}
+	case dtFloat64:
+		for i := range f {
+			f[i] = math.Float64frombits(d.byteOrder.Uint64(raw[8*i : 8*(i+1)]))
+		}
+	default:
+		return nil, FormatError{Kind: Unsupported, Tag: tag, Detail: "data type"}
+	}
+	return f, nil
+}
+
 // parseIFD decides whether the the IFD entry in p is "interesting" and
 // stows away the data in the decoder. It returns the tag number of the
 // entry and an error, if any.
@@ -130,11 +323,22 @@ func (d *decoder) parseIFD(p []byte) (int, error) {
 	tag := d.byteOrder.Uint16(p[0:2])
 
 	switch tag {
-	case tBitsPerSample,
+	case tNewSubfileType,
+		tBitsPerSample,
 		tExtraSamples,
 		tPhotometricInterpretation,
 		tCompression,
+		tInkSet,
+		tInkNames,
+		tNumberOfInks,
+		tPlanarConfiguration,
 		tPredictor,
+		tFillOrder,
+		tT4Options,
+		tT6Options,
+		tJPEGTables,
+		tJPEGInterchangeFormat,
+		tJPEGInterchangeFormatLength,
 		tStripOffsets,
 		tStripByteCounts,
 		tRowsPerStrip,
@@ -143,71 +347,59 @@ func (d *decoder) parseIFD(p []byte) (int, error) {
 		tTileOffsets,
 		tTileByteCounts,
 		tImageLength,
-		tImageWidth:
+		tImageWidth,
+		tSamplesPerPixel,
+		tGeoKeyDirectory,
+		tGeoASCIIParams,
+		tGDALMetadata,
+		tGDALNoData,
+		tOrientation,
+		tSubIFDs,
+		tYCbCrSubSampling:
 		val, err := d.ifdUint(p)
 		if err != nil {
 			return 0, err
 		}
 		d.features[int(tag)] = val
-	case tOrientation,
-		tXResolution,
+	case tXResolution,
 		tYResolution,
-		tXPosition,
-		tYPosition,
 		tResolutionUnit:
+		// The resolution does not affect decoding, so a bad entry is
+		// ignored rather than reported.
+		if val, err := d.ifdUint(p); err == nil {
+			d.features[int(tag)] = val
+		}
+	case tXPosition,
+		tYPosition:
 		d.ifdUint(p)
 
-	case tModelTiepoint:
-		val, err := d.ifdUint(p)
+	case tGeoDoubleParams:
+		val, err := d.ifdFloat64(p)
 		if err != nil {
 			return 0, err
 		}
+		d.geoDouble = val
 
-		d.tiePoint = make([]float64, len(val))
-		for i, v := range val {
-			d.tiePoint[i] = math.Float64frombits(uint64(v))
-		}
-
-	//* TODO: Need to find Projection info
-	case tGeoKeyDirectory:
-		fmt.Println("BBB")
-		val, err := d.ifdUint(p)
+	case tModelTiepoint:
+		val, err := d.ifdFloat64(p)
 		if err != nil {
 			return 0, err
 		}
-		if len(val)%4 != 0 {
-			return 0, err
-		}
-		fmt.Println("AAA", len(val))
-		for i := 0; i < (len(val) / 4); i++ {
-			fmt.Printf("KeyID: %d, TIFFTagLocation: %d, Count: %d, Value_Offset: %d\n", val[i*4], val[(i*4)+1], val[(i*4)+2], val[(i*4)+3])
-		}
+		d.tiePoint = val
 
 	case tModelPixelScale:
-		val, err := d.ifdUint(p)
+		val, err := d.ifdFloat64(p)
 		if err != nil {
 			return 0, err
 		}
+		d.pixScale = val
 
-		d.pixScale = make([]float64, len(val))
-		for i, v := range val {
-			d.pixScale[i] = math.Float64frombits(uint64(v))
-		}
-
-	case tGDALNoData:
-		val, err := d.ifdUint(p)
-		if err != nil {
-			return 0, err
-		}
-		str := make([]byte, len(val))
-		for i, v := range val {
-			str[i] = byte(v)
-		}
-		f, err := strconv.ParseFloat(string(bytes.Trim(str, "\x00")), 64)
+	case tModelTransformation:
+		val, err := d.ifdFloat64(p)
 		if err != nil {
 			return 0, err
 		}
-		d.noData = f
+		d.transform = val
 
 	case tColorMap:
 		val, err := d.ifdUint(p)
@@ -215,8 +407,8 @@ func (d *decoder) parseIFD(p []byte) (int, error) {
 			return 0, err
 		}
 		numcolors := len(val) / 3
-		if len(val)%3 != 0 || numcolors <= 0 || numcolors > 256 {
-			return 0, FormatError("bad ColorMap length")
+		if len(val)%3 != 0 || numcolors <= 0 || numcolors > 1<<16 {
+			return 0, FormatError{Kind: BadTag, Tag: tColorMap, Detail: "bad ColorMap length"}
 		}
 		d.palette = make([]color.Color, numcolors)
 		for i := 0; i < numcolors; i++ {
@@ -233,6 +425,7 @@ func (d *decoder) parseIFD(p []byte) (int, error) {
 			return 0, err
 		}
 		d.sFormat = sampleFormat(val[0])
+		d.features[int(tag)] = val
 	}
 	return int(tag), nil
 }
@@ -269,76 +462,646 @@ func minInt(a, b int) int {
 	return b
 }
 
-// decode decodes the raw data of an image.
-// It reads from d.buf and writes the strip or tile into dst.
-func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
-	d.off = 0
+// unpremultiply returns v, which is premultiplied by the alpha value a,
+// divided by a.
+func unpremultiply(v, a uint8) uint8 {
+	if v >= a {
+		return 0xff
+	}
+	return uint8(uint32(v) * 0xff / uint32(a))
+}
+
+func maxInt(a, b int) int {
+	if a >= b {
+		return a
+	}
+	return b
+}
 
+// unpredict reverses the differencing predictor, if any, applied to the
+// strip or tile in buf, which holds height rows of width pixels.
+func (d *decoder) unpredict(buf []byte, width, height int) error {
+	// The predictors are defined for the compression schemes that benefit
+	// from them, and are invalid with others, such as JPEG.
+	if pr := d.firstVal(tPredictor); pr > prNone {
+		switch c := d.firstVal(tCompression); c {
+		case cLZW, cDeflate, cDeflateOld, cZstd:
+		case cNone, 0:
+			return FormatError{Kind: BadTag, Tag: tPredictor, Detail: "predictor with uncompressed data"}
+		default:
+			return FormatError{Kind: BadTag, Tag: tPredictor, Detail: fmt.Sprintf("predictor with compression value %d", c)}
+		}
+	}
 	// Apply horizontal predictor if necessary.
 	// In this case, p contains the color difference to the preceding pixel.
 	// See page 64-65 of the spec.
 	if d.firstVal(tPredictor) == prHorizontal {
 		switch d.bpp {
+		case 32:
+			var off int
+			n := 4 * d.blockSamples() // bytes per sample times samples per pixel
+			for y := 0; y < height; y++ {
+				off += n
+				for x := 0; x < (width-1)*n; x += 4 {
+					if off+4 > len(buf) {
+						return errNoPixels
+					}
+					v0 := d.byteOrder.Uint32(buf[off-n : off-n+4])
+					v1 := d.byteOrder.Uint32(buf[off : off+4])
+					d.byteOrder.PutUint32(buf[off:off+4], v1+v0)
+					off += 4
+				}
+			}
 		case 16:
 			var off int
-			n := 2 * len(d.features[tBitsPerSample]) // bytes per sample times samples per pixel
-			for y := ymin; y < ymax; y++ {
+			n := 2 * d.blockSamples() // bytes per sample times samples per pixel
+			for y := 0; y < height; y++ {
 				off += n
-				for x := 0; x < (xmax-xmin-1)*n; x += 2 {
-					if off+2 > len(d.buf) {
+				for x := 0; x < (width-1)*n; x += 2 {
+					if off+2 > len(buf) {
 						return errNoPixels
 					}
-					v0 := d.byteOrder.Uint16(d.buf[off-n : off-n+2])
-					v1 := d.byteOrder.Uint16(d.buf[off : off+2])
-					d.byteOrder.PutUint16(d.buf[off:off+2], v1+v0)
+					v0 := d.byteOrder.Uint16(buf[off-n : off-n+2])
+					v1 := d.byteOrder.Uint16(buf[off : off+2])
+					d.byteOrder.PutUint16(buf[off:off+2], v1+v0)
 					off += 2
 				}
 			}
 		case 8:
 			var off int
-			n := 1 * len(d.features[tBitsPerSample]) // bytes per sample times samples per pixel
-			for y := ymin; y < ymax; y++ {
+			n := 1 * d.blockSamples() // bytes per sample times samples per pixel
+			for y := 0; y < height; y++ {
 				off += n
-				for x := 0; x < (xmax-xmin-1)*n; x++ {
-					if off >= len(d.buf) {
+				for x := 0; x < (width-1)*n; x++ {
+					if off >= len(buf) {
 						return errNoPixels
 					}
-					d.buf[off] += d.buf[off-n]
+					buf[off] += buf[off-n]
 					off++
 				}
 			}
-		case 1:
-			return UnsupportedError("horizontal predictor with 1 BitsPerSample")
+		default:
+			if d.bpp%8 != 0 {
+				return FormatError{Kind: Unsupported, Tag: tPredictor, Detail: fmt.Sprintf("horizontal predictor with %d BitsPerSample", d.bpp)}
+			}
+		}
+	}
+
+	// The floating point predictor splits the bytes of the samples of a row
+	// into planes, from the most to the least significant byte, and then
+	// applies horizontal differencing to the bytes of the row.
+	if d.firstVal(tPredictor) == prFloatingPoint {
+		bps := int(d.bpp / 8)
+		if d.sFormat != ieeefpSample || bps < 2 {
+			return FormatError{Kind: BadTag, Tag: tPredictor, Detail: "floating point predictor with non floating point samples"}
+		}
+		spp := d.blockSamples()
+		wc := width * spp // Samples per row.
+		n := wc * bps
+		if n*height > len(buf) {
+			return errNoPixels
+		}
+		tmp := make([]byte, n)
+		for y := 0; y < height; y++ {
+			row := buf[y*n : (y+1)*n]
+			for i := spp; i < n; i++ {
+				row[i] += row[i-spp]
+			}
+			copy(tmp, row)
+			for i := 0; i < wc; i++ {
+				for b := 0; b < bps; b++ {
+					if d.byteOrder == binary.BigEndian {
+						row[i*bps+b] = tmp[b*wc+i]
+					} else {
+						row[i*bps+b] = tmp[(bps-b-1)*wc+i]
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// planes returns the strips or tiles of each sample plane of the image.
+// Images with chunky storage have a single plane.
+func (d *decoder) planes() ([][]block, error) {
+	n := 1
+	if d.firstVal(tPlanarConfiguration) == pcPlanar {
+		n = len(d.features[tBitsPerSample])
+	}
+	planes := make([][]block, n)
+	for p := range planes {
+		var err error
+		if planes[p], err = d.blocks(p); err != nil {
+			return nil, err
+		}
+	}
+	return planes, nil
+}
+
+// readBlock decompresses the i'th strip or tile of each of the given planes,
+// reversing the predictor. The samples of planar images are interleaved, so
+// that the returned buffer holds the pixels with chunky storage. The blocks
+// of Readers go through their cache, so the buffer must not be modified.
+func (d *decoder) readBlock(planes [][]block, i int) ([]byte, error) {
+	if d.cache == nil {
+		return d.readBlockData(planes, i)
+	}
+	k := cacheKey{d.ifdOffset, i}
+	if buf, ok := d.cache.get(k); ok {
+		return buf, nil
+	}
+	buf, err := d.readBlockData(planes, i)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(k, buf)
+	return buf, nil
+}
+
+// readBlockData is like readBlock, without the cache.
+func (d *decoder) readBlockData(planes [][]block, i int) ([]byte, error) {
+	b := planes[0][i]
+	w, h := b.rect.Dx(), b.rect.Dy()
+	if len(planes) == 1 {
+		buf, err := d.decompress(b)
+		if err != nil {
+			return nil, err
+		}
+		return buf, d.unpredict(buf, w, h)
+	}
+
+	if d.bpp%8 != 0 {
+		return nil, FormatError{Kind: Unsupported, Tag: tPlanarConfiguration, Detail: fmt.Sprintf("planar storage with BitsPerSample of %v", d.bpp)}
+	}
+	bps, spp := int(d.bpp/8), len(planes)
+	buf := make([]byte, w*h*spp*bps)
+	for p := range planes {
+		pb, err := d.decompress(planes[p][i])
+		if err != nil {
+			return nil, err
+		}
+		if err = d.unpredict(pb, w, h); err != nil {
+			return nil, err
+		}
+		if len(pb) < w*h*bps {
+			return nil, errNoPixels
+		}
+		for j := 0; j < w*h; j++ {
+			copy(buf[(j*spp+p)*bps:], pb[j*bps:(j+1)*bps])
+		}
+	}
+	return buf, nil
+}
+
+// readBlocks decompresses the strips or tiles with the given indices, and
+// calls fn with each of them in order. Up to d.Concurrency blocks are
+// decompressed concurrently, but fn is always called from the calling
+// goroutine. readBlocks stops at the first error, returned either by a
+// decompression or by fn.
+func (d *decoder) readBlocks(planes [][]block, indices []int, fn func(i int, buf []byte) error) error {
+	workers := d.Concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	// A buffer grows as it is read, so it cannot be shared between
+	// goroutines.
+	if _, ok := d.r.(*buffer); ok {
+		workers = 1
+	}
+	workers = minInt(workers, len(indices))
+	if workers <= 1 {
+		for k, i := range indices {
+			if err := d.canceled(); err != nil {
+				return err
+			}
+			buf, err := d.readBlock(planes, i)
+			if err != nil {
+				return err
+			}
+			if err = fn(i, buf); err != nil {
+				return err
+			}
+			d.progress(k+1, len(indices))
+		}
+		return nil
+	}
+
+	type result struct {
+		buf []byte
+		err error
+	}
+	results := make([]chan result, len(indices))
+	for k := range results {
+		results[k] = make(chan result, 1)
+	}
+	// Blocks are decompressed ahead of the one being passed to fn by at
+	// most 2*workers blocks, which bounds the memory held by the results.
+	sem := make(chan struct{}, 2*workers)
+	// The workers stop taking blocks once readBlocks returns, which it does
+	// as soon as the decoding is canceled. The results channels are
+	// buffered, so that the blocks being decompressed are dropped. The
+	// workers still read d.r, so readBlocks waits for them to finish the
+	// blocks they hold before the file may be closed.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	done := make(chan struct{})
+	defer close(done)
+	var canceled <-chan struct{}
+	if d.ctx != nil {
+		canceled = d.ctx.Done()
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for k := range indices {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- k:
+			case <-done:
+				return
+			}
+		}
+	}()
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				buf, err := d.readBlock(planes, indices[k])
+				results[k] <- result{buf, err}
+			}
+		}()
+	}
+	for k, i := range indices {
+		var r result
+		select {
+		case r = <-results[k]:
+		case <-canceled:
+			return d.ctx.Err()
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if err := fn(i, r.buf); err != nil {
+			return err
+		}
+		d.progress(k+1, len(indices))
+		<-sem
+	}
+	return nil
+}
+
+// progress reports the number of strips or tiles decoded to d.Progress.
+func (d *decoder) progress(done, total int) {
+	if d.Progress != nil {
+		d.Progress(done, total)
+	}
+}
+
+// Resolution returns the number of pixels per unit in the horizontal and
+// vertical directions, and their unit.
+func (d *decoder) Resolution() (x, y float64, unit ResolutionUnit, err error) {
+	switch d.firstVal(tResolutionUnit) {
+	case resNone:
+		unit = NoResolutionUnit
+	case resPerCM:
+		unit = PerCM
+	}
+	xr, yr := d.features[tXResolution], d.features[tYResolution]
+	if len(xr) < 2 || len(yr) < 2 {
+		return 0, 0, unit, FormatError{Kind: MissingTag, Detail: "XResolution or YResolution tag missing"}
+	}
+	if xr[1] == 0 || yr[1] == 0 {
+		return 0, 0, unit, FormatError{Kind: BadTag, Detail: "zero resolution denominator"}
+	}
+	return float64(xr[0]) / float64(xr[1]), float64(yr[0]) / float64(yr[1]), unit, nil
+}
+
+// ColorMap returns the palette stored in the ColorMap tag, with its 16-bit
+// components scaled down to 8 bits. The color map must hold one entry per
+// possible sample value, that is 2^BitsPerSample entries, for up to 16 bits
+// per sample.
+func (d *decoder) ColorMap() (color.Palette, error) {
+	if d.palette == nil {
+		return nil, FormatError{Kind: MissingTag, Tag: tColorMap, Detail: "ColorMap tag missing"}
+	}
+	if d.bpp > 16 || len(d.palette) != 1<<d.bpp {
+		return nil, FormatError{Kind: BadTag, Tag: tColorMap, Detail: "bad ColorMap length"}
+	}
+	p := make(color.Palette, len(d.palette))
+	for i, c := range d.palette {
+		c := c.(color.RGBA64)
+		p[i] = color.RGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), 0xff}
+	}
+	return p, nil
+}
+
+// InkNames returns the names of the inks of a separated (usually CMYK)
+// image, as given by the InkNames tag, in the order of the samples of the
+// pixels. Images of other inks than CMYK, or of more than four inks and an
+// alpha sample, cannot be decoded with Decode, but each ink can be read as
+// a band, such as with Band.
+func (d *decoder) InkNames() ([]string, error) {
+	s, ok := d.asciiVal(tInkNames)
+	if !ok {
+		return nil, FormatError{Kind: MissingTag, Tag: tInkNames, Detail: "InkNames tag missing"}
+	}
+	names := strings.Split(s, "\x00")
+	// An empty NumberOfInks entry counts as zero inks.
+	if _, ok := d.features[tNumberOfInks]; ok {
+		if n := d.firstVal(tNumberOfInks); int(n) != len(names) {
+			return nil, FormatError{Kind: BadTag, Tag: tInkNames, Detail: fmt.Sprintf("%d ink names for NumberOfInks %d", len(names), n)}
+		}
+	}
+	return names, nil
+}
+
+// ExtraSamples returns the meaning of each of the extra samples of the
+// pixels, as given by the ExtraSamples tag. Decode returns an image.RGBA or
+// image.RGBA64 for RGB images with an associated alpha sample, and an
+// image.NRGBA or image.NRGBA64 for RGB images with an unassociated one.
+func (d *decoder) ExtraSamples() []ExtraSample {
+	f := d.features[tExtraSamples]
+	if len(f) == 0 {
+		return nil
+	}
+	s := make([]ExtraSample, len(f))
+	for i, v := range f {
+		s[i] = ExtraSample(v)
+	}
+	return s
+}
+
+// SampleFormats returns the format of each of the samples of the pixels, as
+// given by the SampleFormat tag: 1 for unsigned integers, 2 for signed
+// integers, 3 for floating point numbers and 4 for undefined data. A single
+// value applies to all the samples, and unsigned integers are the default.
+// Decode only supports images whose samples all have the same format, but
+// the bands of other images can be read with Band and the Band functions.
+func (d *decoder) SampleFormats() []int {
+	n := int(d.firstVal(tSamplesPerPixel))
+	if n == 0 {
+		n = 1
+	}
+	f := make([]int, n)
+	for i := range f {
+		f[i] = int(d.bandFormat(i))
+	}
+	return f
+}
+
+// bandFormat returns the format of the samples of the given band.
+func (d *decoder) bandFormat(band int) sampleFormat {
+	if f := d.features[tSampleFormat]; band >= 0 && band < len(f) {
+		return sampleFormat(f[band])
+	}
+	return d.sFormat
+}
+
+// checkSampleFormats returns an error if the samples of the pixels do not
+// all have the same format.
+func (d *decoder) checkSampleFormats() error {
+	for _, f := range d.features[tSampleFormat] {
+		if sampleFormat(f) != d.sFormat {
+			return FormatError{Kind: Unsupported, Tag: tSampleFormat, Detail: fmt.Sprintf("mixed sample formats %v", d.features[tSampleFormat])}
+		}
+	}
+	return nil
+}
+
+// Compression returns the compression scheme of the image, as given by the
+// Compression tag. Schemes that cannot be used for encoding are reported
+// as UnknownCompression, and the raw value of the tag is then available
+// from RawTag.
+func (d *decoder) Compression() CompressionType {
+	switch d.firstVal(tCompression) {
+	case 0, cNone:
+		// The tag defaults to no compression.
+		return Uncompressed
+	case cDeflate, cDeflateOld:
+		return Deflate
+	case cLZW:
+		return LZW
+	case cPackBits:
+		return PackBits
+	case cZstd:
+		return Zstd
+	}
+	return UnknownCompression
+}
+
+// ByteOrder returns the byte order of the file.
+func (d *decoder) ByteOrder() binary.ByteOrder {
+	return d.byteOrder
+}
+
+// IsTiled reports whether the image is stored in tiles rather than in
+// strips.
+func (d *decoder) IsTiled() bool {
+	return d.firstVal(tTileWidth) != 0
+}
+
+// TileSize returns the size in pixels of the tiles of the image, as given
+// by the TileWidth and TileLength tags. Strips are reported as tiles
+// spanning the width of the image, so that reads of strip-based images can
+// be aligned the same way.
+func (d *decoder) TileSize() (w, h int) {
+	if d.IsTiled() {
+		return int(d.firstVal(tTileWidth)), int(d.firstVal(tTileLength))
+	}
+	w, h = d.config.Width, d.config.Height
+	if rps := int(d.firstVal(tRowsPerStrip)); rps != 0 && rps < h {
+		h = rps
+	}
+	return w, h
+}
+
+// TileGrid returns the number of columns and rows of tiles that cover the
+// image, or of strips, which make up a single column.
+func (d *decoder) TileGrid() (cols, rows int) {
+	w, h := d.TileSize()
+	if w == 0 || h == 0 {
+		return 0, 0
+	}
+	return ceilDiv(d.config.Width, w), ceilDiv(d.config.Height, h)
+}
+
+// RawTag returns the data type, the number of values and the raw data of
+// the entry with the given tag in the IFD of the image, whether or not the
+// package knows the tag. The data is in the byte order of the file. ok is
+// false if there is no such entry, or if its data cannot be read.
+func (d *decoder) RawTag(tag uint16) (dtype uint16, count uint32, data []byte, ok bool) {
+	entryLen := d.ifdLen()
+	for i := 0; i+entryLen <= len(d.ifd); i += entryLen {
+		p := d.ifd[i : i+entryLen]
+		if d.byteOrder.Uint16(p[0:2]) != tag {
+			continue
+		}
+		_, dt, n, raw, err := d.ifdData(p)
+		if err != nil {
+			return 0, 0, nil, false
+		}
+		// Small values are held in the IFD entry itself, so the data is
+		// copied.
+		return dt, uint32(n), append([]byte(nil), raw...), true
+	}
+	return 0, 0, nil, false
+}
+
+// textTags lists the informational ASCII tags returned by TextTags.
+var textTags = []uint16{
+	tImageDescription,
+	tMake,
+	tModel,
+	tSoftware,
+	tDateTime,
+	tArtist,
+	tCopyright,
+}
+
+// TextTags returns the informational ASCII tags of the image, keyed by tag:
+// ImageDescription (270), Make (271), Model (272), Software (305),
+// DateTime (306), Artist (315) and Copyright (33432). Missing tags and tags
+// of another data type than ASCII are left out. The values are given
+// without their terminating NUL. A Copyright value may hold both the
+// photographer and the editor copyrights, separated by a NUL.
+func (d *decoder) TextTags() map[uint16]string {
+	tags := map[uint16]string{}
+	for _, tag := range textTags {
+		dtype, _, data, ok := d.RawTag(tag)
+		if !ok || dtype != dtASCII {
+			continue
+		}
+		tags[tag] = string(bytes.TrimRight(data, "\x00"))
+	}
+	return tags
+}
+
+// subsampling returns the horizontal and vertical chroma subsampling
+// factors of a YCbCr image, which default to 2.
+func (d *decoder) subsampling() (int, int) {
+	f := d.features[tYCbCrSubSampling]
+	if len(f) < 2 {
+		return 2, 2
+	}
+	return int(f[0]), int(f[1])
+}
+
+// decodePacked decodes the raw data of a grayscale or RGB image whose
+// samples are neither 8 nor 16 bits long, scaling them to 16 bits. The
+// samples are packed tightly, with each row starting on a byte boundary.
+func (d *decoder) decodePacked(dst image.Image, xmin, ymin, xmax, ymax int) error {
+	r := dst.Bounds().Intersect(image.Rect(xmin, ymin, xmax, ymax))
+	spp := len(d.features[tBitsPerSample])
+	max := uint32(1)<<d.bpp - 1
+	s := make([]uint16, spp)
+	for y := ymin; y < r.Max.Y; y++ {
+		for x := xmin; x < xmax; x++ {
+			for i := range s {
+				v, ok := d.readBits(d.bpp)
+				if !ok {
+					return errNoPixels
+				}
+				s[i] = uint16(v * 0xffff / max)
+			}
+			if x < r.Min.X || x >= r.Max.X || y < r.Min.Y {
+				continue
+			}
+			switch img := dst.(type) {
+			case *scimage.GrayU16:
+				if d.mode == mGrayInvert {
+					s[0] = 0xffff - s[0]
+				}
+				img.SetGrayU16(x, y, scicolor.GrayU16{Y: s[0], Min: img.Min, Max: img.Max})
+			case *image.RGBA64:
+				a := uint16(0xffff)
+				if d.mode == mRGBA {
+					a = s[3]
+				}
+				img.SetRGBA64(x, y, color.RGBA64{s[0], s[1], s[2], a})
+			case *image.NRGBA64:
+				img.SetNRGBA64(x, y, color.NRGBA64{s[0], s[1], s[2], s[3]})
+			}
 		}
+		d.flushBits()
 	}
+	return nil
+}
+
+// decode decodes the raw data of an image.
+// It reads from d.buf and writes the strip or tile into dst.
+func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
+	d.off = 0
 
+	// Pixels outside of dst are decoded but not stored.
+	rMinX := maxInt(xmin, dst.Bounds().Min.X)
+	rMinY := maxInt(ymin, dst.Bounds().Min.Y)
 	rMaxX := minInt(xmax, dst.Bounds().Max.X)
 	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
 
+	// Samples of other depths than 16 bits decoded into 16-bit images are
+	// tightly packed.
+	switch dst.(type) {
+	case *scimage.GrayU16, *image.RGBA64, *image.NRGBA64:
+		if d.bpp != 16 && d.mode != mPaletted {
+			return d.decodePacked(dst, xmin, ymin, xmax, ymax)
+		}
+	}
+
 	switch d.mode {
 	case mGray, mGrayInvert:
 		switch d.sFormat {
 		case uintSample:
+			// The standard gray images are the destinations of
+			// DecodeIntoGray and DecodeIntoGray16.
 			if d.bpp == 16 {
-				img := dst.(*scimage.GrayU16)
+				var set func(x, y int, v uint16)
+				switch img := dst.(type) {
+				case *scimage.GrayU16:
+					set = func(x, y int, v uint16) {
+						img.SetGrayU16(x, y, scicolor.GrayU16{Y: v, Min: img.Min, Max: img.Max})
+					}
+				case *image.Gray16:
+					set = func(x, y int, v uint16) {
+						i := img.PixOffset(x, y)
+						img.Pix[i], img.Pix[i+1] = uint8(v>>8), uint8(v)
+					}
+				}
 				for y := ymin; y < rMaxY; y++ {
 					for x := xmin; x < rMaxX; x++ {
 						if d.off+2 > len(d.buf) {
 							return errNoPixels
 						}
-						v := uint16(d.buf[d.off+0])<<8 | uint16(d.buf[d.off+1])
+						v := d.byteOrder.Uint16(d.buf[d.off : d.off+2])
 						d.off += 2
 						if d.mode == mGrayInvert {
 							v = 0xffff - v
 						}
-						img.SetGrayU16(x, y, scicolor.GrayU16{v, img.Min, img.Max})
+						if x >= rMinX && y >= rMinY {
+							set(x, y, v)
+						}
 					}
-					if rMaxX == img.Bounds().Max.X {
-						d.off += 2 * (xmax - img.Bounds().Max.X)
+					if rMaxX == dst.Bounds().Max.X {
+						d.off += 2 * (xmax - dst.Bounds().Max.X)
 					}
 				}
 			} else {
-				img := dst.(*scimage.GrayU8)
+				var set func(x, y int, v uint8)
+				switch img := dst.(type) {
+				case *scimage.GrayU8:
+					set = func(x, y int, v uint8) {
+						img.SetGrayU8(x, y, scicolor.GrayU8{Y: v, Min: img.Min, Max: img.Max})
+					}
+				case *image.Gray:
+					set = func(x, y int, v uint8) {
+						img.Pix[img.PixOffset(x, y)] = v
+					}
+				}
 				max := uint32((1 << d.bpp) - 1)
 				for y := ymin; y < rMaxY; y++ {
 					for x := xmin; x < rMaxX; x++ {
@@ -350,9 +1113,14 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 						if d.mode == mGrayInvert {
 							v = 0xff - v
 						}
-						img.SetGrayU8(x, y, scicolor.GrayU8{uint8(v), img.Min, img.Max})
+						if x >= rMinX && y >= rMinY {
+							set(x, y, uint8(v))
+						}
 					}
 					d.flushBits()
+					if rMaxX == dst.Bounds().Max.X {
+						d.off += (xmax - dst.Bounds().Max.X) * int(d.bpp) / 8
+					}
 				}
 			}
 		case sintSample:
@@ -363,14 +1131,14 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 						if d.off+2 > len(d.buf) {
 							return errNoPixels
 						}
-						v := int16(d.buf[d.off+0])<<8 | int16(d.buf[d.off+1])
+						v := int16(d.byteOrder.Uint16(d.buf[d.off : d.off+2]))
 						d.off += 2
-						//TODO Invert a signed int?
-						/*
 						if d.mode == mGrayInvert {
-							v = 0xffff - v
-						}*/
-						img.SetGrayS16(x, y, scicolor.GrayS16{v, img.Min, img.Max})
+							v = ^v
+						}
+						if x >= rMinX && y >= rMinY {
+							img.SetGrayS16(x, y, scicolor.GrayS16{Y: v, Min: img.Min, Max: img.Max})
+						}
 					}
 					if rMaxX == img.Bounds().Max.X {
 						d.off += 2 * (xmax - img.Bounds().Max.X)
@@ -386,17 +1154,43 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 							return errNoPixels
 						}
 						v = v * 0xff / max
-						//TODO Invert a signed int?
-						/*if d.mode == mGrayInvert {
+						if d.mode == mGrayInvert {
 							v = 0xff - v
-						}*/
-						img.SetGrayS8(x, y, scicolor.GrayS8{int8(v), img.Min, img.Max})
+						}
+						if x >= rMinX && y >= rMinY {
+							img.SetGrayS8(x, y, scicolor.GrayS8{Y: int8(v), Min: img.Min, Max: img.Max})
+						}
 					}
 					d.flushBits()
+					if rMaxX == img.Bounds().Max.X {
+						d.off += (xmax - img.Bounds().Max.X) * int(d.bpp) / 8
+					}
 				}
 			}
 		}
 	case mPaletted:
+		if d.bpp > 8 {
+			// The indices are read up to xmax, as the padding of rows
+			// may not fall on byte boundaries.
+			img := dst.(*image.RGBA64)
+			for y := ymin; y < rMaxY; y++ {
+				for x := xmin; x < xmax; x++ {
+					v, ok := d.readBits(d.bpp)
+					if !ok {
+						return errNoPixels
+					}
+					if x < rMinX || x >= rMaxX || y < rMinY {
+						continue
+					}
+					if int(v) >= len(d.palette) {
+						return FormatError{Kind: BadTag, Tag: tColorMap, Detail: fmt.Sprintf("color index %d outside of ColorMap", v)}
+					}
+					img.Set(x, y, d.palette[v])
+				}
+				d.flushBits()
+			}
+			break
+		}
 		img := dst.(*image.Paletted)
 		for y := ymin; y < rMaxY; y++ {
 			for x := xmin; x < rMaxX; x++ {
@@ -404,9 +1198,14 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 				if !ok {
 					return errNoPixels
 				}
-				img.SetColorIndex(x, y, uint8(v))
+				if x >= rMinX && y >= rMinY {
+					img.SetColorIndex(x, y, uint8(v))
+				}
 			}
 			d.flushBits()
+			if rMaxX == img.Bounds().Max.X {
+				d.off += (xmax - img.Bounds().Max.X) * int(d.bpp) / 8
+			}
 		}
 	case mRGB:
 		if d.bpp == 16 {
@@ -420,15 +1219,20 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 					g := d.byteOrder.Uint16(d.buf[d.off+2 : d.off+4])
 					b := d.byteOrder.Uint16(d.buf[d.off+4 : d.off+6])
 					d.off += 6
-					img.SetRGBA64(x, y, color.RGBA64{r, g, b, 0xffff})
+					if x >= rMinX && y >= rMinY {
+						img.SetRGBA64(x, y, color.RGBA64{r, g, b, 0xffff})
+					}
+				}
+				if rMaxX == img.Bounds().Max.X {
+					d.off += 6 * (xmax - img.Bounds().Max.X)
 				}
 			}
 		} else {
 			img := dst.(*image.RGBA)
-			for y := ymin; y < rMaxY; y++ {
-				min := img.PixOffset(xmin, y)
+			for y := rMinY; y < rMaxY; y++ {
+				min := img.PixOffset(rMinX, y)
 				max := img.PixOffset(rMaxX, y)
-				off := (y - ymin) * (xmax - xmin) * 3
+				off := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 3
 				for i := min; i < max; i += 4 {
 					if off+3 > len(d.buf) {
 						return errNoPixels
@@ -454,15 +1258,21 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 					b := d.byteOrder.Uint16(d.buf[d.off+4 : d.off+6])
 					a := d.byteOrder.Uint16(d.buf[d.off+6 : d.off+8])
 					d.off += 8
-					img.SetNRGBA64(x, y, color.NRGBA64{r, g, b, a})
+					if x >= rMinX && y >= rMinY {
+						img.SetNRGBA64(x, y, color.NRGBA64{r, g, b, a})
+					}
+				}
+				if rMaxX == img.Bounds().Max.X {
+					d.off += 8 * (xmax - img.Bounds().Max.X)
 				}
 			}
 		} else {
 			img := dst.(*image.NRGBA)
-			for y := ymin; y < rMaxY; y++ {
-				min := img.PixOffset(xmin, y)
+			for y := rMinY; y < rMaxY; y++ {
+				min := img.PixOffset(rMinX, y)
 				max := img.PixOffset(rMaxX, y)
-				i0, i1 := (y-ymin)*(xmax-xmin)*4, (y-ymin+1)*(xmax-xmin)*4
+				i0 := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 4
+				i1 := i0 + (rMaxX-rMinX)*4
 				if i1 > len(d.buf) {
 					return errNoPixels
 				}
@@ -482,101 +1292,361 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 					b := d.byteOrder.Uint16(d.buf[d.off+4 : d.off+6])
 					a := d.byteOrder.Uint16(d.buf[d.off+6 : d.off+8])
 					d.off += 8
-					img.SetRGBA64(x, y, color.RGBA64{r, g, b, a})
+					if x >= rMinX && y >= rMinY {
+						img.SetRGBA64(x, y, color.RGBA64{r, g, b, a})
+					}
+				}
+				if rMaxX == img.Bounds().Max.X {
+					d.off += 8 * (xmax - img.Bounds().Max.X)
 				}
 			}
 		} else {
 			img := dst.(*image.RGBA)
-			for y := ymin; y < rMaxY; y++ {
-				min := img.PixOffset(xmin, y)
+			for y := rMinY; y < rMaxY; y++ {
+				min := img.PixOffset(rMinX, y)
 				max := img.PixOffset(rMaxX, y)
-				i0, i1 := (y-ymin)*(xmax-xmin)*4, (y-ymin+1)*(xmax-xmin)*4
+				i0 := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 4
+				i1 := i0 + (rMaxX-rMinX)*4
 				if i1 > len(d.buf) {
 					return errNoPixels
 				}
 				copy(img.Pix[min:max], d.buf[i0:i1])
 			}
 		}
+	case mCMYK:
+		img := dst.(*image.CMYK)
+		for y := rMinY; y < rMaxY; y++ {
+			min := img.PixOffset(rMinX, y)
+			max := img.PixOffset(rMaxX, y)
+			i0 := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 4
+			i1 := i0 + (rMaxX-rMinX)*4
+			if i1 > len(d.buf) {
+				return errNoPixels
+			}
+			copy(img.Pix[min:max], d.buf[i0:i1])
+		}
+	case mCMYKA:
+		img := dst.(*image.NRGBA)
+		extra := d.firstVal(tExtraSamples)
+		for y := rMinY; y < rMaxY; y++ {
+			off := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 5
+			for x := rMinX; x < rMaxX; x++ {
+				if off+5 > len(d.buf) {
+					return errNoPixels
+				}
+				c, m, yy, k, a := d.buf[off], d.buf[off+1], d.buf[off+2], d.buf[off+3], d.buf[off+4]
+				off += 5
+				switch extra {
+				case 0:
+					// The extra sample has no specified meaning.
+					a = 0xff
+				case 1:
+					// The inks are premultiplied by alpha.
+					c, m, yy, k = unpremultiply(c, a), unpremultiply(m, a), unpremultiply(yy, a), unpremultiply(k, a)
+				}
+				r, g, b := color.CMYKToRGB(c, m, yy, k)
+				img.SetNRGBA(x, y, color.NRGBA{r, g, b, a})
+			}
+		}
+	case mYCbCr:
+		// The samples are stored in data units, each holding the luma
+		// samples of a block of sh×sv pixels followed by their chroma
+		// samples. See section 21 of the spec.
+		img := dst.(*image.RGBA)
+		sh, sv := d.subsampling()
+		unitsAcross := (xmax - xmin + sh - 1) / sh
+		unitsDown := (ymax - ymin + sv - 1) / sv
+		n := sh*sv + 2
+		for uy := 0; uy < unitsDown; uy++ {
+			for ux := 0; ux < unitsAcross; ux++ {
+				if d.off+n > len(d.buf) {
+					return errNoPixels
+				}
+				unit := d.buf[d.off : d.off+n]
+				d.off += n
+				cb, cr := unit[n-2], unit[n-1]
+				for j := 0; j < sv; j++ {
+					y := ymin + uy*sv + j
+					for i := 0; i < sh; i++ {
+						x := xmin + ux*sh + i
+						if x < rMinX || x >= rMaxX || y < rMinY || y >= rMaxY {
+							continue
+						}
+						r, g, b := color.YCbCrToRGB(unit[j*sh+i], cb, cr)
+						img.SetRGBA(x, y, color.RGBA{r, g, b, 0xff})
+					}
+				}
+			}
+		}
+	case mCIELab:
+		if d.bpp == 16 {
+			img := dst.(*image.NRGBA64)
+			for y := ymin; y < rMaxY; y++ {
+				for x := xmin; x < rMaxX; x++ {
+					if d.off+6 > len(d.buf) {
+						return errNoPixels
+					}
+					l := float64(d.byteOrder.Uint16(d.buf[d.off+0:d.off+2])) * 100 / 0xffff
+					a := float64(int16(d.byteOrder.Uint16(d.buf[d.off+2:d.off+4]))) / 256
+					b := float64(int16(d.byteOrder.Uint16(d.buf[d.off+4:d.off+6]))) / 256
+					d.off += 6
+					if x >= rMinX && y >= rMinY {
+						r, g, b := labToRGB(l, a, b)
+						img.SetNRGBA64(x, y, color.NRGBA64{uint16(r*0xffff + 0.5), uint16(g*0xffff + 0.5), uint16(b*0xffff + 0.5), 0xffff})
+					}
+				}
+				if rMaxX == img.Bounds().Max.X {
+					d.off += 6 * (xmax - img.Bounds().Max.X)
+				}
+			}
+		} else {
+			img := dst.(*image.NRGBA)
+			for y := rMinY; y < rMaxY; y++ {
+				off := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 3
+				for x := rMinX; x < rMaxX; x++ {
+					if off+3 > len(d.buf) {
+						return errNoPixels
+					}
+					l := float64(d.buf[off]) * 100 / 0xff
+					a := float64(int8(d.buf[off+1]))
+					b := float64(int8(d.buf[off+2]))
+					off += 3
+					r, g, b := labToRGB(l, a, b)
+					img.SetNRGBA(x, y, color.NRGBA{uint8(r*0xff + 0.5), uint8(g*0xff + 0.5), uint8(b*0xff + 0.5), 0xff})
+				}
+			}
+		}
 	}
 
 	return nil
 }
 
 func newDecoder(r io.Reader) (*decoder, error) {
+	return newDecoderAt(newReaderAt(r))
+}
+
+// newDecoderAt reads the header and the first IFD of the TIFF file in r, and
+// returns a decoder of its image.
+func newDecoderAt(r io.ReaderAt) (*decoder, error) {
+	var o *DecodeOptions
+	return o.newDecoder(r)
+}
+
+// newDecoder is like newDecoderAt, with the decoding parameters of o.
+func (o *DecodeOptions) newDecoder(r io.ReaderAt) (*decoder, error) {
+	d, err := o.readFirstIFD(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.configure(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readFirstIFD reads the header and the first IFD of the TIFF file in r. The
+// returned decoder must be configured before decoding the image.
+func readFirstIFD(r io.ReaderAt) (*decoder, error) {
+	var o *DecodeOptions
+	return o.readFirstIFD(r)
+}
+
+// readFirstIFD is like the package-level readFirstIFD, with the decoding
+// parameters of o.
+func (o *DecodeOptions) readFirstIFD(r io.ReaderAt) (*decoder, error) {
 	d := &decoder{
-		r:        newReaderAt(r),
+		r:        r,
 		features: make(map[int][]uint),
+		// SampleFormat defaults to unsigned integer data (p. 80 of the spec).
+		sFormat:          uintSample,
+		ApplyOrientation: true,
+		MaxImageBytes:    DefaultMaxImageBytes,
 	}
+	o.apply(d)
 
 	p := make([]byte, 8)
 	if _, err := d.r.ReadAt(p, 0); err != nil {
-		return nil, err
+		return nil, truncated(err)
 	}
 	switch string(p[0:4]) {
 	case leHeader:
 		d.byteOrder = binary.LittleEndian
 	case beHeader:
 		d.byteOrder = binary.BigEndian
+	case leHeaderBig:
+		d.byteOrder = binary.LittleEndian
+		d.bigTIFF = true
+	case beHeaderBig:
+		d.byteOrder = binary.BigEndian
+		d.bigTIFF = true
 	default:
-		return nil, FormatError("malformed header")
+		return nil, FormatError{Kind: BadHeader, Detail: "malformed header"}
 	}
 
-	ifdOffset := int64(d.byteOrder.Uint32(p[4:8]))
+	var ifdOffset int64
+	if d.bigTIFF {
+		// The BigTIFF header holds the size of offsets, which is always 8,
+		// and a zero word before the 8-byte offset of the first IFD.
+		if d.byteOrder.Uint16(p[4:6]) != 8 || d.byteOrder.Uint16(p[6:8]) != 0 {
+			return nil, FormatError{Kind: BadHeader, Detail: "malformed BigTIFF header"}
+		}
+		if _, err := d.r.ReadAt(p, 8); err != nil {
+			return nil, truncated(err)
+		}
+		ifdOffset = d.offset(p)
+	} else {
+		ifdOffset = d.offset(p[4:8])
+	}
 
-	// The first two bytes contain the number of entries (12 bytes each).
-	if _, err := d.r.ReadAt(p[0:2], ifdOffset); err != nil {
+	if err := d.readIFD(ifdOffset); err != nil {
 		return nil, err
 	}
-	numItems := int(d.byteOrder.Uint16(p[0:2]))
+	return d, nil
+}
 
-	// All IFD entries are read in one chunk.
-	p = make([]byte, ifdLen*numItems)
-	if _, err := d.r.ReadAt(p, ifdOffset+2); err != nil {
+// ifdDecoder returns a decoder of the image described by the IFD at offset,
+// in the same file as d. Only the IFD is read: the decoder must be
+// configured before decoding the image.
+func (d *decoder) ifdDecoder(offset int64) (*decoder, error) {
+	d1 := &decoder{
+		r:                d.r,
+		byteOrder:        d.byteOrder,
+		bigTIFF:          d.bigTIFF,
+		features:         make(map[int][]uint),
+		sFormat:          uintSample,
+		ApplyOrientation: d.ApplyOrientation,
+		Concurrency:      d.Concurrency,
+		MaxImageBytes:    d.MaxImageBytes,
+		Progress:         d.Progress,
+		cache:            d.cache,
+		ctx:              d.ctx,
+		strict:           d.strict,
+	}
+	if err := d1.readIFD(offset); err != nil {
 		return nil, err
 	}
+	return d1, nil
+}
+
+// walkIFDs calls fn with a decoder of each of the IFDs that follow the IFD
+// of d in the file, as returned by ifdDecoder. It stops at the end of the
+// chain of IFDs or at the first error, and reports cycles in the chain.
+func (d *decoder) walkIFDs(fn func(d1 *decoder) error) error {
+	seen := map[int64]bool{d.ifdOffset: true}
+	for off := d.nextIFD; off != 0; {
+		if seen[off] {
+			return FormatError{Kind: Malformed, Detail: "IFD chain has a cycle"}
+		}
+		seen[off] = true
+		d1, err := d.ifdDecoder(off)
+		if err != nil {
+			return err
+		}
+		if err := fn(d1); err != nil {
+			return err
+		}
+		off = d1.nextIFD
+	}
+	return nil
+}
+
+// readIFD reads the entries of the IFD at ifdOffset, and the offset of the
+// next IFD.
+func (d *decoder) readIFD(ifdOffset int64) error {
+	d.ifdOffset = ifdOffset
+	p := make([]byte, 8)
+	// The IFD starts with the number of entries, which takes two bytes,
+	// or eight bytes in BigTIFF files.
+	var numItems int
+	if d.bigTIFF {
+		if _, err := d.r.ReadAt(p, ifdOffset); err != nil {
+			return truncated(err)
+		}
+		// Tags are unique 16-bit numbers, which bounds the number of
+		// entries.
+		n := d.byteOrder.Uint64(p)
+		if n > 1<<16 {
+			return FormatError{Kind: Malformed, Detail: "too many IFD entries"}
+		}
+		numItems = int(n)
+		ifdOffset += 8
+	} else {
+		if _, err := d.r.ReadAt(p[0:2], ifdOffset); err != nil {
+			return truncated(err)
+		}
+		numItems = int(d.byteOrder.Uint16(p[0:2]))
+		ifdOffset += 2
+	}
 
+	// All IFD entries are read in one chunk, along with the offset of the
+	// next IFD that follows them. A missing offset is treated as the end of
+	// the chain.
+	entryLen := d.ifdLen()
+	p = make([]byte, entryLen*numItems+d.offsetLen())
+	n, err := d.r.ReadAt(p, ifdOffset)
+	if n < entryLen*numItems {
+		return truncated(err)
+	}
+	if n == len(p) {
+		d.nextIFD = d.offset(p[entryLen*numItems:])
+	}
+	p = p[:entryLen*numItems]
+	d.ifd = p
+
+	// The spec requires the entries to be sorted by tag, but some writers
+	// do not sort them, so only strict decoding rejects them. Duplicate
+	// tags are always rejected.
 	prevTag := -1
-	for i := 0; i < len(p); i += ifdLen {
-		tag, err := d.parseIFD(p[i : i+ifdLen])
+	seen := make(map[int]bool, numItems)
+	for i := 0; i < len(p); i += entryLen {
+		tag, err := d.parseIFD(p[i : i+entryLen])
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if seen[tag] {
+			return FormatError{Kind: Malformed, Tag: tag, Detail: "duplicate tag"}
 		}
-		if tag <= prevTag {
-			return nil, FormatError("tags are not sorted in ascending order")
+		if d.strict && tag < prevTag {
+			return FormatError{Kind: Malformed, Tag: tag, Detail: "tags are not sorted in ascending order"}
 		}
+		seen[tag] = true
 		prevTag = tag
 	}
 
+	return nil
+}
+
+// configure sets up d to decode the image described by its IFD, which must
+// have been read by readIFD.
+func (d *decoder) configure() error {
 	d.config.Width = int(d.firstVal(tImageWidth))
 	d.config.Height = int(d.firstVal(tImageLength))
 
 	if _, ok := d.features[tBitsPerSample]; !ok {
-		return nil, FormatError("BitsPerSample tag missing")
+		return FormatError{Kind: MissingTag, Tag: tBitsPerSample, Detail: "BitsPerSample tag missing"}
 	}
 	d.bpp = d.firstVal(tBitsPerSample)
 	switch d.bpp {
 	case 0:
-		return nil, FormatError("BitsPerSample must not be 0")
+		return FormatError{Kind: BadTag, Tag: tBitsPerSample, Detail: "BitsPerSample must not be 0"}
 	case 1, 8, 16:
 		// Nothing to do, these are accepted by this implementation.
+	case 32, 64:
+		// Only accessible through the band accessors, such as Float32Band.
 	default:
-		return nil, UnsupportedError(fmt.Sprintf("BitsPerSample of %v", d.bpp))
+		// Samples of other depths up to 16 bits are tightly packed, and
+		// unpacked bit by bit.
+		if d.bpp > 16 {
+			return FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("BitsPerSample of %v", d.bpp)}
+		}
 	}
 
 	// Determine the image mode.
 	switch d.firstVal(tPhotometricInterpretation) {
 	case pRGB:
-		if d.bpp == 16 {
-			for _, b := range d.features[tBitsPerSample] {
-				if b != 16 {
-					return nil, FormatError("wrong number of samples for 16bit RGB")
-				}
-			}
-		} else {
-			for _, b := range d.features[tBitsPerSample] {
-				if b != 8 {
-					return nil, FormatError("wrong number of samples for 8bit RGB")
-				}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != d.bpp {
+				return FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: fmt.Sprintf("wrong number of samples for %dbit RGB", d.bpp)}
 			}
 		}
 		// RGB images normally have 3 samples per pixel.
@@ -588,7 +1658,7 @@ func newDecoder(r io.Reader) (*decoder, error) {
 		switch len(d.features[tBitsPerSample]) {
 		case 3:
 			d.mode = mRGB
-			if d.bpp == 16 {
+			if d.bpp != 8 {
 				d.config.ColorModel = color.RGBA64Model
 			} else {
 				d.config.ColorModel = color.RGBAModel
@@ -597,66 +1667,150 @@ func newDecoder(r io.Reader) (*decoder, error) {
 			switch d.firstVal(tExtraSamples) {
 			case 1:
 				d.mode = mRGBA
-				if d.bpp == 16 {
+				if d.bpp != 8 {
 					d.config.ColorModel = color.RGBA64Model
 				} else {
 					d.config.ColorModel = color.RGBAModel
 				}
 			case 2:
 				d.mode = mNRGBA
-				if d.bpp == 16 {
+				if d.bpp != 8 {
 					d.config.ColorModel = color.NRGBA64Model
 				} else {
 					d.config.ColorModel = color.NRGBAModel
 				}
 			default:
-				return nil, FormatError("wrong number of samples for RGB")
+				return FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: "wrong number of samples for RGB"}
 			}
 		default:
-			return nil, FormatError("wrong number of samples for RGB")
+			return FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: "wrong number of samples for RGB"}
+		}
+	case pCMYK:
+		if n := len(d.features[tBitsPerSample]); d.firstVal(tInkSet) == inkNotCMYK || n > 5 {
+			// Spot colors cannot be converted to RGB, but each ink can
+			// be read as a band.
+			// Decode does not support the image, so it has no color
+			// model.
+			d.mode = mSeparated
+			break
+		}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != 8 {
+				return FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("CMYK BitsPerSample of %v", b)}
+			}
+		}
+		// This implementation supports at most one extra sample,
+		// which is usually an alpha channel.
+		switch len(d.features[tBitsPerSample]) {
+		case 4:
+			d.mode = mCMYK
+			d.config.ColorModel = color.CMYKModel
+		case 5:
+			d.mode = mCMYKA
+			d.config.ColorModel = color.NRGBAModel
+		default:
+			return FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: "wrong number of samples for CMYK"}
+		}
+	case pYCbCr:
+		if len(d.features[tBitsPerSample]) != 3 {
+			return FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: "wrong number of samples for YCbCr"}
+		}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != 8 {
+				return FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("YCbCr BitsPerSample of %v", b)}
+			}
+		}
+		if c := d.firstVal(tCompression); c == cJPEG || c == cJPEGOld {
+			// The JPEG decoder converts the samples to RGB, and handles
+			// the subsampling itself.
+			if d.firstVal(tPlanarConfiguration) == pcPlanar {
+				return FormatError{Kind: Unsupported, Tag: tPlanarConfiguration, Detail: "planar JPEG compressed YCbCr"}
+			}
+			d.mode = mRGB
+			d.config.ColorModel = color.RGBAModel
+			break
+		}
+		sh, sv := d.subsampling()
+		if sh != 1 && sh != 2 && sh != 4 || sv != 1 && sv != 2 && sv != 4 {
+			return FormatError{Kind: BadTag, Tag: tYCbCrSubSampling, Detail: "bad YCbCrSubSampling"}
+		}
+		if d.firstVal(tPlanarConfiguration) == pcPlanar && (sh != 1 || sv != 1) {
+			return FormatError{Kind: Unsupported, Tag: tPlanarConfiguration, Detail: "planar subsampled YCbCr"}
+		}
+		// The samples are converted to RGB assuming the default
+		// YCbCrCoefficients and ReferenceBlackWhite, as in JFIF.
+		d.mode = mYCbCr
+		d.config.ColorModel = color.RGBAModel
+	case pCIELab:
+		if len(d.features[tBitsPerSample]) != 3 {
+			return FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: "wrong number of samples for CIELab"}
+		}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != d.bpp || b != 8 && b != 16 {
+				return FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("CIELab BitsPerSample of %v", b)}
+			}
+		}
+		d.mode = mCIELab
+		if d.bpp == 16 {
+			d.config.ColorModel = color.NRGBA64Model
+		} else {
+			d.config.ColorModel = color.NRGBAModel
 		}
 	case pPaletted:
+		if d.bpp > 16 {
+			return FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("paletted BitsPerSample of %v", d.bpp)}
+		}
 		d.mode = mPaletted
-		d.config.ColorModel = color.Palette(d.palette)
+		if d.bpp > 8 {
+			// Indices do not fit in an image.Paletted, so the colors
+			// are looked up while decoding.
+			d.config.ColorModel = color.RGBA64Model
+		} else {
+			d.config.ColorModel = color.Palette(d.palette)
+		}
 	case pWhiteIsZero:
 		d.mode = mGrayInvert
-		if d.bpp == 16 {
-			d.config.ColorModel = scicolor.GrayU16Model{Min: 0, Max: 10000}
+		if d.bpp > 8 {
+			d.config.ColorModel = scicolor.GrayU16Model{Min: 0, Max: 65535}
 		} else {
 			d.config.ColorModel = scicolor.GrayU8Model{Min: 0, Max: 255}
 		}
+	case pTransMask:
+		// Transparency masks are bilevel images where a 1 marks the
+		// pixels of the image they belong to that are shown.
+		if len(d.features[tBitsPerSample]) != 1 {
+			return FormatError{Kind: BadTag, Tag: tSamplesPerPixel, Detail: "wrong number of samples for transparency mask"}
+		}
+		if d.bpp != 1 {
+			return FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("transparency mask BitsPerSample of %v", d.bpp)}
+		}
+		d.mode = mGray
+		d.config.ColorModel = scicolor.GrayU8Model{Min: 0, Max: 255}
 	case pBlackIsZero:
 		d.mode = mGray
-		if d.bpp == 16 {
-			d.config.ColorModel = scicolor.GrayU16Model{Min: 0, Max: 10000}
+		if d.bpp > 8 {
+			d.config.ColorModel = scicolor.GrayU16Model{Min: 0, Max: 65535}
 		} else {
 			d.config.ColorModel = scicolor.GrayU8Model{Min: 0, Max: 255}
 		}
 	default:
-		return nil, UnsupportedError("color model")
+		return FormatError{Kind: UnsupportedPhotometric, Tag: tPhotometricInterpretation, Detail: "color model"}
 	}
 
-	return d, nil
+	return nil
 }
 
-// DecodeConfig returns the color model and dimensions of a TIFF image without
-// decoding the entire image.
-func DecodeConfig(r io.Reader) (image.Config, error) {
-	d, err := newDecoder(r)
-	if err != nil {
-		return image.Config{}, err
-	}
-	return d.config, nil
+// A block is a strip or a tile of the image.
+type block struct {
+	offset, count int64 // Location of the compressed data in the file.
+	// rect holds the pixels covered by the block. Tiles are padded and may
+	// extend beyond the image bounds.
+	rect image.Rectangle
 }
 
-// Decode reads a TIFF image from r and returns it as an image.Image.
-// The type of Image returned depends on the contents of the TIFF.
-func Decode(r io.Reader) (img image.Image, err error) {
-	d, err := newDecoder(r)
-	if err != nil {
-		return
-	}
-
+// blocks returns the strips or tiles holding the given sample plane of the
+// image, in row-major order. Images with chunky storage only have plane 0.
+func (d *decoder) blocks(plane int) ([]block, error) {
 	blockPadding := false
 	blockWidth := d.config.Width
 	blockHeight := d.config.Height
@@ -671,6 +1825,7 @@ func Decode(r io.Reader) (img image.Image, err error) {
 	}
 
 	var blockOffsets, blockCounts []uint
+	countTag := tStripByteCounts
 
 	if int(d.firstVal(tTileWidth)) != 0 {
 		blockPadding = true
@@ -687,6 +1842,7 @@ func Decode(r io.Reader) (img image.Image, err error) {
 
 		blockCounts = d.features[tTileByteCounts]
 		blockOffsets = d.features[tTileOffsets]
+		countTag = tTileByteCounts
 
 	} else {
 		if int(d.firstVal(tRowsPerStrip)) != 0 {
@@ -702,109 +1858,753 @@ func Decode(r io.Reader) (img image.Image, err error) {
 	}
 
 	// Check if we have the right number of strips/tiles, offsets and counts.
-	if n := blocksAcross * blocksDown; len(blockOffsets) < n || len(blockCounts) < n {
-		return nil, FormatError("inconsistent header")
+	// The blocks of each plane follow the ones of the previous plane.
+	n := blocksAcross * blocksDown
+	if len(blockOffsets) < (plane+1)*n || len(blockCounts) < (plane+1)*n {
+		return nil, FormatError{Kind: BadTag, Detail: "inconsistent header"}
+	}
+	blockOffsets = blockOffsets[plane*n:]
+	blockCounts = blockCounts[plane*n:]
+
+	blocks := make([]block, 0, blocksAcross*blocksDown)
+	for j := 0; j < blocksDown; j++ {
+		blkH := blockHeight
+		if !blockPadding && j == blocksDown-1 && d.config.Height%blockHeight != 0 {
+			blkH = d.config.Height % blockHeight
+		}
+		for i := 0; i < blocksAcross; i++ {
+			blkW := blockWidth
+			if !blockPadding && i == blocksAcross-1 && d.config.Width%blockWidth != 0 {
+				blkW = d.config.Width % blockWidth
+			}
+			xmin := i * blockWidth
+			ymin := j * blockHeight
+			blocks = append(blocks, block{
+				offset: int64(blockOffsets[j*blocksAcross+i]),
+				count:  int64(blockCounts[j*blocksAcross+i]),
+				rect:   image.Rect(xmin, ymin, xmin+blkW, ymin+blkH),
+			})
+		}
 	}
 
-	imgRect := image.Rect(0, 0, d.config.Width, d.config.Height)
+	// Corrupt files may claim blocks far beyond the end of the file, which
+	// would cause huge allocations when they are read.
+	if size, ok := d.size(); ok {
+		for _, b := range blocks {
+			if b.offset < 0 || b.count < 0 || b.offset > size || b.count > size-b.offset {
+				return nil, FormatError{Kind: Truncated, Tag: countTag, Detail: "strip or tile data out of file bounds"}
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// blockChunk is the size of the first chunk in which the data of a strip or
+// tile is read when the size of the file is unknown.
+const blockChunk = 1 << 20
+
+// readData reads the n bytes of strip or tile data at offset. The returned
+// data is shorter if the file ends before it.
+func (d *decoder) readData(offset, n int64) ([]byte, error) {
+	if offset < 0 || n < 0 {
+		return nil, FormatError{Kind: Truncated, Detail: "strip or tile data out of file bounds"}
+	}
+	if _, ok := d.size(); ok || n <= blockChunk {
+		p := make([]byte, n)
+		if m, err := d.r.ReadAt(p, offset); m < len(p) {
+			if err != io.EOF {
+				return nil, truncated(err)
+			}
+			p = p[:m]
+		}
+		return p, nil
+	}
+	// The byte count could not be checked against the size of the file, so
+	// the data is read in growing chunks, and memory is only allocated for
+	// the data that the file actually holds.
+	var buf bytes.Buffer
+	buf.Grow(blockChunk)
+	r := io.LimitReader(io.NewSectionReader(d.r, offset, math.MaxInt64-offset), n)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, truncated(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// blockReader returns a reader of the n bytes of compressed data at offset.
+// The data is read with few ReadAt calls, usually a single one, rather than
+// with the many small reads of the decompressors, which matters for remote
+// files.
+func (d *decoder) blockReader(offset, n int64) (io.Reader, error) {
+	if n < 0 {
+		return nil, FormatError{Kind: BadTag, Detail: "negative block byte count"}
+	}
+	if rb, ok := d.r.(*buffer); ok {
+		sr := io.NewSectionReader(rb, offset, n)
+		if d.firstVal(tFillOrder) == foLSB2MSB {
+			return reverseBitsReader{sr}, nil
+		}
+		return sr, nil
+	}
+	if m, ok := d.r.(*mappedFile); ok {
+		// Decompression fails on the truncated data, unless the end of
+		// the data is not needed.
+		p, _ := m.Slice(int(offset), int(n))
+		if d.firstVal(tFillOrder) == foLSB2MSB {
+			return reverseBitsReader{bytes.NewReader(p)}, nil
+		}
+		return bytes.NewReader(p), nil
+	}
+	// Decompression fails on the truncated data, unless the end of the data
+	// is not needed.
+	p, err := d.readData(offset, n)
+	if err != nil {
+		return nil, err
+	}
+	if d.firstVal(tFillOrder) == foLSB2MSB {
+		reverseBits(p)
+	}
+	return bytes.NewReader(p), nil
+}
+
+// decompress reads and decompresses the data of the strip or tile b.
+func (d *decoder) decompress(b block) (buf []byte, err error) {
+	offset, n := b.offset, b.count
+	if int64(int(offset+n)) != offset+n {
+		// The data cannot be held in memory on 32-bit systems.
+		return nil, FormatError{Kind: Truncated, Detail: "strip or tile data out of memory bounds"}
+	}
+	// The size of the uncompressed data bounds the output of the
+	// decompressors, which is otherwise only limited by the compressed data.
+	size := d.rawSize(b.rect.Dx(), b.rect.Dy(), d.blockSamples())
+	if err := d.checkSize(size); err != nil {
+		return nil, err
+	}
+	switch d.firstVal(tCompression) {
+
+	// According to the spec, Compression does not have a default value,
+	// but some tools interpret a missing Compression value as none so we do
+	// the same.
+	case cNone, 0:
+		if rb, ok := d.r.(slicer); ok {
+			buf, err = rb.Slice(int(offset), int(n))
+			if err == nil && (d.firstVal(tFillOrder) == foLSB2MSB || d.firstVal(tPredictor) > prNone) {
+				// The slice is shared with the buffer or the mapped
+				// file, so that it must not be modified.
+				buf = append([]byte(nil), buf...)
+			}
+		} else if buf, err = d.readData(offset, n); err == nil && int64(len(buf)) < n {
+			err = io.ErrUnexpectedEOF
+		}
+		err = truncated(err)
+		if err == nil && d.firstVal(tFillOrder) == foLSB2MSB {
+			reverseBits(buf)
+		}
+	case cLZW:
+		var src io.Reader
+		if src, err = d.blockReader(offset, n); err != nil {
+			return nil, err
+		}
+		r := lzw.NewReader(src, lzw.MSB, 8)
+		buf, err = ioutil.ReadAll(io.LimitReader(r, size))
+		r.Close()
+	case cDeflate, cDeflateOld:
+		var src io.Reader
+		if src, err = d.blockReader(offset, n); err != nil {
+			return nil, err
+		}
+		var r io.ReadCloser
+		r, err = zlib.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r, size))
+		r.Close()
+	case cG3, cG4:
+		if d.bpp != 1 || d.blockSamples() != 1 {
+			return nil, FormatError{Kind: BadTag, Tag: tBitsPerSample, Detail: "CCITT compression of more than 1 bit per pixel"}
+		}
+		// The fill bits of the T4Options tag need no special handling, as
+		// the decoder skips them wherever they are.
+		if d.firstVal(tT4Options)&t4Uncompressed != 0 || d.firstVal(tT6Options)&t6Uncompressed != 0 {
+			return nil, FormatError{Kind: UnsupportedCompression, Tag: tCompression, Detail: "CCITT uncompressed mode"}
+		}
+		var src io.Reader
+		if src, err = d.blockReader(offset, n); err != nil {
+			return nil, err
+		}
+		if d.firstVal(tCompression) == cG3 {
+			opts := ccitt.Group3Options{TwoD: d.firstVal(tT4Options)&t4TwoD != 0}
+			buf, err = ccitt.DecodeGroup3(src, b.rect.Dx(), b.rect.Dy(), opts)
+		} else {
+			buf, err = ccitt.DecodeGroup4(src, b.rect.Dx(), b.rect.Dy())
+		}
+	case cJPEG:
+		var src io.Reader
+		if src, err = d.blockReader(offset, n); err != nil {
+			return nil, err
+		}
+		buf, err = d.decodeJPEG(src, b.rect.Dx(), b.rect.Dy())
+	case cJPEGOld:
+		buf, err = d.decodeOldJPEG(b.rect)
+	case cPackBits:
+		var src io.Reader
+		if src, err = d.blockReader(offset, n); err != nil {
+			return nil, err
+		}
+		buf, err = unpackBits(src, int(size))
+	case cZstd:
+		if zstdNewReader == nil {
+			return nil, errNoZstd
+		}
+		var src io.Reader
+		if src, err = d.blockReader(offset, n); err != nil {
+			return nil, err
+		}
+		var r io.ReadCloser
+		if r, err = zstdNewReader(src); err != nil {
+			return nil, err
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r, size))
+		r.Close()
+	default:
+		c := d.firstVal(tCompression)
+		detail := fmt.Sprintf("compression value %d", c)
+		if name, ok := compressionNames[c]; ok {
+			detail += " (" + name + ")"
+		}
+		err = FormatError{Kind: UnsupportedCompression, Tag: tCompression, Detail: detail}
+	}
+	return buf, err
+}
+
+// rawSize returns the size in bytes of the uncompressed data of w×h pixels
+// with spp samples each.
+func (d *decoder) rawSize(w, h, spp int) int64 {
+	return int64(h) * ((int64(w)*int64(d.bpp)*int64(spp) + 7) / 8)
+}
+
+// checkSize returns an error if n bytes of pixel data exceed the limit set
+// by d.MaxImageBytes.
+func (d *decoder) checkSize(n int64) error {
+	max := d.MaxImageBytes
+	if max == 0 {
+		max = DefaultMaxImageBytes
+	}
+	if max > 0 && n > max {
+		return FormatError{Kind: TooLarge, Detail: fmt.Sprintf("image of %d bytes exceeds the limit of %d bytes", n, max)}
+	}
+	return nil
+}
+
+// newImage allocates an image with bounds r of the type that Decode returns
+// for the image described by d.
+func (d *decoder) newImage(r image.Rectangle) (image.Image, error) {
+	if err := d.checkSampleFormats(); err != nil {
+		return nil, err
+	}
+	if err := d.checkSize(d.rawSize(r.Dx(), r.Dy(), len(d.features[tBitsPerSample]))); err != nil {
+		return nil, err
+	}
+	var img image.Image
 	switch d.mode {
 	case mGray, mGrayInvert:
 		switch d.sFormat {
 		case uintSample:
-			if d.bpp == 16 {
+			if d.bpp > 8 {
 				// TODO: This is a hack to test new geospatial types that implement the Image interface
-				//img = &scimage.NewGrayU16(imgRect), "", []float64{d.tiePoint[3], d.pixScale[0], 0, d.tiePoint[4], 0, -1 * d.pixScale[1]}, d.noData}
-				img = scimage.NewGrayU16(imgRect, 0, 65535)
+				//img = &scimage.NewGrayU16(r), "", []float64{d.tiePoint[3], d.pixScale[0], 0, d.tiePoint[4], 0, -1 * d.pixScale[1]}, d.noData}
+				img = scimage.NewGrayU16(r, 0, 65535)
 			} else {
-				img = scimage.NewGrayU8(imgRect, 0, 255)
+				img = scimage.NewGrayU8(r, 0, 255)
 			}
 		case sintSample:
+			if d.bpp != 8 && d.bpp != 16 {
+				return nil, FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("signed BitsPerSample of %v", d.bpp)}
+			}
 			if d.bpp == 16 {
-				//img = scimage.NewGrayS16(imgRect, -32768, 32767)
-				img = scimage.NewGrayS16(imgRect, 0, 32767)
+				//img = scimage.NewGrayS16(r, -32768, 32767)
+				img = scimage.NewGrayS16(r, 0, 32767)
 			} else {
-				img = scimage.NewGrayS8(imgRect, -128, 127)
+				img = scimage.NewGrayS8(r, -128, 127)
 			}
 		default:
-			return nil, FormatError("image data type not implemented")
+			return nil, FormatError{Kind: Unsupported, Tag: tSampleFormat, Detail: "image data type not implemented"}
 		}
 	case mPaletted:
-		img = image.NewPaletted(imgRect, d.palette)
+		if d.bpp > 8 {
+			img = image.NewRGBA64(r)
+		} else {
+			img = image.NewPaletted(r, d.palette)
+		}
 	case mNRGBA:
-		if d.bpp == 16 {
-			img = image.NewNRGBA64(imgRect)
+		if d.bpp != 8 {
+			img = image.NewNRGBA64(r)
 		} else {
-			img = image.NewNRGBA(imgRect)
+			img = image.NewNRGBA(r)
 		}
 	case mRGB, mRGBA:
+		if d.bpp != 8 {
+			img = image.NewRGBA64(r)
+		} else {
+			img = image.NewRGBA(r)
+		}
+	case mCIELab:
 		if d.bpp == 16 {
-			img = image.NewRGBA64(imgRect)
+			img = image.NewNRGBA64(r)
 		} else {
-			img = image.NewRGBA(imgRect)
+			img = image.NewNRGBA(r)
 		}
+	case mCMYK:
+		img = image.NewCMYK(r)
+	case mYCbCr:
+		img = image.NewRGBA(r)
+	case mCMYKA:
+		img = image.NewNRGBA(r)
+	case mSeparated:
+		return nil, FormatError{Kind: Unsupported, Tag: tInkSet, Detail: "inks other than CMYK"}
 	default:
-		return nil, FormatError("color model not implemented")
+		return nil, FormatError{Kind: UnsupportedPhotometric, Tag: tPhotometricInterpretation, Detail: "color model not implemented"}
 	}
+	return img, nil
+}
 
-	for i := 0; i < blocksAcross; i++ {
-		blkW := blockWidth
-		if !blockPadding && i == blocksAcross-1 && d.config.Width%blockWidth != 0 {
-			blkW = d.config.Width % blockWidth
+// ReadWindow decodes the w×h pixel window of the image whose top-left corner
+// is at (x, y). Only the strips or tiles intersecting the window are
+// decompressed. The returned image has the same type as the one returned by
+// Decode, and its bounds are the window.
+func (d *decoder) ReadWindow(x, y, w, h int) (image.Image, error) {
+	r := image.Rect(x, y, x+w, y+h)
+	if w <= 0 || h <= 0 || !r.In(image.Rect(0, 0, d.config.Width, d.config.Height)) {
+		return nil, fmt.Errorf("tiff: window %v outside of image bounds %dx%d", r, d.config.Width, d.config.Height)
+	}
+	if d.bpp > 16 {
+		return nil, FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("BitsPerSample of %v", d.bpp)}
+	}
+	planes, err := d.planes()
+	if err != nil {
+		return nil, err
+	}
+	img, err := d.newImage(r)
+	if err != nil {
+		return nil, err
+	}
+	var indices []int
+	for i, b := range planes[0] {
+		if b.rect.Overlaps(r) {
+			indices = append(indices, i)
 		}
-		for j := 0; j < blocksDown; j++ {
-			blkH := blockHeight
-			if !blockPadding && j == blocksDown-1 && d.config.Height%blockHeight != 0 {
-				blkH = d.config.Height % blockHeight
-			}
-			offset := int64(blockOffsets[j*blocksAcross+i])
-			n := int64(blockCounts[j*blocksAcross+i])
-			switch d.firstVal(tCompression) {
+	}
+	err = d.readBlocks(planes, indices, func(i int, buf []byte) error {
+		d.buf = buf
+		b := planes[0][i].rect
+		return d.decode(img, b.Min.X, b.Min.Y, b.Max.X, b.Max.Y)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
 
-			// According to the spec, Compression does not have a default value,
-			// but some tools interpret a missing Compression value as none so we do
-			// the same.
-			case cNone, 0:
-				if b, ok := d.r.(*buffer); ok {
-					d.buf, err = b.Slice(int(offset), int(n))
-				} else {
-					d.buf = make([]byte, n)
-					_, err = d.r.ReadAt(d.buf, offset)
-				}
-			case cLZW:
-				r := lzw.NewReader(io.NewSectionReader(d.r, offset, n), lzw.MSB, 8)
-				d.buf, err = ioutil.ReadAll(r)
-				r.Close()
-			case cDeflate, cDeflateOld:
-				var r io.ReadCloser
-				r, err = zlib.NewReader(io.NewSectionReader(d.r, offset, n))
-				if err != nil {
-					return nil, err
-				}
-				d.buf, err = ioutil.ReadAll(r)
-				r.Close()
-			case cPackBits:
-				d.buf, err = unpackBits(io.NewSectionReader(d.r, offset, n))
-			default:
-				err = UnsupportedError(fmt.Sprintf("compression value %d", d.firstVal(tCompression)))
-			}
-			if err != nil {
-				return nil, err
-			}
+// DecodeStrips decodes the TIFF image in r one strip at a time, or one tile
+// at a time for tiled images, and calls fn with the index of the strip, its
+// bounds and its decompressed pixels. pix holds the samples of the pixels
+// of bounds in row-major order, as stored in the file: samples keep the byte
+// order of the file, the samples of a pixel are contiguous and each row
+// starts on a byte boundary. Tiles are padded, so their bounds may extend
+// beyond the image. pix is only valid until fn returns.
+//
+// If fn returns an error, DecodeStrips stops and returns that error.
+func DecodeStrips(r io.ReaderAt, fn func(stripIndex int, bounds image.Rectangle, pix []byte) error) error {
+	d, err := newDecoderAt(r)
+	if err != nil {
+		return err
+	}
+	planes, err := d.planes()
+	if err != nil {
+		return err
+	}
+	bitsPerPixel := 0
+	for _, b := range d.features[tBitsPerSample] {
+		bitsPerPixel += int(b)
+	}
+	for i, b := range planes[0] {
+		buf, err := d.readBlock(planes, i)
+		if err != nil {
+			return err
+		}
+		n := (b.rect.Dx()*bitsPerPixel + 7) / 8 * b.rect.Dy()
+		if len(buf) < n {
+			return errNoPixels
+		}
+		if err := fn(i, b.rect, buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			xmin := i * blockWidth
-			ymin := j * blockHeight
-			xmax := xmin + blkW
-			ymax := ymin + blkH
-			err = d.decode(img, xmin, ymin, xmax, ymax)
-			if err != nil {
-				return nil, err
-			}
+// DecodeOptions are the decoding parameters of the package-level functions
+// Decode, DecodeContext, DecodeConfig, DecodeAll and DecodeAt, which are
+// also provided as methods of DecodeOptions. A nil *DecodeOptions uses the
+// defaults, as the package-level functions do.
+type DecodeOptions struct {
+	// Concurrency is the maximum number of strips or tiles decompressed
+	// concurrently when decoding an image. If zero or negative, the value
+	// of runtime.GOMAXPROCS is used.
+	Concurrency int
+
+	// MaxImageBytes is the maximum size in bytes of the uncompressed pixel
+	// data of an image, or of a strip or tile, that is decoded. If zero,
+	// DefaultMaxImageBytes is used. If negative, there is no limit.
+	MaxImageBytes int64
+
+	// Progress, if not nil, is called after each strip or tile of an image
+	// is decoded, with the number of strips or tiles decoded so far and
+	// the number of those of the image.
+	Progress func(done, total int)
+
+	// Strict determines whether files that do not follow the spec in ways
+	// that the decoder otherwise tolerates are rejected with a FormatError,
+	// such as IFDs whose entries are not sorted in ascending tag order.
+	Strict bool
+}
+
+// apply sets the decoding parameters of d from o.
+func (o *DecodeOptions) apply(d *decoder) {
+	if o == nil {
+		return
+	}
+	d.Concurrency = o.Concurrency
+	if o.MaxImageBytes != 0 {
+		d.MaxImageBytes = o.MaxImageBytes
+	}
+	d.Progress = o.Progress
+	d.strict = o.Strict
+}
+
+// DecodeConfig returns the color model and dimensions of a TIFF image without
+// decoding the entire image. Only the header and the first IFD are read.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	var o *DecodeOptions
+	return o.DecodeConfig(r)
+}
+
+// DecodeConfig is like the package-level DecodeConfig, with the decoding
+// parameters of o.
+func (o *DecodeOptions) DecodeConfig(r io.Reader) (image.Config, error) {
+	d, err := o.newDecoder(newReaderAt(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return d.config, nil
+}
+
+// Metadata describes the image of a TIFF file, as returned by Info.
+type Metadata struct {
+	Width, Height int             // The size of the image in pixels.
+	Bands         int             // The number of samples per pixel.
+	BitsPerSample []int           // The depth of each sample.
+	Compression   CompressionType // See decoder.Compression.
+	Photometric   int             // The PhotometricInterpretation tag.
+	Tiled         bool            // Whether the image is stored in tiles.
+	GeoKeys       bool            // Whether the image has a GeoKeyDirectory.
+}
+
+// Info returns the metadata of the first image of the TIFF file in r. Like
+// DecodeConfig, only the header and the first IFD are read, but the image
+// need not be supported by Decode.
+func Info(r io.Reader) (Metadata, error) {
+	d, err := readFirstIFD(newReaderAt(r))
+	if err != nil {
+		return Metadata{}, err
+	}
+	bands, err := d.Bands()
+	if err != nil {
+		return Metadata{}, err
+	}
+	m := Metadata{
+		Width:       int(d.firstVal(tImageWidth)),
+		Height:      int(d.firstVal(tImageLength)),
+		Bands:       bands,
+		Compression: d.Compression(),
+		Photometric: int(d.firstVal(tPhotometricInterpretation)),
+		Tiled:       d.IsTiled(),
+	}
+	for _, b := range d.features[tBitsPerSample] {
+		m.BitsPerSample = append(m.BitsPerSample, int(b))
+	}
+	_, m.GeoKeys = d.features[tGeoKeyDirectory]
+	return m, nil
+}
+
+// Decode reads a TIFF image from r and returns it as an image.Image.
+// The type of Image returned depends on the contents of the TIFF.
+func Decode(r io.Reader) (img image.Image, err error) {
+	var o *DecodeOptions
+	return o.Decode(r)
+}
+
+// Decode is like the package-level Decode, with the decoding parameters of
+// o.
+func (o *DecodeOptions) Decode(r io.Reader) (image.Image, error) {
+	d, err := o.newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeImage()
+}
+
+// DecodeContext is like Decode, but stops decoding the image and returns
+// ctx.Err() once ctx is canceled. The cancellation is checked between the
+// strips or tiles of the image.
+func DecodeContext(ctx context.Context, r io.Reader) (image.Image, error) {
+	var o *DecodeOptions
+	return o.DecodeContext(ctx, r)
+}
+
+// DecodeContext is like the package-level DecodeContext, with the decoding
+// parameters of o.
+func (o *DecodeOptions) DecodeContext(ctx context.Context, r io.Reader) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, err := o.newDecoder(newReaderAt(r))
+	if err != nil {
+		return nil, err
+	}
+	d.ctx = ctx
+	return d.decodeImage()
+}
+
+// canceled returns the error of the context of d, if it is canceled.
+func (d *decoder) canceled() error {
+	if d.ctx == nil {
+		return nil
+	}
+	return d.ctx.Err()
+}
+
+// DecodeAll decodes all the images of the TIFF file in r, such as the pages
+// of a multi-page file or the levels of an image pyramid, in file order.
+func DecodeAll(r io.ReaderAt) ([]image.Image, error) {
+	var o *DecodeOptions
+	return o.DecodeAll(r)
+}
+
+// DecodeAll is like the package-level DecodeAll, with the decoding
+// parameters of o.
+func (o *DecodeOptions) DecodeAll(r io.ReaderAt) ([]image.Image, error) {
+	d, err := o.newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	img, err := d.decodeImage()
+	if err != nil {
+		return nil, err
+	}
+	imgs := []image.Image{img}
+	err = d.walkIFDs(func(d1 *decoder) error {
+		if err := d1.configure(); err != nil {
+			return err
+		}
+		img, err := d1.decodeImage()
+		if err != nil {
+			return err
 		}
+		imgs = append(imgs, img)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return imgs, nil
+}
+
+// CountImages returns the number of images in the TIFF file in r, that is
+// the number of IFDs in its chain of IFDs. Only the IFDs are read.
+func CountImages(r io.ReaderAt) (int, error) {
+	d, err := readFirstIFD(r)
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	err = d.walkIFDs(func(*decoder) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// A Reader gives random access to a TIFF image stored in an io.ReaderAt.
+// Only the header and the first IFD are read when the Reader is created;
+// the strips or tiles are read when needed, with one ReadAt call each. For
+// example, ReadWindow only reads the tiles overlapping the window.
+//
+// The strips or tiles may be read concurrently, as allowed by the contract
+// of io.ReaderAt.
+type Reader struct {
+	*decoder
+	closer io.Closer // The file opened by DecodeFile, if any.
+}
+
+// DecodeAt reads the header and the first IFD of the TIFF file in r, and
+// returns a Reader of its image.
+func DecodeAt(r io.ReaderAt) (*Reader, error) {
+	var o *DecodeOptions
+	return o.DecodeAt(r)
+}
+
+// DecodeAt is like the package-level DecodeAt, with the decoding parameters
+// of o.
+func (o *DecodeOptions) DecodeAt(r io.ReaderAt) (*Reader, error) {
+	d, err := o.newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	d.cache = newTileCache()
+	return &Reader{decoder: d}, nil
+}
+
+// Open is like DecodeAt. The returned Reader should be closed with Close
+// once it is no longer needed.
+func Open(r io.ReaderAt) (*Reader, error) {
+	return DecodeAt(r)
+}
+
+// errClosed is returned by the reads of a closed Reader.
+var errClosed = errors.New("tiff: read from closed Reader")
+
+// closedReaderAt is the io.ReaderAt of a closed Reader.
+type closedReaderAt struct{}
+
+func (closedReaderAt) ReadAt([]byte, int64) (int, error) { return 0, errClosed }
+
+// Close releases the data held by the Reader, such as its decompression
+// buffer and the IFDs of its overviews. The methods of a closed Reader that
+// need to read the file, including those of its overviews, return an error.
+// Close does not close r itself, which belongs to the caller of Open, but
+// closes the file opened by DecodeFile.
+func (r *Reader) Close() error {
+	for _, o := range r.overviews {
+		o.d.release()
+	}
+	r.release()
+	r.cache.resize(0)
+	if c := r.closer; c != nil {
+		r.closer = nil
+		return c.Close()
+	}
+	return nil
+}
+
+// release detaches d from its file and drops the data it holds.
+func (d *decoder) release() {
+	d.r = closedReaderAt{}
+	d.ifd = nil
+	d.buf = nil
+	d.overviews = nil
+}
+
+// Decode decodes the whole image, as the package-level Decode does.
+func (r *Reader) Decode() (image.Image, error) {
+	return r.decodeImage()
+}
+
+// decodeImage decodes the whole image, applying its orientation if
+// d.ApplyOrientation is true.
+func (d *decoder) decodeImage() (img image.Image, err error) {
+	if d.bpp > 16 {
+		return nil, FormatError{Kind: Unsupported, Tag: tBitsPerSample, Detail: fmt.Sprintf("BitsPerSample of %v", d.bpp)}
+	}
+
+	planes, err := d.planes()
+	if err != nil {
+		return nil, err
+	}
+
+	img, err = d.newImage(image.Rect(0, 0, d.config.Width, d.config.Height))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.decodeBlocks(img, planes); err != nil {
+		return nil, err
+	}
+	if d.ApplyOrientation {
+		return d.orient(img)
 	}
 	return
 }
 
+// decodeBlocks decodes all the strips or tiles of planes into img.
+func (d *decoder) decodeBlocks(img image.Image, planes [][]block) error {
+	indices := make([]int, len(planes[0]))
+	for i := range indices {
+		indices[i] = i
+	}
+	return d.readBlocks(planes, indices, func(i int, buf []byte) error {
+		d.buf = buf
+		r := planes[0][i].rect
+		return d.decode(img, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+	})
+}
+
+// DecodeInto decodes the image into dst, which must have the bounds of
+// the image, so that the pixels of images of the same size can be decoded
+// without allocating a new image each time. The image must be one that
+// Decode returns as an image.RGBA, such as an RGB image of 8-bit samples.
+// The orientation of the image is not applied.
+func (d *decoder) DecodeInto(dst *image.RGBA) error {
+	// The type of the images returned by Decode does not depend on their
+	// size.
+	m, err := d.newImage(image.Rectangle{})
+	if err != nil {
+		return err
+	}
+	_, ok := m.(*image.RGBA)
+	return d.decodeInto(dst, ok)
+}
+
+// DecodeIntoGray is like DecodeInto, for grayscale images of unsigned
+// samples of up to 8 bits.
+func (d *decoder) DecodeIntoGray(dst *image.Gray) error {
+	return d.decodeInto(dst, d.isGray() && d.bpp <= 8)
+}
+
+// DecodeIntoGray16 is like DecodeInto, for grayscale images of unsigned
+// 16-bit samples.
+func (d *decoder) DecodeIntoGray16(dst *image.Gray16) error {
+	return d.decodeInto(dst, d.isGray() && d.bpp == 16)
+}
+
+// isGray reports whether the image is a grayscale image of unsigned
+// samples.
+func (d *decoder) isGray() bool {
+	return (d.mode == mGray || d.mode == mGrayInvert) && d.sFormat == uintSample
+}
+
+// decodeInto decodes the image into dst. ok reports whether dst has a type
+// the image can be decoded into.
+func (d *decoder) decodeInto(dst image.Image, ok bool) error {
+	if !ok {
+		return fmt.Errorf("tiff: cannot decode image into %T", dst)
+	}
+	if r := image.Rect(0, 0, d.config.Width, d.config.Height); dst.Bounds() != r {
+		return fmt.Errorf("tiff: destination bounds %v do not match image bounds %v", dst.Bounds(), r)
+	}
+	planes, err := d.planes()
+	if err != nil {
+		return err
+	}
+	return d.decodeBlocks(dst, planes)
+}
+
 func init() {
 	image.RegisterFormat("tiff", leHeader, Decode, DecodeConfig)
 	image.RegisterFormat("tiff", beHeader, Decode, DecodeConfig)
+	image.RegisterFormat("tiff", leHeaderBig, Decode, DecodeConfig)
+	image.RegisterFormat("tiff", beHeaderBig, Decode, DecodeConfig)
 }
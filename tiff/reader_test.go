@@ -6,16 +6,33 @@ package tiff
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "image/png"
+
+	"github.com/prl900/scimage"
+	"github.com/prl900/scimage/scicolor"
 )
 
 const testdataDir = "../testdata/"
@@ -69,7 +86,7 @@ func TestUnpackBits(t *testing.T) {
 		"\xaa\xaa\xaa\x80\x00\x2a\xaa\xaa\xaa\xaa\x80\x00\x2a\x22\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa",
 	}}
 	for _, u := range unpackBitsTests {
-		buf, err := unpackBits(strings.NewReader(u.compressed))
+		buf, err := unpackBits(strings.NewReader(u.compressed), len(u.uncompressed))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -79,6 +96,44 @@ func TestUnpackBits(t *testing.T) {
 	}
 }
 
+// TestUnpackBitsCorrupt tests that truncated or corrupt PackBits data does
+// not cause a panic nor produce more data than requested.
+func TestUnpackBitsCorrupt(t *testing.T) {
+	const compressed = "\xfe\xaa\x02\x80\x00\x2a\xfd\xaa\x03\x80\x00\x2a\x22\xf7\xaa"
+	for i := 0; i < len(compressed); i++ {
+		for _, n := range []int{0, 1, 7, 24, 1000} {
+			buf, err := unpackBits(strings.NewReader(compressed[:i]), n)
+			if err == nil && len(buf) > n {
+				t.Errorf("compressed[:%d], n=%d: got %d bytes", i, n, len(buf))
+			}
+		}
+	}
+
+	// A replicate run cut short is an error.
+	if _, err := unpackBits(strings.NewReader("\xfe"), 10); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated replicate run: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// A run claiming more bytes than the strip can hold is truncated.
+	buf, err := unpackBits(strings.NewReader("\x81\xaa\x81\xbb"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 100 {
+		t.Errorf("overlong run: got %d bytes, want 100", len(buf))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	junk := make([]byte, 64)
+	for i := 0; i < 1000; i++ {
+		r.Read(junk)
+		buf, err := unpackBits(bytes.NewReader(junk), 256)
+		if err == nil && len(buf) > 256 {
+			t.Fatalf("random input %x: got %d bytes", junk, len(buf))
+		}
+	}
+}
+
 func TestShortBlockData(t *testing.T) {
 	b, err := ioutil.ReadFile("../testdata/bw-uncompressed.tiff")
 	if err != nil {
@@ -147,6 +202,81 @@ func compare(t *testing.T, img0, img1 image.Image) {
 	}
 }
 
+// window restricts an image to the bounds r.
+type window struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (w window) Bounds() image.Rectangle { return w.r }
+
+func TestReadWindow(t *testing.T) {
+	var tiled []byte
+	for _, name := range []string{"video-001.tiff", "video-001-gray.tiff", "video-001-16bit.tiff"} {
+		img, err := load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Compression: Deflate, TileWidth: 32, TileLength: 32}); err != nil {
+			t.Fatal(err)
+		}
+		if tiled == nil {
+			tiled = buf.Bytes()
+		}
+		strips, err := ioutil.ReadFile(testdataDir + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, b := range [][]byte{buf.Bytes(), strips} {
+			d, err := newDecoder(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range []image.Rectangle{
+				img.Bounds(),
+				image.Rect(10, 20, 11, 21),
+				image.Rect(30, 30, 70, 90),
+				image.Rect(140, 100, 150, 103),
+			} {
+				m, err := d.ReadWindow(r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+				if err != nil {
+					t.Fatalf("%s %v: %v", name, r, err)
+				}
+				if m.Bounds() != r {
+					t.Fatalf("%s %v: got bounds %v", name, r, m.Bounds())
+				}
+				compare(t, window{img, r}, m)
+			}
+			if _, err := d.ReadWindow(140, 100, 11, 3); err == nil {
+				t.Errorf("%s: window outside of the image: got nil error, want non-nil", name)
+			}
+		}
+	}
+
+	// Corrupt the first tile, which must not be read for windows that do
+	// not intersect it.
+	d, err := newDecoder(bytes.NewReader(tiled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, n := d.features[tTileOffsets][0], d.features[tTileByteCounts][0]
+	for i := off; i < off+n; i++ {
+		tiled[i] = 0
+	}
+	d, err = newDecoder(bytes.NewReader(tiled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ReadWindow(100, 50, 20, 20); err != nil {
+		t.Errorf("window away from the corrupt tile: %v", err)
+	}
+	if _, err := d.ReadWindow(0, 0, 1, 1); err == nil {
+		t.Error("window in the corrupt tile: got nil error, want non-nil")
+	}
+}
+
 // TestDecode tests that decoding a PNG image and a TIFF image result in the
 // same pixel data.
 func TestDecode(t *testing.T) {
@@ -192,21 +322,55 @@ func TestDecodeLZW(t *testing.T) {
 	compare(t, img0, img1)
 }
 
+// TestDecodeLZWPredictor tests that the horizontal differencing predictor is
+// reversed on top of LZW-decompressed strips.
+func TestDecodeLZWPredictor(t *testing.T) {
+	img0, err := load("blue-purple-pink.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img1, err := load("blue-purple-pink.lzwcompressed-predictor.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, img0, img1)
+}
+
 // TestDecodeTagOrder tests that a malformed image with unsorted IFD entries is
-// correctly rejected.
+// decoded, and correctly rejected by strict decoding.
 func TestDecodeTagOrder(t *testing.T) {
 	data, err := ioutil.ReadFile("../testdata/video-001.tiff")
 	if err != nil {
 		t.Fatal(err)
 	}
+	want, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Swap the first two IFD entries.
 	ifdOffset := int64(binary.LittleEndian.Uint32(data[4:8]))
 	for i := ifdOffset + 2; i < ifdOffset+14; i++ {
 		data[i], data[i+12] = data[i+12], data[i]
 	}
-	if _, _, err := image.Decode(bytes.NewReader(data)); err == nil {
-		t.Fatal("got nil error, want non-nil")
+	got, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, want, got)
+	_, err = (&DecodeOptions{Strict: true}).Decode(bytes.NewReader(data))
+	if e, ok := err.(FormatError); !ok || e.Kind != Malformed {
+		t.Errorf("strict: got %v, want malformed file", err)
+	}
+
+	// Duplicate tags are rejected in both modes.
+	copy(data[ifdOffset+14:ifdOffset+16], data[ifdOffset+2:ifdOffset+4])
+	for _, strict := range []bool{false, true} {
+		_, err := (&DecodeOptions{Strict: strict}).Decode(bytes.NewReader(data))
+		if e, ok := err.(FormatError); !ok || e.Kind != Malformed {
+			t.Errorf("strict %v: duplicate tag: got %v, want malformed file", strict, err)
+		}
 	}
 }
 
@@ -232,6 +396,43 @@ func TestDecompress(t *testing.T) {
 	}
 }
 
+// TestDecodeDeflateOld tests that the superseded Deflate compression code
+// 32946, which bw-deflate.tiff uses, decodes the same as the current one, 8.
+func TestDecodeDeflateOld(t *testing.T) {
+	b0, err := ioutil.ReadFile(testdataDir + "bw-deflate.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(b0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.firstVal(tCompression); got != cDeflateOld {
+		t.Fatalf("Compression: got %d, want %d", got, cDeflateOld)
+	}
+	m0, err := d.decodeImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 03 01: tag number (tCompression)
+	// 03 00: data type (short, or uint16)
+	// 01 00 00 00: count
+	// ?? ?? 00 00: value (32946 -> 8)
+	b1, err := replace(b0,
+		"03 01 03 00 01 00 00 00 b2 80 00 00",
+		"03 01 03 00 01 00 00 00 08 00 00 00",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1, err := Decode(bytes.NewReader(b1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, m0, m1)
+}
+
 func replace(src []byte, find, repl string) ([]byte, error) {
 	removeSpaces := func(r rune) rune {
 		if r != ' ' {
@@ -255,6 +456,313 @@ func replace(src []byte, find, repl string) ([]byte, error) {
 	return dst, nil
 }
 
+// rawEntry is an IFD entry used to build test images. Each value in vals is
+// stored with the size of the entry's datatype.
+type rawEntry struct {
+	tag      uint16
+	datatype uint16
+	vals     []uint64
+}
+
+func shortsEntry(tag uint16, v ...uint16) rawEntry {
+	e := rawEntry{tag, dtShort, make([]uint64, len(v))}
+	for i, x := range v {
+		e.vals[i] = uint64(x)
+	}
+	return e
+}
+
+func longsEntry(tag uint16, v ...uint32) rawEntry {
+	e := rawEntry{tag, dtLong, make([]uint64, len(v))}
+	for i, x := range v {
+		e.vals[i] = uint64(x)
+	}
+	return e
+}
+
+func long8sEntry(tag uint16, v ...uint64) rawEntry {
+	return rawEntry{tag, dtLong8, v}
+}
+
+func doublesEntry(tag uint16, v ...float64) rawEntry {
+	e := rawEntry{tag, dtFloat64, make([]uint64, len(v))}
+	for i, x := range v {
+		e.vals[i] = math.Float64bits(x)
+	}
+	return e
+}
+
+func asciiEntry(tag uint16, s string) rawEntry {
+	e := rawEntry{tag, dtASCII, make([]uint64, len(s)+1)}
+	for i := 0; i < len(s); i++ {
+		e.vals[i] = uint64(s[i])
+	}
+	return e
+}
+
+// pixOffset and bigPixOffset are the offsets of the pixel data in the files
+// made by makeTIFF and makeBigTIFF.
+const (
+	pixOffset    = 8
+	bigPixOffset = 16
+)
+
+// makeTIFF returns a TIFF file with the given byte order, holding pix at
+// pixOffset followed by a single IFD. The IFD describes a single-strip 1x1
+// 8-bit grayscale image, unless the given entries override its tags.
+func makeTIFF(order binary.ByteOrder, pix []byte, entries ...rawEntry) []byte {
+	return makeFile(order, false, pix, entries)
+}
+
+// makeBigTIFF is like makeTIFF, but returns a BigTIFF file holding pix at
+// bigPixOffset.
+func makeBigTIFF(order binary.ByteOrder, pix []byte, entries ...rawEntry) []byte {
+	return makeFile(order, true, pix, entries)
+}
+
+func makeFile(order binary.ByteOrder, big bool, pix []byte, entries []rawEntry) []byte {
+	return makePages(order, big, page{pix, entries})
+}
+
+// A page is the pixel data and the IFD entries of one of the images of a
+// file made by makePages.
+type page struct {
+	pix     []byte
+	entries []rawEntry
+}
+
+// makePages returns a TIFF file with the given byte order, holding the
+// pixel data of each page followed by its IFD. The IFDs are chained in
+// order, and their entries default to those described for makeTIFF, with
+// StripOffsets pointing to the pixel data of the page.
+func makePages(order binary.ByteOrder, big bool, pages ...page) []byte {
+	var out bytes.Buffer
+	// word writes an offset or count, which is 8 bytes long in BigTIFF
+	// files and 4 bytes long otherwise.
+	word := func(b *bytes.Buffer, v int) {
+		if big {
+			binary.Write(b, order, uint64(v))
+		} else {
+			binary.Write(b, order, uint32(v))
+		}
+	}
+	switch {
+	case order == binary.BigEndian && big:
+		out.WriteString(beHeaderBig)
+	case big:
+		out.WriteString(leHeaderBig)
+	case order == binary.BigEndian:
+		out.WriteString(beHeader)
+	default:
+		out.WriteString(leHeader)
+	}
+	if big {
+		binary.Write(&out, order, [2]uint16{8, 0})
+	}
+	// next is the offset of the pointer to the next IFD.
+	next := out.Len()
+	word(&out, 0)
+
+	entryLen, countLen, valLen := ifdLen, 2, 4
+	if big {
+		entryLen, countLen, valLen = ifdLenBig, 8, 8
+	}
+	for _, pg := range pages {
+		off := out.Len()
+		byTag := map[uint16]rawEntry{}
+		for _, e := range []rawEntry{
+			shortsEntry(tImageWidth, 1),
+			shortsEntry(tImageLength, 1),
+			shortsEntry(tBitsPerSample, 8),
+			shortsEntry(tCompression, cNone),
+			shortsEntry(tPhotometricInterpretation, pBlackIsZero),
+			longsEntry(tStripOffsets, uint32(off)),
+			shortsEntry(tSamplesPerPixel, 1),
+			shortsEntry(tRowsPerStrip, 1),
+			longsEntry(tStripByteCounts, uint32(len(pg.pix))),
+		} {
+			byTag[e.tag] = e
+		}
+		for _, e := range pg.entries {
+			byTag[e.tag] = e
+		}
+		var tags []int
+		for tag := range byTag {
+			tags = append(tags, int(tag))
+		}
+		sort.Ints(tags)
+
+		out.Write(pg.pix)
+		ifdOffset := out.Len()
+		var p bytes.Buffer
+		word(&p, ifdOffset)
+		copy(out.Bytes()[next:], p.Bytes())
+
+		var data bytes.Buffer
+		parea := ifdOffset + countLen + entryLen*len(tags) + valLen
+		if big {
+			word(&out, len(tags))
+		} else {
+			binary.Write(&out, order, uint16(len(tags)))
+		}
+		for _, tag := range tags {
+			e := byTag[uint16(tag)]
+			var val bytes.Buffer
+			for _, v := range e.vals {
+				switch lengths[e.datatype] {
+				case 1:
+					val.WriteByte(byte(v))
+				case 2:
+					binary.Write(&val, order, uint16(v))
+				case 4:
+					binary.Write(&val, order, uint32(v))
+				case 8:
+					binary.Write(&val, order, v)
+				}
+			}
+			binary.Write(&out, order, e.tag)
+			binary.Write(&out, order, e.datatype)
+			word(&out, len(e.vals))
+			if val.Len() <= valLen {
+				p := make([]byte, valLen)
+				copy(p, val.Bytes())
+				out.Write(p)
+			} else {
+				word(&out, parea+data.Len())
+				data.Write(val.Bytes())
+			}
+		}
+		next = out.Len()
+		word(&out, 0)
+		out.Write(data.Bytes())
+	}
+	return out.Bytes()
+}
+
+// buildTIFF returns a little-endian TIFF file holding a 1x1 8-bit grayscale
+// image, whose IFD also contains the given extra entries.
+func buildTIFF(extra ...rawEntry) []byte {
+	return makeTIFF(binary.LittleEndian, []byte{0}, extra...)
+}
+
+func TestDecodeBigTIFF(t *testing.T) {
+	pix := []byte{
+		0x00, 0x10, 0x20,
+		0x30, 0x40, 0x50,
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		b := makeBigTIFF(order, pix,
+			shortsEntry(tImageWidth, 3),
+			shortsEntry(tImageLength, 2),
+			long8sEntry(tStripOffsets, bigPixOffset, bigPixOffset+3),
+			shortsEntry(tRowsPerStrip, 1),
+			long8sEntry(tStripByteCounts, 3, 3),
+			doublesEntry(tModelPixelScale, 30, 30, 0),
+			doublesEntry(tModelTiepoint, 0, 0, 0, 440720, 3751320, 0),
+		)
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		if !d.bigTIFF {
+			t.Errorf("%v: not detected as BigTIFF", order)
+		}
+		if gt, err := d.GeoTransform(); err != nil || gt[0] != 440720 || gt[3] != 3751320 {
+			t.Errorf("%v: GeoTransform: got %v, %v", order, gt, err)
+		}
+		m, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		want := makeTIFF(order, pix,
+			shortsEntry(tImageWidth, 3),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tRowsPerStrip, 2),
+			longsEntry(tStripByteCounts, 6),
+		)
+		m0, err := Decode(bytes.NewReader(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		compare(t, m0, m)
+	}
+
+	// The offset size in the header must be 8.
+	b := makeBigTIFF(binary.LittleEndian, []byte{0})
+	b[4] = 4
+	if _, err := Decode(bytes.NewReader(b)); err == nil {
+		t.Error("bad offset size: got nil error, want non-nil")
+	}
+}
+
+func TestDecodePlanar(t *testing.T) {
+	const w, h = 3, 2
+	pix := []byte{
+		10, 20, 30, 11, 22, 33, 12, 24, 36,
+		40, 50, 60, 41, 52, 63, 42, 54, 66,
+	}
+	want, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix,
+		shortsEntry(tImageWidth, w),
+		shortsEntry(tImageLength, h),
+		shortsEntry(tBitsPerSample, 8, 8, 8),
+		shortsEntry(tPhotometricInterpretation, pRGB),
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tRowsPerStrip, h),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each plane is a single deflated strip, using the horizontal predictor.
+	var data bytes.Buffer
+	var offsets, counts []uint32
+	for s := 0; s < 3; s++ {
+		plane := make([]byte, 0, w*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := pix[(y*w+x)*3+s]
+				if x > 0 {
+					v -= pix[(y*w+x-1)*3+s]
+				}
+				plane = append(plane, v)
+			}
+		}
+		offsets = append(offsets, uint32(pixOffset+data.Len()))
+		zw := zlib.NewWriter(&data)
+		zw.Write(plane)
+		zw.Close()
+		counts = append(counts, uint32(pixOffset+data.Len())-offsets[s])
+	}
+	b := makeTIFF(binary.LittleEndian, data.Bytes(),
+		shortsEntry(tImageWidth, w),
+		shortsEntry(tImageLength, h),
+		shortsEntry(tBitsPerSample, 8, 8, 8),
+		shortsEntry(tCompression, cDeflate),
+		shortsEntry(tPhotometricInterpretation, pRGB),
+		longsEntry(tStripOffsets, offsets...),
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tRowsPerStrip, h),
+		longsEntry(tStripByteCounts, counts...),
+		shortsEntry(tPlanarConfiguration, pcPlanar),
+		shortsEntry(tPredictor, prHorizontal),
+	)
+	got, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, want, got)
+
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.ReadWindow(1, 1, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, window{want, image.Rect(1, 1, 3, 2)}, m)
+}
+
 // TestZeroBitsPerSample tests that an IFD with a bitsPerSample of 0 does not
 // cause a crash.
 // Issue 10711.
@@ -393,3 +901,1686 @@ func benchmarkDecode(b *testing.B, filename string) {
 
 func BenchmarkDecodeCompressed(b *testing.B)   { benchmarkDecode(b, "video-001.tiff") }
 func BenchmarkDecodeUncompressed(b *testing.B) { benchmarkDecode(b, "video-001-uncompressed.tiff") }
+
+func TestDecodeOrientation(t *testing.T) {
+	// The stored image is 3x2:
+	//	0 1 2
+	//	3 4 5
+	testCases := []struct {
+		orientation uint16
+		w, h        int
+		want        []uint8
+	}{
+		{1, 3, 2, []uint8{0, 1, 2, 3, 4, 5}},
+		{2, 3, 2, []uint8{2, 1, 0, 5, 4, 3}},
+		{3, 3, 2, []uint8{5, 4, 3, 2, 1, 0}},
+		{4, 3, 2, []uint8{3, 4, 5, 0, 1, 2}},
+		{5, 2, 3, []uint8{0, 3, 1, 4, 2, 5}},
+		{6, 2, 3, []uint8{3, 0, 4, 1, 5, 2}},
+		{7, 2, 3, []uint8{5, 2, 4, 1, 3, 0}},
+		{8, 2, 3, []uint8{2, 5, 1, 4, 0, 3}},
+	}
+	for _, tc := range testCases {
+		b := makeTIFF(binary.LittleEndian, []byte{0, 1, 2, 3, 4, 5},
+			shortsEntry(tImageWidth, 3),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tOrientation, tc.orientation),
+			shortsEntry(tRowsPerStrip, 2),
+			longsEntry(tStripByteCounts, 6),
+		)
+		m, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("orientation %d: %v", tc.orientation, err)
+		}
+		if got := m.Bounds(); got != image.Rect(0, 0, tc.w, tc.h) {
+			t.Errorf("orientation %d: got bounds %v, want %dx%d", tc.orientation, got, tc.w, tc.h)
+			continue
+		}
+		var got []uint8
+		for y := 0; y < tc.h; y++ {
+			for x := 0; x < tc.w; x++ {
+				got = append(got, m.At(x, y).(scicolor.GrayU8).Y)
+			}
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("orientation %d: got %v, want %v", tc.orientation, got, tc.want)
+		}
+
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o := d.Orientation(); o != int(tc.orientation) {
+			t.Errorf("Orientation: got %d, want %d", o, tc.orientation)
+		}
+		d.ApplyOrientation = false
+		m, err = d.decodeImage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Bounds(); got != image.Rect(0, 0, 3, 2) {
+			t.Errorf("orientation %d not applied: got bounds %v, want 3x2", tc.orientation, got)
+		}
+	}
+}
+
+func TestDecodeCMYK(t *testing.T) {
+	pix := []byte{
+		0, 0, 0, 0, 0xff, 0x80, 0x40, 0x20,
+		0x10, 0x20, 0x30, 0x40, 0, 0, 0, 0xff,
+	}
+	m, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix,
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tBitsPerSample, 8, 8, 8, 8),
+		shortsEntry(tPhotometricInterpretation, pCMYK),
+		shortsEntry(tSamplesPerPixel, 4),
+		shortsEntry(tRowsPerStrip, 2),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &image.CMYK{Pix: pix, Stride: 8, Rect: image.Rect(0, 0, 2, 2)}
+	if got, ok := m.(*image.CMYK); !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+
+	// An extra sample holding unassociated alpha.
+	pix = []byte{0x10, 0x20, 0x30, 0x40, 0x80}
+	m, err = Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix,
+		shortsEntry(tBitsPerSample, 8, 8, 8, 8, 8),
+		shortsEntry(tPhotometricInterpretation, pCMYK),
+		shortsEntry(tSamplesPerPixel, 5),
+		shortsEntry(tExtraSamples, 2),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b := color.CMYKToRGB(0x10, 0x20, 0x30, 0x40)
+	if got, want := m.At(0, 0), (color.NRGBA{r, g, b, 0x80}); got != want {
+		t.Errorf("CMYK with alpha: got %v, want %v", got, want)
+	}
+
+	_, err = Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, make([]byte, 4),
+		shortsEntry(tBitsPerSample, 8, 8, 8, 8),
+		shortsEntry(tPhotometricInterpretation, pCMYK),
+		shortsEntry(tSamplesPerPixel, 4),
+		shortsEntry(tInkSet, inkNotCMYK),
+	)))
+	if e, ok := err.(FormatError); !ok || e.Kind != Unsupported || e.Tag != tInkSet {
+		t.Errorf("InkSet not CMYK: got %v, want unsupported InkSet", err)
+	}
+}
+
+func TestDecodeYCbCr(t *testing.T) {
+	// A 3x3 image with 4:2:0 subsampling is stored in 2x2 data units of 4
+	// luma samples, followed by Cb and Cr.
+	units := [][6]byte{
+		{10, 20, 30, 40, 100, 150},
+		{50, 60, 70, 80, 128, 128},
+		{90, 100, 110, 120, 200, 50},
+		{130, 140, 150, 160, 0, 255},
+	}
+	var pix []byte
+	for _, u := range units {
+		pix = append(pix, u[:]...)
+	}
+	for _, entries := range [][]rawEntry{
+		nil, // The subsampling defaults to 2x2.
+		{shortsEntry(tYCbCrSubSampling, 2, 2)},
+	} {
+		m, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix, append(entries,
+			shortsEntry(tImageWidth, 3),
+			shortsEntry(tImageLength, 3),
+			shortsEntry(tBitsPerSample, 8, 8, 8),
+			shortsEntry(tPhotometricInterpretation, pYCbCr),
+			shortsEntry(tSamplesPerPixel, 3),
+			shortsEntry(tRowsPerStrip, 4),
+		)...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Bounds() != image.Rect(0, 0, 3, 3) {
+			t.Fatalf("got bounds %v, want 3x3", m.Bounds())
+		}
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 3; x++ {
+				u := units[(y/2)*2+x/2]
+				r, g, b := color.YCbCrToRGB(u[(y%2)*2+x%2], u[4], u[5])
+				if got, want := m.At(x, y), (color.RGBA{r, g, b, 0xff}); got != want {
+					t.Errorf("pixel at (%d, %d): got %v, want %v", x, y, got, want)
+				}
+			}
+		}
+	}
+
+	_, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix,
+		shortsEntry(tBitsPerSample, 8, 8, 8),
+		shortsEntry(tPhotometricInterpretation, pYCbCr),
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tYCbCrSubSampling, 3, 1),
+	)))
+	if err == nil {
+		t.Error("bad subsampling: got nil error, want non-nil")
+	}
+}
+
+func TestDecodeCIELab(t *testing.T) {
+	// The L*a*b* coordinates, relative to D50, of some sRGB colors.
+	testCases := []struct {
+		l, a, b float64
+		want    color.NRGBA
+	}{
+		{100, 0, 0, color.NRGBA{0xff, 0xff, 0xff, 0xff}},
+		{0, 0, 0, color.NRGBA{0x00, 0x00, 0x00, 0xff}},
+		{53.585, 0, 0, color.NRGBA{0x80, 0x80, 0x80, 0xff}},
+		{54.29, 80.81, 69.89, color.NRGBA{0xff, 0x00, 0x00, 0xff}},
+		{87.82, -79.29, 80.99, color.NRGBA{0x00, 0xff, 0x00, 0xff}},
+		{29.57, 68.30, -112.03, color.NRGBA{0x00, 0x00, 0xff, 0xff}},
+	}
+	// The 8-bit encoding quantizes the coordinates too coarsely to
+	// round-trip saturated colors exactly.
+	const tolerance8 = 10
+
+	var pix8, pix16 bytes.Buffer
+	for _, tc := range testCases {
+		pix8.Write([]byte{uint8(math.Floor(tc.l*0xff/100 + 0.5)), uint8(int8(math.Floor(tc.a + 0.5))), uint8(int8(math.Floor(tc.b + 0.5)))})
+		binary.Write(&pix16, binary.LittleEndian, []uint16{
+			uint16(math.Floor(tc.l*0xffff/100 + 0.5)),
+			uint16(int16(math.Floor(tc.a*256 + 0.5))),
+			uint16(int16(math.Floor(tc.b*256 + 0.5))),
+		})
+	}
+	for _, f := range []struct {
+		bps       uint16
+		pix       []byte
+		tolerance int
+	}{
+		{8, pix8.Bytes(), tolerance8},
+		{16, pix16.Bytes(), 1},
+	} {
+		m, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, f.pix,
+			shortsEntry(tImageWidth, uint16(len(testCases))),
+			shortsEntry(tBitsPerSample, f.bps, f.bps, f.bps),
+			shortsEntry(tPhotometricInterpretation, pCIELab),
+			shortsEntry(tSamplesPerPixel, 3),
+			longsEntry(tStripByteCounts, uint32(len(f.pix))),
+		)))
+		if err != nil {
+			t.Fatalf("%d-bit: %v", f.bps, err)
+		}
+		for i, tc := range testCases {
+			got := color.NRGBAModel.Convert(m.At(i, 0)).(color.NRGBA)
+			if !withinTolerance(got, tc.want, f.tolerance) {
+				t.Errorf("%d-bit: Lab(%v, %v, %v): got %v, want %v", f.bps, tc.l, tc.a, tc.b, got, tc.want)
+			}
+		}
+	}
+}
+
+// withinTolerance reports whether the components of c0 and c1 differ by at
+// most tolerance.
+func withinTolerance(c0, c1 color.NRGBA, tolerance int) bool {
+	for _, d := range []int{
+		int(c0.R) - int(c1.R),
+		int(c0.G) - int(c1.G),
+		int(c0.B) - int(c1.B),
+		int(c0.A) - int(c1.A),
+	} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func TestColorMap(t *testing.T) {
+	// The red, green and blue components of a 1-bit palette.
+	cm := []uint16{
+		0x1c1c, 0x8000,
+		0x8c8c, 0x80ff,
+		0x2a2a, 0xffff,
+	}
+	want := color.Palette{
+		color.RGBA{0x1c, 0x8c, 0x2a, 0xff},
+		color.RGBA{0x80, 0x80, 0xff, 0xff},
+	}
+	d, err := newDecoder(bytes.NewReader(buildTIFF(
+		shortsEntry(tBitsPerSample, 1),
+		shortsEntry(tPhotometricInterpretation, pPaletted),
+		shortsEntry(tColorMap, cm...),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.ColorMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, entries := range [][]rawEntry{
+		{shortsEntry(tBitsPerSample, 8), shortsEntry(tColorMap, cm...)},
+		{shortsEntry(tBitsPerSample, 1)},
+	} {
+		d, err := newDecoder(bytes.NewReader(buildTIFF(entries...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.ColorMap(); err == nil {
+			t.Errorf("entries %v: got nil error, want non-nil", entries)
+		}
+	}
+}
+
+func TestDecodePaletted12(t *testing.T) {
+	// A 12-bit palette where entry i has the components i<<4, i<<3 and
+	// i<<2.
+	const n = 1 << 12
+	cm := make([]uint16, 3*n)
+	for i := 0; i < n; i++ {
+		cm[i], cm[i+n], cm[i+2*n] = uint16(i<<4), uint16(i<<3), uint16(i<<2)
+	}
+	// The indices 0x123, 0xabc and 0xfff, padded to whole bytes.
+	pix := []byte{0x12, 0x3a, 0xbc, 0xff, 0xf0}
+	b := makeTIFF(binary.LittleEndian, pix,
+		shortsEntry(tImageWidth, 3),
+		shortsEntry(tBitsPerSample, 12),
+		shortsEntry(tPhotometricInterpretation, pPaletted),
+		shortsEntry(tColorMap, cm...),
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := d.ColorMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != n {
+		t.Fatalf("got %d ColorMap entries, want %d", len(p), n)
+	}
+	if got, want := p[0xabc], (color.RGBA{0xab, 0x55, 0x2a, 0xff}); got != want {
+		t.Errorf("ColorMap entry 0xabc: got %v, want %v", got, want)
+	}
+
+	m, err := d.decodeImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x, i := range []int{0x123, 0xabc, 0xfff} {
+		want := color.RGBA64{uint16(i << 4), uint16(i << 3), uint16(i << 2), 0xffff}
+		if got := m.At(x, 0); got != want {
+			t.Errorf("pixel %d: got %v, want %v", x, got, want)
+		}
+	}
+}
+
+func TestPredictorCompression(t *testing.T) {
+	// A single pixel, stored as is and as a PackBits literal run.
+	for c, pix := range map[uint16][]byte{cNone: {7}, cPackBits: {0, 7}} {
+		_, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix,
+			shortsEntry(tCompression, c),
+			shortsEntry(tPredictor, prHorizontal),
+		)))
+		if e, ok := err.(FormatError); !ok || e.Kind != BadTag || e.Tag != tPredictor {
+			t.Errorf("compression %d: got %v, want bad Predictor", c, err)
+		}
+	}
+	// No predictor is always valid.
+	if _, err := Decode(bytes.NewReader(buildTIFF(shortsEntry(tPredictor, prNone)))); err != nil {
+		t.Errorf("no predictor: %v", err)
+	}
+}
+
+func TestDecodeHorizontalPredictor(t *testing.T) {
+	// A 16-bit gradient row, deflated after horizontal differencing.
+	want16 := []uint16{1000, 1300, 1600, 1900, 1850, 0, 65535, 2}
+	diff16 := make([]uint16, len(want16))
+	for i := range want16 {
+		diff16[i] = want16[i]
+		if i > 0 {
+			diff16[i] -= want16[i-1]
+		}
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var raw, pix bytes.Buffer
+		binary.Write(&raw, order, diff16)
+		w := zlib.NewWriter(&pix)
+		w.Write(raw.Bytes())
+		w.Close()
+		m, err := Decode(bytes.NewReader(makeTIFF(order, pix.Bytes(),
+			shortsEntry(tImageWidth, uint16(len(want16))),
+			shortsEntry(tBitsPerSample, 16),
+			shortsEntry(tCompression, cDeflate),
+			shortsEntry(tPredictor, prHorizontal),
+			longsEntry(tStripByteCounts, uint32(pix.Len())),
+		)))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		for x, want := range want16 {
+			if c, ok := m.At(x, 0).(scicolor.GrayU16); !ok || c.Y != want {
+				t.Errorf("%v: 16-bit pixel %d: got %v, want %d", order, x, m.At(x, 0), want)
+			}
+		}
+	}
+
+	// A row of 32-bit pixels with two samples, differenced per sample.
+	want32 := [][2]int32{{-5, 100000}, {70000, 99999}, {-2147483648, 0}}
+	var prev [2]int32
+	var raw bytes.Buffer
+	for _, p := range want32 {
+		binary.Write(&raw, binary.LittleEndian, []int32{p[0] - prev[0], p[1] - prev[1]})
+		prev = p
+	}
+	var pix bytes.Buffer
+	w := zlib.NewWriter(&pix)
+	w.Write(raw.Bytes())
+	w.Close()
+	d, err := newDecoder(bytes.NewReader(makeTIFF(binary.LittleEndian, pix.Bytes(),
+		shortsEntry(tImageWidth, uint16(len(want32))),
+		shortsEntry(tBitsPerSample, 32, 32),
+		shortsEntry(tSamplesPerPixel, 2),
+		shortsEntry(tSampleFormat, uint16(sintSample), uint16(sintSample)),
+		shortsEntry(tCompression, cDeflate),
+		shortsEntry(tPredictor, prHorizontal),
+		longsEntry(tStripByteCounts, uint32(pix.Len())),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for band := 0; band < 2; band++ {
+		got, _, _, err := d.Int32Band(band)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x, p := range want32 {
+			if got[x] != p[band] {
+				t.Errorf("32-bit band %d pixel %d: got %d, want %d", band, x, got[x], p[band])
+			}
+		}
+	}
+}
+
+func TestDecodeStrips(t *testing.T) {
+	// A 3x5 RGB image in strips of 2 rows.
+	const w, h = 3, 5
+	pix := make([]byte, 3*w*h)
+	for i := range pix {
+		pix[i] = uint8(i)
+	}
+	b := makeTIFF(binary.BigEndian, pix,
+		shortsEntry(tImageWidth, w),
+		shortsEntry(tImageLength, h),
+		shortsEntry(tBitsPerSample, 8, 8, 8),
+		shortsEntry(tPhotometricInterpretation, pRGB),
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tRowsPerStrip, 2),
+		longsEntry(tStripOffsets, pixOffset, pixOffset+18, pixOffset+36),
+		longsEntry(tStripByteCounts, 18, 18, 9),
+	)
+	var got []byte
+	var bounds []image.Rectangle
+	err := DecodeStrips(bytes.NewReader(b), func(i int, r image.Rectangle, p []byte) error {
+		if i != len(bounds) {
+			t.Errorf("strip index: got %d, want %d", i, len(bounds))
+		}
+		bounds = append(bounds, r)
+		got = append(got, p...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBounds := []image.Rectangle{
+		image.Rect(0, 0, w, 2),
+		image.Rect(0, 2, w, 4),
+		image.Rect(0, 4, w, 5),
+	}
+	if !reflect.DeepEqual(bounds, wantBounds) {
+		t.Errorf("bounds: got %v, want %v", bounds, wantBounds)
+	}
+	if !bytes.Equal(got, pix) {
+		t.Errorf("pixels: got %v, want %v", got, pix)
+	}
+
+	// The first error returned by fn stops decoding.
+	errStop := errors.New("stop")
+	calls := 0
+	err = DecodeStrips(bytes.NewReader(b), func(i int, r image.Rectangle, p []byte) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("got %v after %d calls, want %v after 1 call", err, calls, errStop)
+	}
+}
+
+func TestDecodeConcurrency(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 100, 70))
+	rnd := rand.New(rand.NewSource(1))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(rnd.Intn(4) * 60)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate, TileWidth: 32, TileLength: 16}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	// Break the zlib header of one of the tiles.
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := append([]byte(nil), b...)
+	bad[d.features[tTileOffsets][9]] = 0xff
+
+	for _, n := range []int{0, 1, 3, 100} {
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Concurrency = n
+		got, err := d.decodeImage()
+		if err != nil {
+			t.Fatalf("concurrency %d: %v", n, err)
+		}
+		compare(t, m, got)
+
+		w, err := d.ReadWindow(20, 10, 50, 40)
+		if err != nil {
+			t.Fatalf("concurrency %d: ReadWindow: %v", n, err)
+		}
+		compare(t, m.SubImage(image.Rect(20, 10, 70, 50)), w)
+
+		o := &DecodeOptions{Concurrency: n}
+		got, err = o.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("concurrency %d: DecodeOptions.Decode: %v", n, err)
+		}
+		compare(t, m, got)
+		all, err := o.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("concurrency %d: DecodeOptions.DecodeAll: %v", n, err)
+		}
+		compare(t, m, all[0])
+
+		d, err = newDecoder(bytes.NewReader(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Concurrency = n
+		if _, err := d.decodeImage(); err == nil {
+			t.Errorf("concurrency %d: corrupt tile: got nil error, want non-nil", n)
+		}
+		if _, err := o.DecodeContext(context.Background(), bytes.NewReader(bad)); err == nil {
+			t.Errorf("concurrency %d: DecodeOptions.DecodeContext: corrupt tile: got nil error, want non-nil", n)
+		}
+	}
+}
+
+// countingReaderAt counts the calls to ReadAt and the bytes read.
+type countingReaderAt struct {
+	r            io.ReaderAt
+	calls, bytes int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.calls++
+	c.bytes += len(p)
+	return c.r.ReadAt(p, off)
+}
+
+func TestDecodeProgress(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 40, 40))
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate, TileWidth: 16, TileLength: 16}); err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 4} {
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Concurrency = workers
+		var calls [][2]int
+		d.Progress = func(done, total int) {
+			calls = append(calls, [2]int{done, total})
+		}
+		if _, err := d.decodeImage(); err != nil {
+			t.Fatal(err)
+		}
+		var want [][2]int
+		for i := 1; i <= 9; i++ {
+			want = append(want, [2]int{i, 9})
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Errorf("%d workers: got calls %v, want %v", workers, calls, want)
+		}
+
+		// A window only reads the tiles it overlaps.
+		calls = nil
+		if _, err := d.ReadWindow(10, 10, 10, 10); err != nil {
+			t.Fatal(err)
+		}
+		if want := [][2]int{{1, 4}, {2, 4}, {3, 4}, {4, 4}}; !reflect.DeepEqual(calls, want) {
+			t.Errorf("%d workers: window: got calls %v, want %v", workers, calls, want)
+		}
+
+		calls = nil
+		o := &DecodeOptions{Concurrency: workers, Progress: d.Progress}
+		if _, err := o.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Errorf("%d workers: DecodeOptions: got calls %v, want %v", workers, calls, want)
+		}
+	}
+}
+
+// cancelingReaderAt calls cancel when the pixel data of a file written by
+// Encode, which lies between the header and the IFD, is read. Reads of the
+// pixel data are slowed down, and those still made once closed is set are
+// counted in late.
+type cancelingReaderAt struct {
+	r            io.ReaderAt
+	ifd          int64
+	once         sync.Once
+	cancel       func()
+	closed, late int32
+}
+
+func (c *cancelingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= 8 && off < c.ifd {
+		c.once.Do(c.cancel)
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&c.closed) != 0 {
+		atomic.AddInt32(&c.late, 1)
+	}
+	return c.r.ReadAt(p, off)
+}
+
+func TestDecodeContext(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 64, 256))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i / 5)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate, RowsPerStrip: 2}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	img, err := DecodeContext(context.Background(), bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, m, img)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DecodeContext(ctx, bytes.NewReader(b)); err != context.Canceled {
+		t.Errorf("canceled context: got %v, want %v", err, context.Canceled)
+	}
+
+	// Canceling while the strips are decompressed stops the decoding.
+	for _, workers := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &cancelingReaderAt{r: bytes.NewReader(b), ifd: int64(binary.LittleEndian.Uint32(b[4:])), cancel: cancel}
+		d, err := newDecoderAt(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.ctx = ctx
+		d.Concurrency = workers
+		if _, err := d.decodeImage(); err != context.Canceled {
+			t.Errorf("%d workers: got %v, want %v", workers, err, context.Canceled)
+		}
+		// The file may be closed once the decoding returns.
+		atomic.StoreInt32(&r.closed, 1)
+		time.Sleep(20 * time.Millisecond)
+		if n := atomic.LoadInt32(&r.late); n != 0 {
+			t.Errorf("%d workers: %d reads after the decoding returned", workers, n)
+		}
+	}
+}
+
+func TestDecodeAt(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i / 7)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate, TileWidth: 16, TileLength: 16}); err != nil {
+		t.Fatal(err)
+	}
+	cr := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+	r, err := DecodeAt(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cr is not safe for concurrent use.
+	r.Concurrency = 1
+	if cr.bytes >= buf.Len()/2 {
+		t.Errorf("DecodeAt read %d of %d bytes", cr.bytes, buf.Len())
+	}
+
+	// A window within the tile at (1, 2) is read with a single call.
+	cr.calls, cr.bytes = 0, 0
+	w, err := r.ReadWindow(20, 35, 8, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, m.SubImage(image.Rect(20, 35, 28, 45)), w)
+	tile := 2*4 + 1
+	if want := int(r.features[tTileByteCounts][tile]); cr.calls != 1 || cr.bytes != want {
+		t.Errorf("ReadWindow: got %d calls reading %d bytes, want 1 call reading %d bytes", cr.calls, cr.bytes, want)
+	}
+
+	got, err := r.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, m, got)
+}
+
+func TestDecodeAll(t *testing.T) {
+	pages := []page{
+		{[]byte{1, 2, 3, 4}, []rawEntry{shortsEntry(tImageWidth, 2), shortsEntry(tImageLength, 2), shortsEntry(tRowsPerStrip, 2)}},
+		{[]byte{5, 6, 7}, []rawEntry{shortsEntry(tImageWidth, 3), longsEntry(tNewSubfileType, sfPage)}},
+		{[]byte{8}, nil},
+	}
+	b := makePages(binary.BigEndian, false, pages...)
+	n, err := CountImages(bytes.NewReader(b))
+	if err != nil || n != 3 {
+		t.Errorf("CountImages: got %d, %v, want 3, nil", n, err)
+	}
+	imgs, err := DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != len(pages) {
+		t.Fatalf("got %d images, want %d", len(imgs), len(pages))
+	}
+	for i, m := range imgs {
+		var got []byte
+		r := m.Bounds()
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				got = append(got, m.At(x, y).(scicolor.GrayU8).Y)
+			}
+		}
+		if !bytes.Equal(got, pages[i].pix) {
+			t.Errorf("image %d: got %v, want %v", i, got, pages[i].pix)
+		}
+	}
+
+	// Make the last IFD point back to the second one.
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	d.walkIFDs(func(d1 *decoder) error {
+		offsets = append(offsets, d1.ifdOffset)
+		return nil
+	})
+	last := offsets[len(offsets)-1]
+	entries := int(binary.BigEndian.Uint16(b[last:]))
+	binary.BigEndian.PutUint32(b[int(last)+2+ifdLen*entries:], uint32(offsets[0]))
+	if _, err := CountImages(bytes.NewReader(b)); err == nil {
+		t.Error("CountImages with a cycle: got nil error, want non-nil")
+	}
+	if _, err := DecodeAll(bytes.NewReader(b)); err == nil {
+		t.Error("DecodeAll with a cycle: got nil error, want non-nil")
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	testCases := []struct {
+		desc string
+		b    []byte
+		kind ErrorKind
+		tag  int
+	}{
+		{"bad header", []byte("II*\x01\x08\x00\x00\x00"), BadHeader, 0},
+		{"truncated", buildTIFF()[:12], Truncated, 0},
+		{"bad tag", buildTIFF(shortsEntry(tBitsPerSample, 0)), BadTag, tBitsPerSample},
+		{"unsupported compression", buildTIFF(shortsEntry(tCompression, cJPEGOld)), UnsupportedCompression, tCompression},
+		{"unsupported photometric", buildTIFF(shortsEntry(tPhotometricInterpretation, 99)), UnsupportedPhotometric, tPhotometricInterpretation},
+	}
+	for _, tc := range testCases {
+		_, err := Decode(bytes.NewReader(tc.b))
+		e, ok := err.(FormatError)
+		if !ok {
+			t.Errorf("%s: got %v, want a FormatError", tc.desc, err)
+			continue
+		}
+		if e.Kind != tc.kind || e.Tag != tc.tag {
+			t.Errorf("%s: got kind %d and tag %d, want kind %d and tag %d", tc.desc, e.Kind, e.Tag, tc.kind, tc.tag)
+		}
+	}
+
+	err := FormatError{Kind: BadTag, Tag: tColorMap, Detail: "bad ColorMap length"}
+	if got, want := err.Error(), "tiff: invalid format: bad ColorMap length (tag 320)"; got != want {
+		t.Errorf("Error: got %q, want %q", got, want)
+	}
+	err = FormatError{Kind: UnsupportedCompression, Detail: "JPEG compression"}
+	if got, want := err.Error(), "tiff: unsupported feature: JPEG compression"; got != want {
+		t.Errorf("Error: got %q, want %q", got, want)
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	for _, tc := range []struct {
+		c      uint16
+		detail string
+	}{
+		{34712, "compression value 34712 (JPEG 2000)"},
+		{34925, "compression value 34925 (LZMA)"},
+		{50002, "compression value 50002 (JPEG XL)"},
+		{50001, "compression value 50001 (WebP)"},
+		{12345, "compression value 12345"},
+	} {
+		_, err := Decode(bytes.NewReader(buildTIFF(shortsEntry(tCompression, tc.c))))
+		want := FormatError{Kind: UnsupportedCompression, Tag: tCompression, Detail: tc.detail}
+		if err != want {
+			t.Errorf("compression %d: got %v, want %v", tc.c, err, want)
+		}
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	// The pixel data lies past the end of the file, which does not matter
+	// as long as only the IFD is read.
+	b := makeTIFF(binary.LittleEndian, nil,
+		shortsEntry(tImageWidth, 3),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tBitsPerSample, 16),
+		longsEntry(tStripOffsets, 1<<20),
+		longsEntry(tStripByteCounts, 12),
+	)
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "tiff" {
+		t.Errorf("format: got %q, want %q", format, "tiff")
+	}
+	if cfg.Width != 3 || cfg.Height != 2 || cfg.ColorModel == nil {
+		t.Errorf("got %dx%d %v, want 3x2 with a color model", cfg.Width, cfg.Height, cfg.ColorModel)
+	}
+	if _, err := Decode(bytes.NewReader(b)); err == nil {
+		t.Error("Decode: got nil error, want non-nil")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	// The pixel data lies past the end of the file, and the JPEG
+	// compressed YCbCr image cannot be decoded.
+	b := makeTIFF(binary.BigEndian, nil,
+		shortsEntry(tImageWidth, 300),
+		shortsEntry(tImageLength, 200),
+		shortsEntry(tBitsPerSample, 8, 8, 8),
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tCompression, cJPEG),
+		shortsEntry(tPhotometricInterpretation, pYCbCr),
+		shortsEntry(tTileWidth, 256),
+		shortsEntry(tTileLength, 256),
+		longsEntry(tTileOffsets, 1<<20, 1<<21),
+		longsEntry(tTileByteCounts, 12, 12),
+		shortsEntry(tGeoKeyDirectory, 1, 1, 0, 0),
+	)
+	got, err := Info(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{
+		Width:         300,
+		Height:        200,
+		Bands:         3,
+		BitsPerSample: []int{8, 8, 8},
+		Compression:   UnknownCompression,
+		Photometric:   pYCbCr,
+		Tiled:         true,
+		GeoKeys:       true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRegisterFormat(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, b := range [][]byte{
+			makeTIFF(order, []byte{0}),
+			makeBigTIFF(order, []byte{0}),
+		} {
+			if _, format, err := image.Decode(bytes.NewReader(b)); err != nil || format != "tiff" {
+				t.Errorf("%v, header %q: got format %q and error %v", order, b[:4], format, err)
+			}
+		}
+	}
+}
+
+func TestDecodeBlockOutOfBounds(t *testing.T) {
+	b := makeTIFF(binary.LittleEndian, []byte{0},
+		longsEntry(tStripByteCounts, 0xfffffff0),
+	)
+	_, err := Decode(bytes.NewReader(b))
+	if e, ok := err.(FormatError); !ok || e.Kind != Truncated || e.Tag != tStripByteCounts {
+		t.Errorf("got %v, want out of bounds StripByteCounts", err)
+	}
+	// The size of the file is unknown when reading from an io.Reader, but
+	// the data must not be allocated before it is read.
+	_, err = Decode(struct{ io.Reader }{bytes.NewReader(b)})
+	if e, ok := err.(FormatError); !ok || e.Kind != Truncated {
+		t.Errorf("io.Reader: got %v, want truncated file", err)
+	}
+	// Nor is it known for an io.ReaderAt without a Size method.
+	c := &countingReaderAt{r: bytes.NewReader(b)}
+	r, err := DecodeAt(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decode(); err == nil {
+		t.Error("io.ReaderAt: got nil error, want non-nil")
+	}
+	if c.bytes > 2*blockChunk {
+		t.Errorf("io.ReaderAt: read %d bytes of a %d-byte file", c.bytes, len(b))
+	}
+}
+
+func TestMaxImageBytes(t *testing.T) {
+	// A single compressed byte claims an image of 2.5 GB.
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte{0})
+	zw.Close()
+	b := makeTIFF(binary.LittleEndian, z.Bytes(),
+		longsEntry(tImageWidth, 50000),
+		longsEntry(tImageLength, 50000),
+		longsEntry(tRowsPerStrip, 50000),
+		shortsEntry(tCompression, cDeflate),
+		longsEntry(tStripByteCounts, uint32(z.Len())),
+	)
+	_, err := Decode(bytes.NewReader(b))
+	if e, ok := err.(FormatError); !ok || e.Kind != TooLarge {
+		t.Fatalf("got %v, want too large image", err)
+	}
+	if !strings.Contains(err.Error(), "2500000000") || !strings.Contains(err.Error(), fmt.Sprint(DefaultMaxImageBytes)) {
+		t.Errorf("error %q does not report the requested and allowed sizes", err)
+	}
+	_, err = (&DecodeOptions{MaxImageBytes: 1 << 20}).Decode(bytes.NewReader(b))
+	if e, ok := err.(FormatError); !ok || e.Kind != TooLarge || !strings.Contains(err.Error(), fmt.Sprint(1<<20)) {
+		t.Errorf("DecodeOptions.MaxImageBytes: got %v, want too large image", err)
+	}
+
+	m := image.NewGray(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := DecodeAt(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MaxImageBytes = 15
+	if _, err := r.Decode(); err == nil {
+		t.Error("MaxImageBytes 15: got nil error, want non-nil")
+	}
+	for _, max := range []int64{16, 0, -1} {
+		r.MaxImageBytes = max
+		if _, err := r.Decode(); err != nil {
+			t.Errorf("MaxImageBytes %d: %v", max, err)
+		}
+	}
+	// Zero selects the default limit, as with DecodeOptions.
+	r, err = DecodeAt(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MaxImageBytes = 0
+	if _, err := r.Decode(); err == nil || !strings.Contains(err.Error(), fmt.Sprint(DefaultMaxImageBytes)) {
+		t.Errorf("MaxImageBytes 0: got %v, want too large image", err)
+	}
+
+	if _, err := (&DecodeOptions{MaxImageBytes: 15}).Decode(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("DecodeOptions.MaxImageBytes 15: got nil error, want non-nil")
+	}
+	for _, max := range []int64{16, 0, -1} {
+		if _, err := (&DecodeOptions{MaxImageBytes: max}).Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Errorf("DecodeOptions.MaxImageBytes %d: %v", max, err)
+		}
+	}
+}
+
+func TestExtraSamples(t *testing.T) {
+	// A half transparent red pixel, with and without premultiplied alpha.
+	for _, tc := range []struct {
+		extra uint16
+		pix   []byte
+		want  color.Color
+	}{
+		{uint16(AssociatedAlpha), []byte{0x40, 0, 0, 0x80}, color.RGBA{0x40, 0, 0, 0x80}},
+		{uint16(UnassociatedAlpha), []byte{0x80, 0, 0, 0x80}, color.NRGBA{0x80, 0, 0, 0x80}},
+	} {
+		b := makeTIFF(binary.LittleEndian, tc.pix,
+			shortsEntry(tBitsPerSample, 8, 8, 8, 8),
+			shortsEntry(tPhotometricInterpretation, pRGB),
+			shortsEntry(tSamplesPerPixel, 4),
+			shortsEntry(tExtraSamples, tc.extra),
+		)
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.ExtraSamples(); !reflect.DeepEqual(got, []ExtraSample{ExtraSample(tc.extra)}) {
+			t.Errorf("ExtraSamples: got %v, want [%d]", got, tc.extra)
+		}
+		m, err := d.decodeImage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.At(0, 0); got != tc.want {
+			t.Errorf("ExtraSamples %d: got %#v, want %#v", tc.extra, got, tc.want)
+		}
+	}
+}
+
+func TestTextTags(t *testing.T) {
+	d, err := newDecoder(bytes.NewReader(buildTIFF(
+		asciiEntry(tImageDescription, "A single pixel"),
+		asciiEntry(tSoftware, "tiff test"),
+		asciiEntry(tDateTime, "2017:06:01 12:00:00"),
+		shortsEntry(tArtist, 1),
+		asciiEntry(tCopyright, "Photographer\x00Editor"),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint16]string{
+		tImageDescription: "A single pixel",
+		tSoftware:         "tiff test",
+		tDateTime:         "2017:06:01 12:00:00",
+		tCopyright:        "Photographer\x00Editor",
+	}
+	if got := d.TextTags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTiling(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 40, 50))
+	for _, tc := range []struct {
+		opts       *Options
+		tiled      bool
+		w, h       int
+		cols, rows int
+	}{
+		{&Options{TileWidth: 16, TileLength: 32}, true, 16, 32, 3, 2},
+		{&Options{RowsPerStrip: 15}, false, 40, 15, 1, 4},
+		{&Options{RowsPerStrip: 50}, false, 40, 50, 1, 1},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.IsTiled(); got != tc.tiled {
+			t.Errorf("%+v: IsTiled: got %t, want %t", tc.opts, got, tc.tiled)
+		}
+		if w, h := d.TileSize(); w != tc.w || h != tc.h {
+			t.Errorf("%+v: TileSize: got %dx%d, want %dx%d", tc.opts, w, h, tc.w, tc.h)
+		}
+		if cols, rows := d.TileGrid(); cols != tc.cols || rows != tc.rows {
+			t.Errorf("%+v: TileGrid: got %dx%d, want %dx%d", tc.opts, cols, rows, tc.cols, tc.rows)
+		}
+	}
+
+	// A zero RowsPerStrip, like a missing one, makes the image a single
+	// strip.
+	d, err := newDecoder(bytes.NewReader(makeTIFF(binary.LittleEndian, []byte{1, 2, 3, 4},
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tRowsPerStrip, 0),
+		longsEntry(tStripByteCounts, 4),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols, rows := d.TileGrid(); cols != 1 || rows != 1 {
+		t.Errorf("zero RowsPerStrip: TileGrid: got %dx%d, want 1x1", cols, rows)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, tc := range []struct {
+		entries []rawEntry
+		want    CompressionType
+	}{
+		{nil, Uncompressed},
+		{[]rawEntry{shortsEntry(tCompression, cNone)}, Uncompressed},
+		{[]rawEntry{shortsEntry(tCompression, cDeflate)}, Deflate},
+		{[]rawEntry{shortsEntry(tCompression, cDeflateOld)}, Deflate},
+		{[]rawEntry{shortsEntry(tCompression, cLZW)}, LZW},
+		{[]rawEntry{shortsEntry(tCompression, cPackBits)}, PackBits},
+		{[]rawEntry{shortsEntry(tCompression, cJPEG)}, UnknownCompression},
+	} {
+		d, err := readFirstIFD(bytes.NewReader(buildTIFF(tc.entries...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.Compression(); got != tc.want {
+			t.Errorf("%v: got %d, want %d", tc.entries, got, tc.want)
+		}
+	}
+
+	// The compression of encoded images round trips.
+	for _, c := range []CompressionType{Uncompressed, Deflate, LZW, PackBits} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)), &Options{Compression: c}); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.Compression(); got != c {
+			t.Errorf("encoded with %d: got %d", c, got)
+		}
+	}
+	if err := Encode(ioutil.Discard, image.NewGray(image.Rect(0, 0, 4, 4)), &Options{Compression: UnknownCompression}); err == nil {
+		t.Error("UnknownCompression: got nil error, want non-nil")
+	}
+}
+
+func TestRawTag(t *testing.T) {
+	undefined := rawEntry{65001, dtUndefined, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, big := range []bool{false, true} {
+			build := makeTIFF
+			if big {
+				build = makeBigTIFF
+			}
+			b := build(order, []byte{0},
+				shortsEntry(65000, 0x1234),
+				undefined,
+				asciiEntry(65002, "vendor"),
+			)
+			d, err := newDecoder(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.ByteOrder() != order {
+				t.Errorf("ByteOrder: got %v, want %v", d.ByteOrder(), order)
+			}
+
+			dt, n, data, ok := d.RawTag(65000)
+			if !ok || dt != dtShort || n != 1 || len(data) != 2 || order.Uint16(data) != 0x1234 {
+				t.Errorf("%v, big %t: tag 65000: got %d, %d, %x, %t", order, big, dt, n, data, ok)
+			}
+			dt, n, data, ok = d.RawTag(65001)
+			if !ok || dt != dtUndefined || n != 10 || !bytes.Equal(data, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}) {
+				t.Errorf("%v, big %t: tag 65001: got %d, %d, %x, %t", order, big, dt, n, data, ok)
+			}
+			dt, n, data, ok = d.RawTag(65002)
+			if !ok || dt != dtASCII || n != 7 || string(data) != "vendor\x00" {
+				t.Errorf("%v, big %t: tag 65002: got %d, %d, %q, %t", order, big, dt, n, data, ok)
+			}
+			// Known tags are returned too.
+			if dt, _, _, ok := d.RawTag(tImageWidth); !ok || dt != dtShort {
+				t.Errorf("%v, big %t: ImageWidth: got %d, %t", order, big, dt, ok)
+			}
+			if _, _, _, ok := d.RawTag(65003); ok {
+				t.Errorf("%v, big %t: missing tag found", order, big)
+			}
+		}
+	}
+}
+
+func TestFillOrder(t *testing.T) {
+	pix := []byte{0xf0, 0x0f, 0x81, 0x3c}
+	reversed := append([]byte(nil), pix...)
+	reverseBits(reversed)
+	entries := []rawEntry{
+		shortsEntry(tImageWidth, 16),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tBitsPerSample, 1),
+		shortsEntry(tRowsPerStrip, 2),
+		longsEntry(tStripByteCounts, 4),
+	}
+	want, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix, entries...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fill order applies to the compressed data.
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(pix)
+	zw.Close()
+	zpix := z.Bytes()
+	reverseBits(zpix)
+
+	for _, tc := range []struct {
+		desc    string
+		pix     []byte
+		entries []rawEntry
+	}{
+		{"uncompressed", reversed, nil},
+		{"deflate", zpix, []rawEntry{
+			shortsEntry(tCompression, cDeflate),
+			longsEntry(tStripByteCounts, uint32(len(zpix))),
+		}},
+	} {
+		b := makeTIFF(binary.LittleEndian, tc.pix,
+			append(append(append([]rawEntry(nil), entries...), tc.entries...), shortsEntry(tFillOrder, foLSB2MSB))...)
+		for _, r := range []io.Reader{bytes.NewReader(b), struct{ io.Reader }{bytes.NewReader(b)}} {
+			got, err := Decode(r)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.desc, err)
+			}
+			compare(t, want, got)
+		}
+	}
+}
+
+func TestDecode16Bit(t *testing.T) {
+	gray := []uint16{0x0000, 0x0001, 0x7fff, 0xfffe}
+	rgb := []uint16{0x0001, 0x0102, 0x0203, 0xfffe, 0x8001, 0x1234}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var pix bytes.Buffer
+		binary.Write(&pix, order, gray)
+		b := makeTIFF(order, pix.Bytes(),
+			shortsEntry(tImageWidth, 4),
+			shortsEntry(tBitsPerSample, 16),
+			longsEntry(tStripByteCounts, 8),
+		)
+		m, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: gray: %v", order, err)
+		}
+		g, ok := m.(*scimage.GrayU16)
+		if !ok {
+			t.Fatalf("%v: gray: got %T, want *scimage.GrayU16", order, m)
+		}
+		for i, want := range gray {
+			if c := g.At(i, 0).(scicolor.GrayU16); c.Y != want {
+				t.Errorf("%v: gray pixel %d: got %#04x, want %#04x", order, i, c.Y, want)
+			}
+		}
+		cfg, err := DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: gray: %v", order, err)
+		}
+		if cfg.ColorModel != m.ColorModel() {
+			t.Errorf("%v: gray: DecodeConfig color model %v, Decode %v", order, cfg.ColorModel, m.ColorModel())
+		}
+
+		pix.Reset()
+		binary.Write(&pix, order, rgb)
+		b = makeTIFF(order, pix.Bytes(),
+			shortsEntry(tImageWidth, 2),
+			shortsEntry(tBitsPerSample, 16, 16, 16),
+			shortsEntry(tSamplesPerPixel, 3),
+			shortsEntry(tPhotometricInterpretation, pRGB),
+			longsEntry(tStripByteCounts, 12),
+		)
+		m, err = Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: rgb: %v", order, err)
+		}
+		c, ok := m.(*image.RGBA64)
+		if !ok {
+			t.Fatalf("%v: rgb: got %T, want *image.RGBA64", order, m)
+		}
+		for i := 0; i < 2; i++ {
+			want := color.RGBA64{rgb[3*i], rgb[3*i+1], rgb[3*i+2], 0xffff}
+			if got := c.RGBA64At(i, 0); got != want {
+				t.Errorf("%v: rgb pixel %d: got %v, want %v", order, i, got, want)
+			}
+		}
+	}
+}
+
+// packSamples packs the n-bit samples of each row of rowLen samples
+// tightly, from the most significant bit, starting every row on a byte
+// boundary.
+func packSamples(n uint, rowLen int, samples ...uint32) []byte {
+	var (
+		out   []byte
+		v     uint64
+		nbits uint
+	)
+	for i, s := range samples {
+		v = v<<n | uint64(s)
+		nbits += n
+		for nbits >= 8 {
+			nbits -= 8
+			out = append(out, byte(v>>nbits))
+		}
+		if (i+1)%rowLen == 0 && nbits > 0 {
+			out = append(out, byte(v<<(8-nbits)))
+			nbits = 0
+		}
+		v &= 1<<nbits - 1
+	}
+	return out
+}
+
+func TestDecodePacked(t *testing.T) {
+	gray := []uint32{0x000, 0x801, 0xfff, 0x123, 0xabc, 0x7ff}
+	pix := packSamples(12, 3, gray...)
+	for _, fillOrder := range []uint16{foMSB2LSB, foLSB2MSB} {
+		p := append([]byte(nil), pix...)
+		if fillOrder == foLSB2MSB {
+			reverseBits(p)
+		}
+		b := makeTIFF(binary.LittleEndian, p,
+			shortsEntry(tImageWidth, 3),
+			shortsEntry(tImageLength, 2),
+			shortsEntry(tBitsPerSample, 12),
+			shortsEntry(tRowsPerStrip, 2),
+			longsEntry(tStripByteCounts, uint32(len(p))),
+			shortsEntry(tFillOrder, fillOrder),
+		)
+		m, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("fill order %d: %v", fillOrder, err)
+		}
+		g, ok := m.(*scimage.GrayU16)
+		if !ok {
+			t.Fatalf("fill order %d: got %T, want *scimage.GrayU16", fillOrder, m)
+		}
+		for i, v := range gray {
+			want := uint16(v * 0xffff / 0xfff)
+			if c := g.At(i%3, i/3).(scicolor.GrayU16); c.Y != want {
+				t.Errorf("fill order %d: pixel %d: got %#04x, want %#04x", fillOrder, i, c.Y, want)
+			}
+		}
+		// A window starting within a byte.
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := d.ReadWindow(1, 1, 2, 1)
+		if err != nil {
+			t.Fatalf("fill order %d: window: %v", fillOrder, err)
+		}
+		compare(t, w, window{m, image.Rect(1, 1, 3, 2)})
+	}
+
+	rgb := []uint32{0x3ff, 0x000, 0x200, 0x001, 0x155, 0x2aa}
+	pix = packSamples(10, 6, rgb...)
+	b := makeTIFF(binary.BigEndian, pix,
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tBitsPerSample, 10, 10, 10),
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tPhotometricInterpretation, pRGB),
+		longsEntry(tStripByteCounts, uint32(len(pix))),
+	)
+	m, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := m.(*image.RGBA64)
+	if !ok {
+		t.Fatalf("rgb: got %T, want *image.RGBA64", m)
+	}
+	for i := 0; i < 2; i++ {
+		s := rgb[3*i : 3*i+3]
+		want := color.RGBA64{uint16(s[0] * 0xffff / 0x3ff), uint16(s[1] * 0xffff / 0x3ff), uint16(s[2] * 0xffff / 0x3ff), 0xffff}
+		if got := c.RGBA64At(i, 0); got != want {
+			t.Errorf("rgb pixel %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestDecodeWhiteIsZero(t *testing.T) {
+	const w, h = 4, 2
+	ramp := make([]uint16, w*h)
+	for i := range ramp {
+		ramp[i] = uint16(i * 0x2000)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var pix bytes.Buffer
+		binary.Write(&pix, order, ramp)
+		b := makeTIFF(order, pix.Bytes(),
+			shortsEntry(tImageWidth, w),
+			shortsEntry(tImageLength, h),
+			shortsEntry(tBitsPerSample, 16),
+			shortsEntry(tRowsPerStrip, h),
+			longsEntry(tStripByteCounts, 2*w*h),
+			shortsEntry(tPhotometricInterpretation, pWhiteIsZero),
+		)
+		m, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		d, err := newDecoder(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		band, err := d.Band(0)
+		if err != nil {
+			t.Fatalf("%v: Band: %v", order, err)
+		}
+		for i, v := range ramp {
+			want := 0xffff - v
+			if c, ok := m.At(i%w, i/w).(scicolor.GrayU16); !ok || c.Y != want {
+				t.Errorf("%v: pixel %d: got %v, want %d", order, i, m.At(i%w, i/w), want)
+			}
+			if c, ok := band.At(i%w, i/w).(scicolor.GrayU16); !ok || c.Y != want {
+				t.Errorf("%v: band pixel %d: got %v, want %d", order, i, band.At(i%w, i/w), want)
+			}
+		}
+	}
+
+	// Signed samples are inverted within their range.
+	b := makeTIFF(binary.LittleEndian, []byte{0x00, 0x80, 0xff, 0xff, 0x00, 0x00, 0xff, 0x7f},
+		shortsEntry(tImageWidth, 4),
+		shortsEntry(tBitsPerSample, 16),
+		longsEntry(tStripByteCounts, 8),
+		shortsEntry(tSampleFormat, uint16(sintSample)),
+		shortsEntry(tPhotometricInterpretation, pWhiteIsZero),
+	)
+	m, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int16{32767, 0, -1, -32768} {
+		if c, ok := m.At(i, 0).(scicolor.GrayS16); !ok || c.Y != want {
+			t.Errorf("signed pixel %d: got %v, want %d", i, m.At(i, 0), want)
+		}
+	}
+}
+
+func TestDecodeCCITT(t *testing.T) {
+	pix := []byte{0x00, 0x38, 0x1c, 0x38, 0x00}
+	entries := []rawEntry{
+		shortsEntry(tImageWidth, 8),
+		shortsEntry(tImageLength, 5),
+		shortsEntry(tBitsPerSample, 1),
+		shortsEntry(tPhotometricInterpretation, pWhiteIsZero),
+		shortsEntry(tRowsPerStrip, 5),
+		longsEntry(tStripByteCounts, uint32(len(pix))),
+	}
+	want, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix, entries...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc string
+		data []byte
+		opts []rawEntry
+	}{
+		// The V0; H; VR1, VR1, V0; VL1, VL1, V0; and P, V0 modes,
+		// followed by an EOFB.
+		{"Group 4", []byte{0x97, 0xad, 0xd2, 0x8c, 0x00, 0x40, 0x04}, []rawEntry{
+			shortsEntry(tCompression, cG4),
+		}},
+		// Lines 0 and 3 with the one-dimensional coding and the others
+		// with the V0; H; VR1, VR1, V0; and P, V0 modes, followed by an
+		// RTC.
+		{"Group 3", []byte{
+			0x00, 0x1c, 0xc0, 0x04, 0x5e, 0x80, 0x09, 0xb8, 0x00, 0xde, 0x80,
+			0x01, 0x0c, 0x00, 0x40, 0x04, 0x00, 0x40, 0x04, 0x00, 0x40, 0x04,
+		}, []rawEntry{
+			shortsEntry(tCompression, cG3),
+			longsEntry(tT4Options, t4TwoD),
+		}},
+	} {
+		entries := append(append([]rawEntry(nil), entries...), tc.opts...)
+		entries = append(entries, longsEntry(tStripByteCounts, uint32(len(tc.data))))
+		got, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, tc.data, entries...)))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		compare(t, want, got)
+	}
+}
+
+// splitJPEG splits a JPEG stream into a stream of its quantization and
+// Huffman tables, as stored in the JPEGTables tag, and an abbreviated stream
+// of the rest.
+func splitJPEG(data []byte) (tables, abbrev []byte) {
+	tables = []byte{0xff, jpegSOI}
+	abbrev = []byte{0xff, jpegSOI}
+	i := 2
+	for data[i+1] != 0xda { // Start of scan.
+		n := 2 + int(data[i+2])<<8 + int(data[i+3])
+		if data[i+1] == 0xdb || data[i+1] == 0xc4 {
+			tables = append(tables, data[i:i+n]...)
+		} else {
+			abbrev = append(abbrev, data[i:i+n]...)
+		}
+		i += n
+	}
+	return append(tables, 0xff, jpegEOI), append(abbrev, data[i:]...)
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			m.SetRGBA(x, y, color.RGBA{uint8(8 * x), uint8(16 * y), 0x80, 0xff})
+		}
+	}
+	gray := image.NewGray(m.Bounds())
+	draw.Draw(gray, gray.Bounds(), m, image.Point{}, draw.Src)
+
+	for _, tc := range []struct {
+		desc string
+		m    image.Image
+		pi   uint16
+		spp  []uint16
+		tile bool
+		abbr bool
+	}{
+		{"YCbCr strip", m, pYCbCr, []uint16{8, 8, 8}, false, false},
+		{"YCbCr tiles", m, pYCbCr, []uint16{8, 8, 8}, true, false},
+		{"YCbCr with JPEGTables", m, pYCbCr, []uint16{8, 8, 8}, false, true},
+		{"gray", gray, pBlackIsZero, []uint16{8}, false, false},
+	} {
+		var blocks [][]byte
+		rects := []image.Rectangle{m.Bounds()}
+		if tc.tile {
+			rects = []image.Rectangle{image.Rect(0, 0, 16, 16), image.Rect(16, 0, 32, 16)}
+		}
+		var tables []byte
+		var want []image.Image
+		for _, r := range rects {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, tc.m.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(r), &jpeg.Options{Quality: 95}); err != nil {
+				t.Fatal(err)
+			}
+			w, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The samples are converted to RGB with 8-bit precision.
+			if _, ok := w.(*image.YCbCr); ok {
+				rgba := image.NewRGBA(w.Bounds())
+				draw.Draw(rgba, rgba.Bounds(), w, w.Bounds().Min, draw.Src)
+				w = rgba
+			}
+			want = append(want, w)
+			b := buf.Bytes()
+			if tc.abbr {
+				tables, b = splitJPEG(b)
+			}
+			blocks = append(blocks, b)
+		}
+
+		var pix []byte
+		var offsets, counts []uint32
+		for _, b := range blocks {
+			offsets = append(offsets, uint32(8+len(pix)))
+			counts = append(counts, uint32(len(b)))
+			pix = append(pix, b...)
+		}
+		entries := []rawEntry{
+			shortsEntry(tImageWidth, 32),
+			shortsEntry(tImageLength, 16),
+			shortsEntry(tBitsPerSample, tc.spp...),
+			shortsEntry(tSamplesPerPixel, uint16(len(tc.spp))),
+			shortsEntry(tPhotometricInterpretation, tc.pi),
+			shortsEntry(tCompression, cJPEG),
+		}
+		if tc.tile {
+			entries = append(entries,
+				shortsEntry(tTileWidth, 16),
+				shortsEntry(tTileLength, 16),
+				longsEntry(tTileOffsets, offsets...),
+				longsEntry(tTileByteCounts, counts...),
+			)
+		} else {
+			entries = append(entries,
+				shortsEntry(tRowsPerStrip, 16),
+				longsEntry(tStripOffsets, offsets...),
+				longsEntry(tStripByteCounts, counts...),
+			)
+		}
+		if tables != nil {
+			e := rawEntry{tJPEGTables, dtUndefined, make([]uint64, len(tables))}
+			for i, b := range tables {
+				e.vals[i] = uint64(b)
+			}
+			entries = append(entries, e)
+		}
+		got, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, pix, entries...)))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		for i, r := range rects {
+			compare(t, want[i], window{got, r})
+		}
+	}
+}
+
+func TestDecodeOldJPEG(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 5)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	w, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := image.NewRGBA(w.Bounds())
+	draw.Draw(want, want.Bounds(), w, image.Point{}, draw.Src)
+
+	// The two strips point into the single JPEG stream of the image.
+	n := uint32(buf.Len())
+	entries := []rawEntry{
+		shortsEntry(tImageWidth, 32),
+		shortsEntry(tImageLength, 16),
+		shortsEntry(tBitsPerSample, 8, 8, 8),
+		shortsEntry(tSamplesPerPixel, 3),
+		shortsEntry(tPhotometricInterpretation, pYCbCr),
+		shortsEntry(tCompression, cJPEGOld),
+		shortsEntry(tRowsPerStrip, 8),
+		longsEntry(tStripOffsets, pixOffset, pixOffset+n/2),
+		longsEntry(tStripByteCounts, n/2, n-n/2),
+	}
+	jif := []rawEntry{
+		longsEntry(tJPEGInterchangeFormat, pixOffset),
+		longsEntry(tJPEGInterchangeFormatLength, n),
+	}
+	got, err := Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, buf.Bytes(), append(entries, jif...)...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, want, got)
+
+	_, err = Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, buf.Bytes(), entries...)))
+	if e, ok := err.(FormatError); !ok || e.Kind != UnsupportedCompression || e.Detail != "old-style JPEG unsupported" {
+		t.Errorf("without JPEGInterchangeFormat: got %v, want old-style JPEG unsupported", err)
+	}
+
+	jif = []rawEntry{longsEntry(tJPEGInterchangeFormat, 1<<31)}
+	_, err = Decode(bytes.NewReader(makeTIFF(binary.LittleEndian, buf.Bytes(), append(entries, jif...)...)))
+	if e, ok := err.(FormatError); !ok || e.Kind != Truncated || e.Tag != tJPEGInterchangeFormat {
+		t.Errorf("JPEGInterchangeFormat beyond the file: got %v, want Truncated", err)
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	r := image.Rect(0, 0, 5, 3)
+	rgba, gray, gray16 := image.NewRGBA(r), image.NewGray(r), image.NewGray16(r)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i)
+		if i%4 == 3 {
+			rgba.Pix[i] = 0xff
+		}
+	}
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(3 * i)
+	}
+	for i := range gray16.Pix {
+		gray16.Pix[i] = uint8(7 * i)
+	}
+	files := map[string][]byte{}
+	for name, m := range map[string]image.Image{"rgba": rgba, "gray": gray, "gray16": gray16} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, &Options{Compression: Deflate}); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = buf.Bytes()
+	}
+	decoder := func(name string) *decoder {
+		d, err := newDecoder(bytes.NewReader(files[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// The destinations are reused.
+	dstRGBA, dstGray, dstGray16 := image.NewRGBA(r), image.NewGray(r), image.NewGray16(r)
+	for i := 0; i < 2; i++ {
+		if err := decoder("rgba").DecodeInto(dstRGBA); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dstRGBA.Pix, rgba.Pix) {
+			t.Errorf("RGBA: got %v, want %v", dstRGBA.Pix, rgba.Pix)
+		}
+		if err := decoder("gray").DecodeIntoGray(dstGray); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dstGray.Pix, gray.Pix) {
+			t.Errorf("Gray: got %v, want %v", dstGray.Pix, gray.Pix)
+		}
+		if err := decoder("gray16").DecodeIntoGray16(dstGray16); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dstGray16.Pix, gray16.Pix) {
+			t.Errorf("Gray16: got %v, want %v", dstGray16.Pix, gray16.Pix)
+		}
+	}
+
+	if err := decoder("gray").DecodeIntoGray(image.NewGray(image.Rect(0, 0, 3, 5))); err == nil {
+		t.Error("size mismatch: got nil error, want non-nil")
+	}
+	if err := decoder("gray").DecodeInto(dstRGBA); err == nil {
+		t.Error("gray into RGBA: got nil error, want non-nil")
+	}
+	if err := decoder("gray16").DecodeIntoGray(dstGray); err == nil {
+		t.Error("16-bit gray into Gray: got nil error, want non-nil")
+	}
+}
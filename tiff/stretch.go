@@ -0,0 +1,98 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// StretchToGray returns a grayscale image of the given width holding the
+// samples in data, in row-major order, linearly mapped from [min, max] to
+// [0, 255], as returned by Float64Band or ScaledFloat64Band. The range
+// is typically given by BandStatistics.
+//
+// Values at or below min are mapped to 0 and values at or above max to
+// 255, so outliers are clamped rather than wrapped around. NaN values, such
+// as the nodata samples of ScaledFloat64Band, are mapped to 0. A final
+// partial row is dropped.
+func StretchToGray(data []float64, width int, min, max float64) *image.Gray {
+	m := newStretched(len(data), width)
+	for i := range m.Pix {
+		m.Pix[i] = stretch(data[i], min, max)
+	}
+	return m
+}
+
+// StretchFloat32ToGray is like StretchToGray, but for 32-bit floating point
+// samples, as returned by Float32Band.
+func StretchFloat32ToGray(data []float32, width int, min, max float64) *image.Gray {
+	m := newStretched(len(data), width)
+	for i := range m.Pix {
+		m.Pix[i] = stretch(float64(data[i]), min, max)
+	}
+	return m
+}
+
+// newStretched returns a grayscale image of the given width with as many
+// whole rows as n samples fill.
+func newStretched(n, width int) *image.Gray {
+	if width <= 0 {
+		return image.NewGray(image.Rectangle{})
+	}
+	return image.NewGray(image.Rect(0, 0, width, n/width))
+}
+
+// stretch maps v from [min, max] to [0, 255].
+func stretch(v, min, max float64) uint8 {
+	switch {
+	case math.IsNaN(v) || v <= min:
+		return 0
+	case v >= max:
+		return 0xff
+	}
+	return uint8((v-min)/(max-min)*0xff + 0.5)
+}
+
+// DecodeWithNoDataMask decodes a single-band image as a grayscale image,
+// with its samples stretched over [0, 255] from the range given by
+// BandStatistics. Samples equal to the GDALNoData value, and NaN samples,
+// are transparent. All the other pixels are opaque.
+func (d *decoder) DecodeWithNoDataMask() (*image.NRGBA, error) {
+	if n, err := d.Bands(); err != nil {
+		return nil, err
+	} else if n != 1 {
+		return nil, FormatError{Kind: Unsupported, Tag: tSamplesPerPixel, Detail: fmt.Sprintf("nodata mask of %d bands", n)}
+	}
+	size, conv, err := d.sampleReader(0)
+	if err != nil {
+		return nil, err
+	}
+	noData, hasNoData, err := d.NoData()
+	if err != nil {
+		return nil, err
+	}
+	// Without valid samples, every pixel is transparent.
+	min, max, _, _, err := d.BandStatistics(0)
+	if err != nil && err != errNoSamples {
+		return nil, err
+	}
+	w := d.config.Width
+	m := image.NewNRGBA(image.Rect(0, 0, w, d.config.Height))
+	err = d.readSamples(0, size, func(i int, p []byte) {
+		v := conv(p)
+		if hasNoData && v == noData || math.IsNaN(v) {
+			return
+		}
+		y := stretch(v, min, max)
+		m.SetNRGBA(i%w, i/w, color.NRGBA{y, y, y, 0xff})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
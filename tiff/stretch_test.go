@@ -0,0 +1,86 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestStretchToGray(t *testing.T) {
+	data := []float64{-5, 10, 15, 20, math.NaN(), 30, 1}
+	want := []uint8{0, 0, 0x80, 0xff, 0, 0xff}
+	m := StretchToGray(data, 3, 10, 20)
+	if m.Bounds() != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("bounds: got %v, want %v", m.Bounds(), image.Rect(0, 0, 3, 2))
+	}
+	for i, w := range want {
+		if got := m.GrayAt(i%3, i/3).Y; got != w {
+			t.Errorf("pixel %d: got %d, want %d", i, got, w)
+		}
+	}
+
+	data32 := make([]float32, len(data))
+	for i, v := range data {
+		data32[i] = float32(v)
+	}
+	m32 := StretchFloat32ToGray(data32, 3, 10, 20)
+	compare(t, m, m32)
+}
+
+func TestDecodeWithNoDataMask(t *testing.T) {
+	var pix bytes.Buffer
+	binary.Write(&pix, binary.LittleEndian, []int16{-9999, 100, 150, 200})
+	b := makeTIFF(binary.LittleEndian, pix.Bytes(),
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tImageLength, 2),
+		shortsEntry(tBitsPerSample, 16),
+		shortsEntry(tRowsPerStrip, 2),
+		shortsEntry(tSampleFormat, uint16(sintSample)),
+		asciiEntry(tGDALNoData, "-9999"),
+	)
+	d, err := newDecoder(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.DecodeWithNoDataMask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []color.NRGBA{{}, {0, 0, 0, 0xff}, {0x80, 0x80, 0x80, 0xff}, {0xff, 0xff, 0xff, 0xff}} {
+		if got := m.NRGBAAt(i%2, i/2); got != want {
+			t.Errorf("pixel %d: got %v, want %v", i, got, want)
+		}
+	}
+
+	nan := float32(math.NaN())
+	b = makeTIFF(binary.LittleEndian, float32Pix(binary.LittleEndian, nan, nan),
+		shortsEntry(tImageWidth, 2),
+		shortsEntry(tBitsPerSample, 32),
+		longsEntry(tStripByteCounts, 8),
+		shortsEntry(tSampleFormat, uint16(ieeefpSample)),
+	)
+	if d, err = newDecoder(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = d.DecodeWithNoDataMask(); err != nil {
+		t.Fatalf("all NaN: %v", err)
+	}
+	if m.NRGBAAt(0, 0).A != 0 || m.NRGBAAt(1, 0).A != 0 {
+		t.Errorf("all NaN: got %v, want transparent pixels", m.Pix)
+	}
+
+	d, err = newDecoder(bytes.NewReader(buildTIFF(shortsEntry(tSamplesPerPixel, 3), shortsEntry(tBitsPerSample, 8, 8, 8))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DecodeWithNoDataMask(); err == nil {
+		t.Error("3 bands: got nil error, want non-nil")
+	}
+}
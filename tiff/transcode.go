@@ -0,0 +1,109 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// transcodedTags lists the tags that Transcode carries over unchanged.
+var transcodedTags = []uint16{
+	tOrientation,
+	tModelPixelScale,
+	tModelTiepoint,
+	tModelTransformation,
+	tGeoKeyDirectory,
+	tGeoDoubleParams,
+	tGeoASCIIParams,
+	tGDALMetadata,
+	tGDALNoData,
+}
+
+// Transcode decodes the first image of the TIFF file in r and writes it to
+// w with the given options, such as another compression type. The
+// georeferencing tags (ModelPixelScale, ModelTiepoint, ModelTransformation
+// and the GeoKeyDirectory with its params), the GDALMetadata and GDALNoData
+// tags, and the Orientation tag are carried over unchanged. The samples are
+// written with the same format and depth, for images of 8 or 16-bit
+// samples and for single band images of 32-bit floating point samples.
+// The SampleFormat and BitsPerSample options are ignored.
+func Transcode(r io.ReaderAt, w io.Writer, opts *Options) error {
+	d, err := newDecoderAt(r)
+	if err != nil {
+		return err
+	}
+	// The orientation is carried over instead of being applied, as the
+	// georeferencing refers to the stored raster.
+	d.ApplyOrientation = false
+
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.SampleFormat, o.BitsPerSample = UnsignedSample, 0
+	var m image.Image
+	if n, _ := d.Bands(); d.sFormat == ieeefpSample && d.bpp == 32 && n == 1 {
+		data, width, height, err := d.Float32Band(0)
+		if err != nil {
+			return err
+		}
+		m = float32Image(data, width, height)
+		o.SampleFormat = FloatSample
+	} else {
+		if m, err = d.decodeImage(); err != nil {
+			return err
+		}
+	}
+
+	var extra []ifdEntry
+	for _, tag := range transcodedTags {
+		dtype, count, raw, ok := d.RawTag(tag)
+		if !ok {
+			continue
+		}
+		data, ok := entryData(d.byteOrder, dtype, int(count), raw)
+		if !ok {
+			return FormatError{Kind: Unsupported, Tag: int(tag), Detail: fmt.Sprintf("transcoding entries of data type %d", dtype)}
+		}
+		extra = append(extra, ifdEntry{int(tag), int(dtype), data})
+	}
+	return writeImage(w, m, &o, extra)
+}
+
+// entryData converts the raw data of an IFD entry, with count values of
+// type dtype in the given byte order, to the data of an ifdEntry. ok is
+// false if the encoder does not support the data type.
+func entryData(order binary.ByteOrder, dtype uint16, count int, raw []byte) (data []uint32, ok bool) {
+	switch dtype {
+	case dtByte, dtASCII, dtUndefined:
+		for _, b := range raw[:count] {
+			data = append(data, uint32(b))
+		}
+	case dtShort:
+		for i := 0; i < count; i++ {
+			data = append(data, uint32(order.Uint16(raw[2*i:])))
+		}
+	case dtLong:
+		for i := 0; i < count; i++ {
+			data = append(data, order.Uint32(raw[4*i:]))
+		}
+	case dtRational:
+		for i := 0; i < 2*count; i++ {
+			data = append(data, order.Uint32(raw[4*i:]))
+		}
+	case dtFloat64:
+		// Held as the low and high halves of each value.
+		for i := 0; i < count; i++ {
+			v := order.Uint64(raw[8*i:])
+			data = append(data, uint32(v), uint32(v>>32))
+		}
+	default:
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prl900/scimage/scicolor"
+)
+
+func TestTranscode(t *testing.T) {
+	m := image.NewGray16(image.Rect(0, 0, 5, 3))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 37)
+	}
+	keys, err := GeoKeysFromEPSG(32755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.Keys[GTCitationGeoKey] = "WGS 84 / UTM zone 55S"
+	keys.Keys[GeogSemiMajorAxisGeoKey] = 6378137.0
+	opts := &GeoOptions{
+		Options:         Options{Compression: Deflate},
+		ModelPixelScale: []float64{30, 30, 0},
+		ModelTiepoint:   []float64{0, 0, 0, 440720, 3751320, 0},
+		GeoKeys:         keys,
+	}
+	opts.SetTag(tGDALNoData, dtASCII, "0")
+	opts.SetTag(tGDALMetadata, dtASCII, `<GDALMetadata><Item name="SCALE">0.5</Item></GDALMetadata>`)
+	var src bytes.Buffer
+	if err := EncodeGeo(&src, m, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var dst bytes.Buffer
+	if err := Transcode(bytes.NewReader(src.Bytes()), &dst, &Options{Compression: LZW}); err != nil {
+		t.Fatal(err)
+	}
+	d0, err := newDecoder(bytes.NewReader(src.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, err := newDecoder(bytes.NewReader(dst.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d1.Compression(); got != LZW {
+		t.Errorf("compression: got %d, want %d", got, LZW)
+	}
+	for _, tag := range transcodedTags[1:] {
+		_, _, want, _ := d0.RawTag(tag)
+		if _, _, got, _ := d1.RawTag(tag); !bytes.Equal(got, want) {
+			t.Errorf("tag %d: got %q, want %q", tag, got, want)
+		}
+	}
+	k, err := d1.GeoKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(k, keys) {
+		t.Errorf("GeoKeys: got %v, want %v", k, keys)
+	}
+	got, err := Decode(bytes.NewReader(dst.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(m.Pix); i += 2 {
+		x, y := i/2%5, i/2/5
+		if c := got.At(x, y).(scicolor.GrayU16); c.Y != m.Gray16At(x, y).Y {
+			t.Errorf("pixel (%d, %d): got %d, want %d", x, y, c.Y, m.Gray16At(x, y).Y)
+		}
+	}
+}
+
+func TestTranscodeSamples(t *testing.T) {
+	var buf bytes.Buffer
+	data := []float32{1.5, float32(math.NaN()), -2, 1e10}
+	if err := EncodeFloat32(&buf, data, 2, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	var dst bytes.Buffer
+	if err := Transcode(bytes.NewReader(buf.Bytes()), &dst, &Options{Compression: Deflate, PredictorType: FloatingPointPredictor}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(dst.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err := d.Float32Band(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range data {
+		if math.Float32bits(got[i]) != math.Float32bits(v) {
+			t.Errorf("float sample %d: got %v, want %v", i, got[i], v)
+		}
+	}
+
+	buf.Reset()
+	ints := []int16{-9999, -1, 0, 32767}
+	if err := EncodeInt16(&buf, ints, 4, 1, -9999, nil); err != nil {
+		t.Fatal(err)
+	}
+	dst.Reset()
+	if err := Transcode(bytes.NewReader(buf.Bytes()), &dst, &Options{Compression: PackBits}); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = newDecoder(bytes.NewReader(dst.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	gotInts, _, _, err := d.Int16Band(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotInts, ints) {
+		t.Errorf("int16 samples: got %v, want %v", gotInts, ints)
+	}
+	if v, ok, err := d.NoData(); v != -9999 || !ok || err != nil {
+		t.Errorf("NoData: got %v, %t, %v, want -9999, true, nil", v, ok, err)
+	}
+
+	// Entries are converted from the byte order of the file.
+	be := makeTIFF(binary.BigEndian, []byte{7},
+		doublesEntry(tModelPixelScale, 10, 20, 0),
+		shortsEntry(tOrientation, 3),
+	)
+	dst.Reset()
+	if err := Transcode(bytes.NewReader(be), &dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = newDecoder(bytes.NewReader(dst.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.pixScale, []float64{10, 20, 0}) || d.firstVal(tOrientation) != 3 {
+		t.Errorf("big-endian entries: got scale %v and orientation %d", d.pixScale, d.firstVal(tOrientation))
+	}
+}
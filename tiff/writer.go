@@ -8,53 +8,133 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"fmt"
 	"image"
 	"io"
+	"math"
 	"sort"
+	"time"
+
+	"github.com/prl900/image/tiff/lzw"
+	"github.com/prl900/scimage"
+	"github.com/prl900/scimage/scicolor"
 )
 
 // The TIFF format allows to choose the order of the different elements freely.
 // The basic structure of a TIFF file written by this package is:
 //
-//   1. Header (8 bytes).
+//   1. Header (8 bytes, or 16 bytes for BigTIFF files).
 //   2. Image data.
 //   3. Image File Directory (IFD).
 //   4. "Pointer area" for larger entries in the IFD.
+//
+// In multi-page files, 2. to 4. are repeated for each page.
 
-// We only write little-endian TIFF files.
+// enc is the byte order of the files written unless Options.BigEndian is
+// set.
 var enc = binary.LittleEndian
 
+// byteOrder returns the byte order of the files written with opt.
+func byteOrder(opt *Options) binary.ByteOrder {
+	if opt != nil && opt.BigEndian {
+		return binary.BigEndian
+	}
+	return enc
+}
+
 // An ifdEntry is a single entry in an Image File Directory.
 // A value of type dtRational is composed of two 32-bit values,
 // thus data contains two uints (numerator and denominator) for a single number.
+// Likewise, a value of type dtFloat64 is stored as the low and high 32 bits
+// of its IEEE 754 representation, and a value of type dtLong8 as its low and
+// high 32 bits.
 type ifdEntry struct {
 	tag      int
 	datatype int
 	data     []uint32
 }
 
-func (e ifdEntry) putData(p []byte) {
+func (e ifdEntry) putData(p []byte, order binary.ByteOrder) {
+	switch e.datatype {
+	case dtFloat64, dtLong8:
+		for i := 0; i+1 < len(e.data); i += 2 {
+			order.PutUint64(p, uint64(e.data[i+1])<<32|uint64(e.data[i]))
+			p = p[8:]
+		}
+		return
+	}
 	for _, d := range e.data {
 		switch e.datatype {
-		case dtByte, dtASCII:
+		case dtByte, dtASCII, dtUndefined:
 			p[0] = byte(d)
 			p = p[1:]
 		case dtShort:
-			enc.PutUint16(p, uint16(d))
+			order.PutUint16(p, uint16(d))
 			p = p[2:]
 		case dtLong, dtRational:
-			enc.PutUint32(p, uint32(d))
+			order.PutUint32(p, uint32(d))
 			p = p[4:]
 		}
 	}
 }
 
+// count returns the number of values in e.
+func (e ifdEntry) count() int {
+	switch e.datatype {
+	case dtRational, dtFloat64, dtLong8:
+		return len(e.data) / 2
+	}
+	return len(e.data)
+}
+
 type byTag []ifdEntry
 
 func (d byTag) Len() int           { return len(d) }
 func (d byTag) Less(i, j int) bool { return d[i].tag < d[j].tag }
 func (d byTag) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
 
+// float64Data returns the data of an ifdEntry of type dtFloat64 holding v.
+func float64Data(v []float64) []uint32 {
+	data := make([]uint32, 0, 2*len(v))
+	for _, f := range v {
+		b := math.Float64bits(f)
+		data = append(data, uint32(b), uint32(b>>32))
+	}
+	return data
+}
+
+// asciiData returns the data of an ifdEntry of type dtASCII holding s,
+// including the NUL terminator.
+func asciiData(s string) []uint32 {
+	data := make([]uint32, len(s)+1)
+	for i := 0; i < len(s); i++ {
+		data[i] = uint32(s[i])
+	}
+	return data
+}
+
+// rationalData returns the data of an ifdEntry of type dtRational holding
+// an approximation of v, which must be positive.
+func rationalData(v float64) []uint32 {
+	num, den := v, 1.0
+	for num != math.Trunc(num) && den < 1e6 {
+		num, den = num*10, den*10
+	}
+	if num > math.MaxUint32 {
+		num, den = math.MaxUint32, math.Trunc(math.MaxUint32/v)
+	}
+	return []uint32{uint32(num + 0.5), uint32(den)}
+}
+
+// long8Data returns the data of an ifdEntry of type dtLong8 holding v.
+func long8Data(v []uint64) []uint32 {
+	data := make([]uint32, 0, 2*len(v))
+	for _, u := range v {
+		data = append(data, uint32(u), uint32(u>>32))
+	}
+	return data
+}
+
 func encodeGray(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) error {
 	if !predictor {
 		return writePix(w, pix, dy, dx, stride)
@@ -78,7 +158,7 @@ func encodeGray(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) er
 	return nil
 }
 
-func encodeGray16(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) error {
+func encodeGray16(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool, order binary.ByteOrder) error {
 	buf := make([]byte, dx*2)
 	for y := 0; y < dy; y++ {
 		min := y*stride + 0
@@ -91,9 +171,7 @@ func encodeGray16(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool)
 			if predictor {
 				v0, v1 = v1, v1-v0
 			}
-			// We only write little-endian TIFF files.
-			buf[off+0] = byte(v1)
-			buf[off+1] = byte(v1 >> 8)
+			order.PutUint16(buf[off:], v1)
 			off += 2
 		}
 		if _, err := w.Write(buf); err != nil {
@@ -103,6 +181,21 @@ func encodeGray16(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool)
 	return nil
 }
 
+// encodeFloat32 writes the 32-bit floating point samples pix of dx by dy
+// pixels, with the given stride in samples, to w in the given byte order.
+func encodeFloat32(w io.Writer, pix []float32, dx, dy, stride int, order binary.ByteOrder) error {
+	buf := make([]byte, dx*4)
+	for y := 0; y < dy; y++ {
+		for x, v := range pix[y*stride : y*stride+dx] {
+			order.PutUint32(buf[4*x:], math.Float32bits(v))
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func encodeRGBA(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) error {
 	if !predictor {
 		return writePix(w, pix, dy, dx*4, stride)
@@ -129,7 +222,7 @@ func encodeRGBA(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) er
 	return nil
 }
 
-func encodeRGBA64(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) error {
+func encodeRGBA64(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool, order binary.ByteOrder) error {
 	buf := make([]byte, dx*8)
 	for y := 0; y < dy; y++ {
 		min := y*stride + 0
@@ -148,15 +241,10 @@ func encodeRGBA64(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool)
 				b0, b1 = b1, b1-b0
 				a0, a1 = a1, a1-a0
 			}
-			// We only write little-endian TIFF files.
-			buf[off+0] = byte(r1)
-			buf[off+1] = byte(r1 >> 8)
-			buf[off+2] = byte(g1)
-			buf[off+3] = byte(g1 >> 8)
-			buf[off+4] = byte(b1)
-			buf[off+5] = byte(b1 >> 8)
-			buf[off+6] = byte(a1)
-			buf[off+7] = byte(a1 >> 8)
+			order.PutUint16(buf[off+0:], r1)
+			order.PutUint16(buf[off+2:], g1)
+			order.PutUint16(buf[off+4:], b1)
+			order.PutUint16(buf[off+6:], a1)
 			off += 8
 		}
 		if _, err := w.Write(buf); err != nil {
@@ -166,8 +254,61 @@ func encodeRGBA64(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool)
 	return nil
 }
 
-func encode(w io.Writer, m image.Image, predictor bool) error {
-	bounds := m.Bounds()
+// predictFloat applies the floating point predictor (see Adobe Photoshop
+// TIFF Technical Note 3) to row, which holds little-endian samples of bps
+// bytes each, spp samples per pixel. The bytes of the samples are split into
+// planes, from the most to the least significant byte, and then differenced
+// horizontally, which gives the same result for both byte orders of the
+// file. tmp must be as long as row.
+func predictFloat(row, tmp []byte, spp, bps int) {
+	wc := len(row) / bps // Samples per row.
+	for i := 0; i < wc; i++ {
+		for b := 0; b < bps; b++ {
+			tmp[(bps-b-1)*wc+i] = row[i*bps+b]
+		}
+	}
+	for i := len(row) - 1; i >= spp; i-- {
+		row[i] = tmp[i] - tmp[i-spp]
+	}
+	copy(row[:spp], tmp[:spp])
+}
+
+// floatPredictor applies the floating point predictor to the rows of rowLen
+// bytes written to it, and writes them to w.
+type floatPredictor struct {
+	w        io.Writer
+	spp, bps int
+	row, tmp []byte
+}
+
+func newFloatPredictor(w io.Writer, rowLen, spp, bps int) *floatPredictor {
+	return &floatPredictor{
+		w:   w,
+		spp: spp,
+		bps: bps,
+		row: make([]byte, 0, rowLen),
+		tmp: make([]byte, rowLen),
+	}
+}
+
+func (p *floatPredictor) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		k := minInt(len(b), cap(p.row)-len(p.row))
+		p.row = append(p.row, b[:k]...)
+		b = b[k:]
+		if len(p.row) == cap(p.row) {
+			predictFloat(p.row, p.tmp, p.spp, p.bps)
+			if _, err := p.w.Write(p.row); err != nil {
+				return 0, err
+			}
+			p.row = p.row[:0]
+		}
+	}
+	return n, nil
+}
+
+func encode(w io.Writer, m image.Image, bounds image.Rectangle, predictor bool) error {
 	buf := make([]byte, 4*bounds.Dx())
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		off := 0
@@ -203,6 +344,60 @@ func encode(w io.Writer, m image.Image, predictor bool) error {
 	return nil
 }
 
+// encodePix writes the pixels of m within r, which must lie within the
+// bounds of m, to w. Samples of 16 bits are written in the given byte order.
+func encodePix(w io.Writer, m image.Image, r image.Rectangle, predictor bool, order binary.ByteOrder) error {
+	if r.Empty() {
+		return nil
+	}
+	dx, dy := r.Dx(), r.Dy()
+	switch m := m.(type) {
+	case *image.Paletted:
+		return encodeGray(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, predictor)
+	case *image.Gray:
+		return encodeGray(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, predictor)
+	case *image.Gray16:
+		return encodeGray16(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, predictor, order)
+	case *image.NRGBA:
+		return encodeRGBA(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, predictor)
+	case *image.NRGBA64:
+		return encodeRGBA64(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, predictor, order)
+	case *image.RGBA:
+		return encodeRGBA(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, predictor)
+	case *image.RGBA64:
+		return encodeRGBA64(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, predictor, order)
+	case *GrayFloat32:
+		return encodeFloat32(w, m.Pix[m.PixOffset(r.Min.X, r.Min.Y):], dx, dy, m.Stride, order)
+	}
+	return encode(w, m, r, predictor)
+}
+
+// encodeBlock writes the pixels of m within the strip or tile r to w. The
+// parts of r outside the bounds of m are padded with zeros.
+func encodeBlock(w io.Writer, m image.Image, r image.Rectangle, bytesPerPixel int, predictor bool, order binary.ByteOrder) error {
+	b := r.Intersect(m.Bounds())
+	if b == r {
+		return encodePix(w, m, r, predictor, order)
+	}
+	row := make([]byte, r.Dx()*bytesPerPixel)
+	pad := row[:(r.Dx()-b.Dx())*bytesPerPixel]
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		var err error
+		if y < b.Max.Y {
+			if err = encodePix(w, m, image.Rect(b.Min.X, y, b.Max.X, y+1), predictor, order); err != nil {
+				return err
+			}
+			_, err = w.Write(pad)
+		} else {
+			_, err = w.Write(row)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // writePix writes the internal byte array of an image to w. It is less general
 // but much faster then encode. writePix is used when pix directly
 // corresponds to one of the TIFF image types.
@@ -211,41 +406,83 @@ func writePix(w io.Writer, pix []byte, nrows, length, stride int) error {
 		_, err := w.Write(pix[:nrows*length])
 		return err
 	}
-	for ; nrows > 0; nrows-- {
-		if _, err := w.Write(pix[:length]); err != nil {
+	for y := 0; y < nrows; y++ {
+		if _, err := w.Write(pix[y*stride : y*stride+length]); err != nil {
 			return err
 		}
-		pix = pix[stride:]
 	}
 	return nil
 }
 
-func writeIFD(w io.Writer, ifdOffset int, d []ifdEntry) error {
-	var buf [ifdLen]byte
+// ifdSize returns the size in bytes of the IFD holding the entries d,
+// including its pointer area.
+func ifdSize(d []ifdEntry, big bool) int {
+	entryLen, valLen := ifdLen, 4
+	if big {
+		entryLen, valLen = ifdLenBig, 8
+	}
+	// The number of entries and the offset of the next IFD take 2 and 4
+	// bytes, or 8 bytes each in BigTIFF files.
+	n := 2 + entryLen*len(d) + 4
+	if big {
+		n = 8 + entryLen*len(d) + 8
+	}
+	for _, ent := range d {
+		if datalen := ent.count() * int(lengths[ent.datatype]); datalen > valLen {
+			n += datalen
+		}
+	}
+	return n
+}
+
+// writeIFD writes the IFD holding the entries d, which starts at ifdOffset
+// in the file and is followed by the IFD at next, or by none if next is
+// zero. If big is true, it is written in the BigTIFF layout.
+func writeIFD(w io.Writer, ifdOffset int, d []ifdEntry, next int, big bool, order binary.ByteOrder) error {
+	entryLen, valLen := ifdLen, 4
+	if big {
+		entryLen, valLen = ifdLenBig, 8
+	}
+	buf := make([]byte, entryLen)
 	// Make space for "pointer area" containing IFD entry data
-	// longer than 4 bytes.
+	// longer than valLen bytes.
 	parea := make([]byte, 1024)
-	pstart := ifdOffset + ifdLen*len(d) + 6
+	pstart := ifdOffset + 2 + entryLen*len(d) + 4
+	if big {
+		pstart = ifdOffset + 8 + entryLen*len(d) + 8
+	}
 	var o int // Current offset in parea.
 
 	// The IFD has to be written with the tags in ascending order.
 	sort.Sort(byTag(d))
 
 	// Write the number of entries in this IFD.
-	if err := binary.Write(w, enc, uint16(len(d))); err != nil {
+	var err error
+	if big {
+		err = binary.Write(w, order, uint64(len(d)))
+	} else {
+		err = binary.Write(w, order, uint16(len(d)))
+	}
+	if err != nil {
 		return err
 	}
 	for _, ent := range d {
-		enc.PutUint16(buf[0:2], uint16(ent.tag))
-		enc.PutUint16(buf[2:4], uint16(ent.datatype))
-		count := uint32(len(ent.data))
-		if ent.datatype == dtRational {
-			count /= 2
-		}
-		enc.PutUint32(buf[4:8], count)
-		datalen := int(count * lengths[ent.datatype])
-		if datalen <= 4 {
-			ent.putData(buf[8:12])
+		for i := range buf {
+			buf[i] = 0
+		}
+		order.PutUint16(buf[0:2], uint16(ent.tag))
+		order.PutUint16(buf[2:4], uint16(ent.datatype))
+		count := ent.count()
+		val := buf[8:12]
+		if big {
+			order.PutUint64(buf[4:12], uint64(count))
+			val = buf[12:20]
+		} else {
+			order.PutUint32(buf[4:8], uint32(count))
+		}
+		datalen := count * int(lengths[ent.datatype])
+		if datalen <= valLen {
+			ent.putData(val, order)
 		} else {
 			if (o + datalen) > len(parea) {
 				newlen := len(parea) + 1024
@@ -256,20 +493,29 @@ func writeIFD(w io.Writer, ifdOffset int, d []ifdEntry) error {
 				copy(newarea, parea)
 				parea = newarea
 			}
-			ent.putData(parea[o : o+datalen])
-			enc.PutUint32(buf[8:12], uint32(pstart+o))
+			ent.putData(parea[o:o+datalen], order)
+			if big {
+				order.PutUint64(val, uint64(pstart+o))
+			} else {
+				order.PutUint32(val, uint32(pstart+o))
+			}
 			o += datalen
 		}
-		if _, err := w.Write(buf[:]); err != nil {
+		if _, err := w.Write(buf); err != nil {
 			return err
 		}
 	}
 	// The IFD ends with the offset of the next IFD in the file,
 	// or zero if it is the last one (page 14).
-	if err := binary.Write(w, enc, uint32(0)); err != nil {
+	if big {
+		err = binary.Write(w, order, uint64(next))
+	} else {
+		err = binary.Write(w, order, uint32(next))
+	}
+	if err != nil {
 		return err
 	}
-	_, err := w.Write(parea[:o])
+	_, err = w.Write(parea[:o])
 	return err
 }
 
@@ -281,80 +527,338 @@ type Options struct {
 	// if true, instead of each pixel's color, the color difference to the
 	// preceding one is saved.  This improves the compression for certain
 	// types of images and compressors. For example, it works well for
-	// photos with Deflate compression.
+	// photos with Deflate compression. The predictor is ignored unless
+	// Compression is LZW, Deflate or Zstd.
 	Predictor bool
+	// PredictorType is the type of differencing predictor used. If it is
+	// NoPredictor, the horizontal predictor is used when Predictor is true.
+	// The floating point predictor can only be used with floating point
+	// samples.
+	PredictorType PredictorType
+	// TileWidth and TileLength are the size of the tiles the image is split
+	// into. If both are zero, the image is written as a single strip.
+	// Otherwise, both must be positive multiples of 16. Tiles on the right
+	// and bottom edges of the image are padded with zeros.
+	TileWidth, TileLength int
+	// RowsPerStrip is the number of rows in each strip of an image that is
+	// not tiled. If zero, it is chosen so that strips hold about 8KB of
+	// uncompressed data. It must not exceed the height of the image.
+	RowsPerStrip int
+	// XResolution and YResolution are the number of pixels per
+	// ResolutionUnit in the horizontal and vertical directions. If either
+	// is zero, a resolution of 72 pixels per inch is written.
+	XResolution, YResolution float64
+	ResolutionUnit           ResolutionUnit
+	// BigTIFF determines whether the image is written as a BigTIFF file,
+	// which uses 8-byte offsets. Images too large for 4-byte offsets are
+	// written as BigTIFF files regardless of BigTIFF, unless ClassicTIFF
+	// is set.
+	BigTIFF bool
+	// ClassicTIFF forbids the switch to BigTIFF of images too large for
+	// 4-byte offsets, for readers that do not support BigTIFF. Encoding
+	// such images is then an error. It cannot be combined with BigTIFF.
+	ClassicTIFF bool
+	// SampleFormat is the format of the samples. The pixel data of the image
+	// is written unchanged, and SampleFormat determines whether readers
+	// interpret it as unsigned integers, the default, as signed integers or
+	// as floating point numbers. Floating point samples can only be written
+	// from a *GrayFloat32, which is always written with them. The signed
+	// grayscale images returned by Decode are written with signed samples
+	// unless another format is given.
+	SampleFormat SampleFormatType
+	// BitsPerSample, if non-zero, is the number of bits of each sample,
+	// which must match the samples of the image. Encode returns an error
+	// otherwise.
+	BitsPerSample int
+	// BigEndian determines whether the file is written in big-endian
+	// ("MM") byte order instead of little-endian ("II") byte order. The
+	// header, the IFD entries and the samples wider than 8 bits are all
+	// written in that order.
+	BigEndian bool
+	// CompressionLevel is the level of Deflate compression, from
+	// zlib.BestSpeed to zlib.BestCompression, or zlib.HuffmanOnly. If zero,
+	// zlib.DefaultCompression is used.
+	CompressionLevel int
+	// ZstdLevel is the Zstandard compression level, from 1 (fastest) to 22
+	// (smallest), used with Zstd compression. If zero, the default level of
+	// the compressor is used.
+	ZstdLevel int
+	// Software, ImageDescription, Artist and Copyright are written in the
+	// informational tags of the same names if not empty. Software defaults
+	// to DefaultSoftware.
+	Software, ImageDescription, Artist, Copyright string
+	// DateTime, if not zero, is written in the DateTime tag as the date
+	// and time the image was created.
+	DateTime time.Time
+
+	tags   []ifdEntry // Tags added by SetTag.
+	tagErr error      // The first invalid value passed to SetTag.
+}
+
+// SetTag adds the tag to the IFD of the images written with o, with the
+// given TIFF data type and value. Tags the package does not know, such as
+// private tags, can be written this way. The value must match the data
+// type: a byte or []byte for BYTE (1) and UNDEFINED (7), a string for
+// ASCII (2), a uint16 or []uint16 for SHORT (3), a uint32 or []uint32 for
+// LONG (4), and a float64 or []float64 for RATIONAL (5), whose values must
+// not be negative, and DOUBLE (12). Setting a tag again replaces its value.
+// An invalid value, or a tag that the encoder writes itself, makes the
+// encoding fail.
+func (o *Options) SetTag(tag uint16, dtype uint16, value interface{}) {
+	data, err := tagData(int(dtype), value)
+	if err != nil {
+		if o.tagErr == nil {
+			o.tagErr = fmt.Errorf("tiff: tag %d: %v", tag, err)
+		}
+		return
+	}
+	e := ifdEntry{int(tag), int(dtype), data}
+	for i := range o.tags {
+		if o.tags[i].tag == e.tag {
+			o.tags[i] = e
+			return
+		}
+	}
+	o.tags = append(o.tags, e)
+}
+
+// tagData returns the data of an ifdEntry of the given type holding value.
+func tagData(dtype int, value interface{}) ([]uint32, error) {
+	var data []uint32
+	switch v := value.(type) {
+	case byte:
+		return tagData(dtype, []byte{v})
+	case uint16:
+		return tagData(dtype, []uint16{v})
+	case uint32:
+		return tagData(dtype, []uint32{v})
+	case float64:
+		return tagData(dtype, []float64{v})
+	case []byte:
+		if dtype != dtByte && dtype != dtUndefined {
+			break
+		}
+		data = make([]uint32, len(v))
+		for i, x := range v {
+			data[i] = uint32(x)
+		}
+		return data, nil
+	case string:
+		if dtype != dtASCII {
+			break
+		}
+		return asciiData(v), nil
+	case []uint16:
+		if dtype != dtShort {
+			break
+		}
+		data = make([]uint32, len(v))
+		for i, x := range v {
+			data[i] = uint32(x)
+		}
+		return data, nil
+	case []uint32:
+		if dtype != dtLong {
+			break
+		}
+		return append(data, v...), nil
+	case []float64:
+		switch dtype {
+		case dtFloat64:
+			return float64Data(v), nil
+		case dtRational:
+			for _, x := range v {
+				if x < 0 || math.IsNaN(x) || math.IsInf(x, 0) {
+					return nil, fmt.Errorf("invalid RATIONAL value %v", x)
+				}
+				data = append(data, rationalData(x)...)
+			}
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("value of type %T for data type %d", value, dtype)
 }
 
 // Encode writes the image m to w. opt determines the options used for
 // encoding, such as the compression type. If opt is nil, an uncompressed
-// image is written.
+// image is written. Images with 16-bit samples, such as *image.Gray16,
+// *image.RGBA64 and the 16-bit grayscale images returned by Decode, are
+// written with 16 bits per sample.
 func Encode(w io.Writer, m image.Image, opt *Options) error {
-	d := m.Bounds().Size()
+	return writeImage(w, m, opt, nil)
+}
 
-	compression := uint32(cNone)
-	predictor := false
-	if opt != nil {
-		compression = opt.Compression.specValue()
-		// The predictor field is only used with LZW. See page 64 of the spec.
-		predictor = opt.Predictor && compression == cLZW
+// EncodeAll writes the images to w as the pages of a single file, in order.
+// opt determines the options used for encoding each of the images, as for
+// Encode.
+func EncodeAll(w io.Writer, images []image.Image, opt *Options) error {
+	if len(images) == 0 {
+		return fmt.Errorf("tiff: no images to encode")
 	}
+	return writeImages(w, images, opt, nil)
+}
 
-	_, err := io.WriteString(w, leHeader)
-	if err != nil {
-		return err
+// writeImage writes the image m to w, adding the entries in extra to its
+// IFD.
+func writeImage(w io.Writer, m image.Image, opt *Options, extra []ifdEntry) error {
+	return writeImages(w, []image.Image{m}, opt, extra)
+}
+
+// writeImages writes the images ms to w as the pages of a single file,
+// adding the entries in extra to each of their IFDs.
+func writeImages(w io.Writer, ms []image.Image, opt *Options, extra []ifdEntry) error {
+	// All pages are prepared before anything is written, so that the
+	// offset of each IFD is known when the previous one is written.
+	pages := make([]*imagePage, len(ms))
+	for i, m := range ms {
+		p, err := newImagePage(m, opt, extra)
+		if err != nil {
+			return err
+		}
+		pages[i] = p
 	}
 
-	// Compressed data is written into a buffer first, so that we
-	// know the compressed size.
-	var buf bytes.Buffer
-	// dst holds the destination for the pixel data of the image --
-	// either w or a writer to buf.
-	var dst io.Writer
-	// imageLen is the length of the pixel data in bytes.
-	// The offset of the IFD is imageLen + 8 header bytes.
-	var imageLen int
+	big := opt != nil && opt.BigTIFF
+	classic := opt != nil && opt.ClassicTIFF
+	if big && classic {
+		return fmt.Errorf("tiff: cannot encode with both BigTIFF and ClassicTIFF")
+	}
+	if !big {
+		// Switch to BigTIFF if the file is too large for 4-byte offsets.
+		n := 8
+		for _, p := range pages {
+			n += p.size(false)
+		}
+		big = uint64(n) > math.MaxUint32
+		if big && classic {
+			return fmt.Errorf("tiff: file of %d bytes too large for ClassicTIFF", n)
+		}
+	}
 
-	switch compression {
-	case cNone:
-		dst = w
-		// Write IFD offset before outputting pixel data.
-		switch m.(type) {
-		case *image.Paletted:
-			imageLen = d.X * d.Y * 1
-		case *image.Gray:
-			imageLen = d.X * d.Y * 1
-		case *image.Gray16:
-			imageLen = d.X * d.Y * 2
-		case *image.RGBA64:
-			imageLen = d.X * d.Y * 8
-		case *image.NRGBA64:
-			imageLen = d.X * d.Y * 8
-		default:
-			imageLen = d.X * d.Y * 4
-		}
-		err = binary.Write(w, enc, uint32(imageLen+8))
+	order := byteOrder(opt)
+	header, headerBig := leHeader, leHeaderBig
+	if order == binary.BigEndian {
+		header, headerBig = beHeader, beHeaderBig
+	}
+	start := 8
+	if big {
+		start = 16
+		_, err := io.WriteString(w, headerBig)
+		if err != nil {
+			return err
+		}
+		// The offset size is always 8, followed by a zero word.
+		if err = binary.Write(w, order, [2]uint16{8, 0}); err != nil {
+			return err
+		}
+		if err = binary.Write(w, order, uint64(start+pages[0].imageLen)); err != nil {
+			return err
+		}
+	} else {
+		_, err := io.WriteString(w, header)
 		if err != nil {
 			return err
 		}
-	case cDeflate:
-		dst = zlib.NewWriter(&buf)
+		if err = binary.Write(w, order, uint32(start+pages[0].imageLen)); err != nil {
+			return err
+		}
 	}
 
+	for i, p := range pages {
+		next := 0
+		if i+1 < len(pages) {
+			next = start + p.size(big) + pages[i+1].imageLen
+		}
+		if err := p.write(w, start, next, big, order); err != nil {
+			return err
+		}
+		start += p.size(big)
+	}
+	return nil
+}
+
+// An imagePage is an image prepared for writing, along with the entries
+// of its IFD.
+type imagePage struct {
+	m             image.Image
+	ifd           []ifdEntry // The entries, except for the block offsets and counts.
+	tiled         bool
+	blocks        []image.Rectangle
+	offsets       []uint64 // The offsets of the blocks from the start of the image data.
+	counts        []uint64
+	compression   uint32
+	bytesPerPixel int
+	predictor     bool
+	imageLen      int           // The length of the pixel data in bytes.
+	buf           *bytes.Buffer // The compressed pixel data.
+}
+
+// newImagePage prepares the image m for writing, adding the entries in
+// extra to its IFD. Compressed pixel data is held in memory until the page
+// is written.
+func newImagePage(m image.Image, opt *Options, extra []ifdEntry) (*imagePage, error) {
+	// The grayscale images returned by Decode are written with the depth
+	// and format of their samples.
+	signed, float := false, false
+	switch m.(type) {
+	case *scimage.GrayS8, *scimage.GrayS16:
+		signed = true
+	case *GrayFloat32:
+		float = true
+	}
+	m = standardGray(m)
+	d := m.Bounds().Size()
+
+	compression := uint32(cNone)
+	level := zlib.DefaultCompression
 	pr := uint32(prNone)
+	tiled := false
+	if opt != nil {
+		if opt.Compression == UnknownCompression {
+			return nil, fmt.Errorf("tiff: cannot encode with UnknownCompression")
+		}
+		if opt.Compression == Zstd && zstdNewWriter == nil {
+			return nil, fmt.Errorf("tiff: Zstd compression requires the zstd build tag")
+		}
+		if l := opt.CompressionLevel; l != 0 {
+			if l < zlib.HuffmanOnly || l > zlib.BestCompression {
+				return nil, fmt.Errorf("tiff: invalid CompressionLevel %d", l)
+			}
+			level = l
+		}
+		compression = opt.Compression.specValue()
+		// The predictor only makes sense with the compression schemes that
+		// benefit from it, and the decoder rejects it with others. See page
+		// 64 of the spec.
+		switch compression {
+		case cLZW, cDeflate, cZstd:
+			pr = opt.PredictorType.specValue()
+			if opt.PredictorType == NoPredictor && opt.Predictor {
+				pr = prHorizontal
+			}
+		}
+		if opt.TileWidth != 0 || opt.TileLength != 0 {
+			if opt.TileWidth <= 0 || opt.TileLength <= 0 || opt.TileWidth%16 != 0 || opt.TileLength%16 != 0 {
+				return nil, fmt.Errorf("tiff: invalid tile size %dx%d, want positive multiples of 16", opt.TileWidth, opt.TileLength)
+			}
+			tiled = true
+		}
+	}
+
 	photometricInterpretation := uint32(pRGB)
 	samplesPerPixel := uint32(4)
 	bitsPerSample := []uint32{8, 8, 8, 8}
 	extraSamples := uint32(0)
 	colorMap := []uint32{}
+	bytesPerPixel := 4
+	sFormat := uintSample
 
-	if predictor {
-		pr = prHorizontal
-	}
 	switch m := m.(type) {
 	case *image.Paletted:
 		photometricInterpretation = pPaletted
 		samplesPerPixel = 1
 		bitsPerSample = []uint32{8}
+		bytesPerPixel = 1
 		colorMap = make([]uint32, 256*3)
 		for i := 0; i < 256 && i < len(m.Palette); i++ {
 			r, g, b, _ := m.Palette[i].RGBA()
@@ -362,77 +866,384 @@ func Encode(w io.Writer, m image.Image, opt *Options) error {
 			colorMap[i+1*256] = uint32(g)
 			colorMap[i+2*256] = uint32(b)
 		}
-		err = encodeGray(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
 	case *image.Gray:
 		photometricInterpretation = pBlackIsZero
 		samplesPerPixel = 1
 		bitsPerSample = []uint32{8}
-		err = encodeGray(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bytesPerPixel = 1
 	case *image.Gray16:
 		photometricInterpretation = pBlackIsZero
 		samplesPerPixel = 1
 		bitsPerSample = []uint32{16}
-		err = encodeGray16(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bytesPerPixel = 2
 	case *image.NRGBA:
 		extraSamples = 2 // Unassociated alpha.
-		err = encodeRGBA(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
 	case *image.NRGBA64:
 		extraSamples = 2 // Unassociated alpha.
 		bitsPerSample = []uint32{16, 16, 16, 16}
-		err = encodeRGBA64(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bytesPerPixel = 8
 	case *image.RGBA:
 		extraSamples = 1 // Associated alpha.
-		err = encodeRGBA(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
 	case *image.RGBA64:
 		extraSamples = 1 // Associated alpha.
 		bitsPerSample = []uint32{16, 16, 16, 16}
-		err = encodeRGBA64(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bytesPerPixel = 8
+	case *GrayFloat32:
+		photometricInterpretation = pBlackIsZero
+		samplesPerPixel = 1
+		bitsPerSample = []uint32{32}
+		bytesPerPixel = 4
 	default:
 		extraSamples = 1 // Associated alpha.
-		err = encode(dst, m, predictor)
 	}
-	if err != nil {
-		return err
+	if opt != nil && opt.BitsPerSample != 0 && uint32(opt.BitsPerSample) != bitsPerSample[0] {
+		return nil, fmt.Errorf("tiff: BitsPerSample %d for the %d-bit samples of %T", opt.BitsPerSample, bitsPerSample[0], m)
+	}
+	if opt != nil {
+		sFormat = opt.SampleFormat.specValue()
+	}
+	switch {
+	case signed && sFormat == uintSample:
+		sFormat = sintSample
+	case float && sFormat == uintSample:
+		sFormat = ieeefpSample
+	}
+	if sFormat != uintSample && photometricInterpretation == pPaletted {
+		return nil, fmt.Errorf("tiff: paletted images must have unsigned samples")
+	}
+	if sFormat == ieeefpSample && !float {
+		return nil, fmt.Errorf("tiff: floating point samples can only be written from a *GrayFloat32, not a %T", m)
+	}
+	if float && sFormat != ieeefpSample {
+		return nil, fmt.Errorf("tiff: %T must be written with floating point samples", m)
+	}
+	if pr == prFloatingPoint && sFormat != ieeefpSample {
+		return nil, fmt.Errorf("tiff: floating point predictor with non floating point samples")
+	}
+	if pr == prHorizontal && float {
+		return nil, fmt.Errorf("tiff: horizontal predictor with floating point samples")
+	}
+	predictor := pr == prHorizontal
+	// The floating point predictor splits the samples into byte planes,
+	// from little-endian samples, regardless of the byte order of the file.
+	order := byteOrder(opt)
+	if pr == prFloatingPoint {
+		order = binary.LittleEndian
 	}
 
-	if compression != cNone {
-		if err = dst.(io.Closer).Close(); err != nil {
-			return err
+	var rowsPerStrip int
+	if !tiled {
+		var err error
+		if rowsPerStrip, err = stripRows(opt, d, bytesPerPixel); err != nil {
+			return nil, err
 		}
-		imageLen = buf.Len()
-		if err = binary.Write(w, enc, uint32(imageLen+8)); err != nil {
-			return err
+	}
+
+	// The image is split into strips or tiles, which are compressed
+	// independently of each other.
+	blocks := []image.Rectangle{m.Bounds()}
+	if tiled {
+		blocks = blocks[:0]
+		for y := 0; y < d.Y; y += opt.TileLength {
+			for x := 0; x < d.X; x += opt.TileWidth {
+				r := image.Rect(x, y, x+opt.TileWidth, y+opt.TileLength)
+				blocks = append(blocks, r.Add(m.Bounds().Min))
+			}
 		}
-		if _, err = buf.WriteTo(w); err != nil {
-			return err
+	} else if d.Y > 0 {
+		blocks = blocks[:0]
+		for y := 0; y < d.Y; y += rowsPerStrip {
+			r := image.Rect(0, y, d.X, minInt(y+rowsPerStrip, d.Y))
+			blocks = append(blocks, r.Add(m.Bounds().Min))
 		}
 	}
+	// offsets holds the offsets of the blocks from the start of the image
+	// data, which follows the header or the previous page.
+	offsets := make([]uint64, len(blocks))
+	counts := make([]uint64, len(blocks))
+
+	// imageLen is the length of the pixel data in bytes.
+	var imageLen int
+
+	// Compressed data is written into a buffer first, so that we
+	// know the compressed size.
+	var buf bytes.Buffer
+	if compression == cNone {
+		for i, b := range blocks {
+			offsets[i] = uint64(imageLen)
+			counts[i] = uint64(b.Dx() * b.Dy() * bytesPerPixel)
+			imageLen += int(counts[i])
+		}
+	} else {
+		for i, b := range blocks {
+			offsets[i] = uint64(buf.Len())
+			var dst io.WriteCloser
+			switch compression {
+			case cDeflate:
+				// The level was validated above.
+				dst, _ = zlib.NewWriterLevel(&buf, level)
+			case cLZW:
+				dst = lzw.NewWriter(&buf, lzw.MSB, 8)
+			case cPackBits:
+				dst = newPackBitsWriter(&buf, b.Dx()*bytesPerPixel)
+			case cZstd:
+				var err error
+				if dst, err = zstdNewWriter(&buf, opt.ZstdLevel); err != nil {
+					return nil, err
+				}
+			}
+			var bw io.Writer = dst
+			if pr == prFloatingPoint {
+				bw = newFloatPredictor(dst, b.Dx()*bytesPerPixel, int(samplesPerPixel), int(bitsPerSample[0]/8))
+			}
+			if err := encodeBlock(bw, m, b, bytesPerPixel, predictor, order); err != nil {
+				return nil, err
+			}
+			if err := dst.Close(); err != nil {
+				return nil, err
+			}
+			counts[i] = uint64(buf.Len()) - offsets[i]
+		}
+		imageLen = buf.Len()
+	}
+
+	xRes, yRes, resUnit := []uint32{72, 1}, []uint32{72, 1}, uint32(resPerInch)
+	if opt != nil && opt.XResolution > 0 && opt.YResolution > 0 {
+		xRes = rationalData(opt.XResolution)
+		yRes = rationalData(opt.YResolution)
+		resUnit = opt.ResolutionUnit.specValue()
+	}
 
 	ifd := []ifdEntry{
-		{tImageWidth, dtShort, []uint32{uint32(d.X)}},
-		{tImageLength, dtShort, []uint32{uint32(d.Y)}},
+		{tImageWidth, dtLong, []uint32{uint32(d.X)}},
+		{tImageLength, dtLong, []uint32{uint32(d.Y)}},
 		{tBitsPerSample, dtShort, bitsPerSample},
 		{tCompression, dtShort, []uint32{compression}},
 		{tPhotometricInterpretation, dtShort, []uint32{photometricInterpretation}},
-		{tStripOffsets, dtLong, []uint32{8}},
 		{tSamplesPerPixel, dtShort, []uint32{samplesPerPixel}},
-		{tRowsPerStrip, dtShort, []uint32{uint32(d.Y)}},
-		{tStripByteCounts, dtLong, []uint32{uint32(imageLen)}},
-		// There is currently no support for storing the image
-		// resolution, so give a bogus value of 72x72 dpi.
-		{tXResolution, dtRational, []uint32{72, 1}},
-		{tYResolution, dtRational, []uint32{72, 1}},
-		{tResolutionUnit, dtShort, []uint32{resPerInch}},
+		{tXResolution, dtRational, xRes},
+		{tYResolution, dtRational, yRes},
+		{tResolutionUnit, dtShort, []uint32{resUnit}},
+	}
+	if tiled {
+		ifd = append(ifd,
+			ifdEntry{tTileWidth, dtShort, []uint32{uint32(opt.TileWidth)}},
+			ifdEntry{tTileLength, dtShort, []uint32{uint32(opt.TileLength)}},
+		)
+	} else {
+		ifd = append(ifd, ifdEntry{tRowsPerStrip, dtLong, []uint32{uint32(rowsPerStrip)}})
 	}
 	if pr != prNone {
 		ifd = append(ifd, ifdEntry{tPredictor, dtShort, []uint32{pr}})
 	}
+	if sFormat != uintSample {
+		formats := make([]uint32, samplesPerPixel)
+		for i := range formats {
+			formats[i] = uint32(sFormat)
+		}
+		ifd = append(ifd, ifdEntry{tSampleFormat, dtShort, formats})
+	}
 	if len(colorMap) != 0 {
 		ifd = append(ifd, ifdEntry{tColorMap, dtShort, colorMap})
 	}
 	if extraSamples > 0 {
 		ifd = append(ifd, ifdEntry{tExtraSamples, dtShort, []uint32{extraSamples}})
 	}
+	ifd = append(ifd, extra...)
+	ifd = append(ifd, textEntries(opt)...)
+	if opt != nil {
+		if opt.tagErr != nil {
+			return nil, opt.tagErr
+		}
+		offsetTag, countTag := tStripOffsets, tStripByteCounts
+		if tiled {
+			offsetTag, countTag = tTileOffsets, tTileByteCounts
+		}
+		for _, t := range opt.tags {
+			dup := t.tag == offsetTag || t.tag == countTag
+			for _, e := range ifd {
+				dup = dup || t.tag == e.tag
+			}
+			if dup {
+				return nil, fmt.Errorf("tiff: tag %d is written by the encoder", t.tag)
+			}
+		}
+		ifd = append(ifd, opt.tags...)
+	}
+
+	return &imagePage{
+		m:             m,
+		ifd:           ifd,
+		tiled:         tiled,
+		blocks:        blocks,
+		offsets:       offsets,
+		counts:        counts,
+		compression:   compression,
+		bytesPerPixel: bytesPerPixel,
+		predictor:     predictor,
+		imageLen:      imageLen,
+		buf:           &buf,
+	}, nil
+}
+
+// DefaultSoftware is the Software tag written when Options.Software is
+// empty.
+const DefaultSoftware = "github.com/prl900/image/tiff"
+
+// textEntries returns the entries of the informational tags set in opt.
+// Tags also set with SetTag are left to it.
+func textEntries(opt *Options) []ifdEntry {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	if o.Software == "" {
+		o.Software = DefaultSoftware
+	}
+	var dateTime string
+	if !o.DateTime.IsZero() {
+		dateTime = o.DateTime.Format("2006:01:02 15:04:05")
+	}
+	var entries []ifdEntry
+	for _, t := range []struct {
+		tag   int
+		value string
+	}{
+		{tImageDescription, o.ImageDescription},
+		{tSoftware, o.Software},
+		{tDateTime, dateTime},
+		{tArtist, o.Artist},
+		{tCopyright, o.Copyright},
+	} {
+		skip := t.value == ""
+		for _, e := range o.tags {
+			skip = skip || e.tag == t.tag
+		}
+		if !skip {
+			entries = append(entries, ifdEntry{t.tag, dtASCII, asciiData(t.value)})
+		}
+	}
+	return entries
+}
+
+// standardGray converts the grayscale images returned by Decode to the
+// image.Gray or image.Gray16 holding the same samples, with signed samples
+// stored as their two's complement. Other images are returned unchanged.
+func standardGray(m image.Image) image.Image {
+	b := m.Bounds()
+	switch m.(type) {
+	case *scimage.GrayU8, *scimage.GrayS8:
+		g := image.NewGray(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				var v uint8
+				switch c := m.At(x, y).(type) {
+				case scicolor.GrayU8:
+					v = c.Y
+				case scicolor.GrayS8:
+					v = uint8(c.Y)
+				}
+				g.Pix[g.PixOffset(x, y)] = v
+			}
+		}
+		return g
+	case *scimage.GrayU16, *scimage.GrayS16:
+		g := image.NewGray16(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				var v uint16
+				switch c := m.At(x, y).(type) {
+				case scicolor.GrayU16:
+					v = c.Y
+				case scicolor.GrayS16:
+					v = uint16(c.Y)
+				}
+				i := g.PixOffset(x, y)
+				g.Pix[i], g.Pix[i+1] = uint8(v>>8), uint8(v)
+			}
+		}
+		return g
+	}
+	return m
+}
+
+// stripRows returns the number of rows per strip of an image of size d
+// with bytesPerPixel bytes per pixel.
+func stripRows(opt *Options, d image.Point, bytesPerPixel int) (int, error) {
+	if opt != nil && opt.RowsPerStrip != 0 {
+		if opt.RowsPerStrip < 0 || opt.RowsPerStrip > d.Y {
+			return 0, fmt.Errorf("tiff: invalid RowsPerStrip %d for an image of height %d", opt.RowsPerStrip, d.Y)
+		}
+		return opt.RowsPerStrip, nil
+	}
+	// Aim for strips of about 8KB, as libtiff does.
+	const stripSize = 8 << 10
+	n := 1
+	if rowLen := d.X * bytesPerPixel; rowLen > 0 && rowLen < stripSize {
+		n = stripSize / rowLen
+	}
+	if n > d.Y {
+		n = d.Y
+	}
+	return n, nil
+}
+
+// entries returns the complete IFD of the page, whose image data starts at
+// start in the file.
+func (p *imagePage) entries(start int, big bool) []ifdEntry {
+	return append(blockEntries(p.tiled, p.offsets, p.counts, start, big), p.ifd...)
+}
+
+// size returns the number of bytes taken by the image data and IFD of the
+// page.
+func (p *imagePage) size(big bool) int {
+	return p.imageLen + ifdSize(p.entries(0, big), big)
+}
+
+// write writes the image data of the page, starting at start in the file,
+// followed by its IFD, which points to the next IFD at next. order is the
+// byte order of the file.
+func (p *imagePage) write(w io.Writer, start, next int, big bool, order binary.ByteOrder) error {
+	if p.compression == cNone {
+		for _, b := range p.blocks {
+			if err := encodeBlock(w, p.m, b, p.bytesPerPixel, p.predictor, order); err != nil {
+				return err
+			}
+		}
+	} else if _, err := p.buf.WriteTo(w); err != nil {
+		return err
+	}
+	return writeIFD(w, start+p.imageLen, p.entries(start, big), next, big, order)
+}
 
-	return writeIFD(w, imageLen+8, ifd)
+// blockEntries returns the IFD entries holding the offsets and byte counts
+// of the strips or tiles of an image, whose data starts at start in the file.
+// If big is true, they are stored as 8-byte values.
+func blockEntries(tiled bool, offsets, counts []uint64, start int, big bool) []ifdEntry {
+	offsetTag, countTag := tStripOffsets, tStripByteCounts
+	if tiled {
+		offsetTag, countTag = tTileOffsets, tTileByteCounts
+	}
+	off := make([]uint64, len(offsets))
+	for i, o := range offsets {
+		off[i] = o + uint64(start)
+	}
+	if big {
+		return []ifdEntry{
+			{offsetTag, dtLong8, long8Data(off)},
+			{countTag, dtLong8, long8Data(counts)},
+		}
+	}
+	off32 := make([]uint32, len(off))
+	for i, o := range off {
+		off32[i] = uint32(o)
+	}
+	counts32 := make([]uint32, len(counts))
+	for i, c := range counts {
+		counts32[i] = uint32(c)
+	}
+	return []ifdEntry{
+		{offsetTag, dtLong, off32},
+		{countTag, dtLong, counts32},
+	}
 }
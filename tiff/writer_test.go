@@ -6,10 +6,21 @@ package tiff
 
 import (
 	"bytes"
+	"compress/zlib"
 	"image"
+	"image/color"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/prl900/scimage"
+	"github.com/prl900/scimage/scicolor"
 )
 
 var roundtripTests = []struct {
@@ -25,6 +36,26 @@ var roundtripTests = []struct {
 	{"video-001.tiff", &Options{Predictor: true}},
 	{"video-001.tiff", &Options{Compression: Deflate}},
 	{"video-001.tiff", &Options{Predictor: true, Compression: Deflate}},
+	{"video-001-16bit.tiff", &Options{Predictor: true, Compression: Deflate}},
+	{"video-001-gray-16bit.tiff", &Options{Predictor: true, Compression: Deflate}},
+	{"video-001-gray.tiff", &Options{Predictor: true, Compression: Deflate, TileWidth: 48, TileLength: 48}},
+	{"video-001.tiff", &Options{TileWidth: 64, TileLength: 32}},
+	{"video-001.tiff", &Options{Compression: Deflate, TileWidth: 32, TileLength: 48}},
+	{"video-001-16bit.tiff", &Options{TileWidth: 16, TileLength: 16}},
+	{"video-001-gray.tiff", &Options{Compression: Deflate, TileWidth: 64, TileLength: 64}},
+	{"video-001-paletted.tiff", &Options{TileWidth: 128, TileLength: 16}},
+	{"video-001.tiff", &Options{BigTIFF: true}},
+	{"video-001-paletted.tiff", &Options{BigTIFF: true, Compression: Deflate, TileWidth: 32, TileLength: 32}},
+	{"video-001.tiff", &Options{Compression: LZW}},
+	{"video-001-16bit.tiff", &Options{Predictor: true, Compression: LZW}},
+	{"video-001-gray.tiff", &Options{Compression: LZW, TileWidth: 32, TileLength: 32}},
+	{"video-001-paletted.tiff", &Options{Compression: LZW}},
+	{"bw-packbits.tiff", &Options{Compression: LZW}},
+	{"video-001.tiff", &Options{Compression: PackBits}},
+	{"video-001-gray-16bit.tiff", &Options{Compression: PackBits, TileWidth: 48, TileLength: 32}},
+	{"video-001-paletted.tiff", &Options{Compression: PackBits}},
+	{"bw-packbits.tiff", &Options{Compression: PackBits}},
+	{"video-001.tiff", &Options{Predictor: true, Compression: PackBits}},
 }
 
 func openImage(filename string) (image.Image, error) {
@@ -56,6 +87,74 @@ func TestRoundtrip(t *testing.T) {
 	}
 }
 
+// TestEncodeBigEndian tests that images encoded in big-endian byte order
+// decode to the same images as their little-endian twins.
+func TestEncodeBigEndian(t *testing.T) {
+	for _, rt := range roundtripTests {
+		img, err := openImage(rt.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts Options
+		if rt.opts != nil {
+			opts = *rt.opts
+		}
+		var le bytes.Buffer
+		if err := Encode(&le, img, &opts); err != nil {
+			t.Fatal(err)
+		}
+		opts.BigEndian = true
+		var be bytes.Buffer
+		if err := Encode(&be, img, &opts); err != nil {
+			t.Fatal(err)
+		}
+		header := beHeader
+		if opts.BigTIFF {
+			header = beHeaderBig
+		}
+		if got := be.String()[:4]; got != header {
+			t.Errorf("%s %+v: header: got %q, want %q", rt.filename, opts, got, header)
+		}
+		m0, err := Decode(&buffer{buf: le.Bytes()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m1, err := Decode(&buffer{buf: be.Bytes()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compare(t, m0, m1)
+	}
+}
+
+func TestEncodeCompressionLevel(t *testing.T) {
+	img, err := openImage("video-001.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[int]int)
+	for _, level := range []int{0, zlib.HuffmanOnly, zlib.BestSpeed, zlib.BestCompression} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, img, &Options{Compression: Deflate, CompressionLevel: level}); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		m, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		compare(t, img, m)
+		sizes[level] = buf.Len()
+	}
+	if sizes[zlib.BestCompression] > sizes[zlib.BestSpeed] {
+		t.Errorf("BestCompression gave %d bytes, more than the %d of BestSpeed", sizes[zlib.BestCompression], sizes[zlib.BestSpeed])
+	}
+	for _, level := range []int{zlib.HuffmanOnly - 1, zlib.BestCompression + 1} {
+		if err := Encode(ioutil.Discard, img, &Options{Compression: Deflate, CompressionLevel: level}); err == nil {
+			t.Errorf("level %d: got nil error, want non-nil", level)
+		}
+	}
+}
+
 // TestRoundtrip2 tests that encoding and decoding an image whose
 // origin is not (0, 0) gives the same thing.
 func TestRoundtrip2(t *testing.T) {
@@ -74,6 +173,225 @@ func TestRoundtrip2(t *testing.T) {
 	compare(t, m0, m1)
 }
 
+// TestPackBits tests that packBits output decodes back to its input and
+// stays within the worst case size.
+func TestPackBits(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		{1},
+		{1, 1},
+		{1, 1, 1},
+		{1, 2, 2, 3, 3, 3, 4, 4, 4, 4},
+		bytes.Repeat([]byte{7}, 300),
+	}
+	noise := make([]byte, 1000)
+	for i := range noise {
+		noise[i] = byte(i * i >> 3)
+	}
+	tests = append(tests, noise, append(bytes.Repeat([]byte{0}, 129), noise[:200]...))
+	for _, src := range tests {
+		dst := packBits(nil, src)
+		if max := len(src) + (len(src)+127)/128; len(dst) > max {
+			t.Errorf("len(src)=%d: packed to %d bytes, want at most %d", len(src), len(dst), max)
+		}
+		got, err := unpackBits(bytes.NewReader(dst), len(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("len(src)=%d: round trip mismatch", len(src))
+		}
+	}
+}
+
+// TestEncodeTiled tests that tiled images are written with padded tiles.
+func TestEncodeTiled(t *testing.T) {
+	m0 := image.NewGray(image.Rect(0, 0, 37, 16))
+	for i := range m0.Pix {
+		m0.Pix[i] = byte(i)
+	}
+	out := new(bytes.Buffer)
+	if err := Encode(out, m0, &Options{TileWidth: 16, TileLength: 32}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.features[tTileByteCounts]; !reflect.DeepEqual(got, []uint{512, 512, 512}) {
+		t.Errorf("TileByteCounts: got %v, want [512 512 512]", got)
+	}
+	if _, ok := d.features[tStripOffsets]; ok {
+		t.Error("tiled image has StripOffsets")
+	}
+	m1, err := Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, m0, m1)
+
+	for _, opts := range []*Options{
+		{TileWidth: 16},
+		{TileWidth: 16, TileLength: 24},
+		{TileWidth: -16, TileLength: 16},
+	} {
+		if err := Encode(ioutil.Discard, m0, opts); err == nil {
+			t.Errorf("tile size %dx%d: got nil error, want non-nil", opts.TileWidth, opts.TileLength)
+		}
+	}
+}
+
+// sparseFile records the first bytes written to it and the bytes written
+// from tailStart on, and only counts the bytes in between. Reading the
+// bytes in between returns zeros.
+type sparseFile struct {
+	n         int64
+	head      [16]byte
+	tail      []byte
+	tailStart int64
+}
+
+func (f *sparseFile) Write(p []byte) (int, error) {
+	if f.n < int64(len(f.head)) {
+		copy(f.head[f.n:], p)
+	}
+	if end := f.n + int64(len(p)); end > f.tailStart {
+		i := f.tailStart - f.n
+		if i < 0 {
+			i = 0
+		}
+		f.tail = append(f.tail, p[i:]...)
+	}
+	f.n += int64(len(p))
+	return len(p), nil
+}
+
+func (f *sparseFile) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *sparseFile) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		switch o := off + int64(i); {
+		case o >= f.n:
+			return i, io.EOF
+		case o < int64(len(f.head)):
+			p[i] = f.head[o]
+		case o >= f.tailStart:
+			p[i] = f.tail[o-f.tailStart]
+		default:
+			p[i] = 0
+		}
+	}
+	return len(p), nil
+}
+
+// TestEncodeBigTIFF tests that images too large for 4-byte offsets are
+// written as BigTIFF files.
+func TestEncodeBigTIFF(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("file sizes beyond 4 GiB overflow int")
+	}
+	// The rows of a zero stride image all share the same pixels.
+	const w, h = 1 << 16, 1<<16 + 1
+	m := &image.Gray{
+		Pix:    make([]byte, w),
+		Stride: 0,
+		Rect:   image.Rect(0, 0, w, h),
+	}
+	f := &sparseFile{tailStart: 16 + w*h}
+	if err := Encode(f, m, &Options{RowsPerStrip: h}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.head[:4]); got != leHeaderBig {
+		t.Fatalf("header: got %q, want %q", got, leHeaderBig)
+	}
+	if got := enc.Uint64(f.head[8:]); got != 16+w*h {
+		t.Fatalf("IFD offset: got %d, want %d", got, uint64(16+w*h))
+	}
+	d, err := newDecoder(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.features[tStripOffsets]; !reflect.DeepEqual(got, []uint{16}) {
+		t.Errorf("StripOffsets: got %v, want [16]", got)
+	}
+	if got := d.features[tStripByteCounts]; len(got) != 1 || uint64(got[0]) != w*h {
+		t.Errorf("StripByteCounts: got %v, want [%d]", got, uint64(w*h))
+	}
+	if d.config.Width != w || d.config.Height != h {
+		t.Errorf("size: got %dx%d, want %dx%d", d.config.Width, d.config.Height, w, h)
+	}
+
+	// ClassicTIFF forbids the switch to BigTIFF.
+	f = &sparseFile{tailStart: 16 + w*h}
+	if err := Encode(f, m, &Options{RowsPerStrip: h, ClassicTIFF: true}); err == nil {
+		t.Error("ClassicTIFF: got nil error, want non-nil")
+	}
+	if f.n != 0 {
+		t.Errorf("ClassicTIFF: %d bytes written, want 0", f.n)
+	}
+	small := image.NewGray(image.Rect(0, 0, 4, 4))
+	var buf bytes.Buffer
+	if err := Encode(&buf, small, &Options{ClassicTIFF: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String()[:4]; got != leHeader {
+		t.Errorf("ClassicTIFF: header: got %q, want %q", got, leHeader)
+	}
+	if err := Encode(ioutil.Discard, small, &Options{BigTIFF: true, ClassicTIFF: true}); err == nil {
+		t.Error("BigTIFF and ClassicTIFF: got nil error, want non-nil")
+	}
+}
+
+// TestEncodeRowsPerStrip tests that images are split into strips of the
+// requested number of rows, or of about 8KB by default.
+func TestEncodeRowsPerStrip(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 1000, 25))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7)
+	}
+	tests := []struct {
+		rowsPerStrip int
+		want         uint
+		strips       int
+	}{
+		{0, 8, 4},
+		{1, 1, 25},
+		{10, 10, 3},
+		{25, 25, 1},
+	}
+	for _, tc := range tests {
+		for _, c := range []CompressionType{Uncompressed, Deflate} {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m, &Options{RowsPerStrip: tc.rowsPerStrip, Compression: c}); err != nil {
+				t.Fatal(err)
+			}
+			d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := d.firstVal(tRowsPerStrip); got != tc.want {
+				t.Errorf("RowsPerStrip %d: got tag %d, want %d", tc.rowsPerStrip, got, tc.want)
+			}
+			if got := len(d.features[tStripOffsets]); got != tc.strips {
+				t.Errorf("RowsPerStrip %d: got %d strips, want %d", tc.rowsPerStrip, got, tc.strips)
+			}
+			m1, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compare(t, m, m1)
+		}
+	}
+
+	for _, n := range []int{-1, 26} {
+		if err := Encode(ioutil.Discard, m, &Options{RowsPerStrip: n}); err == nil {
+			t.Errorf("RowsPerStrip %d: got nil error", n)
+		}
+	}
+}
+
 func benchmarkEncode(b *testing.B, name string, pixelSize int) {
 	img, err := openImage(name)
 	if err != nil {
@@ -93,3 +411,623 @@ func BenchmarkEncodeGray(b *testing.B)     { benchmarkEncode(b, "video-001-gray.
 func BenchmarkEncodeGray16(b *testing.B)   { benchmarkEncode(b, "video-001-gray-16bit.tiff", 2) }
 func BenchmarkEncodeRGBA(b *testing.B)     { benchmarkEncode(b, "video-001.tiff", 4) }
 func BenchmarkEncodeRGBA64(b *testing.B)   { benchmarkEncode(b, "video-001-16bit.tiff", 8) }
+
+func TestEncodeResolution(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 2, 2))
+	testCases := []struct {
+		opts *Options
+		x, y float64
+		unit ResolutionUnit
+	}{
+		{nil, 72, 72, PerInch},
+		{&Options{XResolution: 300, YResolution: 600}, 300, 600, PerInch},
+		{&Options{XResolution: 118.11, YResolution: 59.055, ResolutionUnit: PerCM}, 118.11, 59.055, PerCM},
+		{&Options{XResolution: 1, YResolution: 2, ResolutionUnit: NoResolutionUnit}, 1, 2, NoResolutionUnit},
+	}
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, y, unit, err := d.Resolution()
+		if err != nil {
+			t.Errorf("%+v: %v", tc.opts, err)
+			continue
+		}
+		if math.Abs(x-tc.x) > 1e-9 || math.Abs(y-tc.y) > 1e-9 || unit != tc.unit {
+			t.Errorf("%+v: got %v, %v, %v, want %v, %v, %v", tc.opts, x, y, unit, tc.x, tc.y, tc.unit)
+		}
+	}
+
+	d, err := newDecoder(bytes.NewReader(buildTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := d.Resolution(); err == nil {
+		t.Error("missing tags: got nil error, want non-nil")
+	}
+}
+
+func TestEncodePaletted(t *testing.T) {
+	p := color.Palette{
+		color.RGBA{0x00, 0x00, 0xff, 0xff},
+		color.RGBA{0x1c, 0x8c, 0x2a, 0xff},
+		color.RGBA{0xd2, 0xb4, 0x8c, 0xff},
+		color.RGBA{0xff, 0xff, 0xff, 0xff},
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 5, 3), p)
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i % len(p))
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, &Options{Compression: Deflate}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.firstVal(tPhotometricInterpretation); got != pPaletted {
+		t.Errorf("PhotometricInterpretation: got %d, want %d", got, pPaletted)
+	}
+	if got := d.features[tBitsPerSample]; !reflect.DeepEqual(got, []uint{8}) {
+		t.Errorf("BitsPerSample: got %v, want [8]", got)
+	}
+	m1, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, ok := m1.(*image.Paletted)
+	if !ok {
+		t.Fatalf("got %T, want *image.Paletted", m1)
+	}
+	// The ColorMap always holds 2^BitsPerSample entries.
+	if len(pm.Palette) != 256 {
+		t.Fatalf("palette length: got %d, want 256", len(pm.Palette))
+	}
+	for i, c := range p {
+		r0, g0, b0, a0 := c.RGBA()
+		r1, g1, b1, a1 := pm.Palette[i].RGBA()
+		if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+			t.Errorf("palette entry %d: got %v, want %v", i, pm.Palette[i], c)
+		}
+	}
+	if !bytes.Equal(pm.Pix, m.Pix) {
+		t.Errorf("pixels: got %v, want %v", pm.Pix, m.Pix)
+	}
+}
+
+func TestPredictFloat(t *testing.T) {
+	// Two rows of 3 pixels with 2 samples each.
+	const w, h, spp = 3, 2, 2
+	want := []float32{
+		-1.5, 0, 2.25, 100, 3e8, -7,
+		float32(math.Inf(-1)), 0.125, 42, 6378137, 1e-20, -0,
+	}
+	pix := float32Pix(enc, want...)
+	tmp := make([]byte, 4*w*spp)
+	for y := 0; y < h; y++ {
+		predictFloat(pix[y*len(tmp):(y+1)*len(tmp)], tmp, spp, 4)
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(pix)
+	zw.Close()
+	d, err := newDecoder(bytes.NewReader(makeTIFF(enc, buf.Bytes(),
+		shortsEntry(tImageWidth, w),
+		shortsEntry(tImageLength, h),
+		shortsEntry(tBitsPerSample, 32, 32),
+		shortsEntry(tSamplesPerPixel, spp),
+		shortsEntry(tSampleFormat, uint16(ieeefpSample), uint16(ieeefpSample)),
+		shortsEntry(tCompression, cDeflate),
+		shortsEntry(tPredictor, prFloatingPoint),
+		shortsEntry(tRowsPerStrip, h),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for band := 0; band < spp; band++ {
+		got, _, _, err := d.Float32Band(band)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range got {
+			if v != want[i*spp+band] {
+				t.Errorf("band %d pixel %d: got %v, want %v", band, i, v, want[i*spp+band])
+			}
+		}
+	}
+}
+
+func TestEncodePredictor(t *testing.T) {
+	m := image.NewGray16(image.Rect(0, 0, 4, 2))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 3)
+	}
+	for _, tc := range []struct {
+		opts *Options
+		want uint
+	}{
+		{&Options{Predictor: true, Compression: Deflate}, prHorizontal},
+		{&Options{PredictorType: HorizontalPredictor, Compression: LZW}, prHorizontal},
+		{&Options{Compression: Deflate}, 0},
+		// The predictor is ignored without compression, or with
+		// compression schemes it is not defined for.
+		{&Options{Predictor: true}, 0},
+		{&Options{Predictor: true, Compression: PackBits}, 0},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.firstVal(tPredictor); got != tc.want {
+			t.Errorf("%+v: Predictor: got %d, want %d", *tc.opts, got, tc.want)
+		}
+	}
+
+	err := Encode(ioutil.Discard, m, &Options{PredictorType: FloatingPointPredictor, Compression: Deflate})
+	if err == nil {
+		t.Error("floating point predictor with integer samples: got nil error, want non-nil")
+	}
+}
+
+// TestEncodeSampleFormat tests that the SampleFormat and BitsPerSample
+// options are written and that the samples are read back unchanged.
+func TestEncodeSampleFormat(t *testing.T) {
+	const w, h = 5, 3
+	m16 := image.NewGray16(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		m16.SetGray16(i%w, i/w, color.Gray16{uint16(int16(i*1000 - 7000))})
+	}
+	for _, c := range []CompressionType{Uncompressed, Deflate} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m16, &Options{SampleFormat: SignedSample, Compression: c, Predictor: true}); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, _, err := d.Int16Band(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range got {
+			if want := int16(i*1000 - 7000); v != want {
+				t.Errorf("compression %d: pixel %d: got %d, want %d", c, i, v, want)
+			}
+		}
+	}
+
+	want := make([]float32, w*h)
+	for i := range want {
+		want[i] = float32(i)*0.75 - 3
+	}
+	mf := NewGrayFloat32(image.Rect(0, 0, w, h), -3, 45)
+	copy(mf.Pix, want)
+	for _, opts := range []*Options{
+		{},
+		{SampleFormat: FloatSample, BitsPerSample: 32},
+		{BigEndian: true},
+		{Compression: Deflate, PredictorType: FloatingPointPredictor},
+		{BigEndian: true, Compression: Deflate, PredictorType: FloatingPointPredictor},
+		{Compression: LZW, PredictorType: FloatingPointPredictor, TileWidth: 16, TileLength: 16},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, mf, opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.features[tBitsPerSample]; !reflect.DeepEqual(got, []uint{32}) {
+			t.Errorf("%+v: BitsPerSample: got %v, want [32]", *opts, got)
+		}
+		if got := d.sFormat; got != ieeefpSample {
+			t.Errorf("%+v: SampleFormat: got %d, want %d", *opts, got, ieeefpSample)
+		}
+		got, _, _, err := d.Float32Band(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: got %v, want %v", *opts, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		m    image.Image
+		opts *Options
+	}{
+		{m16, &Options{SampleFormat: FloatSample}},
+		{m16, &Options{BitsPerSample: 32}},
+		{image.NewNRGBA(image.Rect(0, 0, w, h)), &Options{SampleFormat: FloatSample, BitsPerSample: 32}},
+		{mf, &Options{BitsPerSample: 16}},
+		{mf, &Options{SampleFormat: SignedSample}},
+		{mf, &Options{Compression: Deflate, Predictor: true}},
+		{image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black}), &Options{SampleFormat: SignedSample}},
+	} {
+		if err := Encode(ioutil.Discard, tc.m, tc.opts); err == nil {
+			t.Errorf("%T %+v: got nil error, want non-nil", tc.m, *tc.opts)
+		}
+	}
+}
+
+func TestEncodeAll(t *testing.T) {
+	var images []image.Image
+	for i, r := range []image.Rectangle{
+		image.Rect(0, 0, 3, 2),
+		image.Rect(0, 0, 5, 7),
+		image.Rect(0, 0, 1, 1),
+	} {
+		m := image.NewNRGBA(r)
+		for j := range m.Pix {
+			m.Pix[j] = uint8(i*50 + j)
+		}
+		images = append(images, m)
+	}
+	for _, opts := range []*Options{
+		nil,
+		{Compression: Deflate, Predictor: true},
+		{BigTIFF: true},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeAll(&buf, images, opts); err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeAll(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(images) {
+			t.Fatalf("%+v: got %d images, want %d", opts, len(got), len(images))
+		}
+		for i := range images {
+			compare(t, images[i], got[i])
+		}
+	}
+
+	if err := EncodeAll(ioutil.Discard, nil, nil); err == nil {
+		t.Error("no images: got nil error, want non-nil")
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 3, 2))
+	opts := &Options{}
+	opts.SetTag(65000, dtShort, uint16(7))
+	opts.SetTag(65001, dtLong, []uint32{1, 2, 3})
+	opts.SetTag(65002, dtASCII, "vendor")
+	opts.SetTag(65003, dtFloat64, []float64{1.5, -2})
+	opts.SetTag(65004, dtRational, 0.25)
+	opts.SetTag(65005, dtUndefined, []byte{9, 8, 7, 6, 5})
+	opts.SetTag(65000, dtShort, []uint16{8, 9}) // Replaces the first value.
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, opts); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tag   uint16
+		dtype uint16
+		count uint32
+		data  []byte
+	}{
+		{65000, dtShort, 2, []byte{8, 0, 9, 0}},
+		{65001, dtLong, 3, []byte{1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0}},
+		{65002, dtASCII, 7, []byte("vendor\x00")},
+		{65003, dtFloat64, 2, []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f, 0, 0, 0, 0, 0, 0, 0, 0xc0}},
+		{65004, dtRational, 1, []byte{25, 0, 0, 0, 100, 0, 0, 0}},
+		{65005, dtUndefined, 5, []byte{9, 8, 7, 6, 5}},
+	} {
+		dtype, count, data, ok := d.RawTag(tc.tag)
+		if !ok || dtype != tc.dtype || count != tc.count || !bytes.Equal(data, tc.data) {
+			t.Errorf("tag %d: got %d, %d, %x, %t, want %d, %d, %x", tc.tag, dtype, count, data, ok, tc.dtype, tc.count, tc.data)
+		}
+	}
+	m1, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, m, m1)
+
+	for _, set := range []func(o *Options){
+		func(o *Options) { o.SetTag(65000, dtShort, "text") },
+		func(o *Options) { o.SetTag(65000, dtLong, uint16(1)) },
+		func(o *Options) { o.SetTag(65000, dtRational, -1.0) },
+		func(o *Options) { o.SetTag(tImageWidth, dtLong, uint32(3)) },
+		func(o *Options) { o.SetTag(tStripOffsets, dtLong, uint32(8)) },
+	} {
+		o := &Options{}
+		set(o)
+		if err := Encode(ioutil.Discard, m, o); err == nil {
+			t.Errorf("%+v: got nil error, want non-nil", o.tags)
+		}
+	}
+}
+
+func TestEncodeTagOrder(t *testing.T) {
+	opts := &GeoOptions{
+		ModelPixelScale: []float64{1, 1, 0},
+		GeoKeys:         GeoKeys{Keys: map[int]interface{}{GTModelTypeGeoKey: uint(ModelTypeGeographic)}},
+	}
+	// Tags set out of order, before and after the ones of the encoder.
+	opts.SetTag(65001, dtShort, uint16(1))
+	opts.SetTag(65000, dtShort, uint16(2))
+	opts.SetTag(tGDALNoData, dtASCII, "0")
+	opts.SetTag(300, dtShort, uint16(3))
+	var buf bytes.Buffer
+	if err := EncodeGeo(&buf, image.NewGray(image.Rect(0, 0, 2, 2)), opts); err != nil {
+		t.Fatal(err)
+	}
+	// Strict decoding rejects IFDs whose entries are not in ascending order.
+	if _, err := (&DecodeOptions{Strict: true}).DecodeConfig(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []int
+	for i := 0; i < len(d.ifd); i += d.ifdLen() {
+		tags = append(tags, int(d.byteOrder.Uint16(d.ifd[i:])))
+	}
+	if !sort.IntsAreSorted(tags) {
+		t.Errorf("tags not in ascending order: %v", tags)
+	}
+}
+
+// TestZstd tests the round trip of Zstandard compressed images when the
+// package is built with the zstd build tag, and the errors without it.
+func TestZstd(t *testing.T) {
+	m := image.NewGray16(image.Rect(0, 0, 40, 30))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * i >> 4)
+	}
+	if zstdNewWriter == nil {
+		if err := Encode(ioutil.Discard, m, &Options{Compression: Zstd}); err == nil {
+			t.Error("Encode: got nil error, want non-nil")
+		}
+		_, err := Decode(bytes.NewReader(buildTIFF(shortsEntry(tCompression, cZstd))))
+		if err != errNoZstd {
+			t.Errorf("Decode: got %v, want %v", err, errNoZstd)
+		}
+		return
+	}
+	for _, opts := range []*Options{
+		{Compression: Zstd},
+		{Compression: Zstd, ZstdLevel: 19, Predictor: true},
+		{Compression: Zstd, TileWidth: 16, TileLength: 16},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.Compression(); got != Zstd {
+			t.Errorf("%+v: Compression: got %d, want %d", opts, got, Zstd)
+		}
+		m1, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		compare(t, m, m1)
+	}
+
+	data := []float32{1.5, -2, 3.25, 1e10, 0, 7, -0.5, 2}
+	var buf bytes.Buffer
+	opts := &GeoOptions{Options: Options{Compression: Zstd, PredictorType: FloatingPointPredictor}}
+	if err := EncodeFloat32(&buf, data, 4, 2, opts); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err := d.Float32Band(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Errorf("float32 samples: got %v, want %v", got, data)
+	}
+}
+
+// TestEncodeGray16 tests that the 16-bit grayscale images returned by
+// Decode are written with 16-bit samples of the same format.
+func TestEncodeGray16(t *testing.T) {
+	r := image.Rect(0, 0, 5, 3)
+	u := scimage.NewGrayU16(r, 0, 65535)
+	s := scimage.NewGrayS16(r, 0, 32767)
+	for i := 0; i < r.Dx()*r.Dy(); i++ {
+		x, y := i%r.Dx(), i/r.Dx()
+		u.SetGrayU16(x, y, scicolor.GrayU16{Y: uint16(i * 4099), Min: u.Min, Max: u.Max})
+		s.SetGrayS16(x, y, scicolor.GrayS16{Y: int16(i*4099 - 30000), Min: s.Min, Max: s.Max})
+	}
+	for _, tc := range []struct {
+		m       image.Image
+		sFormat sampleFormat
+	}{
+		{u, uintSample},
+		{s, sintSample},
+	} {
+		for _, opts := range []*Options{nil, {BigEndian: true, Compression: Deflate, Predictor: true}} {
+			var buf bytes.Buffer
+			if err := Encode(&buf, tc.m, opts); err != nil {
+				t.Fatal(err)
+			}
+			d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.bpp != 16 || d.sFormat != tc.sFormat {
+				t.Errorf("%T %+v: got %d bits of format %d, want 16 bits of format %d", tc.m, opts, d.bpp, d.sFormat, tc.sFormat)
+			}
+			m, err := d.decodeImage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					if got, want := m.At(x, y), tc.m.At(x, y); got != want {
+						t.Errorf("%T %+v: pixel (%d, %d): got %v, want %v", tc.m, opts, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// A memFile is an in-memory io.ReadWriteSeeker, which unlike os.File does
+// not implement io.ReaderAt.
+type memFile struct {
+	b   []byte
+	off int64
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.off >= int64(len(f.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.b[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if end := f.off + int64(len(p)); end > int64(len(f.b)) {
+		f.b = append(f.b, make([]byte, end-int64(len(f.b)))...)
+	}
+	n := copy(f.b[f.off:], p)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.b))
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func TestAppendImage(t *testing.T) {
+	var images []image.Image
+	for i, r := range []image.Rectangle{
+		image.Rect(0, 0, 3, 2),
+		image.Rect(0, 0, 5, 7),
+		image.Rect(0, 0, 1, 1),
+	} {
+		m := image.NewNRGBA(r)
+		for j := range m.Pix {
+			m.Pix[j] = uint8(i*50 + j)
+		}
+		images = append(images, m)
+	}
+	for _, opts := range []*Options{
+		nil,
+		{Compression: Deflate, Predictor: true},
+		{BigTIFF: true},
+		{BigEndian: true},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, images[0], opts); err != nil {
+			t.Fatal(err)
+		}
+		f := &memFile{b: buf.Bytes()}
+		for _, m := range images[1:] {
+			// The byte order and BigTIFF format follow the file.
+			if err := AppendImage(f, m, nil); err != nil {
+				t.Fatalf("%+v: %v", opts, err)
+			}
+		}
+		got, err := DecodeAll(bytes.NewReader(f.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(images) {
+			t.Fatalf("%+v: got %d images, want %d", opts, len(got), len(images))
+		}
+		for i := range images {
+			compare(t, images[i], got[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, images[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*Options{{BigTIFF: true}, {BigEndian: true}} {
+		if err := AppendImage(&memFile{b: buf.Bytes()}, images[1], opts); err == nil {
+			t.Errorf("%+v: got nil error, want non-nil", opts)
+		}
+	}
+	buf.Reset()
+	if err := Encode(&buf, images[0], &Options{BigTIFF: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendImage(&memFile{b: buf.Bytes()}, images[1], &Options{ClassicTIFF: true}); err == nil {
+		t.Error("ClassicTIFF to BigTIFF file: got nil error, want non-nil")
+	}
+}
+
+func TestEncodeTextTags(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 2, 2))
+	textTags := func(opts *Options) map[uint16]string {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, opts); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.TextTags()
+	}
+
+	if got, want := textTags(nil), map[uint16]string{tSoftware: DefaultSoftware}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no options: got %v, want %v", got, want)
+	}
+	got := textTags(&Options{
+		Software:         "capture 1.0",
+		ImageDescription: "Frame 12",
+		Artist:           "Survey team",
+		Copyright:        "Public domain",
+		DateTime:         time.Date(2017, 6, 1, 12, 30, 5, 0, time.UTC),
+	})
+	want := map[uint16]string{
+		tSoftware:         "capture 1.0",
+		tImageDescription: "Frame 12",
+		tArtist:           "Survey team",
+		tCopyright:        "Public domain",
+		tDateTime:         "2017:06:01 12:30:05",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// SetTag takes precedence over the defaults.
+	opts := &Options{}
+	opts.SetTag(tSoftware, dtASCII, "custom")
+	if got := textTags(opts)[tSoftware]; got != "custom" {
+		t.Errorf("SetTag: got Software %q, want %q", got, "custom")
+	}
+}